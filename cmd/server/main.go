@@ -2,16 +2,31 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/btors/admira-etl/internal/api"
 	"github.com/btors/admira-etl/internal/config"
 	"github.com/btors/admira-etl/internal/data"
 	"github.com/btors/admira-etl/internal/etl"
+	"github.com/btors/admira-etl/internal/jobs"
+	"github.com/btors/admira-etl/internal/scheduler"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	_ "modernc.org/sqlite"
 )
 
+// shutdownTimeout es lo que se espera a que terminen las peticiones en curso al apagar el servidor.
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	// 1. Cargar configuración
 	cfg, err := config.Load()
@@ -20,13 +35,258 @@ func main() {
 	}
 
 	// 2. Inicializar dependencias
-	repo := data.NewInMemoryRepository()
-	ingestor := etl.NewIngestor(cfg.AdsAPIURL, cfg.CrmAPIURL)
-	transformer := etl.NewTransformer()
-	exporter := etl.NewExporter(cfg.SinkURL, cfg.SinkSecret)
+	attributionMode, err := etl.ParseAttributionMode(cfg.AttributionMode)
+	if err != nil {
+		log.Fatalf("FATAL: invalid attribution config: %v", err)
+	}
+	attributionModel, err := etl.ParseAttributionModel(cfg.AttributionModel)
+	if err != nil {
+		log.Fatalf("FATAL: invalid attribution config: %v", err)
+	}
+	// Sólo se exportan las métricas del modelo por defecto, para no enviar la misma fila una vez por modelo
+	exportModel := data.WithExportModel(etl.MetricModel(attributionMode, attributionModel))
+	var repo data.MetricRepository
+	var outbox data.ExportOutbox
+	var watermarks data.WatermarkStore
+	var quarantine data.QuarantineStore
+	var joinReports data.JoinReportStore
+	var deadLetters data.DeadLetterStore
+	var deliveries data.DeliveryLedger
+	closeStorage := func() error { return nil }
+	switch cfg.StorageBackend {
+	case "memory":
+		memRepo := data.NewInMemoryRepository(exportModel)
+		repo, outbox = memRepo, memRepo
+		watermarks = data.NewInMemoryWatermarkStore()
+		quarantine = data.NewInMemoryQuarantineStore()
+		joinReports = data.NewInMemoryJoinReportStore(cfg.JoinReportHistory)
+		deadLetters = data.NewInMemoryDeadLetterStore()
+		deliveries = data.NewInMemoryDeliveryLedger()
+	case "disk":
+		fileRepo, err := data.NewFileRepository(cfg.StorageDir, cfg.StorageSnapshotEvery, exportModel)
+		if err != nil {
+			log.Fatalf("FATAL: could not open disk repository: %v", err)
+		}
+		closeStorage = fileRepo.Close
+		repo, outbox = fileRepo, fileRepo
+		watermarks, err = data.NewFileWatermarkStore(filepath.Join(cfg.StorageDir, "watermarks.json"))
+		if err != nil {
+			log.Fatalf("FATAL: could not open watermark store: %v", err)
+		}
+		quarantine, err = data.NewFileQuarantineStore(filepath.Join(cfg.StorageDir, "quarantine.json"))
+		if err != nil {
+			log.Fatalf("FATAL: could not open quarantine store: %v", err)
+		}
+		joinReports, err = data.NewFileJoinReportStore(filepath.Join(cfg.StorageDir, "join_reports.json"), cfg.JoinReportHistory)
+		if err != nil {
+			log.Fatalf("FATAL: could not open join report store: %v", err)
+		}
+		deadLetters, err = data.NewFileDeadLetterStore(filepath.Join(cfg.StorageDir, "export_dlq.json"))
+		if err != nil {
+			log.Fatalf("FATAL: could not open export dead-letter store: %v", err)
+		}
+		deliveries, err = data.NewFileDeliveryLedger(filepath.Join(cfg.StorageDir, "export_ledger.json"))
+		if err != nil {
+			log.Fatalf("FATAL: could not open export delivery ledger: %v", err)
+		}
+	case "sql":
+		db, err := sql.Open(cfg.DatabaseDriver, cfg.DatabaseDSN)
+		if err != nil {
+			log.Fatalf("FATAL: could not open database: %v", err)
+		}
+		closeStorage = db.Close
+		sqlRepo, err := data.NewSQLRepository(db, data.DialectForDriver(cfg.DatabaseDriver), exportModel)
+		if err != nil {
+			log.Fatalf("FATAL: could not initialize sql repository: %v", err)
+		}
+		repo, outbox = sqlRepo, sqlRepo
+		watermarks, err = data.NewSQLWatermarkStore(db, data.DialectForDriver(cfg.DatabaseDriver))
+		if err != nil {
+			log.Fatalf("FATAL: could not initialize watermark store: %v", err)
+		}
+		quarantine, err = data.NewSQLQuarantineStore(db, data.DialectForDriver(cfg.DatabaseDriver))
+		if err != nil {
+			log.Fatalf("FATAL: could not initialize quarantine store: %v", err)
+		}
+		joinReports, err = data.NewSQLJoinReportStore(db, data.DialectForDriver(cfg.DatabaseDriver), cfg.JoinReportHistory)
+		if err != nil {
+			log.Fatalf("FATAL: could not initialize join report store: %v", err)
+		}
+		deadLetters, err = data.NewSQLDeadLetterStore(db, data.DialectForDriver(cfg.DatabaseDriver))
+		if err != nil {
+			log.Fatalf("FATAL: could not initialize export dead-letter store: %v", err)
+		}
+		deliveries, err = data.NewSQLDeliveryLedger(db, data.DialectForDriver(cfg.DatabaseDriver))
+		if err != nil {
+			log.Fatalf("FATAL: could not initialize export delivery ledger: %v", err)
+		}
+	default:
+		log.Fatalf("FATAL: unknown STORAGE_BACKEND %q, use memory, disk or sql", cfg.StorageBackend)
+	}
+	// Fuentes de ingesta: el archivo SOURCES_CONFIG o, si no se indica, las URLs históricas de Ads y CRM
+	var sources *etl.SourceRegistry
+	if cfg.SourcesConfig != "" {
+		sourcesConfig, err := etl.LoadSourcesConfig(cfg.SourcesConfig)
+		if err != nil {
+			log.Fatalf("FATAL: could not load sources config: %v", err)
+		}
+		if sources, err = etl.NewSourceRegistryFromConfig(sourcesConfig); err != nil {
+			log.Fatalf("FATAL: invalid sources config: %v", err)
+		}
+	} else if sources, err = etl.LegacySourceRegistry(cfg.AdsAPIURL, cfg.CrmAPIURL, cfg.AdsSinceParam, cfg.CrmSinceParam); err != nil {
+		log.Fatalf("FATAL: invalid ingestion sources: %v", err)
+	}
+	log.Printf("INFO: Ingestion sources: %v", sources.Names())
+	ingestor := etl.NewIngestorFromRegistry(sources)
+	// Funnel: el de FUNNEL_CONFIG o, si no se indica, el funnel por defecto (lead → won)
+	funnelConfig := etl.DefaultFunnelConfig()
+	if cfg.FunnelConfig != "" {
+		if funnelConfig, err = etl.LoadFunnelConfig(cfg.FunnelConfig); err != nil {
+			log.Fatalf("FATAL: could not load funnel config: %v", err)
+		}
+	}
+	funnel, err := etl.NewFunnel(funnelConfig)
+	if err != nil {
+		log.Fatalf("FATAL: invalid funnel config: %v", err)
+	}
+	log.Printf("INFO: Funnel steps: %v", funnel.Steps())
+	// Reglas de UTM: las de UTM_RULES, recargadas cuando cambia el archivo, o sólo decodificar y pasar a minúsculas
+	var utm *etl.UTMNormalizer
+	if cfg.UTMRules != "" {
+		if utm, err = etl.LoadUTMNormalizer(cfg.UTMRules); err != nil {
+			log.Fatalf("FATAL: invalid UTM rules: %v", err)
+		}
+		utm.Watch(cfg.UTMRulesReload)
+		defer utm.Stop()
+	}
+	// Zonas horarias de reporte: la de REPORTING_TIMEZONE y, por cuenta de Ads, las de ACCOUNT_TIMEZONES
+	timezones, err := etl.NewTimezones(cfg.ReportingTimezone, cfg.AccountTimezones)
+	if err != nil {
+		log.Fatalf("FATAL: invalid timezone config: %v", err)
+	}
+	transformerOptions := []etl.TransformerOption{
+		etl.WithAttribution(attributionMode, cfg.AttributionLookbackDays),
+		etl.WithAttributionModel(attributionModel, cfg.AttributionHalfLifeDays),
+		etl.WithFunnel(funnel),
+		etl.WithUTMNormalizer(utm),
+		etl.WithTimezones(timezones),
+	}
+	// Moneda de reporte: sin REPORTING_CURRENCY no se convierte; sin FX_RATES sólo se admiten registros en esa moneda
+	if cfg.ReportingCurrency != "" {
+		var fx etl.FXProvider
+		if cfg.FXRates != "" {
+			rates, err := etl.NewFileFXProvider(cfg.FXRates)
+			if err != nil {
+				log.Fatalf("FATAL: could not load FX rates: %v", err)
+			}
+			rates.Watch(cfg.FXRatesReload)
+			defer rates.Stop()
+			fx = rates
+		}
+		transformerOptions = append(transformerOptions, etl.WithReportingCurrency(cfg.ReportingCurrency, fx))
+		log.Printf("INFO: Reporting currency: %s", cfg.ReportingCurrency)
+	}
+	transformer := etl.NewTransformer(transformerOptions...)
+	// Exportación por lotes con reintentos; los lotes que el sink no acepta van a la DLQ y los ya entregados
+	// sin cambios se omiten
+	exporterOptions := []etl.ExporterOption{
+		etl.WithExportBatchSize(cfg.ExportBatchSize),
+		etl.WithRetryPolicy(etl.RetryPolicy{
+			MaxAttempts: cfg.ExportMaxAttempts,
+			BaseDelay:   cfg.ExportRetryBaseDelay,
+			MaxDelay:    cfg.ExportRetryMaxDelay,
+		}),
+		etl.WithDeadLetters(deadLetters),
+		etl.WithDeliveryLedger(deliveries),
+	}
+	// Firma de las peticiones al sink: la primera clave de SINK_SIGNING_KEYS o, si no se indica, SINK_SECRET
+	if len(cfg.SinkSigningKeys) > 0 {
+		exporterOptions = append(exporterOptions, etl.WithSigningKey(cfg.SinkSigningKeys[0]))
+		log.Printf("INFO: Signing sink requests with key %q (%d active keys).", cfg.SinkSigningKeys[0].ID, len(cfg.SinkSigningKeys))
+	}
+	// Sinks de exportación: el archivo SINKS_CONFIG o, si no se indica, el sink HTTP de SINK_URL
+	if cfg.SinksConfig != "" {
+		sinksConfig, err := etl.LoadSinksConfig(cfg.SinksConfig)
+		if err != nil {
+			log.Fatalf("FATAL: could not load sinks config: %v", err)
+		}
+		sinks, err := etl.NewSinksFromConfig(sinksConfig)
+		if err != nil {
+			log.Fatalf("FATAL: invalid sinks config: %v", err)
+		}
+		exporterOptions = append(exporterOptions, etl.WithSinks(sinks...))
+	}
+	exporter := etl.NewExporter(cfg.SinkURL, cfg.SinkSecret, exporterOptions...)
+	log.Printf("INFO: Export sinks: %v", exporter.SinkNames())
+
+	// Reglas de validación: las de VALIDATION_RULES o, si no se indica, las reglas por defecto
+	validationConfig := etl.DefaultValidationConfig()
+	if cfg.ValidationRules != "" {
+		if validationConfig, err = etl.LoadValidationConfig(cfg.ValidationRules); err != nil {
+			log.Fatalf("FATAL: could not load validation rules: %v", err)
+		}
+	}
+	validator, err := etl.NewValidator(validationConfig)
+	if err != nil {
+		log.Fatalf("FATAL: invalid validation rules: %v", err)
+	}
+
+	pipelineOptions := []etl.PipelineOption{
+		etl.WithWatermarks(watermarks, cfg.IngestOverlap),
+		etl.WithIngestBatchSize(cfg.IngestBatchSize),
+		etl.WithValidation(validator, quarantine),
+		etl.WithJoinReports(joinReports),
+		etl.WithOutbox(outbox),
+	}
+	// Con el dispatcher del outbox, éste es la única vía de entrega a los sinks
+	if cfg.ExportOutboxInterval > 0 {
+		pipelineOptions = append(pipelineOptions, etl.WithOutboxDelivery())
+	}
+	// Archivo de respuestas en bruto, para repetir ingestas sin volver a llamar a las fuentes
+	if cfg.ArchiveDir != "" {
+		archive, err := data.NewPayloadArchive(cfg.ArchiveDir, cfg.ArchiveRetention)
+		if err != nil {
+			log.Fatalf("FATAL: could not open payload archive: %v", err)
+		}
+		pipelineOptions = append(pipelineOptions, etl.WithArchive(archive))
+	}
+	pipeline := etl.NewPipeline(repo, ingestor, transformer, exporter, pipelineOptions...)
+
+	// Dispatcher del outbox: envía a los sinks cada métrica que cambia, sin esperar a la exportación diaria
+	var dispatcher *etl.OutboxDispatcher
+	if cfg.ExportOutboxInterval > 0 {
+		if !exporter.Configured() {
+			log.Fatalf("FATAL: EXPORT_OUTBOX_INTERVAL requires SINK_URL or SINKS_CONFIG")
+		}
+		dispatcher = etl.NewOutboxDispatcher(outbox, exporter, etl.WithOutboxMaxAttempts(cfg.ExportOutboxAttempts))
+		dispatcher.Start(cfg.ExportOutboxInterval)
+		log.Printf("INFO: Export outbox dispatched every %s.", cfg.ExportOutboxInterval)
+	}
+	jobManager := jobs.NewManager(cfg.JobWorkers, cfg.JobQueueSize, cfg.JobHistory)
+
+	// Scheduler de ingestas y exportaciones periódicas; puede desactivarse por réplica
+	var sched *scheduler.Scheduler
+	if cfg.SchedulerEnabled {
+		sched = scheduler.New(jobManager, cfg.SchedulerJitter)
+		if cfg.IngestCron != "" {
+			if err := sched.Add("ingest", cfg.IngestCron, etl.JobKindIngest, scheduler.IngestionTask(pipeline)); err != nil {
+				log.Fatalf("FATAL: invalid SCHEDULE_INGEST_CRON: %v", err)
+			}
+		}
+		if cfg.ExportCron != "" && pipeline.ExportsViaOutbox() {
+			log.Println("INFO: Daily export not scheduled; metrics are delivered through the export outbox.")
+		} else if cfg.ExportCron != "" {
+			if err := sched.Add("daily_export", cfg.ExportCron, etl.JobKindExport, scheduler.ExportTask(pipeline)); err != nil {
+				log.Fatalf("FATAL: invalid SCHEDULE_EXPORT_CRON: %v", err)
+			}
+		}
+		sched.Start()
+	} else {
+		log.Println("INFO: Scheduler disabled on this replica.")
+	}
 
 	// 3. Inyectar dependencias en el Handler de la API
-	apiHandler := api.NewHandler(repo, ingestor, transformer, exporter)
+	apiHandler := api.NewHandler(repo, pipeline, jobManager, sched)
 
 	// 4. Configurar el router y los endpoints
 	router := gin.Default()
@@ -40,17 +300,71 @@ func main() {
 
 	// Endpoint de Ingesta
 	router.POST("/ingest/run", apiHandler.RunIngestion)
+	router.GET("/ingest/watermarks", apiHandler.ListWatermarks)
+	router.POST("/ingest/watermarks/:source/reset", apiHandler.ResetWatermark)
+	router.POST("/ingest/replay", apiHandler.ReplayIngestion)
+	router.GET("/ingest/archive", apiHandler.ListArchivedRuns)
+
+	// Endpoints de la cuarentena de registros rechazados por la validación
+	router.GET("/quarantine", apiHandler.ListQuarantine)
+	router.POST("/quarantine/resubmit", apiHandler.ResubmitQuarantine)
+
+	// Endpoints de diagnóstico del cruce entre Ads y CRM
+	router.GET("/utm/unmatched", apiHandler.GetUnmatchedUTMs)
+	router.GET("/ingest/join-reports", apiHandler.ListJoinReports)
+	router.GET("/ingest/join-reports/:run_id", apiHandler.GetJoinReport)
 
 	// Endpoints de Métricas
 	router.GET("/metrics/channel", apiHandler.GetMetricsByChannel)
 	router.GET("/metrics/funnel", apiHandler.GetMetricsByFunnel)
+	router.GET("/metrics/aggregate", apiHandler.GetMetricsAggregate)
 
 	// Endpoint de Exportación
 	router.POST("/export/run", apiHandler.RunExport)
+	router.GET("/export/dlq", apiHandler.ListDeadLetters)
+	router.POST("/export/dlq/replay", apiHandler.ReplayDeadLetters)
+	router.GET("/export/outbox", apiHandler.ListOutbox)
+	router.GET("/export/outbox/:id", apiHandler.GetOutboxRecord)
+
+	// Endpoints de Jobs asíncronos
+	router.GET("/jobs", apiHandler.ListJobs)
+	router.GET("/jobs/:id", apiHandler.GetJob)
+
+	// Endpoint del Scheduler
+	router.GET("/schedules", apiHandler.ListSchedules)
 
 	// 5. Iniciar el servidor
-	log.Printf("INFO: Server starting on port %s", cfg.Port)
-	if err := router.Run(":" + cfg.Port); err != nil {
-		log.Fatalf("FATAL: could not start server: %v", err)
+	server := &http.Server{Addr: ":" + cfg.Port, Handler: router}
+	go func() {
+		log.Printf("INFO: Server starting on port %s", cfg.Port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("FATAL: could not start server: %v", err)
+		}
+	}()
+
+	// 6. Apagar en orden al recibir SIGINT o SIGTERM: primero deja de aceptar peticiones y espera a las que
+	// están en curso, después detiene el scheduler, espera a los jobs encolados y al vaciado del outbox en curso,
+	// y por último cierra el almacenamiento
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	stop()
+	log.Println("INFO: Shutting down server...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("ERROR: Server shutdown did not complete: %v", err)
+	}
+	if sched != nil {
+		sched.Stop()
+	}
+	jobManager.Close()
+	if dispatcher != nil {
+		dispatcher.Stop()
+	}
+	if err := closeStorage(); err != nil {
+		log.Printf("ERROR: Failed to close storage: %v", err)
 	}
+	log.Println("INFO: Server stopped.")
 }
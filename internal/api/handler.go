@@ -2,6 +2,8 @@
 package api
 
 import (
+	"errors"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
@@ -9,6 +11,8 @@ import (
 
 	"github.com/btors/admira-etl/internal/data"
 	"github.com/btors/admira-etl/internal/etl"
+	"github.com/btors/admira-etl/internal/jobs"
+	"github.com/btors/admira-etl/internal/scheduler"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -39,10 +43,10 @@ func init() {
 
 // Handler contiene las dependencias y los manejadores de la API.
 type Handler struct {
-	repo        data.MetricRepository
-	ingestor    *etl.Ingestor
-	transformer *etl.Transformer
-	exporter    *etl.Exporter
+	repo      data.MetricRepository
+	pipeline  *etl.Pipeline
+	jobs      *jobs.Manager
+	scheduler *scheduler.Scheduler // nil si el scheduler está desactivado en esta réplica
 }
 
 // Middleware para medir métricas Prometheus
@@ -58,12 +62,12 @@ func prometheusMiddleware(endpoint string) gin.HandlerFunc {
 }
 
 // NewHandler crea una nueva instancia del Handler con sus dependencias.
-func NewHandler(repo data.MetricRepository, ingestor *etl.Ingestor, transformer *etl.Transformer, exporter *etl.Exporter) *Handler {
+func NewHandler(repo data.MetricRepository, pipeline *etl.Pipeline, jobManager *jobs.Manager, sched *scheduler.Scheduler) *Handler {
 	return &Handler{
-		repo:        repo,
-		ingestor:    ingestor,
-		transformer: transformer,
-		exporter:    exporter,
+		repo:      repo,
+		pipeline:  pipeline,
+		jobs:      jobManager,
+		scheduler: sched,
 	}
 }
 
@@ -77,7 +81,7 @@ func (h *Handler) RunIngestion(c *gin.Context) {
 	sinceStr := c.Query("since")
 	var since *time.Time
 	if sinceStr != "" {
-		parsedSince, err := time.Parse("2006-01-02", sinceStr)
+		parsedSince, err := h.pipeline.Timezones().ParseDate(sinceStr, "")
 		if err != nil {
 			// Devuelve un error si el formato de la fecha es inválido
 			log.Printf("ERROR: Invalid 'since' parameter: %v", err)
@@ -87,32 +91,24 @@ func (h *Handler) RunIngestion(c *gin.Context) {
 		since = &parsedSince
 	}
 
-	// Obtener datos de Ads y CRM
-	ads, crm, err := h.ingestor.FetchData(since)
-	if err != nil {
-		log.Printf("ERROR: Data ingestion failed: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to ingest data"})
-		return
-	}
-
-	// Combina y calcula las métricas a partir de los datos obtenidos
-	enrichedData, err := h.transformer.CombineAndCalculateMetrics(ads, crm)
-	if err != nil {
-		log.Printf("ERROR: Data transformation failed: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to transform data"})
-		return
-	}
-
-	// Guarda las métricas enriquecidas en el repositorio
-	for _, metric := range enrichedData {
-		if err := h.repo.Save(metric); err != nil {
-			log.Printf("WARN: Failed to save metric for campaign %s: %v", metric.CampaignID, err)
+	// Validar el parámetro 'model'; si no se indica se usa el modelo configurado
+	model := h.pipeline.DefaultModel()
+	if modelStr := c.Query("model"); modelStr != "" {
+		parsedModel, err := etl.ParseAttributionModel(modelStr)
+		if err != nil {
+			log.Printf("ERROR: Invalid 'model' parameter: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'model' parameter. Use one of: last_touch, first_touch, linear, time_decay, position_based."})
+			return
 		}
+		model = parsedModel
 	}
 
-	log.Printf("INFO: Ingestion process completed successfully. Processed %d metrics.", len(enrichedData))
-
-	c.JSON(http.StatusAccepted, gin.H{"status": "Ingestion process completed successfully."})
+	// Encolar la ingesta y responder sin esperar a que termine
+	params := map[string]string{"model": string(model)}
+	if sinceStr != "" {
+		params["since"] = sinceStr
+	}
+	h.submitJob(c, etl.JobKindIngest, params, h.pipeline.IngestionJob(since, model))
 }
 
 // Readyz es un endpoint para verificar la disponibilidad del servicio
@@ -133,50 +129,41 @@ func (h *Handler) GetMetricsByChannel(c *gin.Context) {
 
 	// Recuperar y validar los parámetros de consulta
 	channel := c.Query("channel")
-	fromStr := c.Query("from")
-	toStr := c.Query("to")
-	limitStr := c.DefaultQuery("limit", "10")
-	offsetStr := c.DefaultQuery("offset", "0")
 
 	// Validar que los parámetros obligatorios no estén vacíos
-	if channel == "" || fromStr == "" || toStr == "" {
+	if channel == "" || c.Query("from") == "" || c.Query("to") == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "missing required parameters: channel, from, to"})
 		return
 	}
 
 	// Convertir los parámetros 'from' y 'to' a formato de fecha
-	from, err := time.Parse("2006-01-02", fromStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'from' date format, use YYYY-MM-DD"})
-		return
-	}
-	to, err := time.Parse("2006-01-02", toStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'to' date format, use YYYY-MM-DD"})
-		return
-	}
-
-	// Validar y convertir los parámetros de paginación
-	limit, err := strconv.Atoi(limitStr)
-	if err != nil || limit <= 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'limit' parameter"})
+	from, to, ok := parseDateRange(c, h.pipeline.Timezones(), channel)
+	if !ok {
 		return
 	}
-	offset, err := strconv.Atoi(offsetStr)
-	if err != nil || offset < 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'offset' parameter"})
+	filter, ok := parseModelFilter(c, h.pipeline.DefaultMetricModel())
+	if !ok {
 		return
 	}
+	filter.Channel, filter.From, filter.To = channel, from, to
 
-	// Recuperar métricas del repositorio
-	metrics, err := h.repo.GetMetricsByChannel(channel, from, to, limit, offset)
-	if err != nil {
-		log.Printf("ERROR: Failed to retrieve metrics by channel: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve data"})
+	// Formato histórico: array sin sobre, paginado con limit/offset
+	if isLegacyFormat(c) {
+		limit, offset, ok := parseLimitOffset(c)
+		if !ok {
+			return
+		}
+		metrics, err := h.repo.GetMetricsByChannel(filter, limit, offset)
+		if err != nil {
+			log.Printf("ERROR: Failed to retrieve metrics by channel: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve data"})
+			return
+		}
+		c.JSON(http.StatusOK, metrics)
 		return
 	}
 
-	c.JSON(http.StatusOK, metrics)
+	h.respondWithPage(c, filter, false)
 }
 
 // GetMetricsByFunnel es el manejador para el endpoint GET /metrics/funnel.
@@ -185,51 +172,123 @@ func (h *Handler) GetMetricsByFunnel(c *gin.Context) {
 
 	// Recuperar y validar los parámetros de consulta
 	utmCampaign := c.Query("utm_campaign")
-	fromStr := c.Query("from")
-	toStr := c.Query("to")
-	limitStr := c.DefaultQuery("limit", "10")
-	offsetStr := c.DefaultQuery("offset", "0")
 
 	// Validar que los parámetros obligatorios no estén vacíos
-	if utmCampaign == "" || fromStr == "" || toStr == "" {
+	if utmCampaign == "" || c.Query("from") == "" || c.Query("to") == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "missing required parameters: utm_campaign, from, to"})
 		return
 	}
 
 	// Convertir los parámetros 'from' y 'to' a formato de fecha
-	from, err := time.Parse("2006-01-02", fromStr)
+	from, to, ok := parseDateRange(c, h.pipeline.Timezones(), "")
+	if !ok {
+		return
+	}
+	filter, ok := parseModelFilter(c, h.pipeline.DefaultMetricModel())
+	if !ok {
+		return
+	}
+	filter.UTMCampaign, filter.From, filter.To = utmCampaign, from, to
+
+	// Formato histórico: array sin sobre, paginado con limit/offset
+	if isLegacyFormat(c) {
+		limit, offset, ok := parseLimitOffset(c)
+		if !ok {
+			return
+		}
+		metrics, err := h.repo.GetMetricsByFunnel(filter, limit, offset)
+		if err != nil {
+			log.Printf("ERROR: Failed to retrieve metrics by funnel: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve data"})
+			return
+		}
+		c.JSON(http.StatusOK, metrics)
+		return
+	}
+
+	h.respondWithPage(c, filter, true)
+}
+
+// GetMetricsAggregate es el manejador para el endpoint GET /metrics/aggregate.
+func (h *Handler) GetMetricsAggregate(c *gin.Context) {
+	prometheusMiddleware("/metrics/aggregate")(c)
+
+	// Validar que los parámetros obligatorios no estén vacíos
+	if c.Query("group_by") == "" || c.Query("from") == "" || c.Query("to") == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing required parameters: group_by, from, to"})
+		return
+	}
+
+	groupBy, err := data.ParseGroupBy(c.Query("group_by"))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'from' date format, use YYYY-MM-DD"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'group_by' parameter, use any of: date, week, month, channel, campaign_id, utm_campaign, utm_source, utm_medium, attribution_model"})
+		return
+	}
+
+	// Convertir los parámetros 'from' y 'to' a formato de fecha
+	from, to, ok := parseDateRange(c, h.pipeline.Timezones(), c.Query("channel"))
+	if !ok {
+		return
+	}
+	filter, ok := parseModelFilter(c, h.pipeline.DefaultMetricModel())
+	if !ok {
 		return
 	}
-	to, err := time.Parse("2006-01-02", toStr)
+	filter.Channel, filter.UTMCampaign, filter.From, filter.To = c.Query("channel"), c.Query("utm_campaign"), from, to
+
+	rows, err := h.repo.Aggregate(filter, groupBy)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'to' date format, use YYYY-MM-DD"})
+		log.Printf("ERROR: Failed to aggregate metrics: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve data"})
 		return
 	}
 
-	// Validar y convertir los parámetros de paginación
-	limit, err := strconv.Atoi(limitStr)
+	c.JSON(http.StatusOK, gin.H{"data": rows})
+}
+
+// respondWithPage responde con una página de métricas paginada por cursor, en el sobre {data, next_cursor, total}.
+// Con withFunnel añade el funnel sumado de todas las métricas del filtro.
+func (h *Handler) respondWithPage(c *gin.Context, filter data.MetricFilter, withFunnel bool) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
 	if err != nil || limit <= 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'limit' parameter"})
 		return
 	}
-	offset, err := strconv.Atoi(offsetStr)
-	if err != nil || offset < 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'offset' parameter"})
-		return
+
+	var after *data.MetricCursor
+	if token := c.Query("cursor"); token != "" {
+		after, err = decodeCursor(token)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'cursor' parameter"})
+			return
+		}
 	}
 
-	// Recuperar métricas del repositorio
-	metrics, err := h.repo.GetMetricsByFunnel(utmCampaign, from, to, limit, offset)
+	page, err := h.repo.GetMetricsPage(filter, after, limit)
 	if err != nil {
-		log.Printf("ERROR: Failed to retrieve metrics by funnel: %v", err)
+		log.Printf("ERROR: Failed to retrieve metrics page: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve data"})
 		return
 	}
 
-	// Devolver las métricas en formato JSON
-	c.JSON(http.StatusOK, metrics)
+	response := metricsPageResponse{Data: page.Metrics, Total: page.Total}
+	if page.Next != nil {
+		next := encodeCursor(*page.Next)
+		response.NextCursor = &next
+	}
+	if withFunnel {
+		rows, err := h.repo.Aggregate(filter, []data.GroupByField{data.GroupByUTMCampaign})
+		if err != nil {
+			log.Printf("ERROR: Failed to aggregate funnel: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve data"})
+			return
+		}
+		// El filtro fija la campaña, así que hay como mucho un grupo.
+		if len(rows) > 0 {
+			response.Funnel = rows[0].Funnel
+		}
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 // RunExport es el manejador para el endpoint POST /export/run.
@@ -246,44 +305,459 @@ func (h *Handler) RunExport(c *gin.Context) {
 	}
 
 	// Convertir el parámetro 'date' al formato de fecha
-	exportDate, err := time.Parse("2006-01-02", dateStr)
+	exportDate, err := h.pipeline.Timezones().ParseDate(dateStr, "")
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'date' format, use YYYY-MM-DD"})
 		return
 	}
+	// Con el dispatcher del outbox activo, las métricas ya se entregan a los mismos sinks
+	if h.pipeline.ExportsViaOutbox() {
+		c.JSON(http.StatusConflict, gin.H{"error": etl.ErrExportViaOutbox.Error()})
+		return
+	}
+
+	// force=true reenvía también los lotes que ya se entregaron sin cambios
+	params := map[string]string{"date": dateStr}
+	force := c.Query("force") == "true"
+	if force {
+		params["force"] = "true"
+	}
+
+	// Encolar la exportación y responder sin esperar a que termine
+	h.submitJob(c, etl.JobKindExport, params, h.pipeline.ExportJob(exportDate, force))
+}
+
+// ListDeadLetters es el manejador para el endpoint GET /export/dlq.
+// El cuerpo de cada lote sólo se incluye con payload=true.
+func (h *Handler) ListDeadLetters(c *gin.Context) {
+	prometheusMiddleware("/export/dlq")(c)
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'limit' parameter"})
+		return
+	}
+	status := c.Query("status")
+	if status != "" && status != data.DeadLetterPending && status != data.DeadLetterReplayed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'status' parameter, use pending or replayed"})
+		return
+	}
 
-	// Recuperar todas las métricas del repositorio
-	allMetrics, err := h.repo.GetAllMetrics()
+	letters, err := h.pipeline.DeadLetters(data.DeadLetterFilter{Status: status, Limit: limit})
 	if err != nil {
-		log.Printf("ERROR: Failed to retrieve metrics from repository: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve data from repository"})
+		if errors.Is(err, etl.ErrDeadLettersDisabled) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("ERROR: Failed to list dead-lettered export batches: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list dead-lettered export batches"})
+		return
+	}
+	if c.Query("payload") != "true" {
+		for i := range letters {
+			letters[i].Payload = nil
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": letters})
+}
+
+// deadLetterReplayRequest es el cuerpo, opcional, de POST /export/dlq/replay.
+type deadLetterReplayRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// ReplayDeadLetters es el manejador para el endpoint POST /export/dlq/replay.
+// Reenvía los lotes indicados en "ids", o todos los pendientes si el cuerpo se omite.
+func (h *Handler) ReplayDeadLetters(c *gin.Context) {
+	prometheusMiddleware("/export/dlq/replay")(c)
+
+	var req deadLetterReplayRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body, expected {\"ids\": [\"...\"]}"})
 		return
 	}
 
-	// Filtrar las métricas por la fecha especificada
-	var filteredMetrics []data.EnrichedMetric
-	for _, metric := range allMetrics {
-		if metric.Date.Equal(exportDate) {
-			filteredMetrics = append(filteredMetrics, metric)
+	// Comprobar antes de encolar que los lotes existen
+	letters, err := h.pipeline.DeadLettersToReplay(req.IDs)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDeadLetterNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, etl.ErrDeadLettersDisabled):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			log.Printf("ERROR: Failed to read dead-lettered export batches: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read dead-lettered export batches"})
 		}
+		return
+	}
+	if len(letters) == 0 {
+		c.JSON(http.StatusOK, gin.H{"status": "No pending batches to replay."})
+		return
 	}
 
-	// Verificar si no se encontraron métricas para la fecha especificada
-	if len(filteredMetrics) == 0 {
-		log.Printf("WARN: No metrics found for the specified date: %s", dateStr)
-		c.JSON(http.StatusNoContent, gin.H{"status": "No metrics found for the specified date."})
+	params := map[string]string{"batches": strconv.Itoa(len(letters))}
+	h.submitJob(c, etl.JobKindExportReplay, params, h.pipeline.DeadLetterReplayJob(letters))
+}
+
+// ListOutbox es el manejador para el endpoint GET /export/outbox.
+// La versión encolada de cada métrica sólo se incluye con payload=true.
+func (h *Handler) ListOutbox(c *gin.Context) {
+	prometheusMiddleware("/export/outbox")(c)
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'limit' parameter"})
+		return
+	}
+	status := c.Query("status")
+	if status != "" && status != data.OutboxPending && status != data.OutboxDelivered && status != data.OutboxDeadLettered {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'status' parameter, use pending, delivered or dead_lettered"})
 		return
 	}
 
-	// Exportar las métricas filtradas
-	if err := h.exporter.ExportMetrics(filteredMetrics); err != nil {
-		log.Printf("ERROR: Export failed: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export data"})
+	records, err := h.pipeline.Outbox(data.OutboxFilter{Status: status, Limit: limit})
+	if err != nil {
+		if errors.Is(err, etl.ErrOutboxDisabled) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("ERROR: Failed to list outbox records: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list outbox records"})
+		return
+	}
+	if c.Query("payload") != "true" {
+		for i := range records {
+			records[i].Metric = nil
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": records})
+}
+
+// GetOutboxRecord es el manejador para el endpoint GET /export/outbox/:id.
+func (h *Handler) GetOutboxRecord(c *gin.Context) {
+	prometheusMiddleware("/export/outbox/:id")(c)
+
+	record, err := h.pipeline.OutboxRecord(c.Param("id"))
+	if err != nil {
+		switch {
+		case errors.Is(err, etl.ErrOutboxRecordNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, etl.ErrOutboxDisabled):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			log.Printf("ERROR: Failed to get outbox record: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get outbox record"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": record})
+}
+
+// GetJob es el manejador para el endpoint GET /jobs/:id.
+func (h *Handler) GetJob(c *gin.Context) {
+	prometheusMiddleware("/jobs/:id")(c)
+
+	job, ok := h.jobs.Get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// ListJobs es el manejador para el endpoint GET /jobs.
+func (h *Handler) ListJobs(c *gin.Context) {
+	prometheusMiddleware("/jobs")(c)
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'limit' parameter"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": h.jobs.List(c.Query("kind"), limit)})
+}
+
+// ListWatermarks es el manejador para el endpoint GET /ingest/watermarks.
+func (h *Handler) ListWatermarks(c *gin.Context) {
+	prometheusMiddleware("/ingest/watermarks")(c)
+
+	watermarks, err := h.pipeline.Watermarks()
+	if err != nil {
+		if errors.Is(err, etl.ErrIncrementalDisabled) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("ERROR: Failed to list watermarks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list watermarks"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": watermarks})
+}
+
+// ResetWatermark es el manejador para el endpoint POST /ingest/watermarks/:source/reset.
+// Sin 'to' borra la marca de agua y la siguiente ingesta de la fuente es completa.
+func (h *Handler) ResetWatermark(c *gin.Context) {
+	prometheusMiddleware("/ingest/watermarks/:source/reset")(c)
+
+	source := c.Param("source")
+	var to *time.Time
+	if toStr := c.Query("to"); toStr != "" {
+		parsed, err := time.Parse(time.RFC3339, toStr)
+		if err != nil {
+			parsed, err = h.pipeline.Timezones().ParseDate(toStr, "")
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'to' parameter, use YYYY-MM-DD or RFC 3339"})
+			return
+		}
+		to = &parsed
+	}
+
+	if err := h.pipeline.ResetWatermark(source, to); err != nil {
+		switch {
+		case errors.Is(err, etl.ErrUnknownSource):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, etl.ErrIncrementalDisabled):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			log.Printf("ERROR: Failed to reset watermark for %s: %v", source, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to reset watermark"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "Watermark reset.", "source": source, "watermark": to})
+}
+
+// ReplayIngestion es el manejador para el endpoint POST /ingest/replay.
+// Repite una ingesta archivada sin llamar a las fuentes; sin 'model' usa el modelo de la ingesta original.
+func (h *Handler) ReplayIngestion(c *gin.Context) {
+	prometheusMiddleware("/ingest/replay")(c)
+
+	runID := c.Query("run_id")
+	if runID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing 'run_id' parameter"})
+		return
+	}
+	var model etl.AttributionModel
+	if modelStr := c.Query("model"); modelStr != "" {
+		parsedModel, err := etl.ParseAttributionModel(modelStr)
+		if err != nil {
+			log.Printf("ERROR: Invalid 'model' parameter: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'model' parameter. Use one of: last_touch, first_touch, linear, time_decay, position_based."})
+			return
+		}
+		model = parsedModel
+	}
+
+	// Comprobar antes de encolar que la ingesta existe y puede repetirse
+	run, err := h.pipeline.ArchivedRun(runID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrArchivedRunNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, etl.ErrArchiveDisabled):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			log.Printf("ERROR: Failed to read archived run %s: %v", runID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read archived run"})
+		}
+		return
+	}
+	if !run.Complete {
+		c.JSON(http.StatusConflict, gin.H{"error": etl.ErrRunNotReplayable.Error(), "reason": run.Error})
+		return
+	}
+	if model == "" {
+		model = etl.AttributionModel(run.Model)
+	}
+
+	params := map[string]string{"run_id": runID, "model": string(model)}
+	h.submitJob(c, etl.JobKindReplay, params, h.pipeline.ReplayJob(runID, model))
+}
+
+// ListArchivedRuns es el manejador para el endpoint GET /ingest/archive.
+func (h *Handler) ListArchivedRuns(c *gin.Context) {
+	prometheusMiddleware("/ingest/archive")(c)
+
+	runs, err := h.pipeline.ArchivedRuns()
+	if err != nil {
+		if errors.Is(err, etl.ErrArchiveDisabled) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("ERROR: Failed to list archived runs: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list archived runs"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": runs})
+}
+
+// GetUnmatchedUTMs es el manejador para el endpoint GET /utm/unmatched.
+// Devuelve las claves UTM de la última transformación que sólo aparecen en Ads o sólo en CRM.
+func (h *Handler) GetUnmatchedUTMs(c *gin.Context) {
+	prometheusMiddleware("/utm/unmatched")(c)
+
+	report, rules, err := h.pipeline.UTMMatch()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error(), "rules": rules})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": report, "rules": rules})
+}
+
+// ListJoinReports es el manejador para el endpoint GET /ingest/join-reports.
+// Devuelve el resumen de los informes de cruce más recientes, sin su detalle.
+func (h *Handler) ListJoinReports(c *gin.Context) {
+	prometheusMiddleware("/ingest/join-reports")(c)
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'limit' parameter"})
+		return
+	}
+	reports, err := h.pipeline.JoinReports(limit)
+	if err != nil {
+		if errors.Is(err, etl.ErrJoinReportsDisabled) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("ERROR: Failed to list join reports: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list join reports"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": reports})
+}
+
+// GetJoinReport es el manejador para el endpoint GET /ingest/join-reports/:run_id.
+func (h *Handler) GetJoinReport(c *gin.Context) {
+	prometheusMiddleware("/ingest/join-reports/:run_id")(c)
+
+	report, err := h.pipeline.JoinReport(c.Param("run_id"))
+	if err != nil {
+		switch {
+		case errors.Is(err, etl.ErrJoinReportNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, etl.ErrJoinReportsDisabled):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			log.Printf("ERROR: Failed to get join report: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get join report"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": report})
+}
+
+// ListQuarantine es el manejador para el endpoint GET /quarantine.
+func (h *Handler) ListQuarantine(c *gin.Context) {
+	prometheusMiddleware("/quarantine")(c)
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'limit' parameter"})
+		return
+	}
+	status := c.Query("status")
+	if status != "" && status != data.QuarantineRejected && status != data.QuarantineResubmitted {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'status' parameter, use rejected or resubmitted"})
+		return
+	}
+
+	records, err := h.pipeline.Quarantine(data.QuarantineFilter{
+		Kind:   c.Query("kind"),
+		Source: c.Query("source"),
+		Status: status,
+		Limit:  limit,
+	})
+	if err != nil {
+		if errors.Is(err, etl.ErrQuarantineDisabled) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("ERROR: Failed to list quarantined records: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list quarantined records"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": records})
+}
+
+// resubmitRequest es el cuerpo de POST /quarantine/resubmit.
+type resubmitRequest struct {
+	Records []etl.ResubmitRequest `json:"records"`
+}
+
+// ResubmitQuarantine es el manejador para el endpoint POST /quarantine/resubmit.
+// Si se acepta algún registro encola una ingesta desde la fecha más antigua afectada, para recalcular sus métricas.
+func (h *Handler) ResubmitQuarantine(c *gin.Context) {
+	prometheusMiddleware("/quarantine/resubmit")(c)
+
+	var req resubmitRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Records) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid body, expected {\"records\": [{\"id\": \"...\", \"record\": {...}}]}"})
+		return
+	}
+	for _, r := range req.Records {
+		if r.ID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "every record needs an 'id'"})
+			return
+		}
+	}
+
+	result, err := h.pipeline.ResubmitQuarantined(req.Records)
+	if err != nil {
+		if errors.Is(err, etl.ErrQuarantineDisabled) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("ERROR: Failed to resubmit quarantined records: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to resubmit quarantined records"})
+		return
+	}
+	if result.Accepted == 0 {
+		c.JSON(http.StatusOK, gin.H{"status": "No records accepted.", "data": result.Outcomes})
+		return
+	}
+
+	// Encolar la ingesta que recalcula las métricas afectadas
+	model := h.pipeline.DefaultModel()
+	params := map[string]string{"model": string(model), "trigger": "quarantine_resubmit"}
+	if result.Since != nil {
+		params["since"] = result.Since.Format("2006-01-02")
+	}
+	job, err := h.jobs.Submit(etl.JobKindIngest, params, h.pipeline.IngestionJob(result.Since, model))
+	if err != nil {
+		log.Printf("ERROR: Failed to enqueue %s job: %v", etl.JobKindIngest, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Records resubmitted but failed to enqueue ingestion job", "data": result.Outcomes})
+		return
+	}
+	c.Header("Location", "/jobs/"+job.ID)
+	c.JSON(http.StatusAccepted, gin.H{"status": "Records resubmitted, ingestion job queued.", "job_id": job.ID, "job": job, "data": result.Outcomes})
+}
+
+// ListSchedules es el manejador para el endpoint GET /schedules.
+func (h *Handler) ListSchedules(c *gin.Context) {
+	prometheusMiddleware("/schedules")(c)
+
+	if h.scheduler == nil {
+		c.JSON(http.StatusOK, gin.H{"enabled": false, "data": []scheduler.Status{}})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "data": h.scheduler.Statuses()})
+}
+
+// submitJob encola un job y responde 202 con su ID y la URL para consultar su estado.
+func (h *Handler) submitJob(c *gin.Context, kind string, params map[string]string, fn jobs.Func) {
+	job, err := h.jobs.Submit(kind, params, fn)
+	if err != nil {
+		log.Printf("ERROR: Failed to enqueue %s job: %v", kind, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to enqueue job"})
 		return
 	}
 
-	log.Printf("INFO: Export process completed successfully. Exported %d metrics.", len(filteredMetrics))
-	c.JSON(http.StatusAccepted, gin.H{"status": "Export process completed successfully."})
+	c.Header("Location", "/jobs/"+job.ID)
+	c.JSON(http.StatusAccepted, gin.H{"status": "Job queued.", "job_id": job.ID, "job": job})
 }
 
 // Healthz es un endpoint que verifica la disponibilidad del servicio.
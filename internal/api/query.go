@@ -0,0 +1,122 @@
+// Package api internal/api/query.go
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/btors/admira-etl/internal/data"
+	"github.com/btors/admira-etl/internal/etl"
+	"github.com/gin-gonic/gin"
+)
+
+// metricsPageResponse es el sobre de las respuestas paginadas por cursor.
+type metricsPageResponse struct {
+	Data       []data.EnrichedMetric `json:"data"`
+	NextCursor *string               `json:"next_cursor"`
+	Total      int                   `json:"total"`
+	Funnel     []data.FunnelStep     `json:"funnel,omitempty"` // Funnel de todas las métricas del filtro, no sólo de la página.
+}
+
+// cursorPayload es la forma serializada de un data.MetricCursor.
+type cursorPayload struct {
+	Date       string `json:"d"`
+	CampaignID string `json:"c"`
+	Channel    string `json:"ch"`
+	Model      string `json:"m,omitempty"`
+}
+
+// encodeCursor convierte un cursor en un token opaco apto para URLs.
+func encodeCursor(cursor data.MetricCursor) string {
+	payload, _ := json.Marshal(cursorPayload{
+		Date:       cursor.Date.Format("2006-01-02"),
+		CampaignID: cursor.CampaignID,
+		Channel:    cursor.Channel,
+		Model:      cursor.AttributionModel,
+	})
+	return base64.RawURLEncoding.EncodeToString(payload)
+}
+
+// decodeCursor valida y decodifica un token generado por encodeCursor.
+func decodeCursor(token string) (*data.MetricCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor encoding: %w", err)
+	}
+	var payload cursorPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return nil, fmt.Errorf("invalid cursor payload: %w", err)
+	}
+	date, err := time.Parse("2006-01-02", payload.Date)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor date: %w", err)
+	}
+	return &data.MetricCursor{Date: date, CampaignID: payload.CampaignID, Channel: payload.Channel, AttributionModel: payload.Model}, nil
+}
+
+// allModels es el valor de 'model' que devuelve las métricas de todos los modelos de atribución.
+const allModels = "all"
+
+// parseModelFilter valida el parámetro 'model' de las consultas de métricas y devuelve el filtro de modelo. Sin él
+// se usa el modelo de las métricas por defecto (naive en modo naive), para no sumar las cifras de varios modelos;
+// con model=all no se filtra. Las métricas guardadas sin modelo cuentan como del modelo por defecto. Si no es
+// válido, responde 400 y devuelve false.
+func parseModelFilter(c *gin.Context, defaultModel string) (data.MetricFilter, bool) {
+	filter := data.MetricFilter{DefaultModel: defaultModel}
+	switch value := c.Query("model"); value {
+	case "":
+		filter.AttributionModel = defaultModel
+	case allModels:
+	case string(etl.AttributionNaive):
+		filter.AttributionModel = value
+	default:
+		model, err := etl.ParseAttributionModel(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'model' parameter, use all, naive or one of: last_touch, first_touch, linear, time_decay, position_based"})
+			return filter, false
+		}
+		filter.AttributionModel = string(model)
+	}
+	return filter, true
+}
+
+// parseDateRange valida los parámetros 'from' y 'to', que son días en la zona de reporte de la cuenta indicada
+// (la zona por defecto si está vacía). Si no son válidos, responde 400 y devuelve false.
+func parseDateRange(c *gin.Context, zones *etl.Timezones, account string) (time.Time, time.Time, bool) {
+	from, err := zones.ParseDate(c.Query("from"), account)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'from' date format, use YYYY-MM-DD"})
+		return time.Time{}, time.Time{}, false
+	}
+	to, err := zones.ParseDate(c.Query("to"), account)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'to' date format, use YYYY-MM-DD"})
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
+}
+
+// parseLimitOffset valida los parámetros de paginación 'limit' y 'offset'. Si no son válidos, responde 400.
+func parseLimitOffset(c *gin.Context) (int, int, bool) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'limit' parameter"})
+		return 0, 0, false
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid 'offset' parameter"})
+		return 0, 0, false
+	}
+	return limit, offset, true
+}
+
+// isLegacyFormat indica si el cliente pidió el formato histórico (array sin sobre, limit/offset).
+func isLegacyFormat(c *gin.Context) bool {
+	legacy, _ := strconv.ParseBool(c.Query("legacy"))
+	return legacy
+}
@@ -2,8 +2,13 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/btors/admira-etl/pkg/signature"
 	"github.com/joho/godotenv"
 )
 
@@ -14,6 +19,61 @@ type Config struct {
 	CrmAPIURL  string // URL de la API de CRM
 	SinkURL    string // URL del servicio SINK
 	SinkSecret string // Secreto para autenticar con el servicio SINK
+	// SinkSigningKeys son las claves de firma activas, en orden: la primera firma las peticiones al sink y el resto
+	// siguen siendo válidas para el sink durante una rotación. Vacío para firmar con SinkSecret.
+	SinkSigningKeys []signature.Key
+	SinksConfig     string // Archivo JSON con los sinks de exportación; vacío para usar SINK_URL
+
+	ExportBatchSize      int           // Métricas por lote enviado al sink
+	ExportMaxAttempts    int           // Envíos por lote, incluido el primero, antes de mandarlo a la DLQ
+	ExportRetryBaseDelay time.Duration // Espera antes del primer reintento; se duplica en cada reintento
+	ExportRetryMaxDelay  time.Duration // Espera máxima entre reintentos de un lote
+	ExportOutboxInterval time.Duration // Cada cuánto se vacía el outbox de exportación; 0 desactiva el dispatcher
+	ExportOutboxAttempts int           // Vaciados fallidos de una versión del outbox antes de mandarla a la DLQ
+
+	SourcesConfig string // Archivo JSON con las fuentes de ingesta; vacío para usar ADS_API_URL y CRM_API_URL
+
+	AttributionMode         string  // Modo de atribución de oportunidades: "window" o "naive"
+	AttributionLookbackDays int     // Ventana de atribución en días para el modo "window"
+	AttributionModel        string  // Modelo de atribución por defecto (last_touch, first_touch, linear, time_decay, position_based)
+	AttributionHalfLifeDays float64 // Vida media en días del modelo time_decay
+	FunnelConfig            string  // Archivo JSON con las etapas del funnel; vacío para usar el funnel por defecto
+
+	UTMRules       string        // Archivo JSON con las reglas de normalización de UTMs; vacío para sólo decodificar y pasar a minúsculas
+	UTMRulesReload time.Duration // Cada cuánto se comprueba si el archivo de reglas de UTMs ha cambiado; 0 desactiva la recarga
+
+	ReportingCurrency string        // Moneda (ISO 4217) a la que se convierten costes e importes; vacía para no convertir
+	FXRates           string        // Archivo JSON con los tipos de cambio diarios
+	FXRatesReload     time.Duration // Cada cuánto se comprueba si el archivo de tipos de cambio ha cambiado; 0 desactiva la recarga
+
+	ReportingTimezone string            // Zona horaria IANA en la que se asignan las fechas a días (por ejemplo America/Mexico_City)
+	AccountTimezones  map[string]string // Zona horaria propia de cada cuenta de Ads (canal), si difiere de ReportingTimezone
+
+	StorageBackend       string // Backend de almacenamiento de métricas: "memory", "disk" o "sql"
+	StorageDir           string // Directorio de datos para el backend "disk"
+	StorageSnapshotEvery int    // Escrituras en el WAL entre snapshots para el backend "disk"
+	DatabaseDriver       string // Nombre del driver de database/sql para el backend "sql"
+	DatabaseDSN          string // Cadena de conexión para el backend "sql"
+
+	JobWorkers   int // Número de jobs de ingesta/exportación que se ejecutan en paralelo
+	JobQueueSize int // Número máximo de jobs pendientes en cola
+	JobHistory   int // Número de jobs terminados que se conservan para GET /jobs
+
+	IngestOverlap   time.Duration // Margen que se retrocede desde la marca de agua en la ingesta incremental
+	AdsSinceParam   string        // Parámetro de consulta con el que la API de Ads acepta "since"; vacío si no lo admite
+	CrmSinceParam   string        // Parámetro de consulta con el que la API de CRM acepta "since"; vacío si no lo admite
+	IngestBatchSize int           // Registros por lote que se entregan al transformer durante la ingesta
+	ValidationRules string        // Ruta al archivo JSON de reglas de validación; vacía para usar las reglas por defecto
+
+	ArchiveDir       string        // Directorio del archivo de respuestas en bruto de las fuentes; vacío para desactivarlo
+	ArchiveRetention time.Duration // Antigüedad a partir de la cual se purgan las ingestas archivadas; 0 las conserva siempre
+
+	JoinReportHistory int // Número de informes de cruce entre Ads y CRM que se conservan
+
+	SchedulerEnabled bool          // Activa el scheduler en esta réplica
+	IngestCron       string        // Expresión cron de la ingesta periódica; vacía para desactivarla
+	ExportCron       string        // Expresión cron de la exportación diaria; vacía para desactivarla
+	SchedulerJitter  time.Duration // Retraso aleatorio máximo antes de cada ejecución programada
 }
 
 // Load carga la configuración desde variables de entorno o un archivo .env
@@ -27,7 +87,174 @@ func Load() (*Config, error) {
 		CrmAPIURL:  getEnv("CRM_API_URL", ""),
 		SinkURL:    getEnv("SINK_URL", ""),
 		SinkSecret: getEnv("SINK_SECRET", "admira_secret_example"),
+
+		SinksConfig: getEnv("SINKS_CONFIG", ""),
+
+		SourcesConfig: getEnv("SOURCES_CONFIG", ""),
+
+		AttributionMode:  getEnv("ATTRIBUTION_MODE", "window"),
+		AttributionModel: getEnv("ATTRIBUTION_MODEL", "last_touch"),
+		FunnelConfig:     getEnv("FUNNEL_CONFIG", ""),
+
+		StorageBackend: getEnv("STORAGE_BACKEND", "memory"),
+		StorageDir:     getEnv("STORAGE_DIR", "./data"),
+		DatabaseDriver: getEnv("DATABASE_DRIVER", "sqlite"),
+		DatabaseDSN:    getEnv("DATABASE_DSN", "file:./data/metrics.db"),
+	}
+
+	lookback, err := getEnvInt("ATTRIBUTION_LOOKBACK_DAYS", 30)
+	if err != nil {
+		return nil, err
+	}
+	if lookback < 0 {
+		return nil, fmt.Errorf("ATTRIBUTION_LOOKBACK_DAYS must be non-negative, got %d", lookback)
+	}
+	cfg.AttributionLookbackDays = lookback
+
+	halfLife, err := getEnvFloat("ATTRIBUTION_HALF_LIFE_DAYS", 7)
+	if err != nil {
+		return nil, err
+	}
+	if halfLife <= 0 {
+		return nil, fmt.Errorf("ATTRIBUTION_HALF_LIFE_DAYS must be positive, got %v", halfLife)
+	}
+	cfg.AttributionHalfLifeDays = halfLife
+
+	snapshotEvery, err := getEnvInt("STORAGE_SNAPSHOT_EVERY", 1000)
+	if err != nil {
+		return nil, err
+	}
+	if snapshotEvery <= 0 {
+		return nil, fmt.Errorf("STORAGE_SNAPSHOT_EVERY must be positive, got %d", snapshotEvery)
+	}
+	cfg.StorageSnapshotEvery = snapshotEvery
+
+	// Configuración de los jobs asíncronos y de los informes que se conservan; todos los valores deben ser positivos
+	for _, setting := range []struct {
+		key      string
+		fallback int
+		target   *int
+	}{
+		{"JOB_WORKERS", 1, &cfg.JobWorkers},
+		{"JOB_QUEUE_SIZE", 100, &cfg.JobQueueSize},
+		{"JOB_HISTORY", 100, &cfg.JobHistory},
+		{"JOIN_REPORT_HISTORY", 100, &cfg.JoinReportHistory},
+	} {
+		value, err := getEnvInt(setting.key, setting.fallback)
+		if err != nil {
+			return nil, err
+		}
+		if value <= 0 {
+			return nil, fmt.Errorf("%s must be positive, got %d", setting.key, value)
+		}
+		*setting.target = value
+	}
+
+	// Configuración de la ingesta incremental y la validación
+	cfg.ValidationRules = getEnv("VALIDATION_RULES", "")
+	cfg.AdsSinceParam = getEnv("ADS_SINCE_PARAM", "")
+	cfg.CrmSinceParam = getEnv("CRM_SINCE_PARAM", "")
+	if cfg.IngestOverlap, err = time.ParseDuration(getEnv("INGEST_WATERMARK_OVERLAP", "48h")); err != nil {
+		return nil, fmt.Errorf("invalid value for INGEST_WATERMARK_OVERLAP: %w", err)
+	}
+	if cfg.IngestOverlap < 0 {
+		return nil, fmt.Errorf("INGEST_WATERMARK_OVERLAP must be non-negative, got %s", cfg.IngestOverlap)
+	}
+	if cfg.IngestBatchSize, err = getEnvInt("INGEST_BATCH_SIZE", 500); err != nil {
+		return nil, err
+	}
+	if cfg.IngestBatchSize <= 0 {
+		return nil, fmt.Errorf("INGEST_BATCH_SIZE must be positive, got %d", cfg.IngestBatchSize)
+	}
+
+	// Configuración de las claves de firma de las peticiones al sink
+	if cfg.SinkSigningKeys, err = signature.ParseKeys(getEnv("SINK_SIGNING_KEYS", "")); err != nil {
+		return nil, fmt.Errorf("invalid value for SINK_SIGNING_KEYS: %w", err)
+	}
+
+	// Configuración de la exportación por lotes y sus reintentos
+	if cfg.ExportBatchSize, err = getEnvInt("EXPORT_BATCH_SIZE", 500); err != nil {
+		return nil, err
+	}
+	if cfg.ExportBatchSize <= 0 {
+		return nil, fmt.Errorf("EXPORT_BATCH_SIZE must be positive, got %d", cfg.ExportBatchSize)
 	}
+	if cfg.ExportMaxAttempts, err = getEnvInt("EXPORT_MAX_ATTEMPTS", 5); err != nil {
+		return nil, err
+	}
+	if cfg.ExportMaxAttempts <= 0 {
+		return nil, fmt.Errorf("EXPORT_MAX_ATTEMPTS must be positive, got %d", cfg.ExportMaxAttempts)
+	}
+	if cfg.ExportRetryBaseDelay, err = time.ParseDuration(getEnv("EXPORT_RETRY_BASE_DELAY", "1s")); err != nil {
+		return nil, fmt.Errorf("invalid value for EXPORT_RETRY_BASE_DELAY: %w", err)
+	}
+	if cfg.ExportRetryMaxDelay, err = time.ParseDuration(getEnv("EXPORT_RETRY_MAX_DELAY", "30s")); err != nil {
+		return nil, fmt.Errorf("invalid value for EXPORT_RETRY_MAX_DELAY: %w", err)
+	}
+	if cfg.ExportRetryBaseDelay <= 0 || cfg.ExportRetryMaxDelay < cfg.ExportRetryBaseDelay {
+		return nil, fmt.Errorf("EXPORT_RETRY_BASE_DELAY must be positive and not exceed EXPORT_RETRY_MAX_DELAY, got %s and %s", cfg.ExportRetryBaseDelay, cfg.ExportRetryMaxDelay)
+	}
+
+	if cfg.ExportOutboxInterval, err = time.ParseDuration(getEnv("EXPORT_OUTBOX_INTERVAL", "0s")); err != nil {
+		return nil, fmt.Errorf("invalid value for EXPORT_OUTBOX_INTERVAL: %w", err)
+	}
+	if cfg.ExportOutboxInterval < 0 {
+		return nil, fmt.Errorf("EXPORT_OUTBOX_INTERVAL must be non-negative, got %s", cfg.ExportOutboxInterval)
+	}
+	if cfg.ExportOutboxAttempts, err = getEnvInt("EXPORT_OUTBOX_MAX_ATTEMPTS", 10); err != nil {
+		return nil, err
+	}
+	if cfg.ExportOutboxAttempts <= 0 {
+		return nil, fmt.Errorf("EXPORT_OUTBOX_MAX_ATTEMPTS must be positive, got %d", cfg.ExportOutboxAttempts)
+	}
+
+	// Configuración de las reglas de normalización de UTMs
+	cfg.UTMRules = getEnv("UTM_RULES", "")
+	if cfg.UTMRulesReload, err = time.ParseDuration(getEnv("UTM_RULES_RELOAD", "30s")); err != nil {
+		return nil, fmt.Errorf("invalid value for UTM_RULES_RELOAD: %w", err)
+	}
+	if cfg.UTMRulesReload < 0 {
+		return nil, fmt.Errorf("UTM_RULES_RELOAD must be non-negative, got %s", cfg.UTMRulesReload)
+	}
+
+	// Configuración de la moneda de reporte y los tipos de cambio
+	cfg.ReportingCurrency = strings.ToUpper(strings.TrimSpace(getEnv("REPORTING_CURRENCY", "")))
+	if cfg.ReportingCurrency != "" && len(cfg.ReportingCurrency) != 3 {
+		return nil, fmt.Errorf("REPORTING_CURRENCY must be a 3-letter ISO 4217 code, got %q", cfg.ReportingCurrency)
+	}
+	cfg.FXRates = getEnv("FX_RATES", "")
+	if cfg.FXRatesReload, err = time.ParseDuration(getEnv("FX_RATES_RELOAD", "5m")); err != nil {
+		return nil, fmt.Errorf("invalid value for FX_RATES_RELOAD: %w", err)
+	}
+	if cfg.FXRatesReload < 0 {
+		return nil, fmt.Errorf("FX_RATES_RELOAD must be non-negative, got %s", cfg.FXRatesReload)
+	}
+
+	// Configuración de las zonas horarias de reporte
+	cfg.ReportingTimezone = getEnv("REPORTING_TIMEZONE", "UTC")
+	if cfg.AccountTimezones, err = getEnvMap("ACCOUNT_TIMEZONES"); err != nil {
+		return nil, err
+	}
+
+	// Configuración del archivo de respuestas en bruto
+	cfg.ArchiveDir = getEnv("ARCHIVE_DIR", "")
+	if cfg.ArchiveRetention, err = time.ParseDuration(getEnv("ARCHIVE_RETENTION", "720h")); err != nil {
+		return nil, fmt.Errorf("invalid value for ARCHIVE_RETENTION: %w", err)
+	}
+	if cfg.ArchiveRetention < 0 {
+		return nil, fmt.Errorf("ARCHIVE_RETENTION must be non-negative, got %s", cfg.ArchiveRetention)
+	}
+
+	// Configuración del scheduler
+	cfg.IngestCron = getEnv("SCHEDULE_INGEST_CRON", "0 * * * *")
+	cfg.ExportCron = getEnv("SCHEDULE_EXPORT_CRON", "30 1 * * *")
+	if cfg.SchedulerEnabled, err = strconv.ParseBool(getEnv("SCHEDULER_ENABLED", "false")); err != nil {
+		return nil, fmt.Errorf("invalid value for SCHEDULER_ENABLED: %w", err)
+	}
+	if cfg.SchedulerJitter, err = time.ParseDuration(getEnv("SCHEDULER_JITTER", "30s")); err != nil {
+		return nil, fmt.Errorf("invalid value for SCHEDULER_JITTER: %w", err)
+	}
+
 	return cfg, nil
 }
 
@@ -38,3 +265,46 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+// getEnvInt obtiene una variable de entorno entera o devuelve un valor predeterminado
+func getEnvInt(key string, fallback int) (int, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	return parsed, nil
+}
+
+// getEnvFloat obtiene una variable de entorno decimal o devuelve un valor predeterminado
+func getEnvFloat(key string, fallback float64) (float64, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	return parsed, nil
+}
+
+// getEnvMap obtiene una variable de entorno con pares "clave=valor" separados por comas
+func getEnvMap(key string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv(key), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" {
+			return nil, fmt.Errorf("invalid value for %s: expected key=value pairs, got %q", key, pair)
+		}
+		values[k] = v
+	}
+	return values, nil
+}
@@ -0,0 +1,218 @@
+// Package data internal/data/aggregate.go
+package data
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GroupByField es un campo por el que se pueden agrupar las métricas.
+type GroupByField string
+
+const (
+	GroupByDate        GroupByField = "date"
+	GroupByWeek        GroupByField = "week"  // Lunes de la semana ISO, YYYY-MM-DD.
+	GroupByMonth       GroupByField = "month" // YYYY-MM.
+	GroupByChannel     GroupByField = "channel"
+	GroupByCampaignID  GroupByField = "campaign_id"
+	GroupByUTMCampaign GroupByField = "utm_campaign"
+	GroupByUTMSource   GroupByField = "utm_source"
+	GroupByUTMMedium   GroupByField = "utm_medium"
+
+	GroupByAttributionModel GroupByField = "attribution_model"
+)
+
+// ParseGroupBy valida una lista de campos de agrupación separados por comas.
+func ParseGroupBy(value string) ([]GroupByField, error) {
+	var fields []GroupByField
+	seen := make(map[GroupByField]bool)
+	for _, part := range strings.Split(value, ",") {
+		field := GroupByField(strings.ToLower(strings.TrimSpace(part)))
+		if field == "" {
+			continue
+		}
+		switch field {
+		case GroupByDate, GroupByWeek, GroupByMonth, GroupByChannel, GroupByCampaignID,
+			GroupByUTMCampaign, GroupByUTMSource, GroupByUTMMedium, GroupByAttributionModel:
+		default:
+			return nil, fmt.Errorf("unknown group_by field: %q", part)
+		}
+		if !seen[field] {
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("group_by requires at least one field")
+	}
+	return fields, nil
+}
+
+// AggregateRow es el resultado de agrupar métricas: suma los conteos base y recalcula
+// los ratios a partir de los totales, en lugar de promediar los ratios diarios.
+type AggregateRow struct {
+	Group             map[string]string
+	Clicks            int
+	Impressions       int
+	Cost              float64
+	Leads             int
+	Opportunities     int
+	ClosedWon         int
+	Revenue           float64
+	LeadCredit        float64
+	OpportunityCredit float64
+	ClosedWonCredit   float64
+	CPC               float64
+	CPA               float64
+	CVRLeadToOpp      float64
+	CVROppToWon       float64
+	ROAS              float64
+	Funnel            []FunnelStep // Suma por etapa, en el orden en que aparecen las etapas.
+}
+
+// add suma una métrica a los totales del grupo.
+func (a *AggregateRow) add(m EnrichedMetric) {
+	a.Clicks += m.Clicks
+	a.Impressions += m.Impressions
+	a.Cost += m.Cost
+	a.Leads += m.Leads
+	a.Opportunities += m.Opportunities
+	a.ClosedWon += m.ClosedWon
+	a.Revenue += m.Revenue
+	a.LeadCredit += m.LeadCredit
+	a.OpportunityCredit += opportunityCredit(m)
+	a.ClosedWonCredit += m.ClosedWonCredit
+	a.Funnel = mergeFunnel(a.Funnel, m.Funnel)
+}
+
+// opportunityCredit devuelve el crédito de oportunidad de la métrica. Antes del funnel configurable
+// toda oportunidad contaba como lead, así que en esas métricas coincide con el de lead.
+func opportunityCredit(m EnrichedMetric) float64 {
+	if m.Funnel == nil {
+		return m.LeadCredit
+	}
+	return m.OpportunityCredit
+}
+
+// mergeFunnel suma las etapas de src a las de dst por nombre; las etapas nuevas se añaden al final.
+func mergeFunnel(dst, src []FunnelStep) []FunnelStep {
+	for _, step := range src {
+		i := slices.IndexFunc(dst, func(s FunnelStep) bool { return s.Step == step.Step })
+		if i < 0 {
+			dst = append(dst, FunnelStep{Step: step.Step})
+			i = len(dst) - 1
+		}
+		dst[i].Count += step.Count
+		dst[i].Credit += step.Credit
+		dst[i].Lost += step.Lost
+		dst[i].LostCredit += step.LostCredit
+	}
+	return dst
+}
+
+// computeRatios recalcula los ratios derivados a partir de los totales del grupo.
+func (a *AggregateRow) computeRatios() {
+	a.CPC, a.CPA, a.CVRLeadToOpp, a.CVROppToWon, a.ROAS = 0, 0, 0, 0, 0
+	if a.Clicks > 0 {
+		a.CPC = a.Cost / float64(a.Clicks)
+	}
+	if a.LeadCredit > 0 {
+		a.CPA = a.Cost / a.LeadCredit
+	}
+	if a.OpportunityCredit > 0 {
+		a.CVROppToWon = a.ClosedWonCredit / a.OpportunityCredit
+	}
+	if a.LeadCredit > 0 {
+		a.CVRLeadToOpp = a.OpportunityCredit / a.LeadCredit
+	}
+	if a.Cost > 0 {
+		a.ROAS = a.Revenue / a.Cost
+	}
+	ComputeFunnelRates(a.Funnel)
+}
+
+// groupValue devuelve el valor de agrupación de una métrica para un campo.
+func groupValue(m EnrichedMetric, field GroupByField) string {
+	switch field {
+	case GroupByDate:
+		return m.Date.Format("2006-01-02")
+	case GroupByWeek:
+		return weekStart(m.Date).Format("2006-01-02")
+	case GroupByMonth:
+		return m.Date.Format("2006-01")
+	case GroupByChannel:
+		return m.Channel
+	case GroupByCampaignID:
+		return m.CampaignID
+	case GroupByUTMCampaign:
+		return m.UTMCampaign
+	case GroupByUTMSource:
+		return m.UTMSource
+	case GroupByUTMMedium:
+		return m.UTMMedium
+	case GroupByAttributionModel:
+		return m.AttributionModel
+	}
+	return ""
+}
+
+// weekStart devuelve el lunes de la semana ISO de la fecha.
+func weekStart(t time.Time) time.Time {
+	offset := (int(t.Weekday()) + 6) % 7 // Lunes = 0, domingo = 6.
+	return t.AddDate(0, 0, -offset)
+}
+
+// sortAggregateRows ordena las filas por los valores de agrupación, en el orden de los campos.
+func sortAggregateRows(rows []AggregateRow, groupBy []GroupByField) {
+	sort.Slice(rows, func(i, j int) bool {
+		for _, field := range groupBy {
+			a, b := rows[i].Group[string(field)], rows[j].Group[string(field)]
+			if a != b {
+				return a < b
+			}
+		}
+		return false
+	})
+}
+
+// Aggregate suma las métricas filtradas agrupándolas por los campos indicados.
+func (r *InMemoryRepository) Aggregate(filter MetricFilter, groupBy []GroupByField) ([]AggregateRow, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	groups := make(map[string]*AggregateRow)
+	for _, e := range r.rangeEntries(filter) {
+		m := r.storage[e.key]
+		if !filter.matches(m) {
+			continue
+		}
+		m.AttributionModel = filter.modelOf(m) // Las métricas sin modelo se agrupan con el modelo por defecto.
+
+		values := make([]string, len(groupBy))
+		for i, field := range groupBy {
+			values[i] = groupValue(m, field)
+		}
+		key := strings.Join(values, "\x00")
+
+		row, ok := groups[key]
+		if !ok {
+			row = &AggregateRow{Group: make(map[string]string, len(groupBy))}
+			for i, field := range groupBy {
+				row.Group[string(field)] = values[i]
+			}
+			groups[key] = row
+		}
+		row.add(m)
+	}
+
+	rows := make([]AggregateRow, 0, len(groups))
+	for _, row := range groups {
+		row.computeRatios()
+		rows = append(rows, *row)
+	}
+	sortAggregateRows(rows, groupBy)
+	return rows, nil
+}
@@ -0,0 +1,135 @@
+package data
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// aggregateFixture devuelve dos días de google_ads (misma semana) y uno de meta_ads.
+func aggregateFixture() []EnrichedMetric {
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	return []EnrichedMetric{
+		// Día con ROAS 10: 100 de coste, 1000 de ingresos.
+		{Date: day("2025-08-04"), CampaignID: "C-1", Channel: "google_ads", UTMCampaign: "summer_sale", Clicks: 100, Cost: 100, Leads: 4, Opportunities: 4, LeadCredit: 4, ClosedWon: 1, ClosedWonCredit: 1, Revenue: 1000},
+		// Día con ROAS 0: 300 de coste, sin ingresos.
+		{Date: day("2025-08-06"), CampaignID: "C-1", Channel: "google_ads", UTMCampaign: "summer_sale", Clicks: 100, Cost: 300, Leads: 0},
+		{Date: day("2025-08-12"), CampaignID: "C-2", Channel: "meta_ads", UTMCampaign: "summer_sale", Clicks: 10, Cost: 50, Leads: 1, Opportunities: 1, LeadCredit: 1},
+	}
+}
+
+func TestAggregate_RecomputesRatiosFromTotals(t *testing.T) {
+	from, _ := time.Parse("2006-01-02", "2025-08-01")
+	to, _ := time.Parse("2006-01-02", "2025-08-31")
+
+	memRepo := NewInMemoryRepository()
+	sqlRepo := newTestSQLRepository(t)
+	for _, m := range aggregateFixture() {
+		require.NoError(t, memRepo.Save(m))
+		require.NoError(t, sqlRepo.Save(m))
+	}
+
+	for name, repo := range map[string]MetricRepository{"memory": memRepo, "sql": sqlRepo} {
+		t.Run(name, func(t *testing.T) {
+			rows, err := repo.Aggregate(MetricFilter{From: from, To: to}, []GroupByField{GroupByChannel, GroupByWeek})
+			require.NoError(t, err)
+			require.Len(t, rows, 2)
+
+			google := rows[0]
+			assert.Equal(t, map[string]string{"channel": "google_ads", "week": "2025-08-04"}, google.Group)
+			assert.Equal(t, 200, google.Clicks)
+			assert.Equal(t, 400.0, google.Cost)
+			// 1000 / 400, no el promedio de los ROAS diarios (10 y 0).
+			assert.InDelta(t, 2.5, google.ROAS, 0.001)
+			assert.InDelta(t, 2.0, google.CPC, 0.001)
+			assert.InDelta(t, 100.0, google.CPA, 0.001)
+
+			assert.Equal(t, "meta_ads", rows[1].Group["channel"])
+			assert.Equal(t, "2025-08-11", rows[1].Group["week"])
+
+			filtered, err := repo.Aggregate(MetricFilter{Channel: "meta_ads", From: from, To: to}, []GroupByField{GroupByMonth})
+			require.NoError(t, err)
+			require.Len(t, filtered, 1)
+			assert.Equal(t, "2025-08", filtered[0].Group["month"])
+			assert.Equal(t, 10, filtered[0].Clicks)
+		})
+	}
+}
+
+func TestAggregate_SumsFunnelSteps(t *testing.T) {
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	funnel := func(lead, opp, won, lostAtOpp float64) []FunnelStep {
+		steps := []FunnelStep{
+			{Step: "lead", Count: int(lead), Credit: lead},
+			{Step: "opportunity", Count: int(opp), Credit: opp, Lost: int(lostAtOpp), LostCredit: lostAtOpp},
+			{Step: "won", Count: int(won), Credit: won},
+		}
+		ComputeFunnelRates(steps)
+		return steps
+	}
+	metrics := []EnrichedMetric{
+		{Date: day("2025-08-04"), CampaignID: "C-1", Channel: "google_ads", UTMCampaign: "summer_sale", Leads: 4, LeadCredit: 4,
+			Opportunities: 2, OpportunityCredit: 2, ClosedWon: 1, ClosedWonCredit: 1, Funnel: funnel(4, 2, 1, 1)},
+		{Date: day("2025-08-05"), CampaignID: "C-1", Channel: "google_ads", UTMCampaign: "summer_sale", Leads: 6, LeadCredit: 6,
+			Opportunities: 2, OpportunityCredit: 2, ClosedWon: 1, ClosedWonCredit: 1, Funnel: funnel(6, 2, 1, 0)},
+		// Métrica anterior al funnel configurable: sin etapas, su crédito de oportunidad es el de lead.
+		{Date: day("2025-08-06"), CampaignID: "C-1", Channel: "google_ads", UTMCampaign: "summer_sale", Leads: 2, LeadCredit: 2, Opportunities: 2},
+	}
+
+	memRepo := NewInMemoryRepository()
+	sqlRepo := newTestSQLRepository(t)
+	for _, m := range metrics {
+		require.NoError(t, memRepo.Save(m))
+		require.NoError(t, sqlRepo.Save(m))
+	}
+	from, to := day("2025-08-01"), day("2025-08-31")
+
+	for name, repo := range map[string]MetricRepository{"memory": memRepo, "sql": sqlRepo} {
+		t.Run(name, func(t *testing.T) {
+			stored, err := repo.GetMetricsByDate(day("2025-08-04"), "")
+			require.NoError(t, err)
+			require.Len(t, stored, 1)
+			assert.Equal(t, metrics[0].Funnel, stored[0].Funnel)
+			legacy, err := repo.GetMetricsByDate(day("2025-08-06"), "")
+			require.NoError(t, err)
+			assert.Nil(t, legacy[0].Funnel)
+
+			rows, err := repo.Aggregate(MetricFilter{UTMCampaign: "summer_sale", From: from, To: to}, []GroupByField{GroupByUTMCampaign})
+			require.NoError(t, err)
+			require.Len(t, rows, 1)
+			row := rows[0]
+			require.Len(t, row.Funnel, 3)
+			assert.Equal(t, "lead", row.Funnel[0].Step)
+			assert.Equal(t, 10, row.Funnel[0].Count)
+			assert.Equal(t, 4, row.Funnel[1].Count)
+			assert.Equal(t, 1, row.Funnel[1].Lost)
+			assert.Equal(t, 2, row.Funnel[2].Count)
+			// Tasas recalculadas desde los totales: 4/10 y 2/4.
+			assert.Zero(t, row.Funnel[0].ConversionRate)
+			assert.InDelta(t, 0.4, row.Funnel[1].ConversionRate, 0.001)
+			assert.InDelta(t, 0.5, row.Funnel[2].ConversionRate, 0.001)
+			// 2 ganadas sobre 4 + 2 (legado) de crédito de oportunidad.
+			assert.InDelta(t, 6.0, row.OpportunityCredit, 0.001)
+			assert.InDelta(t, 2.0/6.0, row.CVROppToWon, 0.001)
+		})
+	}
+}
+
+func TestParseGroupBy(t *testing.T) {
+	fields, err := ParseGroupBy("channel, week,channel")
+	require.NoError(t, err)
+	assert.Equal(t, []GroupByField{GroupByChannel, GroupByWeek}, fields)
+
+	_, err = ParseGroupBy("country")
+	assert.Error(t, err)
+	_, err = ParseGroupBy(" , ")
+	assert.Error(t, err)
+}
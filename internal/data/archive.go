@@ -0,0 +1,454 @@
+// Package data internal/data/archive.go
+package data
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArchivedPayload es una respuesta en bruto archivada: la página page de una fuente en una ingesta.
+type ArchivedPayload struct {
+	Source    string    `json:"source"`
+	Page      int       `json:"page"`
+	SHA256    string    `json:"sha256"` // Hash del contenido sin comprimir; identifica el objeto archivado.
+	Bytes     int64     `json:"bytes"`  // Tamaño sin comprimir.
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// ArchivedRun es el manifiesto de una ingesta archivada.
+type ArchivedRun struct {
+	RunID      string                `json:"run_id"`
+	Model      string                `json:"model"`
+	StartedAt  time.Time             `json:"started_at"`
+	FinishedAt time.Time             `json:"finished_at"`
+	Window     map[string]*time.Time `json:"window"` // Inicio de la ventana de cada fuente, para repetir el filtrado local.
+	// RecomputeFrom es el primer día cuyas métricas guardó la ingesta; las anteriores sólo se descargaron como
+	// contexto de la atribución. Nil si se guardaron todas.
+	RecomputeFrom *time.Time `json:"recompute_from,omitempty"`
+	// Complete indica que se archivaron todas las páginas de todas las fuentes; sólo entonces puede repetirse.
+	Complete bool              `json:"complete"`
+	Error    string            `json:"error,omitempty"`
+	Payloads []ArchivedPayload `json:"payloads"`
+	// Snapshot es el hash del objeto con la configuración con la que se ejecutó la ingesta; vacío en las
+	// ingestas archivadas sin ella.
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+// ErrArchivedRunNotFound se devuelve al consultar una ingesta que no está en el archivo.
+var ErrArchivedRunNotFound = errors.New("archived run not found")
+
+// runIDPattern restringe los IDs de ingesta, que forman parte de nombres de archivo.
+var runIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// PayloadArchive guarda en disco las respuestas en bruto de las fuentes, comprimidas con gzip y direccionadas
+// por contenido (objects/<hash[:2]>/<hash>.json.gz), con un manifiesto por ingesta (runs/<run_id>.json).
+// Una respuesta idéntica en varias ingestas se guarda una sola vez.
+type PayloadArchive struct {
+	dir       string
+	retention time.Duration // 0 conserva las ingestas indefinidamente.
+
+	mu     sync.Mutex
+	active map[string]int // Objetos de ingestas en curso, aún sin manifiesto; la purga no los borra.
+}
+
+// NewPayloadArchive abre (o crea) el archivo en dir y purga las ingestas más antiguas que retention.
+func NewPayloadArchive(dir string, retention time.Duration) (*PayloadArchive, error) {
+	a := &PayloadArchive{dir: dir, retention: retention, active: make(map[string]int)}
+	for _, sub := range []string{"objects", "runs", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create archive dir: %w", err)
+		}
+	}
+	if _, err := a.Prune(time.Now()); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// ArchiveRun acumula las respuestas archivadas de una ingesta en curso hasta que Finish escribe su manifiesto.
+type ArchiveRun struct {
+	archive *PayloadArchive
+
+	mu       sync.Mutex
+	manifest ArchivedRun
+	missing  []string // Motivos por los que la ingesta no queda completa.
+}
+
+// Begin empieza a archivar una ingesta.
+func (a *PayloadArchive) Begin(runID, model string, window map[string]*time.Time) (*ArchiveRun, error) {
+	if !runIDPattern.MatchString(runID) {
+		return nil, fmt.Errorf("invalid run id %q", runID)
+	}
+	return &ArchiveRun{archive: a, manifest: ArchivedRun{
+		RunID:     runID,
+		Model:     model,
+		StartedAt: time.Now().UTC(),
+		Window:    window,
+		Payloads:  []ArchivedPayload{},
+	}}, nil
+}
+
+// RunID devuelve el ID de la ingesta.
+func (r *ArchiveRun) RunID() string {
+	return r.manifest.RunID
+}
+
+// SetRecomputeFrom registra el primer día cuyas métricas guarda la ingesta, para que su repetición guarde las mismas.
+func (r *ArchiveRun) SetRecomputeFrom(day *time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.manifest.RecomputeFrom = day
+}
+
+// MarkIncomplete registra que una parte de la ingesta no se archivó, de modo que no podrá repetirse.
+func (r *ArchiveRun) MarkIncomplete(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.missing = append(r.missing, reason)
+}
+
+// PayloadCapture copia una respuesta en el archivo mientras se lee. Sólo queda archivada si se llama a
+// Commit después de leerla entera; Discard descarta la copia (por ejemplo, si el intento se reintenta).
+type PayloadCapture struct {
+	run       *ArchiveRun
+	source    string
+	page      int
+	fetchedAt time.Time
+	reader    io.Reader
+	tmp       *os.File
+	gz        *gzip.Writer
+	hash      hash.Hash
+	size      int64
+	done      bool
+	snapshot  bool // Es la configuración de la ingesta, no una página de una fuente.
+}
+
+// Capture devuelve un lector de body que copia todo lo leído al archivo como la página page de source.
+func (r *ArchiveRun) Capture(source string, page int, body io.Reader) (*PayloadCapture, error) {
+	tmp, err := os.CreateTemp(filepath.Join(r.archive.dir, "tmp"), "payload-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archive file: %w", err)
+	}
+	c := &PayloadCapture{
+		run:       r,
+		source:    source,
+		page:      page,
+		fetchedAt: time.Now().UTC(),
+		tmp:       tmp,
+		gz:        gzip.NewWriter(tmp),
+		hash:      sha256.New(),
+	}
+	c.reader = io.TeeReader(body, io.MultiWriter(c.hash, c.gz, countingWriter{&c.size}))
+	return c, nil
+}
+
+// Read lee de la respuesta original y archiva lo leído.
+func (c *PayloadCapture) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Commit lee lo que quede de la respuesta, la instala en el archivo y la añade al manifiesto de la ingesta.
+func (c *PayloadCapture) Commit() error {
+	if c.done {
+		return nil
+	}
+	c.done = true
+	defer os.Remove(c.tmp.Name())
+
+	// El decodificador puede no consumir el final del cuerpo (espacios tras el documento): se archiva completo.
+	if _, err := io.Copy(io.Discard, c.reader); err != nil {
+		c.tmp.Close()
+		return fmt.Errorf("failed to read payload: %w", err)
+	}
+	if err := c.gz.Close(); err != nil {
+		c.tmp.Close()
+		return fmt.Errorf("failed to compress payload: %w", err)
+	}
+	if err := c.tmp.Sync(); err != nil {
+		c.tmp.Close()
+		return fmt.Errorf("failed to sync payload: %w", err)
+	}
+	if err := c.tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close payload: %w", err)
+	}
+
+	sum := hex.EncodeToString(c.hash.Sum(nil))
+	a := c.run.archive
+	path := a.objectPath(sum)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return fmt.Errorf("failed to create archive dir: %w", err)
+		}
+		if err := os.Rename(c.tmp.Name(), path); err != nil {
+			return fmt.Errorf("failed to install payload: %w", err)
+		}
+	}
+	a.active[sum]++
+
+	c.run.mu.Lock()
+	if c.snapshot {
+		c.run.manifest.Snapshot = sum
+	} else {
+		c.run.manifest.Payloads = append(c.run.manifest.Payloads, ArchivedPayload{
+			Source: c.source, Page: c.page, SHA256: sum, Bytes: c.size, FetchedAt: c.fetchedAt,
+		})
+	}
+	c.run.mu.Unlock()
+	return nil
+}
+
+// AttachSnapshot archiva la configuración con la que se ejecuta la ingesta, para repetirla después con ella.
+// Se guarda como un objeto más, de modo que las ingestas con la misma configuración la comparten.
+func (r *ArchiveRun) AttachSnapshot(snapshot []byte) error {
+	r.mu.Lock()
+	attached := r.manifest.Snapshot != ""
+	r.mu.Unlock()
+	if attached {
+		return fmt.Errorf("run %s already has a snapshot", r.manifest.RunID)
+	}
+	c, err := r.Capture("", 0, bytes.NewReader(snapshot))
+	if err != nil {
+		return err
+	}
+	c.snapshot = true
+	if err := c.Commit(); err != nil {
+		return fmt.Errorf("failed to archive run snapshot: %w", err)
+	}
+	return nil
+}
+
+// Discard descarta la copia si no se ha confirmado con Commit.
+func (c *PayloadCapture) Discard() {
+	if c.done {
+		return
+	}
+	c.done = true
+	c.gz.Close()
+	c.tmp.Close()
+	os.Remove(c.tmp.Name())
+}
+
+// Finish escribe el manifiesto de la ingesta. runErr es el error de la descarga, si falló: el manifiesto se
+// escribe igualmente, para poder inspeccionar las respuestas, pero la ingesta no queda completa.
+func (r *ArchiveRun) Finish(runErr error) error {
+	r.mu.Lock()
+	manifest := r.manifest
+	manifest.FinishedAt = time.Now().UTC()
+	manifest.Complete = runErr == nil && len(r.missing) == 0
+	var problems []string
+	if runErr != nil {
+		problems = append(problems, runErr.Error())
+	}
+	manifest.Error = strings.Join(append(problems, r.missing...), "; ")
+	// Orden determinista: por fuente y página.
+	manifest.Payloads = append([]ArchivedPayload(nil), manifest.Payloads...)
+	sort.SliceStable(manifest.Payloads, func(i, j int) bool {
+		if manifest.Payloads[i].Source != manifest.Payloads[j].Source {
+			return manifest.Payloads[i].Source < manifest.Payloads[j].Source
+		}
+		return manifest.Payloads[i].Page < manifest.Payloads[j].Page
+	})
+	r.mu.Unlock()
+
+	a := r.archive
+	err := writeJSONAtomic(a.runPath(manifest.RunID), manifest)
+
+	a.mu.Lock()
+	for _, sum := range manifest.objects() {
+		if a.active[sum]--; a.active[sum] <= 0 {
+			delete(a.active, sum)
+		}
+	}
+	a.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("failed to write archive manifest: %w", err)
+	}
+	if _, err := a.Prune(time.Now()); err != nil {
+		log.Printf("WARN: Failed to prune payload archive: %v", err)
+	}
+	return nil
+}
+
+// Run devuelve el manifiesto de una ingesta archivada.
+func (a *PayloadArchive) Run(runID string) (*ArchivedRun, error) {
+	if !runIDPattern.MatchString(runID) {
+		return nil, fmt.Errorf("%w: %q", ErrArchivedRunNotFound, runID)
+	}
+	raw, err := os.ReadFile(a.runPath(runID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %q", ErrArchivedRunNotFound, runID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive manifest: %w", err)
+	}
+	var run ArchivedRun
+	if err := json.Unmarshal(raw, &run); err != nil {
+		return nil, fmt.Errorf("failed to decode archive manifest %s: %w", runID, err)
+	}
+	return &run, nil
+}
+
+// ListRuns devuelve los manifiestos de las ingestas archivadas, de la más reciente a la más antigua.
+func (a *PayloadArchive) ListRuns() ([]ArchivedRun, error) {
+	entries, err := os.ReadDir(filepath.Join(a.dir, "runs"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list archived runs: %w", err)
+	}
+	runs := []ArchivedRun{}
+	for _, entry := range entries {
+		runID, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !runIDPattern.MatchString(runID) {
+			continue // Temporales de writeJSONAtomic.
+		}
+		run, err := a.Run(runID)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, *run)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].StartedAt.After(runs[j].StartedAt) })
+	return runs, nil
+}
+
+// Open devuelve el contenido sin comprimir de una respuesta archivada. El lector comprueba al llegar al final
+// que el contenido coincide con su hash.
+func (a *PayloadArchive) Open(sum string) (io.ReadCloser, error) {
+	f, err := os.Open(a.objectPath(sum))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archived payload %s: %w", sum, err)
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to decompress archived payload %s: %w", sum, err)
+	}
+	return &verifiedReader{file: f, gz: gz, hash: sha256.New(), want: sum}, nil
+}
+
+// Prune borra los manifiestos de las ingestas que empezaron hace más de la retención y los objetos
+// que ya no usa ningún manifiesto ni ninguna ingesta en curso. Devuelve el número de ingestas borradas.
+func (a *PayloadArchive) Prune(now time.Time) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	runs, err := a.ListRuns()
+	if err != nil {
+		return 0, err
+	}
+	referenced := make(map[string]bool)
+	pruned := 0
+	for _, run := range runs {
+		if a.retention > 0 && now.Sub(run.StartedAt) > a.retention {
+			if err := os.Remove(a.runPath(run.RunID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return pruned, fmt.Errorf("failed to prune archived run %s: %w", run.RunID, err)
+			}
+			pruned++
+			continue
+		}
+		for _, sum := range run.objects() {
+			referenced[sum] = true
+		}
+	}
+
+	err = filepath.WalkDir(filepath.Join(a.dir, "objects"), func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		sum := strings.TrimSuffix(d.Name(), ".json.gz")
+		if referenced[sum] || a.active[sum] > 0 {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return pruned, fmt.Errorf("failed to prune archived payloads: %w", err)
+	}
+	if pruned > 0 {
+		log.Printf("INFO: Pruned %d archived runs older than %s.", pruned, a.retention)
+	}
+	return pruned, nil
+}
+
+// objects devuelve los hashes de los objetos que usa la ingesta: sus respuestas y su configuración.
+func (r ArchivedRun) objects() []string {
+	sums := make([]string, 0, len(r.Payloads)+1)
+	for _, p := range r.Payloads {
+		sums = append(sums, p.SHA256)
+	}
+	if r.Snapshot != "" {
+		sums = append(sums, r.Snapshot)
+	}
+	return sums
+}
+
+// objectPath devuelve la ruta del objeto con el hash indicado.
+func (a *PayloadArchive) objectPath(sum string) string {
+	prefix := sum
+	if len(prefix) > 2 {
+		prefix = prefix[:2]
+	}
+	return filepath.Join(a.dir, "objects", prefix, sum+".json.gz")
+}
+
+// runPath devuelve la ruta del manifiesto de una ingesta.
+func (a *PayloadArchive) runPath(runID string) string {
+	return filepath.Join(a.dir, "runs", runID+".json")
+}
+
+// countingWriter suma los bytes escritos.
+type countingWriter struct {
+	n *int64
+}
+
+// Write cuenta los bytes de p.
+func (w countingWriter) Write(p []byte) (int, error) {
+	*w.n += int64(len(p))
+	return len(p), nil
+}
+
+// verifiedReader descomprime un objeto archivado y comprueba su hash al llegar al final.
+type verifiedReader struct {
+	file *os.File
+	gz   *gzip.Reader
+	hash hash.Hash
+	want string
+}
+
+// Read lee el contenido sin comprimir; al llegar al final devuelve un error si el hash no coincide.
+func (r *verifiedReader) Read(p []byte) (int, error) {
+	n, err := r.gz.Read(p)
+	r.hash.Write(p[:n])
+	if errors.Is(err, io.EOF) {
+		if got := hex.EncodeToString(r.hash.Sum(nil)); got != r.want {
+			return n, fmt.Errorf("archived payload %s is corrupted (content hash %s)", r.want, got)
+		}
+	}
+	return n, err
+}
+
+// Close cierra el objeto.
+func (r *verifiedReader) Close() error {
+	r.gz.Close()
+	return r.file.Close()
+}
@@ -0,0 +1,218 @@
+package data
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// archivePage captura body como una página de run y la confirma.
+func archivePage(t *testing.T, run *ArchiveRun, source string, page int, body string) {
+	capture, err := run.Capture(source, page, strings.NewReader(body))
+	require.NoError(t, err)
+	// Se lee sólo una parte: Commit archiva también lo que el decodificador no consumió.
+	_, err = io.ReadFull(capture, make([]byte, 2))
+	require.NoError(t, err)
+	require.NoError(t, capture.Commit())
+}
+
+func countObjects(t *testing.T, dir string) int {
+	count := 0
+	require.NoError(t, filepath.WalkDir(filepath.Join(dir, "objects"), func(_ string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			count++
+		}
+		return err
+	}))
+	return count
+}
+
+func TestPayloadArchive_CaptureDedupAndOpen(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := NewPayloadArchive(dir, 0)
+	require.NoError(t, err)
+
+	since := time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC)
+	run, err := archive.Begin("run-1", "last_touch", map[string]*time.Time{"ads": &since, "crm": nil})
+	require.NoError(t, err)
+	archivePage(t, run, "crm", 1, `{"page": "crm"}`)
+	archivePage(t, run, "ads", 2, `{"page": "same"}`)
+	archivePage(t, run, "ads", 1, `{"page": "same"}`)
+
+	// Un intento descartado no deja rastro en el manifiesto ni en disco.
+	discarded, err := run.Capture("ads", 3, strings.NewReader(`{"retried": true}`))
+	require.NoError(t, err)
+	discarded.Discard()
+	require.NoError(t, run.Finish(nil))
+
+	manifest, err := archive.Run("run-1")
+	require.NoError(t, err)
+	assert.True(t, manifest.Complete)
+	assert.Equal(t, "last_touch", manifest.Model)
+	assert.Equal(t, since, *manifest.Window["ads"])
+	assert.Nil(t, manifest.Window["crm"])
+	require.Len(t, manifest.Payloads, 3)
+	assert.Equal(t, "ads", manifest.Payloads[0].Source)
+	assert.Equal(t, 1, manifest.Payloads[0].Page)
+	assert.Equal(t, manifest.Payloads[0].SHA256, manifest.Payloads[1].SHA256)
+	assert.Equal(t, int64(len(`{"page": "same"}`)), manifest.Payloads[0].Bytes)
+	assert.False(t, manifest.Payloads[0].FetchedAt.IsZero())
+	assert.Equal(t, 2, countObjects(t, dir), "identical payloads are stored once")
+	tmp, err := os.ReadDir(filepath.Join(dir, "tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, tmp)
+
+	reader, err := archive.Open(manifest.Payloads[2].SHA256)
+	require.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	assert.Equal(t, `{"page": "crm"}`, string(content))
+
+	// Una ingesta fallida se archiva, pero no queda completa.
+	failed, err := archive.Begin("run-2", "last_touch", nil)
+	require.NoError(t, err)
+	failed.MarkIncomplete("ads page 2 not archived")
+	require.NoError(t, failed.Finish(assert.AnError))
+	manifest, err = archive.Run("run-2")
+	require.NoError(t, err)
+	assert.False(t, manifest.Complete)
+	assert.Contains(t, manifest.Error, "ads page 2 not archived")
+
+	runs, err := archive.ListRuns()
+	require.NoError(t, err)
+	assert.Len(t, runs, 2)
+
+	_, err = archive.Run("missing")
+	assert.ErrorIs(t, err, ErrArchivedRunNotFound)
+	_, err = archive.Run("../escape")
+	assert.ErrorIs(t, err, ErrArchivedRunNotFound)
+	_, err = archive.Begin("../escape", "last_touch", nil)
+	assert.Error(t, err)
+}
+
+func TestPayloadArchive_OpenDetectsCorruption(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := NewPayloadArchive(dir, 0)
+	require.NoError(t, err)
+	run, err := archive.Begin("run-1", "last_touch", nil)
+	require.NoError(t, err)
+	archivePage(t, run, "ads", 1, `{"original": true}`)
+	require.NoError(t, run.Finish(nil))
+	manifest, err := archive.Run("run-1")
+	require.NoError(t, err)
+	sum := manifest.Payloads[0].SHA256
+
+	// Se reescribe el objeto con otro contenido, comprimido correctamente.
+	f, err := os.Create(archive.objectPath(sum))
+	require.NoError(t, err)
+	gz := gzip.NewWriter(f)
+	_, err = gz.Write([]byte(`{"tampered": true}`))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	require.NoError(t, f.Close())
+
+	reader, err := archive.Open(sum)
+	require.NoError(t, err)
+	defer reader.Close()
+	_, err = io.ReadAll(reader)
+	assert.ErrorContains(t, err, "corrupted")
+}
+
+func TestPayloadArchive_PruneByRetention(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := NewPayloadArchive(dir, 24*time.Hour)
+	require.NoError(t, err)
+
+	old, err := archive.Begin("old", "last_touch", nil)
+	require.NoError(t, err)
+	archivePage(t, old, "ads", 1, `{"only": "old"}`)
+	archivePage(t, old, "crm", 1, `{"shared": true}`)
+	require.NoError(t, old.Finish(nil))
+
+	recent, err := archive.Begin("recent", "last_touch", nil)
+	require.NoError(t, err)
+	archivePage(t, recent, "crm", 1, `{"shared": true}`)
+	require.NoError(t, recent.Finish(nil))
+
+	// Una ingesta en curso protege sus objetos aunque aún no tenga manifiesto.
+	inFlight, err := archive.Begin("in-flight", "last_touch", nil)
+	require.NoError(t, err)
+	archivePage(t, inFlight, "ads", 1, `{"in": "flight"}`)
+	require.Equal(t, 3, countObjects(t, dir))
+
+	// Se envejece dos días el manifiesto de "old".
+	manifest, err := archive.Run("old")
+	require.NoError(t, err)
+	manifest.StartedAt = manifest.StartedAt.Add(-48 * time.Hour)
+	require.NoError(t, writeJSONAtomic(archive.runPath("old"), manifest))
+
+	// Sólo caduca "old"; su objeto compartido con "recent" se conserva.
+	pruned, err := archive.Prune(time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 1, pruned)
+	_, err = archive.Run("old")
+	assert.ErrorIs(t, err, ErrArchivedRunNotFound)
+	_, err = archive.Run("recent")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, countObjects(t, dir))
+
+	require.NoError(t, inFlight.Finish(nil))
+
+	// Sin retención no se purga nada.
+	forever, err := NewPayloadArchive(dir, 0)
+	require.NoError(t, err)
+	pruned, err = forever.Prune(time.Now().Add(365 * 24 * time.Hour))
+	require.NoError(t, err)
+	assert.Zero(t, pruned)
+	assert.Equal(t, 2, countObjects(t, dir))
+}
+
+func TestPayloadArchive_SnapshotIsSharedAndPruned(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := NewPayloadArchive(dir, 24*time.Hour)
+	require.NoError(t, err)
+
+	old, err := archive.Begin("old", "last_touch", nil)
+	require.NoError(t, err)
+	require.NoError(t, old.AttachSnapshot([]byte(`{"config": "v1"}`)))
+	assert.Error(t, old.AttachSnapshot([]byte(`{"config": "v2"}`)), "a run has a single snapshot")
+	archivePage(t, old, "ads", 1, `{"page": 1}`)
+	require.NoError(t, old.Finish(nil))
+
+	recent, err := archive.Begin("recent", "last_touch", nil)
+	require.NoError(t, err)
+	require.NoError(t, recent.AttachSnapshot([]byte(`{"config": "v1"}`)))
+	require.NoError(t, recent.Finish(nil))
+
+	manifest, err := archive.Run("recent")
+	require.NoError(t, err)
+	assert.Empty(t, manifest.Payloads, "the snapshot is not a source page")
+	require.NotEmpty(t, manifest.Snapshot)
+	reader, err := archive.Open(manifest.Snapshot)
+	require.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	assert.Equal(t, `{"config": "v1"}`, string(content))
+	assert.Equal(t, 2, countObjects(t, dir), "identical snapshots are stored once")
+
+	// Al caducar "old" se borra su página, pero no la configuración que comparte con "recent".
+	manifest, err = archive.Run("old")
+	require.NoError(t, err)
+	manifest.StartedAt = manifest.StartedAt.Add(-48 * time.Hour)
+	require.NoError(t, writeJSONAtomic(archive.runPath("old"), manifest))
+	_, err = archive.Prune(time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 1, countObjects(t, dir))
+	reader, err = archive.Open(manifest.Snapshot)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+}
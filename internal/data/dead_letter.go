@@ -0,0 +1,322 @@
+// Package data internal/data/dead_letter.go
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Estados de un lote en la cola de mensajes fallidos (DLQ) de la exportación.
+const (
+	DeadLetterPending  = "pending"  // Falló tras agotar los reintentos; pendiente de reenvío.
+	DeadLetterReplayed = "replayed" // Reenviado con éxito.
+)
+
+// LegacySinkName es el sink de los lotes fallidos y las entregas registrados antes de que la exportación
+// admitiera varios sinks: el sink HTTP de SINK_URL.
+const LegacySinkName = "http"
+
+// DeadLetter es un lote de exportación que un sink no aceptó tras agotar los reintentos.
+type DeadLetter struct {
+	ID        string          `json:"id"`      // Hash del sink y del cuerpo; el mismo lote fallido dos veces es una sola entrada.
+	Sink      string          `json:"sink"`    // Sink que no aceptó el lote y al que se reenvía.
+	Date      string          `json:"date"`    // Día exportado (YYYY-MM-DD); vacío en los lotes del outbox, que mezclan días.
+	Batch     int             `json:"batch"`   // Índice del lote dentro de la exportación, desde 0.
+	Metrics   int             `json:"metrics"` // Métricas del lote.
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Attempts  int             `json:"attempts"` // Envíos acumulados, incluidos los reenvíos.
+	LastError string          `json:"last_error"`
+	Status    string          `json:"status"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// DeadLetterFilter restringe los lotes devueltos por ListDeadLetters; los campos vacíos no filtran.
+type DeadLetterFilter struct {
+	Status string
+	Limit  int // 0 sin límite.
+}
+
+// matches indica si el lote cumple el filtro.
+func (f DeadLetterFilter) matches(l DeadLetter) bool {
+	return f.Status == "" || l.Status == f.Status
+}
+
+// DeadLetterStore persiste los lotes de exportación fallidos para inspeccionarlos y reenviarlos.
+type DeadLetterStore interface {
+	// AddDeadLetter guarda un lote fallido como pendiente. Si ya existe (mismo ID) suma sus intentos y
+	// actualiza el último error, conservando CreatedAt.
+	AddDeadLetter(letter DeadLetter) error
+	// GetDeadLetter devuelve un lote por ID, o nil si no existe.
+	GetDeadLetter(id string) (*DeadLetter, error)
+	// ListDeadLetters devuelve los lotes que cumplen el filtro, del actualizado más recientemente al más antiguo.
+	ListDeadLetters(filter DeadLetterFilter) ([]DeadLetter, error)
+	// ResolveDeadLetter marca un lote como reenviado, sumando los intentos del reenvío.
+	ResolveDeadLetter(id string, attempts int) error
+}
+
+// ErrDeadLetterNotFound se devuelve al resolver un lote que no está en la DLQ.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// InMemoryDeadLetterStore guarda la DLQ en memoria; se pierde al reiniciar.
+type InMemoryDeadLetterStore struct {
+	mu      sync.RWMutex
+	letters map[string]DeadLetter
+}
+
+// NewInMemoryDeadLetterStore crea una DLQ vacía.
+func NewInMemoryDeadLetterStore() *InMemoryDeadLetterStore {
+	return &InMemoryDeadLetterStore{letters: make(map[string]DeadLetter)}
+}
+
+// AddDeadLetter guarda o actualiza un lote fallido.
+func (s *InMemoryDeadLetterStore) AddDeadLetter(letter DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(letter)
+	return nil
+}
+
+// GetDeadLetter devuelve un lote por ID, o nil si no existe.
+func (s *InMemoryDeadLetterStore) GetDeadLetter(id string) (*DeadLetter, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	letter, ok := s.letters[id]
+	if !ok {
+		return nil, nil
+	}
+	return &letter, nil
+}
+
+// ListDeadLetters devuelve los lotes que cumplen el filtro, del actualizado más recientemente al más antiguo.
+func (s *InMemoryDeadLetterStore) ListDeadLetters(filter DeadLetterFilter) ([]DeadLetter, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := []DeadLetter{}
+	for _, letter := range s.letters {
+		if filter.matches(letter) {
+			list = append(list, letter)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].UpdatedAt.Equal(list[j].UpdatedAt) {
+			return list[i].UpdatedAt.After(list[j].UpdatedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	if filter.Limit > 0 && len(list) > filter.Limit {
+		list = list[:filter.Limit]
+	}
+	return list, nil
+}
+
+// ResolveDeadLetter marca un lote como reenviado.
+func (s *InMemoryDeadLetterStore) ResolveDeadLetter(id string, attempts int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resolve(id, attempts)
+}
+
+// add aplica AddDeadLetter; el llamador debe tener el lock.
+func (s *InMemoryDeadLetterStore) add(letter DeadLetter) {
+	if current, ok := s.letters[letter.ID]; ok {
+		letter.CreatedAt = current.CreatedAt
+		letter.Attempts += current.Attempts
+	}
+	letter.Status = DeadLetterPending
+	s.letters[letter.ID] = letter
+}
+
+// resolve aplica ResolveDeadLetter; el llamador debe tener el lock.
+func (s *InMemoryDeadLetterStore) resolve(id string, attempts int) error {
+	letter, ok := s.letters[id]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrDeadLetterNotFound, id)
+	}
+	letter.Status = DeadLetterReplayed
+	letter.Attempts += attempts
+	letter.LastError = ""
+	letter.UpdatedAt = time.Now().UTC()
+	s.letters[id] = letter
+	return nil
+}
+
+// FileDeadLetterStore persiste la DLQ en un archivo JSON, reescrito de forma atómica en cada cambio.
+type FileDeadLetterStore struct {
+	mem  *InMemoryDeadLetterStore
+	path string
+}
+
+// NewFileDeadLetterStore abre (o crea) la DLQ en la ruta indicada.
+func NewFileDeadLetterStore(path string) (*FileDeadLetterStore, error) {
+	s := &FileDeadLetterStore{mem: NewInMemoryDeadLetterStore(), path: path}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dead letters: %w", err)
+	}
+	defer f.Close()
+
+	var list []DeadLetter
+	if err := json.NewDecoder(f).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode dead letters: %w", err)
+	}
+	for _, letter := range list {
+		if letter.Sink == "" {
+			letter.Sink = LegacySinkName
+		}
+		s.mem.letters[letter.ID] = letter
+	}
+	return s, nil
+}
+
+// AddDeadLetter guarda o actualiza un lote fallido y lo persiste.
+func (s *FileDeadLetterStore) AddDeadLetter(letter DeadLetter) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	s.mem.add(letter)
+	return s.persist()
+}
+
+// GetDeadLetter devuelve un lote por ID, o nil si no existe.
+func (s *FileDeadLetterStore) GetDeadLetter(id string) (*DeadLetter, error) {
+	return s.mem.GetDeadLetter(id)
+}
+
+// ListDeadLetters devuelve los lotes que cumplen el filtro, del actualizado más recientemente al más antiguo.
+func (s *FileDeadLetterStore) ListDeadLetters(filter DeadLetterFilter) ([]DeadLetter, error) {
+	return s.mem.ListDeadLetters(filter)
+}
+
+// ResolveDeadLetter marca un lote como reenviado y lo persiste.
+func (s *FileDeadLetterStore) ResolveDeadLetter(id string, attempts int) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	if err := s.mem.resolve(id, attempts); err != nil {
+		return err
+	}
+	return s.persist()
+}
+
+// persist reescribe el archivo con el estado actual; el llamador debe tener el lock.
+func (s *FileDeadLetterStore) persist() error {
+	list := make([]DeadLetter, 0, len(s.mem.letters))
+	for _, letter := range s.mem.letters {
+		list = append(list, letter)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return writeJSONAtomic(s.path, list)
+}
+
+// deadLetterColumns son las columnas de export_dead_letters, en el orden de query.
+var deadLetterColumns = []string{"id", "sink", "date", "batch", "metrics", "payload", "attempts", "last_error", "status", "created_at", "updated_at"}
+
+// SQLDeadLetterStore persiste la DLQ en la tabla export_dead_letters, compartida entre réplicas.
+type SQLDeadLetterStore struct {
+	db      *sql.DB
+	dialect SQLDialect
+}
+
+// NewSQLDeadLetterStore crea la DLQ SQL y aplica las migraciones pendientes.
+func NewSQLDeadLetterStore(db *sql.DB, dialect SQLDialect) (*SQLDeadLetterStore, error) {
+	if err := Migrate(db); err != nil {
+		return nil, err
+	}
+	return &SQLDeadLetterStore{db: db, dialect: dialect}, nil
+}
+
+// AddDeadLetter guarda o actualiza un lote fallido.
+func (s *SQLDeadLetterStore) AddDeadLetter(l DeadLetter) error {
+	p := s.dialect.Placeholder
+	if _, err := s.db.Exec(fmt.Sprintf(
+		"INSERT INTO export_dead_letters (%s) VALUES (%s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s) "+
+			"ON CONFLICT (id) DO UPDATE SET attempts = export_dead_letters.attempts + excluded.attempts, "+
+			"last_error = excluded.last_error, status = excluded.status, updated_at = excluded.updated_at",
+		strings.Join(deadLetterColumns, ", "), p(1), p(2), p(3), p(4), p(5), p(6), p(7), p(8), p(9), p(10), p(11)),
+		l.ID, l.Sink, l.Date, l.Batch, l.Metrics, string(l.Payload), l.Attempts, l.LastError, DeadLetterPending,
+		formatWatermark(l.CreatedAt), formatWatermark(l.UpdatedAt)); err != nil {
+		return fmt.Errorf("failed to save dead letter %s: %w", l.ID, err)
+	}
+	return nil
+}
+
+// GetDeadLetter devuelve un lote por ID, o nil si no existe.
+func (s *SQLDeadLetterStore) GetDeadLetter(id string) (*DeadLetter, error) {
+	list, err := s.query(fmt.Sprintf("SELECT %s FROM export_dead_letters WHERE id = %s",
+		strings.Join(deadLetterColumns, ", "), s.dialect.Placeholder(1)), id)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	return &list[0], nil
+}
+
+// ListDeadLetters devuelve los lotes que cumplen el filtro, del actualizado más recientemente al más antiguo.
+func (s *SQLDeadLetterStore) ListDeadLetters(filter DeadLetterFilter) ([]DeadLetter, error) {
+	query := fmt.Sprintf("SELECT %s FROM export_dead_letters", strings.Join(deadLetterColumns, ", "))
+	var args []interface{}
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		query += " WHERE status = " + s.dialect.Placeholder(len(args))
+	}
+	query += " ORDER BY updated_at DESC, id"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += " LIMIT " + s.dialect.Placeholder(len(args))
+	}
+	return s.query(query, args...)
+}
+
+// ResolveDeadLetter marca un lote como reenviado, sumando los intentos del reenvío.
+func (s *SQLDeadLetterStore) ResolveDeadLetter(id string, attempts int) error {
+	p := s.dialect.Placeholder
+	res, err := s.db.Exec(fmt.Sprintf(
+		"UPDATE export_dead_letters SET status = %s, attempts = attempts + %s, last_error = '', updated_at = %s WHERE id = %s",
+		p(1), p(2), p(3), p(4)), DeadLetterReplayed, attempts, formatWatermark(time.Now()), id)
+	if err != nil {
+		return fmt.Errorf("failed to resolve dead letter %s: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("%w: %q", ErrDeadLetterNotFound, id)
+	}
+	return nil
+}
+
+// query ejecuta una consulta sobre export_dead_letters y escanea los lotes.
+func (s *SQLDeadLetterStore) query(query string, args ...interface{}) ([]DeadLetter, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	list := []DeadLetter{}
+	for rows.Next() {
+		var l DeadLetter
+		var payload, createdAt, updatedAt string
+		if err := rows.Scan(&l.ID, &l.Sink, &l.Date, &l.Batch, &l.Metrics, &payload, &l.Attempts, &l.LastError, &l.Status, &createdAt, &updatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan dead letter: %w", err)
+		}
+		l.Payload = json.RawMessage(payload)
+		if l.CreatedAt, err = time.Parse(watermarkLayout, createdAt); err != nil {
+			return nil, fmt.Errorf("invalid created_at for %s: %w", l.ID, err)
+		}
+		if l.UpdatedAt, err = time.Parse(watermarkLayout, updatedAt); err != nil {
+			return nil, fmt.Errorf("invalid updated_at for %s: %w", l.ID, err)
+		}
+		list = append(list, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query dead letters: %w", err)
+	}
+	return list, nil
+}
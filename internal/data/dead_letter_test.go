@@ -0,0 +1,87 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetterStores_AddListAndResolve(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	sqlStore, err := NewSQLDeadLetterStore(db, DialectSQLite)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "export_dlq.json")
+	fileStore, err := NewFileDeadLetterStore(path)
+	require.NoError(t, err)
+
+	stores := map[string]DeadLetterStore{
+		"memory": NewInMemoryDeadLetterStore(),
+		"file":   fileStore,
+		"sql":    sqlStore,
+	}
+	aug1 := time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC)
+	aug2 := time.Date(2025, 8, 2, 0, 0, 0, 0, time.UTC)
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, store.AddDeadLetter(DeadLetter{
+				ID: "b0", Date: "2025-08-01", Batch: 0, Metrics: 2, Payload: json.RawMessage(`[{},{}]`),
+				Attempts: 5, LastError: "sink returned status 503", CreatedAt: aug1, UpdatedAt: aug1,
+			}))
+			require.NoError(t, store.AddDeadLetter(DeadLetter{
+				ID: "b1", Date: "2025-08-01", Batch: 1, Metrics: 1, Payload: json.RawMessage(`[{}]`),
+				Attempts: 1, LastError: "sink returned status 400", CreatedAt: aug1, UpdatedAt: aug1,
+			}))
+
+			// El mismo lote fallido de nuevo suma intentos y conserva CreatedAt.
+			require.NoError(t, store.AddDeadLetter(DeadLetter{
+				ID: "b0", Date: "2025-08-01", Batch: 0, Metrics: 2, Payload: json.RawMessage(`[{},{}]`),
+				Attempts: 5, LastError: "sink returned status 502", CreatedAt: aug2, UpdatedAt: aug2,
+			}))
+			letter, err := store.GetDeadLetter("b0")
+			require.NoError(t, err)
+			require.NotNil(t, letter)
+			assert.Equal(t, 10, letter.Attempts)
+			assert.Equal(t, "sink returned status 502", letter.LastError)
+			assert.Equal(t, DeadLetterPending, letter.Status)
+			assert.True(t, letter.CreatedAt.Equal(aug1))
+			assert.JSONEq(t, `[{},{}]`, string(letter.Payload))
+
+			list, err := store.ListDeadLetters(DeadLetterFilter{})
+			require.NoError(t, err)
+			require.Len(t, list, 2)
+			assert.Equal(t, "b0", list[0].ID) // Actualizado más recientemente.
+
+			require.NoError(t, store.ResolveDeadLetter("b1", 1))
+			pending, err := store.ListDeadLetters(DeadLetterFilter{Status: DeadLetterPending})
+			require.NoError(t, err)
+			require.Len(t, pending, 1)
+			assert.Equal(t, "b0", pending[0].ID)
+			replayed, err := store.GetDeadLetter("b1")
+			require.NoError(t, err)
+			assert.Equal(t, DeadLetterReplayed, replayed.Status)
+			assert.Equal(t, 2, replayed.Attempts)
+			assert.Empty(t, replayed.LastError)
+
+			assert.ErrorIs(t, store.ResolveDeadLetter("missing", 1), ErrDeadLetterNotFound)
+			missing, err := store.GetDeadLetter("missing")
+			require.NoError(t, err)
+			assert.Nil(t, missing)
+		})
+	}
+
+	// La DLQ en archivo sobrevive a un reinicio.
+	reopened, err := NewFileDeadLetterStore(path)
+	require.NoError(t, err)
+	list, err := reopened.ListDeadLetters(DeadLetterFilter{Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+}
@@ -0,0 +1,169 @@
+// Package data internal/data/delivery_ledger.go
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExportDelivery es un lote de exportación que un sink aceptó, identificado por el sink y su Idempotency-Key.
+type ExportDelivery struct {
+	Sink        string    `json:"sink"`
+	Key         string    `json:"key"`     // Idempotency-Key del lote: fecha, índice y hash del contenido.
+	Date        string    `json:"date"`    // Día exportado (YYYY-MM-DD).
+	Batch       int       `json:"batch"`   // Índice del lote dentro de la exportación, desde 0.
+	Metrics     int       `json:"metrics"` // Métricas del lote.
+	DeliveredAt time.Time `json:"delivered_at"`
+}
+
+// DeliveryLedger registra los lotes ya entregados a cada sink, para no reenviar los que no cambiaron.
+type DeliveryLedger interface {
+	// RecordDelivery registra un lote entregado. Si ya estaba registrado actualiza DeliveredAt.
+	RecordDelivery(delivery ExportDelivery) error
+	// GetDelivery devuelve la entrega al sink con esa clave, o nil si el lote no se le ha entregado.
+	GetDelivery(sink, key string) (*ExportDelivery, error)
+}
+
+// deliveryID identifica una entrega en los registros en memoria y en archivo.
+func deliveryID(sink, key string) string {
+	return sink + "/" + key
+}
+
+// InMemoryDeliveryLedger guarda las entregas en memoria; se pierde al reiniciar.
+type InMemoryDeliveryLedger struct {
+	mu         sync.RWMutex
+	deliveries map[string]ExportDelivery
+}
+
+// NewInMemoryDeliveryLedger crea un registro de entregas vacío.
+func NewInMemoryDeliveryLedger() *InMemoryDeliveryLedger {
+	return &InMemoryDeliveryLedger{deliveries: make(map[string]ExportDelivery)}
+}
+
+// RecordDelivery registra un lote entregado.
+func (l *InMemoryDeliveryLedger) RecordDelivery(delivery ExportDelivery) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.deliveries[deliveryID(delivery.Sink, delivery.Key)] = delivery
+	return nil
+}
+
+// GetDelivery devuelve la entrega al sink con esa clave, o nil si no existe.
+func (l *InMemoryDeliveryLedger) GetDelivery(sink, key string) (*ExportDelivery, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	delivery, ok := l.deliveries[deliveryID(sink, key)]
+	if !ok {
+		return nil, nil
+	}
+	return &delivery, nil
+}
+
+// FileDeliveryLedger persiste las entregas en un archivo JSON, reescrito de forma atómica en cada cambio.
+type FileDeliveryLedger struct {
+	mem  *InMemoryDeliveryLedger
+	path string
+}
+
+// NewFileDeliveryLedger abre (o crea) el registro de entregas en la ruta indicada.
+func NewFileDeliveryLedger(path string) (*FileDeliveryLedger, error) {
+	l := &FileDeliveryLedger{mem: NewInMemoryDeliveryLedger(), path: path}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open delivery ledger: %w", err)
+	}
+	defer f.Close()
+
+	var list []ExportDelivery
+	if err := json.NewDecoder(f).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode delivery ledger: %w", err)
+	}
+	for _, delivery := range list {
+		if delivery.Sink == "" {
+			delivery.Sink = LegacySinkName
+		}
+		l.mem.deliveries[deliveryID(delivery.Sink, delivery.Key)] = delivery
+	}
+	return l, nil
+}
+
+// RecordDelivery registra un lote entregado y lo persiste.
+func (l *FileDeliveryLedger) RecordDelivery(delivery ExportDelivery) error {
+	l.mem.mu.Lock()
+	defer l.mem.mu.Unlock()
+	l.mem.deliveries[deliveryID(delivery.Sink, delivery.Key)] = delivery
+
+	list := make([]ExportDelivery, 0, len(l.mem.deliveries))
+	for _, d := range l.mem.deliveries {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return deliveryID(list[i].Sink, list[i].Key) < deliveryID(list[j].Sink, list[j].Key)
+	})
+	return writeJSONAtomic(l.path, list)
+}
+
+// GetDelivery devuelve la entrega al sink con esa clave, o nil si no existe.
+func (l *FileDeliveryLedger) GetDelivery(sink, key string) (*ExportDelivery, error) {
+	return l.mem.GetDelivery(sink, key)
+}
+
+// deliveryColumns son las columnas de export_sink_deliveries, en el orden de query.
+var deliveryColumns = []string{"sink", "idempotency_key", "date", "batch", "metrics", "delivered_at"}
+
+// SQLDeliveryLedger persiste las entregas en la tabla export_sink_deliveries, compartida entre réplicas.
+type SQLDeliveryLedger struct {
+	db      *sql.DB
+	dialect SQLDialect
+}
+
+// NewSQLDeliveryLedger crea el registro de entregas SQL y aplica las migraciones pendientes.
+func NewSQLDeliveryLedger(db *sql.DB, dialect SQLDialect) (*SQLDeliveryLedger, error) {
+	if err := Migrate(db); err != nil {
+		return nil, err
+	}
+	return &SQLDeliveryLedger{db: db, dialect: dialect}, nil
+}
+
+// RecordDelivery registra un lote entregado.
+func (l *SQLDeliveryLedger) RecordDelivery(d ExportDelivery) error {
+	p := l.dialect.Placeholder
+	if _, err := l.db.Exec(fmt.Sprintf(
+		"INSERT INTO export_sink_deliveries (%s) VALUES (%s, %s, %s, %s, %s, %s) "+
+			"ON CONFLICT (sink, idempotency_key) DO UPDATE SET delivered_at = excluded.delivered_at",
+		strings.Join(deliveryColumns, ", "), p(1), p(2), p(3), p(4), p(5), p(6)),
+		d.Sink, d.Key, d.Date, d.Batch, d.Metrics, formatWatermark(d.DeliveredAt)); err != nil {
+		return fmt.Errorf("failed to record delivery %s: %w", d.Key, err)
+	}
+	return nil
+}
+
+// GetDelivery devuelve la entrega al sink con esa clave, o nil si no existe.
+func (l *SQLDeliveryLedger) GetDelivery(sink, key string) (*ExportDelivery, error) {
+	var d ExportDelivery
+	var deliveredAt string
+	err := l.db.QueryRow(fmt.Sprintf("SELECT %s FROM export_sink_deliveries WHERE sink = %s AND idempotency_key = %s",
+		strings.Join(deliveryColumns, ", "), l.dialect.Placeholder(1), l.dialect.Placeholder(2)), sink, key).
+		Scan(&d.Sink, &d.Key, &d.Date, &d.Batch, &d.Metrics, &deliveredAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query delivery %s: %w", key, err)
+	}
+	if d.DeliveredAt, err = time.Parse(watermarkLayout, deliveredAt); err != nil {
+		return nil, fmt.Errorf("invalid delivered_at for %s: %w", key, err)
+	}
+	return &d, nil
+}
@@ -0,0 +1,63 @@
+package data
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeliveryLedgers_RecordAndGet(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	sqlLedger, err := NewSQLDeliveryLedger(db, DialectSQLite)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "export_ledger.json")
+	fileLedger, err := NewFileDeliveryLedger(path)
+	require.NoError(t, err)
+
+	ledgers := map[string]DeliveryLedger{
+		"memory": NewInMemoryDeliveryLedger(),
+		"file":   fileLedger,
+		"sql":    sqlLedger,
+	}
+	aug1 := time.Date(2025, 8, 1, 10, 0, 0, 0, time.UTC)
+	aug2 := time.Date(2025, 8, 2, 10, 0, 0, 0, time.UTC)
+
+	for name, ledger := range ledgers {
+		t.Run(name, func(t *testing.T) {
+			missing, err := ledger.GetDelivery("http", "2025-08-01-0-abc")
+			require.NoError(t, err)
+			assert.Nil(t, missing)
+
+			require.NoError(t, ledger.RecordDelivery(ExportDelivery{Sink: "http", Key: "2025-08-01-0-abc", Date: "2025-08-01", Batch: 0, Metrics: 500, DeliveredAt: aug1}))
+			// Una entrega forzada del mismo lote actualiza la fecha de entrega.
+			require.NoError(t, ledger.RecordDelivery(ExportDelivery{Sink: "http", Key: "2025-08-01-0-abc", Date: "2025-08-01", Batch: 0, Metrics: 500, DeliveredAt: aug2}))
+
+			// Cada sink lleva su propio registro: el lote sigue pendiente para los demás.
+			other, err := ledger.GetDelivery("archive", "2025-08-01-0-abc")
+			require.NoError(t, err)
+			assert.Nil(t, other)
+
+			delivery, err := ledger.GetDelivery("http", "2025-08-01-0-abc")
+			require.NoError(t, err)
+			require.NotNil(t, delivery)
+			assert.Equal(t, "2025-08-01", delivery.Date)
+			assert.Equal(t, 500, delivery.Metrics)
+			assert.True(t, delivery.DeliveredAt.Equal(aug2))
+		})
+	}
+
+	// El registro en archivo sobrevive a un reinicio.
+	reopened, err := NewFileDeliveryLedger(path)
+	require.NoError(t, err)
+	delivery, err := reopened.GetDelivery("http", "2025-08-01-0-abc")
+	require.NoError(t, err)
+	require.NotNil(t, delivery)
+	assert.Equal(t, 0, delivery.Batch)
+}
@@ -0,0 +1,296 @@
+// Package data internal/data/file_repository.go
+package data
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	walFileName      = "metrics.wal"
+	snapshotFileName = "metrics.snapshot.json"
+
+	// DefaultSnapshotEvery es el número de escrituras en el WAL tras el cual se compacta en un snapshot.
+	DefaultSnapshotEvery = 1000
+)
+
+// FileRepository es una implementación del Repositorio persistida en disco local.
+// Cada Save se añade a un write-ahead log y, periódicamente, el estado completo se compacta en un snapshot.
+// Las consultas se resuelven sobre una copia en memoria reconstruida al arrancar. El outbox de exportación
+// se guarda aparte, en un diario (outbox.jsonl) al que se añade cada cambio de estado de sus registros y que
+// al compactar se reescribe sólo con los pendientes.
+type FileRepository struct {
+	mu            sync.Mutex
+	dir           string
+	wal           *os.File
+	walWriter     *bufio.Writer
+	outboxLog     *os.File // Diario del outbox, abierto en modo append.
+	pending       int      // Escrituras en el WAL desde el último snapshot.
+	snapshotEvery int
+	mem           *InMemoryRepository
+}
+
+// NewFileRepository abre (o crea) un repositorio en disco en el directorio indicado y reconstruye su estado.
+func NewFileRepository(dir string, snapshotEvery int, opts ...RepositoryOption) (*FileRepository, error) {
+	if snapshotEvery <= 0 {
+		snapshotEvery = DefaultSnapshotEvery
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create storage dir: %w", err)
+	}
+
+	r := &FileRepository{
+		dir:           dir,
+		snapshotEvery: snapshotEvery,
+		mem:           NewInMemoryRepository(opts...),
+	}
+
+	// 1. Carga el último snapshot, si existe.
+	if err := r.loadSnapshot(); err != nil {
+		return nil, err
+	}
+
+	// 2. Carga el outbox, antes del WAL para que éste sólo vuelva a encolar las versiones que no tiene.
+	if err := r.loadOutbox(); err != nil {
+		return nil, err
+	}
+
+	// 3. Reaplica las escrituras del WAL posteriores al snapshot.
+	if err := r.replayWAL(); err != nil {
+		return nil, err
+	}
+
+	// 4. Abre el WAL en modo append para las nuevas escrituras.
+	wal, err := os.OpenFile(r.walPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wal: %w", err)
+	}
+	r.wal = wal
+	r.walWriter = bufio.NewWriter(wal)
+
+	return r, nil
+}
+
+// Save añade la métrica al WAL, la aplica en memoria (encolándola en el outbox si cambió) y compacta si corresponde.
+func (r *FileRepository) Save(metric EnrichedMetric) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.appendWAL(metric); err != nil {
+		return err
+	}
+	if err := r.mem.Save(metric); err != nil {
+		return err
+	}
+
+	r.pending++
+	if r.pending >= r.snapshotEvery {
+		if err := r.compact(); err != nil {
+			// El WAL sigue siendo válido, así que no se pierde nada si la compactación falla.
+			log.Printf("WARN: failed to compact metrics wal: %v", err)
+		}
+	}
+	return nil
+}
+
+// GetMetricsByChannel obtiene las métricas del canal filter.Channel que cumplen el filtro, con paginación.
+func (r *FileRepository) GetMetricsByChannel(filter MetricFilter, limit, offset int) ([]EnrichedMetric, error) {
+	return r.mem.GetMetricsByChannel(filter, limit, offset)
+}
+
+// GetMetricsByFunnel obtiene las métricas de la campaña UTM filter.UTMCampaign que cumplen el filtro, con paginación.
+func (r *FileRepository) GetMetricsByFunnel(filter MetricFilter, limit, offset int) ([]EnrichedMetric, error) {
+	return r.mem.GetMetricsByFunnel(filter, limit, offset)
+}
+
+// GetMetricsByDate devuelve las métricas de un día concreto y un modelo.
+func (r *FileRepository) GetMetricsByDate(date time.Time, model string) ([]EnrichedMetric, error) {
+	return r.mem.GetMetricsByDate(date, model)
+}
+
+// GetMetricsPage obtiene una página de métricas filtradas posterior al cursor indicado.
+func (r *FileRepository) GetMetricsPage(filter MetricFilter, after *MetricCursor, limit int) (MetricPage, error) {
+	return r.mem.GetMetricsPage(filter, after, limit)
+}
+
+// Aggregate suma las métricas filtradas agrupándolas por los campos indicados.
+func (r *FileRepository) Aggregate(filter MetricFilter, groupBy []GroupByField) ([]AggregateRow, error) {
+	return r.mem.Aggregate(filter, groupBy)
+}
+
+// GetAllMetrics devuelve todas las métricas almacenadas en el repositorio.
+func (r *FileRepository) GetAllMetrics() ([]EnrichedMetric, error) {
+	return r.mem.GetAllMetrics()
+}
+
+// Snapshot fuerza la compactación del WAL en un snapshot.
+func (r *FileRepository) Snapshot() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.compact()
+}
+
+// Close vacía el WAL pendiente y cierra el WAL y el diario del outbox.
+func (r *FileRepository) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.walWriter.Flush(); err != nil {
+		return fmt.Errorf("failed to flush wal: %w", err)
+	}
+	if err := r.outboxLog.Close(); err != nil {
+		return fmt.Errorf("failed to close outbox: %w", err)
+	}
+	return r.wal.Close()
+}
+
+// appendWAL escribe la métrica como una línea JSON y la sincroniza en disco.
+func (r *FileRepository) appendWAL(metric EnrichedMetric) error {
+	line, err := json.Marshal(metric)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metric: %w", err)
+	}
+	if _, err := r.walWriter.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write wal: %w", err)
+	}
+	if err := r.walWriter.Flush(); err != nil {
+		return fmt.Errorf("failed to flush wal: %w", err)
+	}
+	if err := r.wal.Sync(); err != nil {
+		return fmt.Errorf("failed to sync wal: %w", err)
+	}
+	return nil
+}
+
+// compact escribe el estado completo en un snapshot de forma atómica y trunca el WAL.
+func (r *FileRepository) compact() error {
+	metrics, err := r.mem.GetAllMetrics()
+	if err != nil {
+		return err
+	}
+	// Sin el WAL ya no podrían reconstruirse los registros encolados desde la última compactación, así que el
+	// diario se reescribe antes. Si el proceso cae antes de truncar el WAL, las versiones de éste ya entregadas
+	// y descartadas del diario se vuelven a encolar: la exportación es al menos una vez.
+	if err := r.compactOutbox(); err != nil {
+		return err
+	}
+
+	// Escribe en un archivo temporal y lo renombra para no dejar nunca un snapshot a medias.
+	tmpPath := r.snapshotPath() + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	if err := json.NewEncoder(tmp).Encode(metrics); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot: %w", err)
+	}
+	if err := os.Rename(tmpPath, r.snapshotPath()); err != nil {
+		return fmt.Errorf("failed to install snapshot: %w", err)
+	}
+
+	// El snapshot ya contiene todo lo escrito en el WAL, así que puede vaciarse.
+	if err := r.walWriter.Flush(); err != nil {
+		return fmt.Errorf("failed to flush wal: %w", err)
+	}
+	if err := r.wal.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate wal: %w", err)
+	}
+	r.pending = 0
+	return nil
+}
+
+// loadSnapshot carga el snapshot en memoria, si existe.
+func (r *FileRepository) loadSnapshot() error {
+	f, err := os.Open(r.snapshotPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer f.Close()
+
+	var metrics []EnrichedMetric
+	if err := json.NewDecoder(f).Decode(&metrics); err != nil {
+		return fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	for _, m := range metrics {
+		r.mem.restore(m)
+	}
+	log.Printf("INFO: Loaded %d metrics from snapshot.", len(metrics))
+	return nil
+}
+
+// replayWAL reaplica las escrituras del WAL sobre el estado en memoria.
+// Una última línea incompleta (por ejemplo, tras una caída a mitad de escritura) se descarta.
+func (r *FileRepository) replayWAL() error {
+	f, err := os.Open(r.walPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open wal: %w", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	replayed := 0
+	var offset int64 // Fin de la última entrada completa.
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				// Se recorta para que las nuevas escrituras no queden pegadas al fragmento.
+				log.Printf("WARN: Discarding incomplete trailing wal entry (%d bytes).", len(line))
+				if err := os.Truncate(r.walPath(), offset); err != nil {
+					return fmt.Errorf("failed to truncate wal: %w", err)
+				}
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read wal: %w", err)
+		}
+
+		var m EnrichedMetric
+		if err := json.Unmarshal(line, &m); err != nil {
+			return fmt.Errorf("corrupt wal entry %d: %w", replayed+1, err)
+		}
+		if err := r.mem.Save(m); err != nil {
+			return fmt.Errorf("failed to replay wal entry %d: %w", replayed+1, err)
+		}
+		replayed++
+		offset += int64(len(line))
+	}
+	r.pending = replayed
+	if replayed > 0 {
+		log.Printf("INFO: Replayed %d metrics from wal.", replayed)
+	}
+	return nil
+}
+
+// walPath devuelve la ruta del write-ahead log.
+func (r *FileRepository) walPath() string {
+	return filepath.Join(r.dir, walFileName)
+}
+
+// snapshotPath devuelve la ruta del snapshot.
+func (r *FileRepository) snapshotPath() string {
+	return filepath.Join(r.dir, snapshotFileName)
+}
@@ -0,0 +1,73 @@
+package data
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sampleMetric(date, campaignID string, clicks int) EnrichedMetric {
+	d, _ := time.Parse("2006-01-02", date)
+	return EnrichedMetric{Date: d, CampaignID: campaignID, Channel: "google_ads", UTMCampaign: "summer_sale", Clicks: clicks}
+}
+
+func TestFileRepository_RecoversFromWALAndSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	repo, err := NewFileRepository(dir, 2)
+	require.NoError(t, err)
+
+	// Dos escrituras disparan un snapshot; la tercera queda sólo en el WAL.
+	require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1001", 10)))
+	require.NoError(t, repo.Save(sampleMetric("2025-08-02", "C-1001", 20)))
+	require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1001", 15))) // Sobrescribe la primera.
+	require.NoError(t, repo.Close())
+
+	reopened, err := NewFileRepository(dir, 2)
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	all, err := reopened.GetAllMetrics()
+	require.NoError(t, err)
+	assert.Len(t, all, 2)
+
+	from, _ := time.Parse("2006-01-02", "2025-08-01")
+	metrics, err := reopened.GetMetricsByChannel(MetricFilter{Channel: "google_ads", From: from, To: from}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, 15, metrics[0].Clicks)
+}
+
+func TestFileRepository_DiscardsTruncatedWALEntry(t *testing.T) {
+	dir := t.TempDir()
+
+	repo, err := NewFileRepository(dir, 100)
+	require.NoError(t, err)
+	require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1001", 10)))
+	require.NoError(t, repo.Close())
+
+	// Simula una caída a mitad de una escritura.
+	f, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"Date":"2025-08-02T00:00:00Z","Campa`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	reopened, err := NewFileRepository(dir, 100)
+	require.NoError(t, err)
+	require.NoError(t, reopened.Save(sampleMetric("2025-08-03", "C-1001", 30)))
+	require.NoError(t, reopened.Close())
+
+	// Tras recortar el fragmento, las nuevas escrituras siguen siendo legibles.
+	again, err := NewFileRepository(dir, 100)
+	require.NoError(t, err)
+	defer again.Close()
+
+	all, err := again.GetAllMetrics()
+	require.NoError(t, err)
+	assert.Len(t, all, 2)
+}
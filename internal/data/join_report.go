@@ -0,0 +1,303 @@
+// Package data internal/data/join_report.go
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Motivos por los que una oportunidad no se acreditó a ninguna fila de Ads.
+const (
+	OrphanNoAdsForKey   = "no_ads_for_key"   // Ninguna fila de Ads válida comparte su clave UTM.
+	OrphanOutsideWindow = "outside_lookback" // Hay filas con su clave, pero ninguna dentro de la ventana de lookback.
+)
+
+// DefaultJoinReportHistory es el número de informes de cruce que se conservan por defecto.
+const DefaultJoinReportHistory = 100
+
+// JoinReport resume el cruce entre Ads y CRM de una ingesta: qué oportunidades se acreditaron a alguna fila
+// de Ads, cuáles quedaron huérfanas (y sus ingresos, que no llegan a ninguna métrica) y qué filas de Ads no
+// recibieron ninguna conversión.
+type JoinReport struct {
+	RunID                 string    `json:"run_id"`
+	Model                 string    `json:"model"`
+	GeneratedAt           time.Time `json:"generated_at"`
+	AdRows                int       `json:"ad_rows"`
+	Opportunities         int       `json:"opportunities"`
+	MatchedOpportunities  int       `json:"matched_opportunities"`
+	OrphanOpportunities   int       `json:"orphan_opportunities"`
+	OrphanAmount          float64   `json:"orphan_amount"`
+	AdsWithoutConversions int       `json:"ads_without_conversions"`
+
+	// Detalle; vacío en los listados de informes.
+	Keys           []JoinKeyStats      `json:"keys,omitempty"`
+	Orphans        []OrphanOpportunity `json:"orphans,omitempty"` // Las de mayor importe de cada clave, etapa y día.
+	UnconvertedAds []UnconvertedAd     `json:"unconverted_ads,omitempty"`
+}
+
+// JoinKeyStats cuenta, para una clave UTM normalizada, las filas de Ads y oportunidades cruzadas y sin cruzar.
+type JoinKeyStats struct {
+	Key                    string  `json:"key"`
+	AdRows                 int     `json:"ad_rows"`
+	ConvertedAdRows        int     `json:"converted_ad_rows"`
+	Opportunities          int     `json:"opportunities"`
+	MatchedOpportunities   int     `json:"matched_opportunities"`
+	UnmatchedOpportunities int     `json:"unmatched_opportunities"`
+	UnmatchedAmount        float64 `json:"unmatched_amount"`
+}
+
+// OrphanOpportunity es una oportunidad que no se acreditó a ninguna fila de Ads.
+type OrphanOpportunity struct {
+	OpportunityID string    `json:"opportunity_id"`
+	Key           string    `json:"key"`
+	Stage         string    `json:"stage"`
+	Amount        float64   `json:"amount"`
+	CreatedAt     time.Time `json:"created_at"`
+	Reason        string    `json:"reason"`
+}
+
+// UnconvertedAd es una fila de Ads que no recibió crédito de ninguna oportunidad.
+type UnconvertedAd struct {
+	Date       string  `json:"date"`
+	CampaignID string  `json:"campaign_id"`
+	Channel    string  `json:"channel"`
+	Key        string  `json:"key"`
+	Cost       float64 `json:"cost"`
+}
+
+// Summary devuelve el informe sin el detalle por clave, oportunidad y fila.
+func (r JoinReport) Summary() JoinReport {
+	r.Keys, r.Orphans, r.UnconvertedAds = nil, nil, nil
+	return r
+}
+
+// JoinReportStore persiste los informes de cruce de las últimas ingestas, uno por RunID.
+type JoinReportStore interface {
+	// SaveJoinReport guarda el informe de una ingesta, sustituyendo el anterior con el mismo RunID
+	// (una repetición de la ingesta), y descarta los más antiguos por encima del límite del almacén.
+	SaveJoinReport(report JoinReport) error
+	// GetJoinReport devuelve el informe de una ingesta, o nil si no existe.
+	GetJoinReport(runID string) (*JoinReport, error)
+	// ListJoinReports devuelve hasta limit informes (0 sin límite), del más reciente al más antiguo.
+	ListJoinReports(limit int) ([]JoinReport, error)
+}
+
+// InMemoryJoinReportStore guarda los informes de cruce en memoria; se pierden al reiniciar.
+type InMemoryJoinReportStore struct {
+	mu      sync.RWMutex
+	reports map[string]JoinReport
+	history int
+}
+
+// NewInMemoryJoinReportStore crea un almacén que conserva los history informes más recientes.
+func NewInMemoryJoinReportStore(history int) *InMemoryJoinReportStore {
+	if history <= 0 {
+		history = DefaultJoinReportHistory
+	}
+	return &InMemoryJoinReportStore{reports: make(map[string]JoinReport), history: history}
+}
+
+// SaveJoinReport guarda el informe y descarta los más antiguos por encima del límite.
+func (s *InMemoryJoinReportStore) SaveJoinReport(report JoinReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.save(report)
+	return nil
+}
+
+// GetJoinReport devuelve el informe de una ingesta, o nil si no existe.
+func (s *InMemoryJoinReportStore) GetJoinReport(runID string) (*JoinReport, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	report, ok := s.reports[runID]
+	if !ok {
+		return nil, nil
+	}
+	return &report, nil
+}
+
+// ListJoinReports devuelve hasta limit informes, del más reciente al más antiguo.
+func (s *InMemoryJoinReportStore) ListJoinReports(limit int) ([]JoinReport, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := s.sorted()
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+// save aplica SaveJoinReport; el llamador debe tener el lock.
+func (s *InMemoryJoinReportStore) save(report JoinReport) {
+	s.reports[report.RunID] = report
+	if len(s.reports) <= s.history {
+		return
+	}
+	for _, old := range s.sorted()[s.history:] {
+		delete(s.reports, old.RunID)
+	}
+}
+
+// sorted devuelve los informes del más reciente al más antiguo; el llamador debe tener el lock.
+func (s *InMemoryJoinReportStore) sorted() []JoinReport {
+	list := make([]JoinReport, 0, len(s.reports))
+	for _, report := range s.reports {
+		list = append(list, report)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].GeneratedAt.Equal(list[j].GeneratedAt) {
+			return list[i].GeneratedAt.After(list[j].GeneratedAt)
+		}
+		return list[i].RunID < list[j].RunID
+	})
+	return list
+}
+
+// FileJoinReportStore persiste los informes de cruce en un archivo JSON, reescrito de forma atómica en cada cambio.
+type FileJoinReportStore struct {
+	mem  *InMemoryJoinReportStore
+	path string
+}
+
+// NewFileJoinReportStore abre (o crea) el almacén de informes en la ruta indicada.
+func NewFileJoinReportStore(path string, history int) (*FileJoinReportStore, error) {
+	s := &FileJoinReportStore{mem: NewInMemoryJoinReportStore(history), path: path}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open join reports: %w", err)
+	}
+	defer f.Close()
+
+	var list []JoinReport
+	if err := json.NewDecoder(f).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode join reports: %w", err)
+	}
+	for _, report := range list {
+		s.mem.save(report)
+	}
+	return s, nil
+}
+
+// SaveJoinReport guarda el informe y lo persiste.
+func (s *FileJoinReportStore) SaveJoinReport(report JoinReport) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	s.mem.save(report)
+	return writeJSONAtomic(s.path, s.mem.sorted())
+}
+
+// GetJoinReport devuelve el informe de una ingesta, o nil si no existe.
+func (s *FileJoinReportStore) GetJoinReport(runID string) (*JoinReport, error) {
+	return s.mem.GetJoinReport(runID)
+}
+
+// ListJoinReports devuelve hasta limit informes, del más reciente al más antiguo.
+func (s *FileJoinReportStore) ListJoinReports(limit int) ([]JoinReport, error) {
+	return s.mem.ListJoinReports(limit)
+}
+
+// SQLJoinReportStore persiste los informes de cruce en la tabla join_reports, compartida entre réplicas.
+// El informe completo se guarda como JSON; generated_at permite ordenar y purgar sin decodificarlo.
+type SQLJoinReportStore struct {
+	db      *sql.DB
+	dialect SQLDialect
+	history int
+}
+
+// NewSQLJoinReportStore crea el almacén SQL de informes y aplica las migraciones pendientes.
+func NewSQLJoinReportStore(db *sql.DB, dialect SQLDialect, history int) (*SQLJoinReportStore, error) {
+	if err := Migrate(db); err != nil {
+		return nil, err
+	}
+	if history <= 0 {
+		history = DefaultJoinReportHistory
+	}
+	return &SQLJoinReportStore{db: db, dialect: dialect, history: history}, nil
+}
+
+// SaveJoinReport guarda el informe y descarta los más antiguos por encima del límite, en una transacción.
+func (s *SQLJoinReportStore) SaveJoinReport(report JoinReport) error {
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to encode join report %s: %w", report.RunID, err)
+	}
+	p := s.dialect.Placeholder
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin join report transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(fmt.Sprintf(
+		"INSERT INTO join_reports (run_id, generated_at, report) VALUES (%s, %s, %s) "+
+			"ON CONFLICT (run_id) DO UPDATE SET generated_at = excluded.generated_at, report = excluded.report",
+		p(1), p(2), p(3)), report.RunID, formatWatermark(report.GeneratedAt), string(encoded)); err != nil {
+		return fmt.Errorf("failed to save join report %s: %w", report.RunID, err)
+	}
+	if _, err := tx.Exec(fmt.Sprintf(
+		"DELETE FROM join_reports WHERE run_id NOT IN "+
+			"(SELECT run_id FROM (SELECT run_id FROM join_reports ORDER BY generated_at DESC, run_id LIMIT %s) AS recent)",
+		p(1)), s.history); err != nil {
+		return fmt.Errorf("failed to prune join reports: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit join report: %w", err)
+	}
+	return nil
+}
+
+// GetJoinReport devuelve el informe de una ingesta, o nil si no existe.
+func (s *SQLJoinReportStore) GetJoinReport(runID string) (*JoinReport, error) {
+	list, err := s.query(fmt.Sprintf("SELECT report FROM join_reports WHERE run_id = %s", s.dialect.Placeholder(1)), runID)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	return &list[0], nil
+}
+
+// ListJoinReports devuelve hasta limit informes, del más reciente al más antiguo.
+func (s *SQLJoinReportStore) ListJoinReports(limit int) ([]JoinReport, error) {
+	query := "SELECT report FROM join_reports ORDER BY generated_at DESC, run_id"
+	var args []interface{}
+	if limit > 0 {
+		args = append(args, limit)
+		query += " LIMIT " + s.dialect.Placeholder(1)
+	}
+	return s.query(query, args...)
+}
+
+// query ejecuta una consulta sobre join_reports y decodifica los informes.
+func (s *SQLJoinReportStore) query(query string, args ...interface{}) ([]JoinReport, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query join reports: %w", err)
+	}
+	defer rows.Close()
+
+	list := []JoinReport{}
+	for rows.Next() {
+		var encoded string
+		if err := rows.Scan(&encoded); err != nil {
+			return nil, fmt.Errorf("failed to scan join report: %w", err)
+		}
+		var report JoinReport
+		if err := json.Unmarshal([]byte(encoded), &report); err != nil {
+			return nil, fmt.Errorf("failed to decode join report: %w", err)
+		}
+		list = append(list, report)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query join reports: %w", err)
+	}
+	return list, nil
+}
@@ -0,0 +1,76 @@
+package data
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJoinReportStores_SaveReplaceAndPrune(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	sqlStore, err := NewSQLJoinReportStore(db, DialectSQLite, 2)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "join_reports.json")
+	fileStore, err := NewFileJoinReportStore(path, 2)
+	require.NoError(t, err)
+
+	stores := map[string]JoinReportStore{
+		"memory": NewInMemoryJoinReportStore(2),
+		"file":   fileStore,
+		"sql":    sqlStore,
+	}
+	base := time.Date(2025, 8, 1, 10, 0, 0, 0, time.UTC)
+	report := func(runID string, at time.Time, orphans int) JoinReport {
+		return JoinReport{
+			RunID: runID, Model: "last_touch", GeneratedAt: at, Opportunities: 3, OrphanOpportunities: orphans, OrphanAmount: 250,
+			Keys:    []JoinKeyStats{{Key: "a|b|c", Opportunities: 3, UnmatchedOpportunities: orphans}},
+			Orphans: []OrphanOpportunity{{OpportunityID: "O-1", Key: "a|b|c", Amount: 250, Reason: OrphanNoAdsForKey}},
+		}
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, store.SaveJoinReport(report("r1", base, 1)))
+			require.NoError(t, store.SaveJoinReport(report("r2", base.Add(time.Hour), 1)))
+
+			// Repetir una ingesta sustituye su informe.
+			require.NoError(t, store.SaveJoinReport(report("r1", base.Add(2*time.Hour), 2)))
+			got, err := store.GetJoinReport("r1")
+			require.NoError(t, err)
+			require.NotNil(t, got)
+			assert.Equal(t, 2, got.OrphanOpportunities)
+			assert.Equal(t, OrphanNoAdsForKey, got.Orphans[0].Reason)
+
+			// Por encima del límite se descartan los más antiguos.
+			require.NoError(t, store.SaveJoinReport(report("r3", base.Add(3*time.Hour), 0)))
+			list, err := store.ListJoinReports(0)
+			require.NoError(t, err)
+			require.Len(t, list, 2)
+			assert.Equal(t, "r3", list[0].RunID)
+			assert.Equal(t, "r1", list[1].RunID)
+
+			missing, err := store.GetJoinReport("r2")
+			require.NoError(t, err)
+			assert.Nil(t, missing)
+
+			list, err = store.ListJoinReports(1)
+			require.NoError(t, err)
+			assert.Len(t, list, 1)
+		})
+	}
+
+	// El almacén en archivo recupera los informes al reabrirse.
+	reopened, err := NewFileJoinReportStore(path, 2)
+	require.NoError(t, err)
+	got, err := reopened.GetJoinReport("r3")
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	assert.Equal(t, "last_touch", got.Model)
+}
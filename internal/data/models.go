@@ -10,6 +10,7 @@ type AdPerformance struct {
 	Clicks      int     `json:"clicks"`
 	Impressions int     `json:"impressions"`
 	Cost        float64 `json:"cost"`
+	Currency    string  `json:"currency"` // Código ISO 4217 de Cost; vacío si está en la moneda de reporte.
 	UTMCampaign string  `json:"utm_campaign"`
 	UTMSource   string  `json:"utm_source"`
 	UTMMedium   string  `json:"utm_medium"`
@@ -20,6 +21,7 @@ type Opportunity struct {
 	ContactEmail  string    `json:"contact_email"`
 	Stage         string    `json:"stage"`
 	Amount        float64   `json:"amount"`
+	Currency      string    `json:"currency"` // Código ISO 4217 de Amount; vacío si está en la moneda de reporte.
 	CreatedAt     time.Time `json:"created_at"`
 	UTMCampaign   string    `json:"utm_campaign"`
 	UTMSource     string    `json:"utm_source"`
@@ -46,4 +48,48 @@ type EnrichedMetric struct {
 	CVRLeadToOpp  float64
 	CVROppToWon   float64
 	ROAS          float64
+
+	// Crédito fraccionario de atribución; coincide con Leads/Opportunities/ClosedWon salvo en modelos multi-toque,
+	// donde éstos son el crédito redondeado. Los ratios se calculan siempre con el crédito.
+	LeadCredit        float64
+	OpportunityCredit float64
+	ClosedWonCredit   float64
+	AttributionModel  string // Modelo de atribución que produjo la métrica
+
+	// Funnel contiene una entrada por etapa del funnel configurado, en orden; nil en métricas anteriores al funnel configurable.
+	Funnel []FunnelStep
+
+	// Currency es la moneda de reporte de Cost, Revenue, CPC, CPA y ROAS; vacía si no se configuró ninguna.
+	Currency string
+	// OriginalCost es el coste en la moneda de la cuenta de Ads y el tipo aplicado; nil sin moneda de reporte.
+	OriginalCost *FXAmount
+	// OriginalRevenue son los ingresos acreditados en su moneda original, uno por moneda y tipo aplicado.
+	OriginalRevenue []FXAmount
+}
+
+// FXAmount es un importe en su moneda original y el tipo con el que se convirtió a la moneda de reporte.
+type FXAmount struct {
+	Currency string
+	Amount   float64
+	Rate     float64 // Unidades de la moneda de reporte por unidad de Currency.
+}
+
+// FunnelStep resume una etapa del funnel: las oportunidades que la alcanzaron y las que se perdieron en ella.
+type FunnelStep struct {
+	Step           string
+	Count          int
+	Credit         float64 // Crédito fraccionario de las oportunidades que alcanzaron la etapa.
+	Lost           int
+	LostCredit     float64 // Crédito de las oportunidades perdidas tras alcanzar esta etapa y no la siguiente.
+	ConversionRate float64 // Crédito de la etapa sobre el de la anterior; 0 en la primera etapa.
+}
+
+// ComputeFunnelRates recalcula las tasas de conversión entre etapas consecutivas a partir del crédito de cada una.
+func ComputeFunnelRates(steps []FunnelStep) {
+	for i := range steps {
+		steps[i].ConversionRate = 0
+		if i > 0 && steps[i-1].Credit > 0 {
+			steps[i].ConversionRate = steps[i].Credit / steps[i-1].Credit
+		}
+	}
 }
@@ -0,0 +1,709 @@
+// Package data internal/data/outbox.go
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Estados de un registro del outbox de exportación.
+const (
+	OutboxPending   = "pending"   // La versión actual de la métrica aún no se ha entregado al sink.
+	OutboxDelivered = "delivered" // El sink aceptó la versión actual de la métrica.
+	// OutboxDeadLettered indica que la versión actual se movió a la DLQ de exportación tras un fallo
+	// permanente o tras agotar los intentos; un cambio posterior de la métrica la vuelve a dejar pendiente.
+	OutboxDeadLettered = "dead_lettered"
+)
+
+// OutboxRecord es la entrada del outbox de una métrica: la última versión guardada y si ya se entregó al sink.
+// Hay una entrada por métrica; un cambio posterior la vuelve a dejar pendiente con la nueva versión.
+type OutboxRecord struct {
+	ID          string          `json:"id"` // Clave de la métrica (fecha-campaña-canal-modelo).
+	Date        string          `json:"date"`
+	CampaignID  string          `json:"campaign_id"`
+	Channel     string          `json:"channel"`
+	Hash        string          `json:"hash"`             // Hash del contenido de la versión encolada.
+	Metric      json.RawMessage `json:"metric,omitempty"` // Versión encolada; se descarta al entregarla o moverla a la DLQ.
+	Status      string          `json:"status"`
+	DeliveredTo []string        `json:"delivered_to,omitempty"` // Sinks que ya aceptaron la versión encolada, ordenados.
+	Attempts    int             `json:"attempts"`               // Envíos fallidos de la versión encolada.
+	LastError   string          `json:"last_error,omitempty"`
+	EnqueuedAt  time.Time       `json:"enqueued_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	DeliveredAt *time.Time      `json:"delivered_at,omitempty"`
+}
+
+// OutboxFilter restringe los registros devueltos por ListOutbox; los campos vacíos no filtran.
+type OutboxFilter struct {
+	Status string
+	Limit  int // 0 sin límite.
+}
+
+// matches indica si el registro cumple el filtro.
+func (f OutboxFilter) matches(r OutboxRecord) bool {
+	return f.Status == "" || r.Status == f.Status
+}
+
+// ExportOutbox es el outbox transaccional de la exportación. Los repositorios de métricas lo implementan:
+// cada Save que cambia una métrica encola su nueva versión en la misma operación que la guarda, así que un
+// cambio guardado nunca queda sin exportar aunque el proceso caiga antes de enviarlo.
+type ExportOutbox interface {
+	// PendingOutbox devuelve hasta limit registros pendientes, del encolado hace más tiempo al más reciente.
+	PendingOutbox(limit int) ([]OutboxRecord, error)
+	// MarkOutboxDelivered marca como entregados los registros cuya versión (Hash) sigue siendo la actual.
+	// Si la métrica cambió mientras se enviaba, su registro sigue pendiente con la versión nueva.
+	MarkOutboxDelivered(records []OutboxRecord) error
+	// MarkOutboxSinksDelivered anota que sinks aceptaron los registros pendientes que siguen en la versión
+	// enviada, para que un reenvío sólo vaya a los sinks que faltan.
+	MarkOutboxSinksDelivered(records []OutboxRecord, sinks []string) error
+	// MarkOutboxFailed suma un envío fallido a los registros que siguen en la versión enviada.
+	MarkOutboxFailed(records []OutboxRecord, reason string) error
+	// MarkOutboxDeadLettered saca del outbox los registros pendientes que siguen en la versión enviada, cuyo
+	// lote ya se guardó en la DLQ, para que no bloqueen a los siguientes.
+	MarkOutboxDeadLettered(records []OutboxRecord, reason string) error
+	// GetOutboxRecord devuelve el registro de una métrica, o nil si no existe.
+	GetOutboxRecord(id string) (*OutboxRecord, error)
+	// ListOutbox devuelve los registros que cumplen el filtro, del actualizado más recientemente al más antiguo.
+	ListOutbox(filter OutboxFilter) ([]OutboxRecord, error)
+}
+
+// newOutboxRecord construye el registro pendiente de la versión de la métrica que se va a guardar.
+func newOutboxRecord(metric EnrichedMetric, now time.Time) (OutboxRecord, error) {
+	metric.Date = CalendarDate(metric.Date)
+	payload, err := json.Marshal(metric)
+	if err != nil {
+		return OutboxRecord{}, fmt.Errorf("failed to marshal metric: %w", err)
+	}
+	sum := sha256.Sum256(payload)
+	return OutboxRecord{
+		ID:         metricKey(metric),
+		Date:       metric.Date.Format("2006-01-02"),
+		CampaignID: metric.CampaignID,
+		Channel:    metric.Channel,
+		Hash:       hex.EncodeToString(sum[:]),
+		Metric:     payload,
+		Status:     OutboxPending,
+		EnqueuedAt: now,
+		UpdatedAt:  now,
+	}, nil
+}
+
+// enqueue guarda el registro salvo que la métrica no haya cambiado; el llamador debe tener el lock.
+func (r *InMemoryRepository) enqueue(record OutboxRecord) {
+	if current, ok := r.outbox[record.ID]; ok && current.Hash == record.Hash {
+		return
+	}
+	r.outbox[record.ID] = record
+}
+
+// PendingOutbox devuelve hasta limit registros pendientes, del encolado hace más tiempo al más reciente.
+func (r *InMemoryRepository) PendingOutbox(limit int) ([]OutboxRecord, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := []OutboxRecord{}
+	for _, record := range r.outbox {
+		if record.Status == OutboxPending {
+			list = append(list, record)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].EnqueuedAt.Equal(list[j].EnqueuedAt) {
+			return list[i].EnqueuedAt.Before(list[j].EnqueuedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+// MarkOutboxDelivered marca como entregados los registros que siguen en la versión enviada.
+func (r *InMemoryRepository) MarkOutboxDelivered(records []OutboxRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now().UTC()
+	for _, sent := range records {
+		record, ok := r.outbox[sent.ID]
+		if !ok || record.Hash != sent.Hash {
+			continue
+		}
+		record.Status = OutboxDelivered
+		record.Metric = nil
+		record.LastError = ""
+		record.UpdatedAt = now
+		record.DeliveredAt = &now
+		r.outbox[sent.ID] = record
+	}
+	return nil
+}
+
+// MarkOutboxSinksDelivered anota que sinks aceptaron los registros pendientes que siguen en la versión enviada.
+func (r *InMemoryRepository) MarkOutboxSinksDelivered(records []OutboxRecord, sinks []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now().UTC()
+	for _, sent := range records {
+		record, ok := r.outbox[sent.ID]
+		if !ok || record.Hash != sent.Hash || record.Status != OutboxPending {
+			continue
+		}
+		record.DeliveredTo = mergeSinks(record.DeliveredTo, sinks)
+		record.UpdatedAt = now
+		r.outbox[sent.ID] = record
+	}
+	return nil
+}
+
+// mergeSinks devuelve la unión ordenada y sin repetidos de dos listas de sinks.
+func mergeSinks(current, added []string) []string {
+	merged := append(append([]string{}, current...), added...)
+	sort.Strings(merged)
+	unique := merged[:0]
+	for i, sink := range merged {
+		if i == 0 || sink != merged[i-1] {
+			unique = append(unique, sink)
+		}
+	}
+	return unique
+}
+
+// MarkOutboxFailed suma un envío fallido a los registros que siguen en la versión enviada.
+func (r *InMemoryRepository) MarkOutboxFailed(records []OutboxRecord, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now().UTC()
+	for _, sent := range records {
+		record, ok := r.outbox[sent.ID]
+		if !ok || record.Hash != sent.Hash || record.Status != OutboxPending {
+			continue
+		}
+		record.Attempts++
+		record.LastError = reason
+		record.UpdatedAt = now
+		r.outbox[sent.ID] = record
+	}
+	return nil
+}
+
+// MarkOutboxDeadLettered marca como movidos a la DLQ los registros pendientes que siguen en la versión enviada.
+func (r *InMemoryRepository) MarkOutboxDeadLettered(records []OutboxRecord, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now().UTC()
+	for _, sent := range records {
+		record, ok := r.outbox[sent.ID]
+		if !ok || record.Hash != sent.Hash || record.Status != OutboxPending {
+			continue
+		}
+		record.Status = OutboxDeadLettered
+		record.Metric = nil
+		record.LastError = reason
+		record.UpdatedAt = now
+		r.outbox[sent.ID] = record
+	}
+	return nil
+}
+
+// GetOutboxRecord devuelve el registro de una métrica, o nil si no existe.
+func (r *InMemoryRepository) GetOutboxRecord(id string) (*OutboxRecord, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	record, ok := r.outbox[id]
+	if !ok {
+		return nil, nil
+	}
+	return &record, nil
+}
+
+// ListOutbox devuelve los registros que cumplen el filtro, del actualizado más recientemente al más antiguo.
+func (r *InMemoryRepository) ListOutbox(filter OutboxFilter) ([]OutboxRecord, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := []OutboxRecord{}
+	for _, record := range r.outbox {
+		if filter.matches(record) {
+			list = append(list, record)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].UpdatedAt.Equal(list[j].UpdatedAt) {
+			return list[i].UpdatedAt.After(list[j].UpdatedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	if filter.Limit > 0 && len(list) > filter.Limit {
+		list = list[:filter.Limit]
+	}
+	return list, nil
+}
+
+// settleOutbox descarta los registros ya entregados o movidos a la DLQ: sólo los pendientes hacen falta para
+// exportar, y Save sigue sin reexportar una versión sin cambios porque la compara con la métrica guardada.
+func (r *InMemoryRepository) settleOutbox() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, record := range r.outbox {
+		if record.Status != OutboxPending {
+			delete(r.outbox, id)
+		}
+	}
+}
+
+const (
+	// outboxFileName es el diario del outbox de FileRepository, junto al WAL y el snapshot: una línea JSON
+	// por cambio de estado de un registro, de la que prevalece la última de cada registro.
+	outboxFileName = "outbox.jsonl"
+	// legacyOutboxFileName es el outbox completo que se reescribía en cada cambio; se migra al diario al abrir.
+	legacyOutboxFileName = "outbox.json"
+)
+
+// PendingOutbox devuelve hasta limit registros pendientes, del encolado hace más tiempo al más reciente.
+func (r *FileRepository) PendingOutbox(limit int) ([]OutboxRecord, error) {
+	return r.mem.PendingOutbox(limit)
+}
+
+// MarkOutboxDelivered marca como entregados los registros que siguen en la versión enviada y lo anota en el
+// diario del outbox.
+func (r *FileRepository) MarkOutboxDelivered(records []OutboxRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.mem.MarkOutboxDelivered(records); err != nil {
+		return err
+	}
+	return r.appendOutbox(records)
+}
+
+// MarkOutboxSinksDelivered anota que sinks aceptaron los registros pendientes que siguen en la versión enviada
+// y lo anota en el diario del outbox.
+func (r *FileRepository) MarkOutboxSinksDelivered(records []OutboxRecord, sinks []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.mem.MarkOutboxSinksDelivered(records, sinks); err != nil {
+		return err
+	}
+	return r.appendOutbox(records)
+}
+
+// MarkOutboxFailed suma un envío fallido a los registros que siguen en la versión enviada y lo anota en el
+// diario del outbox.
+func (r *FileRepository) MarkOutboxFailed(records []OutboxRecord, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.mem.MarkOutboxFailed(records, reason); err != nil {
+		return err
+	}
+	return r.appendOutbox(records)
+}
+
+// MarkOutboxDeadLettered marca como movidos a la DLQ los registros pendientes que siguen en la versión enviada
+// y lo anota en el diario del outbox.
+func (r *FileRepository) MarkOutboxDeadLettered(records []OutboxRecord, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.mem.MarkOutboxDeadLettered(records, reason); err != nil {
+		return err
+	}
+	return r.appendOutbox(records)
+}
+
+// GetOutboxRecord devuelve el registro de una métrica, o nil si no existe.
+func (r *FileRepository) GetOutboxRecord(id string) (*OutboxRecord, error) {
+	return r.mem.GetOutboxRecord(id)
+}
+
+// ListOutbox devuelve los registros que cumplen el filtro, del actualizado más recientemente al más antiguo.
+func (r *FileRepository) ListOutbox(filter OutboxFilter) ([]OutboxRecord, error) {
+	return r.mem.ListOutbox(filter)
+}
+
+// appendOutbox añade al diario el estado actual de los registros enviados y lo sincroniza en disco; el
+// llamador debe tener el lock. Los registros encolados por Save no se anotan: hasta la compactación el WAL los
+// reconstruye, porque al reaplicarlo se vuelve a encolar toda versión que no coincide con la del diario.
+func (r *FileRepository) appendOutbox(records []OutboxRecord) error {
+	var buf bytes.Buffer
+	for _, sent := range records {
+		record, err := r.mem.GetOutboxRecord(sent.ID)
+		if err != nil {
+			return err
+		}
+		if record == nil {
+			continue
+		}
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to marshal outbox record: %w", err)
+		}
+		buf.Write(append(line, '\n'))
+	}
+	if buf.Len() == 0 {
+		return nil
+	}
+	if _, err := r.outboxLog.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write outbox: %w", err)
+	}
+	if err := r.outboxLog.Sync(); err != nil {
+		return fmt.Errorf("failed to sync outbox: %w", err)
+	}
+	return nil
+}
+
+// compactOutbox descarta los registros ya entregados o movidos a la DLQ y reescribe el diario sólo con los
+// pendientes, incluidos los encolados por Save desde la última compactación; el llamador debe tener el lock.
+func (r *FileRepository) compactOutbox() error {
+	r.mem.settleOutbox()
+	return r.rewriteOutbox()
+}
+
+// rewriteOutbox reescribe el diario de forma atómica con los registros en memoria y lo reabre para añadir.
+func (r *FileRepository) rewriteOutbox() error {
+	list, err := r.mem.ListOutbox(OutboxFilter{})
+	if err != nil {
+		return err
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	tmpPath := r.outboxPath() + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create outbox: %w", err)
+	}
+	encoder := json.NewEncoder(tmp)
+	for _, record := range list {
+		if err := encoder.Encode(record); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to encode outbox: %w", err)
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync outbox: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close outbox: %w", err)
+	}
+	if err := os.Rename(tmpPath, r.outboxPath()); err != nil {
+		return fmt.Errorf("failed to install outbox: %w", err)
+	}
+	return r.openOutbox()
+}
+
+// openOutbox (re)abre el diario del outbox en modo append.
+func (r *FileRepository) openOutbox() error {
+	if r.outboxLog != nil {
+		r.outboxLog.Close()
+	}
+	f, err := os.OpenFile(r.outboxPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open outbox: %w", err)
+	}
+	r.outboxLog = f
+	return nil
+}
+
+// loadOutbox carga el diario del outbox, si existe, y lo abre para añadir. Una última línea incompleta se
+// descarta como en el WAL. Un outbox.json de versiones anteriores se migra al diario.
+func (r *FileRepository) loadOutbox() error {
+	migrated, err := r.loadLegacyOutbox()
+	if err != nil {
+		return err
+	}
+	if migrated {
+		// Se conservan también los entregados: el WAL aún no se ha reaplicado y los necesita para no reexportarlos.
+		if err := r.rewriteOutbox(); err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(r.dir, legacyOutboxFileName)); err != nil {
+			return fmt.Errorf("failed to remove legacy outbox: %w", err)
+		}
+		return nil
+	}
+
+	f, err := os.Open(r.outboxPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return r.openOutbox()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open outbox: %w", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var offset int64 // Fin de la última línea completa.
+	for entry := 1; ; entry++ {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Printf("WARN: Discarding incomplete trailing outbox entry (%d bytes).", len(line))
+				if err := os.Truncate(r.outboxPath(), offset); err != nil {
+					return fmt.Errorf("failed to truncate outbox: %w", err)
+				}
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read outbox: %w", err)
+		}
+		var record OutboxRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("corrupt outbox entry %d: %w", entry, err)
+		}
+		r.mem.outbox[record.ID] = record
+		offset += int64(len(line))
+	}
+	return r.openOutbox()
+}
+
+// loadLegacyOutbox carga el outbox.json de versiones anteriores, si existe.
+func (r *FileRepository) loadLegacyOutbox() (bool, error) {
+	f, err := os.Open(filepath.Join(r.dir, legacyOutboxFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open legacy outbox: %w", err)
+	}
+	defer f.Close()
+
+	var list []OutboxRecord
+	if err := json.NewDecoder(f).Decode(&list); err != nil {
+		return false, fmt.Errorf("failed to decode legacy outbox: %w", err)
+	}
+	for _, record := range list {
+		r.mem.outbox[record.ID] = record
+	}
+	return true, nil
+}
+
+// outboxPath devuelve la ruta del diario del outbox.
+func (r *FileRepository) outboxPath() string {
+	return filepath.Join(r.dir, outboxFileName)
+}
+
+// outboxColumns son las columnas de export_outbox, en el orden de insertOutbox y scanOutbox.
+var outboxColumns = []string{
+	"id", "date", "campaign_id", "channel", "hash", "metric", "status", "attempts", "last_error",
+	"enqueued_at", "updated_at", "delivered_at", "delivered_to",
+}
+
+// insertOutbox encola la versión de la métrica dentro de la transacción de Save. Si el registro existe sólo
+// se actualiza cuando el contenido cambió, así que volver a guardar la misma métrica no la reexporta.
+func (r *SQLRepository) insertOutbox(tx *sql.Tx, record OutboxRecord) error {
+	placeholders := make([]string, len(outboxColumns))
+	for i := range outboxColumns {
+		placeholders[i] = r.dialect.Placeholder(i + 1)
+	}
+	query := fmt.Sprintf(
+		"INSERT INTO export_outbox (%s) VALUES (%s) "+
+			"ON CONFLICT (id) DO UPDATE SET hash = excluded.hash, metric = excluded.metric, status = excluded.status, "+
+			"attempts = 0, last_error = '', enqueued_at = excluded.enqueued_at, updated_at = excluded.updated_at, delivered_at = '', "+
+			"delivered_to = '' "+
+			"WHERE export_outbox.hash <> excluded.hash",
+		strings.Join(outboxColumns, ", "), strings.Join(placeholders, ", "))
+	if _, err := tx.Exec(query,
+		record.ID, record.Date, record.CampaignID, record.Channel, record.Hash, string(record.Metric), record.Status,
+		0, "", formatWatermark(record.EnqueuedAt), formatWatermark(record.UpdatedAt), "", ""); err != nil {
+		return fmt.Errorf("failed to enqueue metric %s in outbox: %w", record.ID, err)
+	}
+	return nil
+}
+
+// PendingOutbox devuelve hasta limit registros pendientes, del encolado hace más tiempo al más reciente.
+func (r *SQLRepository) PendingOutbox(limit int) ([]OutboxRecord, error) {
+	p := r.dialect.Placeholder
+	query := fmt.Sprintf("SELECT %s FROM export_outbox WHERE status = %s ORDER BY enqueued_at, id",
+		strings.Join(outboxColumns, ", "), p(1))
+	args := []interface{}{OutboxPending}
+	if limit > 0 {
+		args = append(args, limit)
+		query += " LIMIT " + p(2)
+	}
+	return r.queryOutbox(query, args...)
+}
+
+// MarkOutboxDelivered marca como entregados los registros que siguen en la versión enviada.
+func (r *SQLRepository) MarkOutboxDelivered(records []OutboxRecord) error {
+	p := r.dialect.Placeholder
+	now := formatWatermark(time.Now())
+	return r.updateOutbox(records, fmt.Sprintf(
+		"UPDATE export_outbox SET status = %s, metric = '', last_error = '', updated_at = %s, delivered_at = %s "+
+			"WHERE id = %s AND hash = %s", p(1), p(2), p(3), p(4), p(5)),
+		func(record OutboxRecord) []interface{} {
+			return []interface{}{OutboxDelivered, now, now, record.ID, record.Hash}
+		})
+}
+
+// MarkOutboxSinksDelivered anota que sinks aceptaron los registros pendientes que siguen en la versión enviada.
+// delivered_to guarda la lista como un array JSON, porque los nombres de los sinks son libres.
+func (r *SQLRepository) MarkOutboxSinksDelivered(records []OutboxRecord, sinks []string) error {
+	p := r.dialect.Placeholder
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin outbox update: %w", err)
+	}
+	defer tx.Rollback()
+	now := formatWatermark(time.Now())
+	for _, sent := range records {
+		var current string
+		err := tx.QueryRow(fmt.Sprintf("SELECT delivered_to FROM export_outbox WHERE id = %s AND hash = %s AND status = %s",
+			p(1), p(2), p(3)), sent.ID, sent.Hash, OutboxPending).Scan(&current)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read outbox record %s: %w", sent.ID, err)
+		}
+		delivered, err := decodeSinks(current)
+		if err != nil {
+			return fmt.Errorf("invalid delivered_to for %s: %w", sent.ID, err)
+		}
+		raw, err := json.Marshal(mergeSinks(delivered, sinks))
+		if err != nil {
+			return fmt.Errorf("failed to encode delivered_to for %s: %w", sent.ID, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("UPDATE export_outbox SET delivered_to = %s, updated_at = %s WHERE id = %s AND hash = %s",
+			p(1), p(2), p(3), p(4)), string(raw), now, sent.ID, sent.Hash); err != nil {
+			return fmt.Errorf("failed to update outbox record %s: %w", sent.ID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit outbox update: %w", err)
+	}
+	return nil
+}
+
+// decodeSinks interpreta la columna delivered_to; vacía si ningún sink aceptó la versión encolada.
+func decodeSinks(raw string) ([]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var sinks []string
+	if err := json.Unmarshal([]byte(raw), &sinks); err != nil {
+		return nil, err
+	}
+	return sinks, nil
+}
+
+// MarkOutboxFailed suma un envío fallido a los registros que siguen en la versión enviada.
+func (r *SQLRepository) MarkOutboxFailed(records []OutboxRecord, reason string) error {
+	p := r.dialect.Placeholder
+	now := formatWatermark(time.Now())
+	return r.updateOutbox(records, fmt.Sprintf(
+		"UPDATE export_outbox SET attempts = attempts + 1, last_error = %s, updated_at = %s "+
+			"WHERE id = %s AND hash = %s AND status = %s", p(1), p(2), p(3), p(4), p(5)),
+		func(record OutboxRecord) []interface{} {
+			return []interface{}{reason, now, record.ID, record.Hash, OutboxPending}
+		})
+}
+
+// MarkOutboxDeadLettered marca como movidos a la DLQ los registros pendientes que siguen en la versión enviada.
+func (r *SQLRepository) MarkOutboxDeadLettered(records []OutboxRecord, reason string) error {
+	p := r.dialect.Placeholder
+	now := formatWatermark(time.Now())
+	return r.updateOutbox(records, fmt.Sprintf(
+		"UPDATE export_outbox SET status = %s, metric = '', last_error = %s, updated_at = %s "+
+			"WHERE id = %s AND hash = %s AND status = %s", p(1), p(2), p(3), p(4), p(5), p(6)),
+		func(record OutboxRecord) []interface{} {
+			return []interface{}{OutboxDeadLettered, reason, now, record.ID, record.Hash, OutboxPending}
+		})
+}
+
+// updateOutbox aplica la misma actualización a cada registro en una transacción.
+func (r *SQLRepository) updateOutbox(records []OutboxRecord, query string, args func(OutboxRecord) []interface{}) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin outbox update: %w", err)
+	}
+	defer tx.Rollback()
+	for _, record := range records {
+		if _, err := tx.Exec(query, args(record)...); err != nil {
+			return fmt.Errorf("failed to update outbox record %s: %w", record.ID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit outbox update: %w", err)
+	}
+	return nil
+}
+
+// GetOutboxRecord devuelve el registro de una métrica, o nil si no existe.
+func (r *SQLRepository) GetOutboxRecord(id string) (*OutboxRecord, error) {
+	list, err := r.queryOutbox(fmt.Sprintf("SELECT %s FROM export_outbox WHERE id = %s",
+		strings.Join(outboxColumns, ", "), r.dialect.Placeholder(1)), id)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	return &list[0], nil
+}
+
+// ListOutbox devuelve los registros que cumplen el filtro, del actualizado más recientemente al más antiguo.
+func (r *SQLRepository) ListOutbox(filter OutboxFilter) ([]OutboxRecord, error) {
+	query := fmt.Sprintf("SELECT %s FROM export_outbox", strings.Join(outboxColumns, ", "))
+	var args []interface{}
+	if filter.Status != "" {
+		args = append(args, filter.Status)
+		query += " WHERE status = " + r.dialect.Placeholder(len(args))
+	}
+	query += " ORDER BY updated_at DESC, id"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += " LIMIT " + r.dialect.Placeholder(len(args))
+	}
+	return r.queryOutbox(query, args...)
+}
+
+// queryOutbox ejecuta una consulta sobre export_outbox y escanea los registros.
+func (r *SQLRepository) queryOutbox(query string, args ...interface{}) ([]OutboxRecord, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query outbox: %w", err)
+	}
+	defer rows.Close()
+
+	list := []OutboxRecord{}
+	for rows.Next() {
+		var o OutboxRecord
+		var metric, enqueuedAt, updatedAt, deliveredAt, deliveredTo string
+		if err := rows.Scan(&o.ID, &o.Date, &o.CampaignID, &o.Channel, &o.Hash, &metric, &o.Status, &o.Attempts,
+			&o.LastError, &enqueuedAt, &updatedAt, &deliveredAt, &deliveredTo); err != nil {
+			return nil, fmt.Errorf("failed to scan outbox record: %w", err)
+		}
+		if o.DeliveredTo, err = decodeSinks(deliveredTo); err != nil {
+			return nil, fmt.Errorf("invalid delivered_to for %s: %w", o.ID, err)
+		}
+		if metric != "" {
+			o.Metric = json.RawMessage(metric)
+		}
+		if o.EnqueuedAt, err = time.Parse(watermarkLayout, enqueuedAt); err != nil {
+			return nil, fmt.Errorf("invalid enqueued_at for %s: %w", o.ID, err)
+		}
+		if o.UpdatedAt, err = time.Parse(watermarkLayout, updatedAt); err != nil {
+			return nil, fmt.Errorf("invalid updated_at for %s: %w", o.ID, err)
+		}
+		if deliveredAt != "" {
+			delivered, err := time.Parse(watermarkLayout, deliveredAt)
+			if err != nil {
+				return nil, fmt.Errorf("invalid delivered_at for %s: %w", o.ID, err)
+			}
+			o.DeliveredAt = &delivered
+		}
+		list = append(list, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query outbox: %w", err)
+	}
+	return list, nil
+}
@@ -0,0 +1,294 @@
+package data
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// outboxRepository es un repositorio de métricas con su outbox de exportación.
+type outboxRepository interface {
+	MetricRepository
+	ExportOutbox
+}
+
+func TestOutbox_EnqueuesOnlyChangedMetrics(t *testing.T) {
+	fileRepo, err := NewFileRepository(t.TempDir(), 100)
+	require.NoError(t, err)
+	defer fileRepo.Close()
+
+	for name, repo := range map[string]outboxRepository{
+		"memory": NewInMemoryRepository(),
+		"file":   fileRepo,
+		"sql":    newTestSQLRepository(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1001", 10)))
+			require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1002", 20)))
+
+			pending, err := repo.PendingOutbox(10)
+			require.NoError(t, err)
+			require.Len(t, pending, 2)
+			assert.Equal(t, "2025-08-01-C-1001-google_ads", pending[0].ID)
+			assert.JSONEq(t, `10`, string(jsonField(t, pending[0].Metric, "Clicks")))
+
+			// Se entrega la primera; volver a guardarla igual no la reencola.
+			require.NoError(t, repo.MarkOutboxDelivered(pending[:1]))
+			require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1001", 10)))
+			delivered, err := repo.GetOutboxRecord(pending[0].ID)
+			require.NoError(t, err)
+			require.NotNil(t, delivered)
+			assert.Equal(t, OutboxDelivered, delivered.Status)
+			assert.NotNil(t, delivered.DeliveredAt)
+			assert.Empty(t, delivered.Metric)
+
+			// La segunda cambia mientras se envía: la entrega de la versión anterior no la marca como entregada.
+			require.NoError(t, repo.MarkOutboxFailed(pending[1:], "sink returned status code: 503"))
+			require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1002", 25)))
+			require.NoError(t, repo.MarkOutboxDelivered(pending[1:]))
+			changed, err := repo.GetOutboxRecord(pending[1].ID)
+			require.NoError(t, err)
+			assert.Equal(t, OutboxPending, changed.Status)
+			assert.Equal(t, 0, changed.Attempts)
+			assert.JSONEq(t, `25`, string(jsonField(t, changed.Metric, "Clicks")))
+
+			// Un cambio de la ya entregada la vuelve a dejar pendiente.
+			require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1001", 11)))
+			pending, err = repo.PendingOutbox(10)
+			require.NoError(t, err)
+			assert.Len(t, pending, 2)
+
+			list, err := repo.ListOutbox(OutboxFilter{Status: OutboxDelivered})
+			require.NoError(t, err)
+			assert.Empty(t, list)
+			missing, err := repo.GetOutboxRecord("missing")
+			require.NoError(t, err)
+			assert.Nil(t, missing)
+		})
+	}
+}
+
+func TestOutbox_DeadLettersPendingRecords(t *testing.T) {
+	fileRepo, err := NewFileRepository(t.TempDir(), 100)
+	require.NoError(t, err)
+	defer fileRepo.Close()
+
+	for name, repo := range map[string]outboxRepository{
+		"memory": NewInMemoryRepository(),
+		"file":   fileRepo,
+		"sql":    newTestSQLRepository(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1001", 10)))
+			pending, err := repo.PendingOutbox(10)
+			require.NoError(t, err)
+			require.Len(t, pending, 1)
+
+			require.NoError(t, repo.MarkOutboxFailed(pending, "sink returned status code: 422"))
+			require.NoError(t, repo.MarkOutboxDeadLettered(pending, "sink returned status code: 422"))
+			record, err := repo.GetOutboxRecord(pending[0].ID)
+			require.NoError(t, err)
+			assert.Equal(t, OutboxDeadLettered, record.Status)
+			assert.Equal(t, 1, record.Attempts)
+			assert.Empty(t, record.Metric)
+			pending, err = repo.PendingOutbox(10)
+			require.NoError(t, err)
+			assert.Empty(t, pending)
+
+			// Guardarla igual no la reencola; un cambio sí.
+			require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1001", 10)))
+			pending, err = repo.PendingOutbox(10)
+			require.NoError(t, err)
+			assert.Empty(t, pending)
+			require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1001", 12)))
+			pending, err = repo.PendingOutbox(10)
+			require.NoError(t, err)
+			require.Len(t, pending, 1)
+			assert.Equal(t, 0, pending[0].Attempts)
+		})
+	}
+}
+
+func TestOutbox_TracksDeliveryPerSink(t *testing.T) {
+	fileRepo, err := NewFileRepository(t.TempDir(), 100)
+	require.NoError(t, err)
+	defer fileRepo.Close()
+
+	for name, repo := range map[string]outboxRepository{
+		"memory": NewInMemoryRepository(),
+		"file":   fileRepo,
+		"sql":    newTestSQLRepository(t),
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1001", 10)))
+			pending, err := repo.PendingOutbox(10)
+			require.NoError(t, err)
+			require.Len(t, pending, 1)
+
+			require.NoError(t, repo.MarkOutboxSinksDelivered(pending, []string{"warehouse"}))
+			require.NoError(t, repo.MarkOutboxSinksDelivered(pending, []string{"http", "warehouse"}))
+			record, err := repo.GetOutboxRecord(pending[0].ID)
+			require.NoError(t, err)
+			assert.Equal(t, OutboxPending, record.Status)
+			assert.Equal(t, []string{"http", "warehouse"}, record.DeliveredTo)
+
+			// Una versión nueva tiene que llegar otra vez a todos los sinks.
+			require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1001", 12)))
+			require.NoError(t, repo.MarkOutboxSinksDelivered(pending, []string{"stdout"}))
+			pending, err = repo.PendingOutbox(10)
+			require.NoError(t, err)
+			require.Len(t, pending, 1)
+			assert.Empty(t, pending[0].DeliveredTo)
+		})
+	}
+}
+
+func TestOutbox_EnqueuesOnlyExportModel(t *testing.T) {
+	fileRepo, err := NewFileRepository(t.TempDir(), 100, WithExportModel("last_touch"))
+	require.NoError(t, err)
+	defer fileRepo.Close()
+	sqlRepo, err := NewSQLRepository(newTestSQLRepository(t).db, DialectSQLite, WithExportModel("last_touch"))
+	require.NoError(t, err)
+
+	for name, repo := range map[string]outboxRepository{
+		"memory": NewInMemoryRepository(WithExportModel("last_touch")),
+		"file":   fileRepo,
+		"sql":    sqlRepo,
+	} {
+		t.Run(name, func(t *testing.T) {
+			for _, model := range []string{"last_touch", "linear"} {
+				metric := sampleMetric("2025-08-01", "C-1001", 10)
+				metric.AttributionModel = model
+				require.NoError(t, repo.Save(metric))
+			}
+
+			// Las dos versiones se guardan, pero sólo la del modelo exportado se encola.
+			all, err := repo.GetAllMetrics()
+			require.NoError(t, err)
+			assert.Len(t, all, 2)
+			pending, err := repo.PendingOutbox(10)
+			require.NoError(t, err)
+			require.Len(t, pending, 1)
+			assert.Equal(t, "2025-08-01-C-1001-google_ads-last_touch", pending[0].ID)
+			assert.JSONEq(t, `"last_touch"`, string(jsonField(t, pending[0].Metric, "AttributionModel")))
+
+			day := all[0].Date
+			byDate, err := repo.GetMetricsByDate(day, "linear")
+			require.NoError(t, err)
+			require.Len(t, byDate, 1)
+			assert.Equal(t, "linear", byDate[0].AttributionModel)
+		})
+	}
+}
+
+func TestFileRepository_OutboxSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewFileRepository(dir, 100)
+	require.NoError(t, err)
+	require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1001", 10)))
+	require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1002", 20)))
+	pending, err := repo.PendingOutbox(1)
+	require.NoError(t, err)
+	require.NoError(t, repo.MarkOutboxDelivered(pending))
+	// Este cambio sólo está en el WAL cuando el proceso cae.
+	require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1003", 30)))
+	require.NoError(t, repo.Close())
+
+	reopened, err := NewFileRepository(dir, 100)
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	delivered, err := reopened.GetOutboxRecord("2025-08-01-C-1001-google_ads")
+	require.NoError(t, err)
+	require.NotNil(t, delivered)
+	assert.Equal(t, OutboxDelivered, delivered.Status)
+	pending, err = reopened.PendingOutbox(10)
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Equal(t, "2025-08-01-C-1002-google_ads", pending[0].ID)
+	assert.Equal(t, "2025-08-01-C-1003-google_ads", pending[1].ID)
+
+	// Tras compactar, el outbox ya no depende del WAL.
+	require.NoError(t, reopened.Snapshot())
+	require.NoError(t, reopened.Close())
+	again, err := NewFileRepository(dir, 100)
+	require.NoError(t, err)
+	defer again.Close()
+	pending, err = again.PendingOutbox(10)
+	require.NoError(t, err)
+	assert.Len(t, pending, 2)
+}
+
+func TestFileRepository_OutboxJournalIsCompacted(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewFileRepository(dir, 100)
+	require.NoError(t, err)
+	require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1001", 10)))
+	require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1002", 20)))
+	require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1003", 30)))
+	pending, err := repo.PendingOutbox(10)
+	require.NoError(t, err)
+	require.NoError(t, repo.MarkOutboxDelivered(pending[:1]))
+	require.NoError(t, repo.MarkOutboxDeadLettered(pending[1:2], "rejected"))
+
+	// Cada cambio de estado añade sólo las líneas de sus registros.
+	assert.Len(t, journalLines(t, dir), 2)
+
+	require.NoError(t, repo.Snapshot())
+	lines := journalLines(t, dir)
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], "2025-08-01-C-1003-google_ads")
+	record, err := repo.GetOutboxRecord("2025-08-01-C-1001-google_ads")
+	require.NoError(t, err)
+	assert.Nil(t, record)
+
+	// Volver a guardar una métrica ya entregada sin cambios no la reexporta; un cambio sí.
+	require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1001", 10)))
+	require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1002", 25)))
+	require.NoError(t, repo.Close())
+
+	reopened, err := NewFileRepository(dir, 100)
+	require.NoError(t, err)
+	defer reopened.Close()
+	pending, err = reopened.PendingOutbox(10)
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Equal(t, "2025-08-01-C-1003-google_ads", pending[0].ID)
+	assert.Equal(t, "2025-08-01-C-1002-google_ads", pending[1].ID)
+}
+
+func TestFileRepository_MigratesLegacyOutbox(t *testing.T) {
+	dir := t.TempDir()
+	record, err := newOutboxRecord(sampleMetric("2025-08-01", "C-1001", 10), time.Now().UTC())
+	require.NoError(t, err)
+	require.NoError(t, writeJSONAtomic(filepath.Join(dir, legacyOutboxFileName), []OutboxRecord{record}))
+
+	repo, err := NewFileRepository(dir, 100)
+	require.NoError(t, err)
+	defer repo.Close()
+	pending, err := repo.PendingOutbox(10)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Len(t, journalLines(t, dir), 1)
+	assert.NoFileExists(t, filepath.Join(dir, legacyOutboxFileName))
+}
+
+// journalLines devuelve las líneas del diario del outbox.
+func journalLines(t *testing.T, dir string) []string {
+	raw, err := os.ReadFile(filepath.Join(dir, outboxFileName))
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n")
+}
+
+// jsonField devuelve el valor JSON de un campo de un objeto.
+func jsonField(t *testing.T, object []byte, field string) []byte {
+	var fields map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(object, &fields))
+	return fields[field]
+}
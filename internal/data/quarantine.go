@@ -0,0 +1,358 @@
+// Package data internal/data/quarantine.go
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tipos de registro que pueden quedar en cuarentena.
+const (
+	QuarantineKindAd          = "ad_performance"
+	QuarantineKindOpportunity = "opportunity"
+)
+
+// Estados de un registro en cuarentena.
+const (
+	QuarantineRejected    = "rejected"    // Rechazado por la validación; no entra en las métricas.
+	QuarantineResubmitted = "resubmitted" // Reenviado y aceptado; las ingestas siguientes usan Correction en su lugar.
+)
+
+// QuarantinedRecord es un registro de una fuente rechazado por la validación, junto con los motivos.
+type QuarantinedRecord struct {
+	ID         string          `json:"id"` // Hash del tipo, la fuente y el registro original; estable entre ingestas.
+	Kind       string          `json:"kind"`
+	Source     string          `json:"source"`
+	Record     json.RawMessage `json:"record"`               // Registro tal como llegó de la fuente.
+	Correction json.RawMessage `json:"correction,omitempty"` // Versión reenviada que sustituye a Record.
+	Reasons    []string        `json:"reasons"`
+	Status     string          `json:"status"`
+	FirstSeen  time.Time       `json:"first_seen"`
+	LastSeen   time.Time       `json:"last_seen"`
+}
+
+// QuarantineFilter restringe los registros devueltos por ListQuarantined; los campos vacíos no filtran.
+type QuarantineFilter struct {
+	Kind   string
+	Source string
+	Status string
+	Limit  int // 0 sin límite.
+}
+
+// matches indica si el registro cumple el filtro.
+func (f QuarantineFilter) matches(r QuarantinedRecord) bool {
+	return (f.Kind == "" || r.Kind == f.Kind) &&
+		(f.Source == "" || r.Source == f.Source) &&
+		(f.Status == "" || r.Status == f.Status)
+}
+
+// QuarantineStore persiste los registros rechazados por la validación de la ingesta.
+type QuarantineStore interface {
+	// QuarantineRecords guarda registros rechazados. Un registro ya en cuarentena (mismo ID) actualiza
+	// sus motivos y LastSeen y vuelve a estado rejected, conservando FirstSeen y su corrección.
+	QuarantineRecords(records []QuarantinedRecord) error
+	// GetQuarantined devuelve un registro por ID, o nil si no existe.
+	GetQuarantined(id string) (*QuarantinedRecord, error)
+	// ListQuarantined devuelve los registros que cumplen el filtro, del visto más recientemente al más antiguo.
+	ListQuarantined(filter QuarantineFilter) ([]QuarantinedRecord, error)
+	// ResolveQuarantined marca un registro como reenviado con la corrección indicada.
+	ResolveQuarantined(id string, correction json.RawMessage) error
+}
+
+// ErrQuarantinedNotFound se devuelve al resolver un registro que no está en cuarentena.
+var ErrQuarantinedNotFound = errors.New("quarantined record not found")
+
+// InMemoryQuarantineStore guarda la cuarentena en memoria; se pierde al reiniciar.
+type InMemoryQuarantineStore struct {
+	mu      sync.RWMutex
+	records map[string]QuarantinedRecord
+}
+
+// NewInMemoryQuarantineStore crea una cuarentena vacía.
+func NewInMemoryQuarantineStore() *InMemoryQuarantineStore {
+	return &InMemoryQuarantineStore{records: make(map[string]QuarantinedRecord)}
+}
+
+// QuarantineRecords guarda o actualiza registros rechazados.
+func (s *InMemoryQuarantineStore) QuarantineRecords(records []QuarantinedRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.upsert(records)
+	return nil
+}
+
+// GetQuarantined devuelve un registro por ID, o nil si no existe.
+func (s *InMemoryQuarantineStore) GetQuarantined(id string) (*QuarantinedRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, ok := s.records[id]
+	if !ok {
+		return nil, nil
+	}
+	return &record, nil
+}
+
+// ListQuarantined devuelve los registros que cumplen el filtro, del visto más recientemente al más antiguo.
+func (s *InMemoryQuarantineStore) ListQuarantined(filter QuarantineFilter) ([]QuarantinedRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := []QuarantinedRecord{}
+	for _, record := range s.records {
+		if filter.matches(record) {
+			list = append(list, record)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].LastSeen.Equal(list[j].LastSeen) {
+			return list[i].LastSeen.After(list[j].LastSeen)
+		}
+		return list[i].ID < list[j].ID
+	})
+	if filter.Limit > 0 && len(list) > filter.Limit {
+		list = list[:filter.Limit]
+	}
+	return list, nil
+}
+
+// ResolveQuarantined marca un registro como reenviado con la corrección indicada.
+func (s *InMemoryQuarantineStore) ResolveQuarantined(id string, correction json.RawMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resolve(id, correction)
+}
+
+// upsert aplica QuarantineRecords; el llamador debe tener el lock.
+func (s *InMemoryQuarantineStore) upsert(records []QuarantinedRecord) {
+	for _, record := range records {
+		if current, ok := s.records[record.ID]; ok {
+			record.FirstSeen = current.FirstSeen
+			record.Correction = current.Correction
+		}
+		record.Status = QuarantineRejected
+		s.records[record.ID] = record
+	}
+}
+
+// resolve aplica ResolveQuarantined; el llamador debe tener el lock.
+func (s *InMemoryQuarantineStore) resolve(id string, correction json.RawMessage) error {
+	record, ok := s.records[id]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrQuarantinedNotFound, id)
+	}
+	record.Status = QuarantineResubmitted
+	record.Correction = correction
+	s.records[id] = record
+	return nil
+}
+
+// FileQuarantineStore persiste la cuarentena en un archivo JSON, reescrito de forma atómica en cada cambio.
+type FileQuarantineStore struct {
+	mem  *InMemoryQuarantineStore
+	path string
+}
+
+// NewFileQuarantineStore abre (o crea) la cuarentena en la ruta indicada.
+func NewFileQuarantineStore(path string) (*FileQuarantineStore, error) {
+	s := &FileQuarantineStore{mem: NewInMemoryQuarantineStore(), path: path}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open quarantine: %w", err)
+	}
+	defer f.Close()
+
+	var list []QuarantinedRecord
+	if err := json.NewDecoder(f).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode quarantine: %w", err)
+	}
+	for _, record := range list {
+		s.mem.records[record.ID] = record
+	}
+	return s, nil
+}
+
+// QuarantineRecords guarda o actualiza registros rechazados y los persiste.
+func (s *FileQuarantineStore) QuarantineRecords(records []QuarantinedRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	s.mem.upsert(records)
+	return s.persist()
+}
+
+// GetQuarantined devuelve un registro por ID, o nil si no existe.
+func (s *FileQuarantineStore) GetQuarantined(id string) (*QuarantinedRecord, error) {
+	return s.mem.GetQuarantined(id)
+}
+
+// ListQuarantined devuelve los registros que cumplen el filtro, del visto más recientemente al más antiguo.
+func (s *FileQuarantineStore) ListQuarantined(filter QuarantineFilter) ([]QuarantinedRecord, error) {
+	return s.mem.ListQuarantined(filter)
+}
+
+// ResolveQuarantined marca un registro como reenviado y lo persiste.
+func (s *FileQuarantineStore) ResolveQuarantined(id string, correction json.RawMessage) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	if err := s.mem.resolve(id, correction); err != nil {
+		return err
+	}
+	return s.persist()
+}
+
+// persist reescribe el archivo con el estado actual; el llamador debe tener el lock.
+func (s *FileQuarantineStore) persist() error {
+	list := make([]QuarantinedRecord, 0, len(s.mem.records))
+	for _, record := range s.mem.records {
+		list = append(list, record)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return writeJSONAtomic(s.path, list)
+}
+
+// quarantineColumns son las columnas de ingest_quarantine, en el orden de scanQuarantined.
+var quarantineColumns = []string{"id", "kind", "source", "record", "correction", "reasons", "status", "first_seen", "last_seen"}
+
+// SQLQuarantineStore persiste la cuarentena en la tabla ingest_quarantine, compartida entre réplicas.
+type SQLQuarantineStore struct {
+	db      *sql.DB
+	dialect SQLDialect
+}
+
+// NewSQLQuarantineStore crea la cuarentena SQL y aplica las migraciones pendientes.
+func NewSQLQuarantineStore(db *sql.DB, dialect SQLDialect) (*SQLQuarantineStore, error) {
+	if err := Migrate(db); err != nil {
+		return nil, err
+	}
+	return &SQLQuarantineStore{db: db, dialect: dialect}, nil
+}
+
+// QuarantineRecords guarda o actualiza registros rechazados en una única transacción.
+func (s *SQLQuarantineStore) QuarantineRecords(records []QuarantinedRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	p := s.dialect.Placeholder
+	query := fmt.Sprintf(
+		"INSERT INTO ingest_quarantine (id, kind, source, record, correction, reasons, status, first_seen, last_seen) "+
+			"VALUES (%s, %s, %s, %s, '', %s, %s, %s, %s) "+
+			"ON CONFLICT (id) DO UPDATE SET reasons = excluded.reasons, status = excluded.status, last_seen = excluded.last_seen",
+		p(1), p(2), p(3), p(4), p(5), p(6), p(7), p(8),
+	)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin quarantine transaction: %w", err)
+	}
+	defer tx.Rollback()
+	for _, r := range records {
+		reasons, err := json.Marshal(r.Reasons)
+		if err != nil {
+			return fmt.Errorf("failed to encode reasons for %s: %w", r.ID, err)
+		}
+		if _, err := tx.Exec(query, r.ID, r.Kind, r.Source, string(r.Record), string(reasons), QuarantineRejected,
+			formatWatermark(r.FirstSeen), formatWatermark(r.LastSeen)); err != nil {
+			return fmt.Errorf("failed to quarantine record %s: %w", r.ID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit quarantine: %w", err)
+	}
+	return nil
+}
+
+// GetQuarantined devuelve un registro por ID, o nil si no existe.
+func (s *SQLQuarantineStore) GetQuarantined(id string) (*QuarantinedRecord, error) {
+	list, err := s.query(fmt.Sprintf("SELECT %s FROM ingest_quarantine WHERE id = %s",
+		strings.Join(quarantineColumns, ", "), s.dialect.Placeholder(1)), id)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	return &list[0], nil
+}
+
+// ListQuarantined devuelve los registros que cumplen el filtro, del visto más recientemente al más antiguo.
+func (s *SQLQuarantineStore) ListQuarantined(filter QuarantineFilter) ([]QuarantinedRecord, error) {
+	var conditions []string
+	var args []interface{}
+	for _, c := range []struct{ column, value string }{
+		{"kind", filter.Kind}, {"source", filter.Source}, {"status", filter.Status},
+	} {
+		if c.value != "" {
+			args = append(args, c.value)
+			conditions = append(conditions, fmt.Sprintf("%s = %s", c.column, s.dialect.Placeholder(len(args))))
+		}
+	}
+	query := fmt.Sprintf("SELECT %s FROM ingest_quarantine", strings.Join(quarantineColumns, ", "))
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY last_seen DESC, id"
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += " LIMIT " + s.dialect.Placeholder(len(args))
+	}
+	return s.query(query, args...)
+}
+
+// ResolveQuarantined marca un registro como reenviado con la corrección indicada.
+func (s *SQLQuarantineStore) ResolveQuarantined(id string, correction json.RawMessage) error {
+	p := s.dialect.Placeholder
+	res, err := s.db.Exec(fmt.Sprintf("UPDATE ingest_quarantine SET status = %s, correction = %s WHERE id = %s", p(1), p(2), p(3)),
+		QuarantineResubmitted, string(correction), id)
+	if err != nil {
+		return fmt.Errorf("failed to resolve quarantined record %s: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("%w: %q", ErrQuarantinedNotFound, id)
+	}
+	return nil
+}
+
+// query ejecuta una consulta sobre ingest_quarantine y escanea los registros.
+func (s *SQLQuarantineStore) query(query string, args ...interface{}) ([]QuarantinedRecord, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query quarantine: %w", err)
+	}
+	defer rows.Close()
+
+	list := []QuarantinedRecord{}
+	for rows.Next() {
+		var r QuarantinedRecord
+		var record, correction, reasons, firstSeen, lastSeen string
+		if err := rows.Scan(&r.ID, &r.Kind, &r.Source, &record, &correction, &reasons, &r.Status, &firstSeen, &lastSeen); err != nil {
+			return nil, fmt.Errorf("failed to scan quarantined record: %w", err)
+		}
+		r.Record = json.RawMessage(record)
+		if correction != "" {
+			r.Correction = json.RawMessage(correction)
+		}
+		if err := json.Unmarshal([]byte(reasons), &r.Reasons); err != nil {
+			return nil, fmt.Errorf("invalid reasons for %s: %w", r.ID, err)
+		}
+		if r.FirstSeen, err = time.Parse(watermarkLayout, firstSeen); err != nil {
+			return nil, fmt.Errorf("invalid first_seen for %s: %w", r.ID, err)
+		}
+		if r.LastSeen, err = time.Parse(watermarkLayout, lastSeen); err != nil {
+			return nil, fmt.Errorf("invalid last_seen for %s: %w", r.ID, err)
+		}
+		list = append(list, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query quarantine: %w", err)
+	}
+	return list, nil
+}
@@ -0,0 +1,95 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuarantineStores_UpsertListAndResolve(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	sqlStore, err := NewSQLQuarantineStore(db, DialectSQLite)
+	require.NoError(t, err)
+	fileStore, err := NewFileQuarantineStore(filepath.Join(t.TempDir(), "quarantine.json"))
+	require.NoError(t, err)
+
+	stores := map[string]QuarantineStore{
+		"memory": NewInMemoryQuarantineStore(),
+		"file":   fileStore,
+		"sql":    sqlStore,
+	}
+	aug1 := time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC)
+	aug2 := time.Date(2025, 8, 2, 0, 0, 0, 0, time.UTC)
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, store.QuarantineRecords([]QuarantinedRecord{
+				{ID: "a1", Kind: QuarantineKindAd, Source: "ads", Record: json.RawMessage(`{"clicks":-1}`), Reasons: []string{"clicks"}, FirstSeen: aug1, LastSeen: aug1},
+				{ID: "o1", Kind: QuarantineKindOpportunity, Source: "crm", Record: json.RawMessage(`{}`), Reasons: []string{"id"}, FirstSeen: aug1, LastSeen: aug1},
+			}))
+
+			// Resolver guarda la corrección; volver a rechazar el registro conserva FirstSeen y la corrección.
+			require.NoError(t, store.ResolveQuarantined("a1", json.RawMessage(`{"clicks":1}`)))
+			assert.ErrorIs(t, store.ResolveQuarantined("missing", nil), ErrQuarantinedNotFound)
+
+			resolved, err := store.ListQuarantined(QuarantineFilter{Status: QuarantineResubmitted})
+			require.NoError(t, err)
+			require.Len(t, resolved, 1)
+			assert.JSONEq(t, `{"clicks":1}`, string(resolved[0].Correction))
+
+			require.NoError(t, store.QuarantineRecords([]QuarantinedRecord{
+				{ID: "a1", Kind: QuarantineKindAd, Source: "ads", Record: json.RawMessage(`{"clicks":-1}`), Reasons: []string{"clicks", "cost"}, FirstSeen: aug2, LastSeen: aug2},
+			}))
+			record, err := store.GetQuarantined("a1")
+			require.NoError(t, err)
+			require.NotNil(t, record)
+			assert.Equal(t, QuarantineRejected, record.Status)
+			assert.Equal(t, []string{"clicks", "cost"}, record.Reasons)
+			assert.True(t, aug1.Equal(record.FirstSeen))
+			assert.True(t, aug2.Equal(record.LastSeen))
+			assert.JSONEq(t, `{"clicks":1}`, string(record.Correction))
+
+			// El listado va del visto más recientemente al más antiguo y admite filtros y límite.
+			list, err := store.ListQuarantined(QuarantineFilter{})
+			require.NoError(t, err)
+			require.Len(t, list, 2)
+			assert.Equal(t, "a1", list[0].ID)
+			list, err = store.ListQuarantined(QuarantineFilter{Source: "crm"})
+			require.NoError(t, err)
+			require.Len(t, list, 1)
+			assert.Equal(t, "o1", list[0].ID)
+			list, err = store.ListQuarantined(QuarantineFilter{Limit: 1})
+			require.NoError(t, err)
+			assert.Len(t, list, 1)
+
+			missing, err := store.GetQuarantined("missing")
+			require.NoError(t, err)
+			assert.Nil(t, missing)
+		})
+	}
+}
+
+func TestFileQuarantineStore_PersistsAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quarantine.json")
+	store, err := NewFileQuarantineStore(path)
+	require.NoError(t, err)
+	now := time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, store.QuarantineRecords([]QuarantinedRecord{
+		{ID: "a1", Kind: QuarantineKindAd, Source: "ads", Record: json.RawMessage(`{}`), Reasons: []string{"date"}, FirstSeen: now, LastSeen: now},
+	}))
+
+	reopened, err := NewFileQuarantineStore(path)
+	require.NoError(t, err)
+	record, err := reopened.GetQuarantined("a1")
+	require.NoError(t, err)
+	require.NotNil(t, record)
+	assert.Equal(t, []string{"date"}, record.Reasons)
+}
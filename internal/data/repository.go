@@ -3,6 +3,8 @@ package data
 
 import (
 	"fmt"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 )
@@ -11,98 +13,422 @@ import (
 type MetricRepository interface {
 	// Save guarda una métrica en el repositorio.
 	Save(metric EnrichedMetric) error
-	// GetMetricsByChannel obtiene métricas filtradas por canal, rango de fechas, límite y desplazamiento.
-	GetMetricsByChannel(channel string, from, to time.Time, limit, offset int) ([]EnrichedMetric, error)
-	// GetMetricsByFunnel obtiene métricas filtradas por campaña UTM, rango de fechas, límite y desplazamiento.
-	GetMetricsByFunnel(utmCampaign string, from, to time.Time, limit, offset int) ([]EnrichedMetric, error)
+	// GetMetricsByChannel obtiene las métricas del canal filter.Channel que cumplen el filtro, con límite y
+	// desplazamiento.
+	GetMetricsByChannel(filter MetricFilter, limit, offset int) ([]EnrichedMetric, error)
+	// GetMetricsByFunnel obtiene las métricas de la campaña UTM filter.UTMCampaign que cumplen el filtro, con
+	// límite y desplazamiento.
+	GetMetricsByFunnel(filter MetricFilter, limit, offset int) ([]EnrichedMetric, error)
+	// GetMetricsByDate devuelve las métricas de un día concreto del modelo de atribución indicado; las guardadas
+	// sin modelo cuentan como de ese modelo. Vacío devuelve las de todos los modelos.
+	GetMetricsByDate(date time.Time, model string) ([]EnrichedMetric, error)
+	// GetMetricsPage obtiene una página de métricas filtradas, posterior al cursor indicado, junto con el total.
+	GetMetricsPage(filter MetricFilter, after *MetricCursor, limit int) (MetricPage, error)
+	// Aggregate suma las métricas filtradas agrupándolas por los campos indicados.
+	Aggregate(filter MetricFilter, groupBy []GroupByField) ([]AggregateRow, error)
 	// GetAllMetrics devuelve todas las métricas almacenadas en el repositorio.
 	GetAllMetrics() ([]EnrichedMetric, error)
 }
 
+// MetricFilter agrupa los filtros de las consultas de métricas. Los campos vacíos no filtran.
+type MetricFilter struct {
+	Channel          string
+	UTMCampaign      string
+	AttributionModel string // Vacío devuelve las métricas de todos los modelos.
+	// DefaultModel es el modelo al que pertenecen las métricas guardadas sin modelo, anteriores a guardar
+	// una métrica por modelo: el filtro de ese modelo también las incluye.
+	DefaultModel string
+	From         time.Time
+	To           time.Time
+}
+
+// matches indica si una métrica cumple los filtros de canal, campaña UTM y modelo de atribución.
+func (f MetricFilter) matches(m EnrichedMetric) bool {
+	return (f.Channel == "" || m.Channel == f.Channel) && (f.UTMCampaign == "" || m.UTMCampaign == f.UTMCampaign) &&
+		(f.AttributionModel == "" || f.modelOf(m) == f.AttributionModel)
+}
+
+// modelOf devuelve el modelo de atribución de una métrica; las guardadas sin modelo son de DefaultModel.
+func (f MetricFilter) modelOf(m EnrichedMetric) string {
+	if m.AttributionModel == "" {
+		return f.DefaultModel
+	}
+	return m.AttributionModel
+}
+
+// refilter indica si las entradas de rangeEntries deben volver a comprobarse con matches: el índice elegido
+// sólo cubre uno de los filtros de canal y campaña, y ninguno el de modelo.
+func (f MetricFilter) refilter() bool {
+	return (f.Channel != "" && f.UTMCampaign != "") || f.AttributionModel != ""
+}
+
+// MetricCursor identifica la última métrica vista en una paginación por cursor,
+// usando el mismo orden (fecha, campaña, canal, modelo) que las consultas.
+type MetricCursor struct {
+	Date             time.Time
+	CampaignID       string
+	Channel          string
+	AttributionModel string
+}
+
+// CursorFor devuelve el cursor que apunta a la métrica indicada.
+func CursorFor(m EnrichedMetric) MetricCursor {
+	return MetricCursor{Date: m.Date, CampaignID: m.CampaignID, Channel: m.Channel, AttributionModel: m.AttributionModel}
+}
+
+// MetricPage es el resultado de una consulta paginada por cursor.
+type MetricPage struct {
+	Metrics []EnrichedMetric
+	Next    *MetricCursor // nil cuando no hay más páginas.
+	Total   int           // Total de métricas que cumplen el filtro, sin paginar.
+}
+
+// RepositoryOption permite personalizar un repositorio de métricas al crearlo.
+type RepositoryOption func(*repositoryOptions)
+
+// repositoryOptions es la configuración común a los repositorios de métricas.
+type repositoryOptions struct {
+	exportModel string // Vacío encola en el outbox las métricas de todos los modelos.
+}
+
+// WithExportModel encola en el outbox de exportación sólo las métricas del modelo de atribución indicado y las
+// guardadas sin modelo, para que los sinks no reciban la misma fila una vez por cada modelo calculado.
+func WithExportModel(model string) RepositoryOption {
+	return func(o *repositoryOptions) {
+		o.exportModel = model
+	}
+}
+
+// exports indica si una métrica se encola en el outbox de exportación.
+func (o repositoryOptions) exports(metric EnrichedMetric) bool {
+	return o.exportModel == "" || metric.AttributionModel == "" || metric.AttributionModel == o.exportModel
+}
+
 // InMemoryRepository es una implementación del Repositorio que utiliza un mapa en memoria.
+// Mantiene índices secundarios ordenados por (fecha, campaña, canal, modelo) para que las consultas
+// sólo recorran las métricas que coinciden con el filtro y devuelvan siempre el mismo orden.
 type InMemoryRepository struct {
 	mu      sync.RWMutex
 	storage map[string]EnrichedMetric
+
+	ordered       []indexEntry            // Todas las métricas, ordenadas.
+	byChannel     map[string][]indexEntry // Índice por canal.
+	byUTMCampaign map[string][]indexEntry // Índice por utm_campaign.
+	byDate        map[string][]indexEntry // Índice por fecha (YYYY-MM-DD).
+
+	outbox map[string]OutboxRecord // Outbox de exportación, por clave de métrica.
+	repositoryOptions
+}
+
+// indexEntry es una referencia ordenable a una métrica almacenada.
+type indexEntry struct {
+	date       time.Time
+	campaignID string
+	channel    string
+	model      string
+	key        string
+}
+
+// less define el orden determinista de las consultas: fecha, campaña, canal y modelo de atribución.
+func (e indexEntry) less(other indexEntry) bool {
+	if !e.date.Equal(other.date) {
+		return e.date.Before(other.date)
+	}
+	if e.campaignID != other.campaignID {
+		return e.campaignID < other.campaignID
+	}
+	if e.channel != other.channel {
+		return e.channel < other.channel
+	}
+	return e.model < other.model
 }
 
 // NewInMemoryRepository crea una nueva instancia del repositorio en memoria.
-func NewInMemoryRepository() *InMemoryRepository {
-	return &InMemoryRepository{
-		storage: make(map[string]EnrichedMetric), // Inicializa el mapa de almacenamiento.
+func NewInMemoryRepository(opts ...RepositoryOption) *InMemoryRepository {
+	r := &InMemoryRepository{
+		storage:       make(map[string]EnrichedMetric), // Inicializa el mapa de almacenamiento.
+		byChannel:     make(map[string][]indexEntry),
+		byUTMCampaign: make(map[string][]indexEntry),
+		byDate:        make(map[string][]indexEntry),
+		outbox:        make(map[string]OutboxRecord),
+	}
+	for _, opt := range opts {
+		opt(&r.repositoryOptions)
 	}
+	return r
 }
 
-// Save guarda una métrica en el almacén en memoria de forma segura.
+// CalendarDate devuelve el día calendario de t en su propia zona horaria, como medianoche UTC. Las fechas de
+// las métricas son días calendario: así una fecha interpretada en la zona de reporte (la medianoche local)
+// y la misma fecha en UTC se guardan y se comparan igual.
+func CalendarDate(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// metricKey genera la clave única de una métrica basada en la fecha, ID de campaña, canal y modelo de
+// atribución: cada modelo guarda sus propias cifras, para poder compararlos. Las métricas sin modelo
+// conservan la clave anterior.
+func metricKey(metric EnrichedMetric) string {
+	key := unlabeledKey(metric)
+	if metric.AttributionModel != "" {
+		key += "-" + metric.AttributionModel
+	}
+	return key
+}
+
+// unlabeledKey es la clave que tendría la métrica si se hubiera guardado sin modelo.
+func unlabeledKey(metric EnrichedMetric) string {
+	return fmt.Sprintf("%s-%s-%s", metric.Date.Format("2006-01-02"), metric.CampaignID, metric.Channel)
+}
+
+// Save guarda una métrica en el almacén en memoria de forma segura, actualiza los índices y, si la métrica
+// cambió y es del modelo que se exporta, encola su nueva versión en el outbox de exportación.
 func (r *InMemoryRepository) Save(metric EnrichedMetric) error {
+	if !r.exports(metric) {
+		r.restore(metric)
+		return nil
+	}
+	record, err := newOutboxRecord(metric, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	// Genera una clave única para la métrica basada en la fecha, ID de campaña y canal.
-	key := fmt.Sprintf("%s-%s-%s", metric.Date.Format("2006-01-02"), metric.CampaignID, metric.Channel)
-	r.storage[key] = metric
+	previous, existed := r.storage[record.ID]
+	r.store(metric)
+	if _, queued := r.outbox[record.ID]; !queued && existed && sameVersion(previous, record) {
+		// Sin registro en el outbox (ya entregado y compactado), guardar la misma versión no la reexporta.
+		return nil
+	}
+	r.enqueue(record)
 	return nil
 }
 
-// GetMetricsByChannel obtiene métricas filtradas por canal y rango de fechas, con paginación.
-func (r *InMemoryRepository) GetMetricsByChannel(channel string, from, to time.Time, limit, offset int) ([]EnrichedMetric, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+// sameVersion indica si la métrica guardada es la versión del registro.
+func sameVersion(metric EnrichedMetric, record OutboxRecord) bool {
+	stored, err := newOutboxRecord(metric, record.EnqueuedAt)
+	return err == nil && stored.Hash == record.Hash
+}
 
-	var filtered []EnrichedMetric
-	for _, m := range r.storage {
-		// Filtra las métricas que coincidan con el canal y estén dentro del rango de fechas.
-		if m.Channel == channel && !m.Date.Before(from) && !m.Date.After(to) {
-			filtered = append(filtered, m)
-		}
+// restore guarda una métrica sin encolarla en el outbox, al reconstruir un estado ya exportado o encolado.
+func (r *InMemoryRepository) restore(metric EnrichedMetric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.store(metric)
+}
+
+// store guarda la métrica y actualiza los índices; el llamador debe tener el lock. Una métrica con modelo
+// sustituye a la guardada sin modelo para la misma fila, anterior a guardar una métrica por modelo, para que
+// el filtro del modelo por defecto no cuente la fila dos veces.
+func (r *InMemoryRepository) store(metric EnrichedMetric) {
+	metric.Date = CalendarDate(metric.Date)
+	key := metricKey(metric)
+	entry := indexEntry{date: metric.Date, campaignID: metric.CampaignID, channel: metric.Channel, model: metric.AttributionModel, key: key}
+	if metric.AttributionModel != "" {
+		r.remove(unlabeledKey(metric))
 	}
 
-	// Aplica la paginación.
-	start := offset
-	if start > len(filtered) {
-		start = len(filtered) // Asegura que el inicio no exceda el tamaño de la lista.
+	previous, exists := r.storage[key]
+	r.storage[key] = metric
+
+	if !exists {
+		r.ordered = insertEntry(r.ordered, entry)
+		r.byChannel[metric.Channel] = insertEntry(r.byChannel[metric.Channel], entry)
+		r.byUTMCampaign[metric.UTMCampaign] = insertEntry(r.byUTMCampaign[metric.UTMCampaign], entry)
+		dateKey := metric.Date.Format("2006-01-02")
+		r.byDate[dateKey] = insertEntry(r.byDate[dateKey], entry)
+		return
 	}
-	end := start + limit
-	if end > len(filtered) {
-		end = len(filtered) // Asegura que el final no exceda el tamaño de la lista.
+
+	// Fecha, campaña, canal y modelo forman la clave; sólo utm_campaign puede cambiar al sobrescribir.
+	if previous.UTMCampaign != metric.UTMCampaign {
+		removeFromIndex(r.byUTMCampaign, previous.UTMCampaign, entry)
+		r.byUTMCampaign[metric.UTMCampaign] = insertEntry(r.byUTMCampaign[metric.UTMCampaign], entry)
 	}
+}
+
+// remove elimina la métrica con la clave indicada y sus entradas de los índices, si existe; el llamador debe
+// tener el lock.
+func (r *InMemoryRepository) remove(key string) {
+	metric, ok := r.storage[key]
+	if !ok {
+		return
+	}
+	delete(r.storage, key)
+	entry := indexEntry{date: metric.Date, campaignID: metric.CampaignID, channel: metric.Channel, model: metric.AttributionModel, key: key}
+	r.ordered = removeEntry(r.ordered, entry)
+	removeFromIndex(r.byChannel, metric.Channel, entry)
+	removeFromIndex(r.byUTMCampaign, metric.UTMCampaign, entry)
+	removeFromIndex(r.byDate, metric.Date.Format("2006-01-02"), entry)
+}
+
+// GetMetricsByChannel obtiene las métricas del canal filter.Channel que cumplen el filtro, con paginación.
+func (r *InMemoryRepository) GetMetricsByChannel(filter MetricFilter, limit, offset int) ([]EnrichedMetric, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.pageFromIndex(filter, limit, offset), nil
+}
+
+// GetMetricsByFunnel obtiene las métricas de la campaña UTM filter.UTMCampaign que cumplen el filtro, con paginación.
+func (r *InMemoryRepository) GetMetricsByFunnel(filter MetricFilter, limit, offset int) ([]EnrichedMetric, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 
-	return filtered[start:end], nil
+	return r.pageFromIndex(filter, limit, offset), nil
 }
 
-// GetMetricsByFunnel obtiene métricas filtradas por campaña UTM y rango de fechas, con paginación.
-func (r *InMemoryRepository) GetMetricsByFunnel(utmCampaign string, from, to time.Time, limit, offset int) ([]EnrichedMetric, error) {
+// GetMetricsByDate devuelve las métricas de un día concreto y un modelo, ordenadas por campaña, canal y modelo.
+func (r *InMemoryRepository) GetMetricsByDate(date time.Time, model string) ([]EnrichedMetric, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	var filtered []EnrichedMetric
-	for _, m := range r.storage {
-		// Filtra las métricas que coincidan con la campaña UTM y estén dentro del rango de fechas.
-		if m.UTMCampaign == utmCampaign && !m.Date.Before(from) && !m.Date.After(to) {
-			filtered = append(filtered, m)
+	entries := r.byDate[date.Format("2006-01-02")]
+	metrics := make([]EnrichedMetric, 0, len(entries))
+	for _, e := range entries {
+		if model != "" && e.model != "" && e.model != model {
+			continue
 		}
+		metrics = append(metrics, r.storage[e.key])
 	}
+	return metrics, nil
+}
 
-	// Aplica la paginación.
-	start := offset
-	if start > len(filtered) {
-		start = len(filtered) // Asegura que el inicio no exceda el tamaño de la lista.
+// GetMetricsPage obtiene una página de métricas posterior al cursor. Como el cursor es la clave de la
+// última métrica vista, las escrituras entre dos llamadas no desplazan las páginas siguientes.
+func (r *InMemoryRepository) GetMetricsPage(filter MetricFilter, after *MetricCursor, limit int) (MetricPage, error) {
+	if limit <= 0 {
+		return MetricPage{}, fmt.Errorf("limit must be positive, got %d", limit)
 	}
-	end := start + limit
-	if end > len(filtered) {
-		end = len(filtered) // Asegura que el final no exceda el tamaño de la lista.
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	inRange := r.rangeEntries(filter)
+
+	start := 0
+	if after != nil {
+		cursor := indexEntry{date: CalendarDate(after.Date), campaignID: after.CampaignID, channel: after.Channel, model: after.AttributionModel}
+		start = searchAfter(inRange, cursor)
+	}
+
+	// Sólo hace falta volver a filtrar si el índice no cubre todo el filtro.
+	refilter := filter.refilter()
+	page := MetricPage{Metrics: []EnrichedMetric{}, Total: len(inRange)}
+	if refilter {
+		page.Total = 0
+		for _, e := range inRange {
+			if filter.matches(r.storage[e.key]) {
+				page.Total++
+			}
+		}
 	}
 
-	return filtered[start:end], nil // Devuelve el segmento paginado de métricas.
+	for _, e := range inRange[start:] {
+		m := r.storage[e.key]
+		if refilter && !filter.matches(m) {
+			continue
+		}
+		// Se encontró una métrica más allá del límite: hay una página siguiente.
+		if len(page.Metrics) == limit {
+			next := CursorFor(page.Metrics[limit-1])
+			page.Next = &next
+			break
+		}
+		page.Metrics = append(page.Metrics, m)
+	}
+	return page, nil
 }
 
-// GetAllMetrics devuelve todas las métricas almacenadas en el repositorio.
+// GetAllMetrics devuelve todas las métricas almacenadas en el repositorio, ordenadas.
 func (r *InMemoryRepository) GetAllMetrics() ([]EnrichedMetric, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
 	// Crea una lista para almacenar todas las métricas.
-	allMetrics := make([]EnrichedMetric, 0, len(r.storage))
-	for _, metric := range r.storage {
-		allMetrics = append(allMetrics, metric)
+	allMetrics := make([]EnrichedMetric, 0, len(r.ordered))
+	for _, e := range r.ordered {
+		allMetrics = append(allMetrics, r.storage[e.key])
 	}
 	return allMetrics, nil // Devuelve todas las métricas.
 }
+
+// rangeEntries elige el índice más selectivo para el filtro y lo acota al rango de fechas con búsqueda binaria.
+// Si filter.refilter() es cierto, el llamador debe volver a filtrar cada métrica con matches.
+func (r *InMemoryRepository) rangeEntries(filter MetricFilter) []indexEntry {
+	entries := r.ordered
+	if filter.Channel != "" {
+		entries = r.byChannel[filter.Channel]
+	} else if filter.UTMCampaign != "" {
+		entries = r.byUTMCampaign[filter.UTMCampaign]
+	}
+	from, to := CalendarDate(filter.From), CalendarDate(filter.To)
+	lo := sort.Search(len(entries), func(i int) bool { return !entries[i].date.Before(from) })
+	hi := sort.Search(len(entries), func(i int) bool { return entries[i].date.After(to) })
+	if hi < lo {
+		hi = lo
+	}
+	return entries[lo:hi]
+}
+
+// pageFromIndex acota el índice más selectivo para el filtro al rango de fechas con búsqueda binaria. Si el índice
+// cubre todo el filtro, salta directamente al desplazamiento y el coste es O(log n + limit); si no (filter.refilter()),
+// tiene que recorrer y descartar las entradas anteriores al desplazamiento que no cumplen el filtro, así que crece
+// con el offset y con las entradas descartadas. La paginación por cursor (GetMetricsPage) evita ese recorrido.
+func (r *InMemoryRepository) pageFromIndex(filter MetricFilter, limit, offset int) []EnrichedMetric {
+	entries := r.rangeEntries(filter)
+	refilter := filter.refilter()
+	if !refilter {
+		entries = entries[min(offset, len(entries)):]
+		offset = 0
+	}
+
+	var page []EnrichedMetric
+	skipped := 0
+	for _, e := range entries {
+		if len(page) >= limit {
+			break
+		}
+		if refilter && !filter.matches(r.storage[e.key]) {
+			continue
+		}
+		// Aplica el desplazamiento de la paginación.
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		page = append(page, r.storage[e.key])
+	}
+	return page
+}
+
+// searchAfter devuelve, con búsqueda binaria, la posición de la primera entrada posterior al cursor.
+func searchAfter(entries []indexEntry, cursor indexEntry) int {
+	return sort.Search(len(entries), func(i int) bool { return cursor.less(entries[i]) })
+}
+
+// insertEntry inserta una entrada manteniendo el orden del índice. La posición se busca en O(log n), pero
+// insertarla desplaza las entradas posteriores, así que el coste total es O(n).
+func insertEntry(entries []indexEntry, entry indexEntry) []indexEntry {
+	i := sort.Search(len(entries), func(i int) bool { return !entries[i].less(entry) })
+	return slices.Insert(entries, i, entry)
+}
+
+// removeFromIndex elimina una entrada del índice secundario de value, y el propio valor si queda vacío.
+func removeFromIndex(index map[string][]indexEntry, value string, entry indexEntry) {
+	index[value] = removeEntry(index[value], entry)
+	if len(index[value]) == 0 {
+		delete(index, value)
+	}
+}
+
+// removeEntry elimina una entrada de un índice ordenado.
+func removeEntry(entries []indexEntry, entry indexEntry) []indexEntry {
+	i := sort.Search(len(entries), func(i int) bool { return !entries[i].less(entry) })
+	if i < len(entries) && entries[i].key == entry.key {
+		return slices.Delete(entries, i, i+1)
+	}
+	return entries
+}
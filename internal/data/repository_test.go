@@ -0,0 +1,231 @@
+package data
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryRepository_DeterministicPagination(t *testing.T) {
+	repo := NewInMemoryRepository()
+
+	// Se insertan en desorden; las consultas deben devolverlas por fecha y campaña.
+	for _, m := range []EnrichedMetric{
+		sampleMetric("2025-08-03", "C-1001", 3),
+		sampleMetric("2025-08-01", "C-1002", 2),
+		sampleMetric("2025-08-02", "C-1001", 4),
+		sampleMetric("2025-08-01", "C-1001", 1),
+	} {
+		require.NoError(t, repo.Save(m))
+	}
+
+	from, _ := time.Parse("2006-01-02", "2025-08-01")
+	to, _ := time.Parse("2006-01-02", "2025-08-31")
+
+	var seen []int
+	for offset := 0; offset < 4; offset += 2 {
+		page, err := repo.GetMetricsByChannel(MetricFilter{Channel: "google_ads", From: from, To: to}, 2, offset)
+		require.NoError(t, err)
+		for _, m := range page {
+			seen = append(seen, m.Clicks)
+		}
+	}
+	assert.Equal(t, []int{1, 2, 4, 3}, seen)
+
+	// Un desplazamiento más allá del final devuelve una página vacía, con o sin filtros adicionales.
+	beyond, err := repo.GetMetricsByChannel(MetricFilter{Channel: "google_ads", From: from, To: to}, 2, 10)
+	require.NoError(t, err)
+	assert.Empty(t, beyond)
+	refiltered, err := repo.GetMetricsByChannel(MetricFilter{Channel: "google_ads", UTMCampaign: "summer_sale", From: from, To: to}, 2, 3)
+	require.NoError(t, err)
+	require.Len(t, refiltered, 1)
+	assert.Equal(t, 3, refiltered[0].Clicks)
+
+	byDate, err := repo.GetMetricsByDate(from, "")
+	require.NoError(t, err)
+	require.Len(t, byDate, 2)
+	assert.Equal(t, "C-1001", byDate[0].CampaignID)
+}
+
+func TestInMemoryRepository_ReindexesChangedUTMCampaign(t *testing.T) {
+	repo := NewInMemoryRepository()
+
+	metric := sampleMetric("2025-08-01", "C-1001", 1)
+	require.NoError(t, repo.Save(metric))
+	metric.UTMCampaign = "back_to_school"
+	require.NoError(t, repo.Save(metric))
+
+	from, _ := time.Parse("2006-01-02", "2025-08-01")
+	old, err := repo.GetMetricsByFunnel(MetricFilter{UTMCampaign: "summer_sale", From: from, To: from}, 10, 0)
+	require.NoError(t, err)
+	assert.Empty(t, old)
+
+	current, err := repo.GetMetricsByFunnel(MetricFilter{UTMCampaign: "back_to_school", From: from, To: from}, 10, 0)
+	require.NoError(t, err)
+	assert.Len(t, current, 1)
+}
+
+func TestInMemoryRepository_KeepsOneMetricPerAttributionModel(t *testing.T) {
+	repo := NewInMemoryRepository()
+
+	// La misma fila de anuncios atribuida con dos modelos no debe sobrescribirse.
+	lastTouch := sampleMetric("2025-08-01", "C-1001", 1)
+	lastTouch.AttributionModel = "last_touch"
+	linear := sampleMetric("2025-08-01", "C-1001", 1)
+	linear.AttributionModel = "linear"
+	require.NoError(t, repo.Save(lastTouch))
+	require.NoError(t, repo.Save(linear))
+
+	from, _ := time.Parse("2006-01-02", "2025-08-01")
+	all, err := repo.GetMetricsByChannel(MetricFilter{Channel: "google_ads", From: from, To: from}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	assert.Equal(t, "last_touch", all[0].AttributionModel)
+
+	page, err := repo.GetMetricsPage(MetricFilter{Channel: "google_ads", AttributionModel: "linear", From: from, To: from}, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, page.Metrics, 1)
+	assert.Equal(t, "linear", page.Metrics[0].AttributionModel)
+}
+
+func TestInMemoryRepository_UnlabeledMetricsBelongToDefaultModel(t *testing.T) {
+	repo := NewInMemoryRepository()
+
+	// Métricas guardadas antes de guardar una por modelo: no tienen modelo.
+	require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1001", 1)))
+	require.NoError(t, repo.Save(sampleMetric("2025-08-02", "C-1001", 2)))
+
+	from, _ := time.Parse("2006-01-02", "2025-08-01")
+	to, _ := time.Parse("2006-01-02", "2025-08-02")
+	filter := MetricFilter{Channel: "google_ads", AttributionModel: "last_touch", DefaultModel: "last_touch", From: from, To: to}
+
+	page, err := repo.GetMetricsPage(filter, nil, 10)
+	require.NoError(t, err)
+	assert.Len(t, page.Metrics, 2)
+	other := filter
+	other.AttributionModel = "linear"
+	page, err = repo.GetMetricsPage(other, nil, 10)
+	require.NoError(t, err)
+	assert.Empty(t, page.Metrics)
+
+	// Al recalcular la fila con un modelo, sustituye a la métrica sin modelo en lugar de sumarse a ella.
+	recomputed := sampleMetric("2025-08-01", "C-1001", 5)
+	recomputed.AttributionModel = "last_touch"
+	require.NoError(t, repo.Save(recomputed))
+
+	legacy, err := repo.GetMetricsByChannel(filter, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, legacy, 2)
+	assert.Equal(t, 5, legacy[0].Clicks)
+
+	rows, err := repo.Aggregate(filter, []GroupByField{GroupByAttributionModel})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, "last_touch", rows[0].Group["attribution_model"])
+	assert.Equal(t, 7, rows[0].Clicks)
+}
+
+// BenchmarkInMemoryRepository_GetMetricsByChannel consulta siempre el mismo canal de 100 filas
+// mientras crece el resto del almacén: el coste por consulta debe mantenerse constante.
+func BenchmarkInMemoryRepository_GetMetricsByChannel(b *testing.B) {
+	from, _ := time.Parse("2006-01-02", "2025-01-01")
+	to := from.AddDate(0, 0, 99)
+
+	for _, total := range []int{1_000, 10_000, 100_000} {
+		b.Run(fmt.Sprintf("store=%d", total), func(b *testing.B) {
+			repo := NewInMemoryRepository()
+			for i := 0; i < total; i++ {
+				channel := fmt.Sprintf("channel_%d", i%(total/100))
+				repo.Save(EnrichedMetric{
+					Date:       from.AddDate(0, 0, i/(total/100)),
+					CampaignID: fmt.Sprintf("C-%d", i),
+					Channel:    channel,
+				})
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := repo.GetMetricsByChannel(MetricFilter{Channel: "channel_0", From: from, To: to}, 10, 50); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestInMemoryRepository_GetMetricsPage_StableAcrossWrites(t *testing.T) {
+	repo := NewInMemoryRepository()
+	for _, m := range []EnrichedMetric{
+		sampleMetric("2025-08-01", "C-1001", 1),
+		sampleMetric("2025-08-02", "C-1001", 2),
+		sampleMetric("2025-08-03", "C-1001", 3),
+	} {
+		require.NoError(t, repo.Save(m))
+	}
+
+	from, _ := time.Parse("2006-01-02", "2025-08-01")
+	to, _ := time.Parse("2006-01-02", "2025-08-31")
+	filter := MetricFilter{Channel: "google_ads", From: from, To: to}
+
+	first, err := repo.GetMetricsPage(filter, nil, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 3, first.Total)
+	require.Len(t, first.Metrics, 2)
+	require.NotNil(t, first.Next)
+
+	// Una ingesta entre páginas inserta una fila anterior al cursor: no debe desplazar la página siguiente.
+	require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1000", 0)))
+
+	second, err := repo.GetMetricsPage(filter, first.Next, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 4, second.Total)
+	require.Len(t, second.Metrics, 1)
+	assert.Equal(t, 3, second.Metrics[0].Clicks)
+	assert.Nil(t, second.Next)
+}
+
+func TestInMemoryRepository_ComparesCalendarDates(t *testing.T) {
+	repo := NewInMemoryRepository()
+	for _, m := range []EnrichedMetric{
+		sampleMetric("2025-07-31", "C-1001", 1),
+		sampleMetric("2025-08-01", "C-1001", 2),
+		sampleMetric("2025-08-02", "C-1001", 3),
+	} {
+		require.NoError(t, repo.Save(m))
+	}
+
+	// Un día interpretado en una zona con desfase (medianoche local) incluye las métricas de ese día calendario,
+	// tanto al oeste como al este de UTC.
+	for _, name := range []string{"America/Mexico_City", "Europe/Madrid"} {
+		loc, err := time.LoadLocation(name)
+		require.NoError(t, err)
+		day, _ := time.ParseInLocation("2006-01-02", "2025-08-01", loc)
+
+		page, err := repo.GetMetricsPage(MetricFilter{Channel: "google_ads", From: day, To: day}, nil, 10)
+		require.NoError(t, err)
+		require.Len(t, page.Metrics, 1, name)
+		assert.Equal(t, 2, page.Metrics[0].Clicks, name)
+
+		legacy, err := repo.GetMetricsByChannel(MetricFilter{Channel: "google_ads", From: day, To: day}, 10, 0)
+		require.NoError(t, err)
+		require.Len(t, legacy, 1, name)
+
+		byDate, err := repo.GetMetricsByDate(day, "")
+		require.NoError(t, err)
+		require.Len(t, byDate, 1, name)
+	}
+
+	// Una métrica guardada con una fecha local se guarda como su día calendario.
+	loc, _ := time.LoadLocation("Europe/Madrid")
+	local := sampleMetric("2025-08-03", "C-1001", 4)
+	local.Date = time.Date(2025, 8, 3, 0, 0, 0, 0, loc)
+	require.NoError(t, repo.Save(local))
+	byDate, err := repo.GetMetricsByDate(time.Date(2025, 8, 3, 0, 0, 0, 0, time.UTC), "")
+	require.NoError(t, err)
+	require.Len(t, byDate, 1)
+	assert.Equal(t, time.UTC, byDate[0].Date.Location())
+}
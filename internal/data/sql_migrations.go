@@ -0,0 +1,252 @@
+// Package data internal/data/sql_migrations.go
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// migration es un paso versionado del esquema SQL.
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// migrations contiene el historial del esquema, en orden. Nunca se edita una migración ya publicada:
+// los cambios se añaden como una versión nueva al final.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create enriched_metrics",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS enriched_metrics (
+				date              TEXT NOT NULL,
+				campaign_id       TEXT NOT NULL,
+				channel           TEXT NOT NULL,
+				utm_campaign      TEXT NOT NULL DEFAULT '',
+				utm_source        TEXT NOT NULL DEFAULT '',
+				utm_medium        TEXT NOT NULL DEFAULT '',
+				clicks            INTEGER NOT NULL DEFAULT 0,
+				impressions       INTEGER NOT NULL DEFAULT 0,
+				cost              DOUBLE PRECISION NOT NULL DEFAULT 0,
+				leads             INTEGER NOT NULL DEFAULT 0,
+				opportunities     INTEGER NOT NULL DEFAULT 0,
+				closed_won        INTEGER NOT NULL DEFAULT 0,
+				revenue           DOUBLE PRECISION NOT NULL DEFAULT 0,
+				cpc               DOUBLE PRECISION NOT NULL DEFAULT 0,
+				cpa               DOUBLE PRECISION NOT NULL DEFAULT 0,
+				cvr_lead_to_opp   DOUBLE PRECISION NOT NULL DEFAULT 0,
+				cvr_opp_to_won    DOUBLE PRECISION NOT NULL DEFAULT 0,
+				roas              DOUBLE PRECISION NOT NULL DEFAULT 0,
+				lead_credit       DOUBLE PRECISION NOT NULL DEFAULT 0,
+				closed_won_credit DOUBLE PRECISION NOT NULL DEFAULT 0,
+				attribution_model TEXT NOT NULL DEFAULT '',
+				CONSTRAINT enriched_metrics_key UNIQUE (date, campaign_id, channel, attribution_model)
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_enriched_metrics_channel_date ON enriched_metrics (channel, date)`,
+			`CREATE INDEX IF NOT EXISTS idx_enriched_metrics_utm_campaign_date ON enriched_metrics (utm_campaign, date)`,
+		},
+	},
+	{
+		version:     2,
+		description: "create ingest_watermarks",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS ingest_watermarks (
+				source     TEXT PRIMARY KEY,
+				watermark  TEXT NOT NULL,
+				updated_at TEXT NOT NULL
+			)`,
+		},
+	},
+	{
+		version:     3,
+		description: "create ingest_quarantine",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS ingest_quarantine (
+				id         TEXT PRIMARY KEY,
+				kind       TEXT NOT NULL,
+				source     TEXT NOT NULL,
+				record     TEXT NOT NULL,
+				correction TEXT NOT NULL DEFAULT '',
+				reasons    TEXT NOT NULL,
+				status     TEXT NOT NULL,
+				first_seen TEXT NOT NULL,
+				last_seen  TEXT NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_ingest_quarantine_last_seen ON ingest_quarantine (last_seen)`,
+		},
+	},
+	{
+		version:     4,
+		description: "add funnel to enriched_metrics",
+		statements: []string{
+			`ALTER TABLE enriched_metrics ADD COLUMN opportunity_credit DOUBLE PRECISION NOT NULL DEFAULT 0`,
+			`ALTER TABLE enriched_metrics ADD COLUMN funnel TEXT NOT NULL DEFAULT ''`,
+			// Antes del funnel configurable toda oportunidad contaba como lead.
+			`UPDATE enriched_metrics SET opportunity_credit = lead_credit`,
+		},
+	},
+	{
+		version:     5,
+		description: "create join_reports",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS join_reports (
+				run_id       TEXT PRIMARY KEY,
+				generated_at TEXT NOT NULL,
+				report       TEXT NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_join_reports_generated_at ON join_reports (generated_at)`,
+		},
+	},
+	{
+		version:     6,
+		description: "add currency to enriched_metrics",
+		statements: []string{
+			`ALTER TABLE enriched_metrics ADD COLUMN currency TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE enriched_metrics ADD COLUMN original_cost TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE enriched_metrics ADD COLUMN original_revenue TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version:     7,
+		description: "create export_dead_letters",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS export_dead_letters (
+				id         TEXT PRIMARY KEY,
+				date       TEXT NOT NULL,
+				batch      INTEGER NOT NULL,
+				metrics    INTEGER NOT NULL,
+				payload    TEXT NOT NULL,
+				attempts   INTEGER NOT NULL,
+				last_error TEXT NOT NULL DEFAULT '',
+				status     TEXT NOT NULL,
+				created_at TEXT NOT NULL,
+				updated_at TEXT NOT NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_export_dead_letters_status ON export_dead_letters (status, updated_at)`,
+		},
+	},
+	{
+		version:     8,
+		description: "create export_outbox",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS export_outbox (
+				id           TEXT PRIMARY KEY,
+				date         TEXT NOT NULL,
+				campaign_id  TEXT NOT NULL,
+				channel      TEXT NOT NULL,
+				hash         TEXT NOT NULL,
+				metric       TEXT NOT NULL DEFAULT '',
+				status       TEXT NOT NULL,
+				attempts     INTEGER NOT NULL DEFAULT 0,
+				last_error   TEXT NOT NULL DEFAULT '',
+				enqueued_at  TEXT NOT NULL,
+				updated_at   TEXT NOT NULL,
+				delivered_at TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_export_outbox_status ON export_outbox (status, enqueued_at)`,
+		},
+	},
+	{
+		version:     9,
+		description: "create export_deliveries",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS export_deliveries (
+				idempotency_key TEXT PRIMARY KEY,
+				date            TEXT NOT NULL,
+				batch           INTEGER NOT NULL,
+				metrics         INTEGER NOT NULL,
+				delivered_at    TEXT NOT NULL
+			)`,
+		},
+	},
+	{
+		version:     10,
+		description: "track export dead letters and deliveries per sink",
+		statements: []string{
+			`ALTER TABLE export_dead_letters ADD COLUMN sink TEXT NOT NULL DEFAULT 'http'`,
+			`CREATE TABLE IF NOT EXISTS export_sink_deliveries (
+				sink            TEXT NOT NULL,
+				idempotency_key TEXT NOT NULL,
+				date            TEXT NOT NULL,
+				batch           INTEGER NOT NULL,
+				metrics         INTEGER NOT NULL,
+				delivered_at    TEXT NOT NULL,
+				PRIMARY KEY (sink, idempotency_key)
+			)`,
+			`INSERT INTO export_sink_deliveries (sink, idempotency_key, date, batch, metrics, delivered_at)
+				SELECT 'http', idempotency_key, date, batch, metrics, delivered_at FROM export_deliveries`,
+			`DROP TABLE export_deliveries`,
+		},
+	},
+	{
+		version:     11,
+		description: "track outbox deliveries per sink",
+		statements: []string{
+			`ALTER TABLE export_outbox ADD COLUMN delivered_to TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+}
+
+// Migrate aplica sobre la base de datos las migraciones pendientes, cada una en su propia transacción.
+func Migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version     INTEGER PRIMARY KEY,
+		description TEXT NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	// Recupera las versiones ya aplicadas.
+	rows, err := db.Query(`SELECT version FROM schema_migrations`)
+	if err != nil {
+		return fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan schema version: %w", err)
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return err
+		}
+		log.Printf("INFO: Applied schema migration %d (%s).", m.version, m.description)
+	}
+	return nil
+}
+
+// applyMigration ejecuta una migración y registra su versión de forma atómica.
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin migration %d: %w", m.version, err)
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range m.statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("migration %d failed: %w", m.version, err)
+		}
+	}
+	// Se usan literales en lugar de placeholders para no depender del dialecto del driver.
+	record := fmt.Sprintf(`INSERT INTO schema_migrations (version, description) VALUES (%d, '%s')`, m.version, m.description)
+	if _, err := tx.Exec(record); err != nil {
+		return fmt.Errorf("failed to record migration %d: %w", m.version, err)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,464 @@
+// Package data internal/data/sql_repository.go
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQLDialect describe las diferencias de sintaxis entre drivers de database/sql.
+type SQLDialect struct {
+	Name string
+	// Placeholder devuelve el marcador del parámetro n-ésimo (empezando en 1).
+	Placeholder func(n int) string
+	// WeekStart devuelve una expresión con el lunes de la semana de una columna de fecha, como YYYY-MM-DD.
+	WeekStart func(column string) string
+}
+
+var (
+	// DialectSQLite usa marcadores posicionales "?" (SQLite, MySQL).
+	DialectSQLite = SQLDialect{
+		Name:        "sqlite",
+		Placeholder: func(int) string { return "?" },
+		WeekStart:   func(column string) string { return fmt.Sprintf("date(%s, '-6 days', 'weekday 1')", column) },
+	}
+	// DialectPostgres usa marcadores numerados "$n".
+	DialectPostgres = SQLDialect{
+		Name:        "postgres",
+		Placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+		WeekStart: func(column string) string {
+			return fmt.Sprintf("to_char(date_trunc('week', %s::date), 'YYYY-MM-DD')", column)
+		},
+	}
+)
+
+// DialectForDriver devuelve el dialecto adecuado para un nombre de driver registrado.
+func DialectForDriver(driver string) SQLDialect {
+	switch driver {
+	case "postgres", "pgx":
+		return DialectPostgres
+	default:
+		return DialectSQLite
+	}
+}
+
+// metricColumns es el orden de columnas usado en inserciones y lecturas de enriched_metrics.
+var metricColumns = []string{
+	"date", "campaign_id", "channel", "utm_campaign", "utm_source", "utm_medium",
+	"clicks", "impressions", "cost", "leads", "opportunities", "closed_won", "revenue",
+	"cpc", "cpa", "cvr_lead_to_opp", "cvr_opp_to_won", "roas",
+	"lead_credit", "closed_won_credit", "attribution_model", "opportunity_credit", "funnel",
+	"currency", "original_cost", "original_revenue",
+}
+
+// metricKeyColumns forman la clave única; coinciden con la clave de Save en InMemoryRepository.
+var metricKeyColumns = []string{"date", "campaign_id", "channel", "attribution_model"}
+
+// metricOrder es el orden determinista de las consultas, el mismo que el de InMemoryRepository.
+const metricOrder = "date, campaign_id, channel, attribution_model"
+
+// SQLRepository es una implementación del Repositorio sobre database/sql.
+// Es independiente del driver: sólo requiere soporte para INSERT ... ON CONFLICT.
+type SQLRepository struct {
+	db      *sql.DB
+	dialect SQLDialect
+	repositoryOptions
+}
+
+// NewSQLRepository crea un repositorio SQL y aplica las migraciones pendientes.
+func NewSQLRepository(db *sql.DB, dialect SQLDialect, opts ...RepositoryOption) (*SQLRepository, error) {
+	if err := Migrate(db); err != nil {
+		return nil, err
+	}
+	r := &SQLRepository{db: db, dialect: dialect}
+	for _, opt := range opts {
+		opt(&r.repositoryOptions)
+	}
+	return r, nil
+}
+
+// Save inserta la métrica o actualiza la existente con la misma clave (fecha, campaña, canal, modelo) y, si cambió
+// y es del modelo que se exporta, encola su nueva versión en export_outbox en la misma transacción.
+func (r *SQLRepository) Save(metric EnrichedMetric) error {
+	record, err := newOutboxRecord(metric, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	placeholders := make([]string, len(metricColumns))
+	for i := range metricColumns {
+		placeholders[i] = r.dialect.Placeholder(i + 1)
+	}
+
+	var updates []string
+	for _, col := range metricColumns {
+		if !slices.Contains(metricKeyColumns, col) {
+			updates = append(updates, fmt.Sprintf("%s = excluded.%s", col, col))
+		}
+	}
+
+	query := fmt.Sprintf(
+		"INSERT INTO enriched_metrics (%s) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET %s",
+		strings.Join(metricColumns, ", "),
+		strings.Join(placeholders, ", "),
+		strings.Join(metricKeyColumns, ", "),
+		strings.Join(updates, ", "),
+	)
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin metric upsert: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(query, metricValues(metric)...); err != nil {
+		return fmt.Errorf("failed to upsert metric: %w", err)
+	}
+	// Una métrica con modelo sustituye a la guardada sin modelo para la misma fila, como en InMemoryRepository.
+	if metric.AttributionModel != "" {
+		p := r.dialect.Placeholder
+		unlabeled := fmt.Sprintf("DELETE FROM enriched_metrics WHERE date = %s AND campaign_id = %s AND channel = %s AND attribution_model = ''", p(1), p(2), p(3))
+		if _, err := tx.Exec(unlabeled, formatSQLDate(metric.Date), metric.CampaignID, metric.Channel); err != nil {
+			return fmt.Errorf("failed to replace unlabeled metric: %w", err)
+		}
+	}
+	if r.exports(metric) {
+		if err := r.insertOutbox(tx, record); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit metric upsert: %w", err)
+	}
+	return nil
+}
+
+// GetMetricsByChannel obtiene las métricas del canal filter.Channel que cumplen el filtro, con paginación.
+func (r *SQLRepository) GetMetricsByChannel(filter MetricFilter, limit, offset int) ([]EnrichedMetric, error) {
+	return r.queryPage(filter, limit, offset)
+}
+
+// GetMetricsByFunnel obtiene las métricas de la campaña UTM filter.UTMCampaign que cumplen el filtro, con paginación.
+func (r *SQLRepository) GetMetricsByFunnel(filter MetricFilter, limit, offset int) ([]EnrichedMetric, error) {
+	return r.queryPage(filter, limit, offset)
+}
+
+// GetMetricsByDate devuelve las métricas de un día concreto y un modelo.
+func (r *SQLRepository) GetMetricsByDate(date time.Time, model string) ([]EnrichedMetric, error) {
+	p := r.dialect.Placeholder
+	where := fmt.Sprintf("date = %s", p(1))
+	args := []interface{}{formatSQLDate(date)}
+	if model != "" {
+		args = append(args, model)
+		where += fmt.Sprintf(" AND (attribution_model = %s OR attribution_model = '')", p(2))
+	}
+	query := fmt.Sprintf("SELECT %s FROM enriched_metrics WHERE %s ORDER BY %s",
+		strings.Join(metricColumns, ", "), where, metricOrder)
+	return r.query(query, args...)
+}
+
+// GetMetricsPage obtiene una página de métricas filtradas posterior al cursor indicado (paginación keyset).
+func (r *SQLRepository) GetMetricsPage(filter MetricFilter, after *MetricCursor, limit int) (MetricPage, error) {
+	if limit <= 0 {
+		return MetricPage{}, fmt.Errorf("limit must be positive, got %d", limit)
+	}
+
+	where, args := r.filterClause(filter)
+
+	// Total de filas que cumplen el filtro, sin paginar.
+	page := MetricPage{}
+	countQuery := "SELECT COUNT(*) FROM enriched_metrics WHERE " + where
+	if err := r.db.QueryRow(countQuery, args...).Scan(&page.Total); err != nil {
+		return page, fmt.Errorf("failed to count metrics: %w", err)
+	}
+
+	// Compara la tupla (date, campaign_id, channel, attribution_model) de forma expandida, válida en cualquier motor.
+	if after != nil {
+		p := r.dialect.Placeholder
+		n := len(args)
+		where += fmt.Sprintf(" AND (date > %s OR (date = %s AND (campaign_id > %s OR (campaign_id = %s AND "+
+			"(channel > %s OR (channel = %s AND attribution_model > %s))))))",
+			p(n+1), p(n+2), p(n+3), p(n+4), p(n+5), p(n+6), p(n+7))
+		d := formatSQLDate(after.Date)
+		args = append(args, d, d, after.CampaignID, after.CampaignID, after.Channel, after.Channel, after.AttributionModel)
+	}
+
+	// Se pide una fila extra para saber si existe una página siguiente.
+	query := fmt.Sprintf("SELECT %s FROM enriched_metrics WHERE %s ORDER BY %s LIMIT %s",
+		strings.Join(metricColumns, ", "), where, metricOrder, r.dialect.Placeholder(len(args)+1))
+	metrics, err := r.query(query, append(args, limit+1)...)
+	if err != nil {
+		return page, err
+	}
+	if len(metrics) > limit {
+		metrics = metrics[:limit]
+		next := CursorFor(metrics[limit-1])
+		page.Next = &next
+	}
+	page.Metrics = metrics
+	return page, nil
+}
+
+// filterClause construye la condición WHERE y sus argumentos para un MetricFilter.
+func (r *SQLRepository) filterClause(filter MetricFilter) (string, []interface{}) {
+	p := r.dialect.Placeholder
+	where := fmt.Sprintf("date >= %s AND date <= %s", p(1), p(2))
+	args := []interface{}{formatSQLDate(filter.From), formatSQLDate(filter.To)}
+	if filter.Channel != "" {
+		args = append(args, filter.Channel)
+		where += fmt.Sprintf(" AND channel = %s", p(len(args)))
+	}
+	if filter.UTMCampaign != "" {
+		args = append(args, filter.UTMCampaign)
+		where += fmt.Sprintf(" AND utm_campaign = %s", p(len(args)))
+	}
+	if filter.AttributionModel != "" {
+		args = append(args, filter.AttributionModel)
+		if filter.AttributionModel == filter.DefaultModel {
+			// Las métricas guardadas sin modelo son del modelo por defecto.
+			where += fmt.Sprintf(" AND (attribution_model = %s OR attribution_model = '')", p(len(args)))
+		} else {
+			where += fmt.Sprintf(" AND attribution_model = %s", p(len(args)))
+		}
+	}
+	return where, args
+}
+
+// Aggregate agrupa y suma las métricas en la propia base de datos, recalculando los ratios desde los totales.
+func (r *SQLRepository) Aggregate(filter MetricFilter, groupBy []GroupByField) ([]AggregateRow, error) {
+	exprs := make([]string, len(groupBy))
+	for i, field := range groupBy {
+		switch field {
+		case GroupByWeek:
+			exprs[i] = r.dialect.WeekStart("date")
+		case GroupByMonth:
+			exprs[i] = "substr(date, 1, 7)"
+		case GroupByAttributionModel:
+			// Las métricas sin modelo se agrupan con el modelo por defecto.
+			exprs[i] = fmt.Sprintf("CASE WHEN attribution_model = '' THEN '%s' ELSE attribution_model END",
+				strings.ReplaceAll(filter.DefaultModel, "'", "''"))
+		case GroupByDate, GroupByChannel, GroupByCampaignID, GroupByUTMCampaign, GroupByUTMSource, GroupByUTMMedium:
+			exprs[i] = string(field)
+		default:
+			return nil, fmt.Errorf("unknown group_by field: %q", field)
+		}
+	}
+
+	where, args := r.filterClause(filter)
+	groupList := strings.Join(exprs, ", ")
+	query := fmt.Sprintf(`SELECT %s,
+		COALESCE(SUM(clicks), 0), COALESCE(SUM(impressions), 0), COALESCE(SUM(cost), 0),
+		COALESCE(SUM(leads), 0), COALESCE(SUM(opportunities), 0), COALESCE(SUM(closed_won), 0),
+		COALESCE(SUM(revenue), 0), COALESCE(SUM(lead_credit), 0), COALESCE(SUM(CASE WHEN funnel = '' THEN lead_credit ELSE opportunity_credit END), 0),
+		COALESCE(SUM(closed_won_credit), 0)
+		FROM enriched_metrics WHERE %s GROUP BY %s ORDER BY %s`, groupList, where, groupList, groupList)
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate metrics: %w", err)
+	}
+	defer rows.Close()
+
+	result := []AggregateRow{}
+	for rows.Next() {
+		values := make([]string, len(groupBy))
+		row := AggregateRow{Group: make(map[string]string, len(groupBy))}
+		dest := make([]interface{}, 0, len(groupBy)+10)
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		dest = append(dest, &row.Clicks, &row.Impressions, &row.Cost, &row.Leads, &row.Opportunities,
+			&row.ClosedWon, &row.Revenue, &row.LeadCredit, &row.OpportunityCredit, &row.ClosedWonCredit)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("failed to scan aggregate: %w", err)
+		}
+		for i, field := range groupBy {
+			row.Group[string(field)] = values[i]
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read aggregates: %w", err)
+	}
+	rows.Close()
+
+	if err := r.aggregateFunnel(result, groupBy, exprs, where, args); err != nil {
+		return nil, err
+	}
+	for i := range result {
+		result[i].computeRatios()
+	}
+	return result, nil
+}
+
+// aggregateFunnel suma el funnel de las métricas filtradas en las filas ya agrupadas. El funnel se guarda
+// como JSON, así que se lee métrica a métrica y se suma fuera de la base de datos.
+func (r *SQLRepository) aggregateFunnel(result []AggregateRow, groupBy []GroupByField, exprs []string, where string, args []interface{}) error {
+	index := make(map[string]int, len(result))
+	for i, row := range result {
+		values := make([]string, len(groupBy))
+		for j, field := range groupBy {
+			values[j] = row.Group[string(field)]
+		}
+		index[strings.Join(values, "\x00")] = i
+	}
+
+	query := fmt.Sprintf("SELECT %s, funnel FROM enriched_metrics WHERE %s AND funnel <> '' ORDER BY %s",
+		strings.Join(exprs, ", "), where, metricOrder)
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to aggregate funnel: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		values := make([]string, len(groupBy))
+		var raw string
+		dest := make([]interface{}, 0, len(groupBy)+1)
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(append(dest, &raw)...); err != nil {
+			return fmt.Errorf("failed to scan funnel: %w", err)
+		}
+		steps, err := decodeFunnel(raw)
+		if err != nil {
+			return err
+		}
+		if i, ok := index[strings.Join(values, "\x00")]; ok {
+			result[i].Funnel = mergeFunnel(result[i].Funnel, steps)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read funnel: %w", err)
+	}
+	return nil
+}
+
+// GetAllMetrics devuelve todas las métricas almacenadas en el repositorio.
+func (r *SQLRepository) GetAllMetrics() ([]EnrichedMetric, error) {
+	query := fmt.Sprintf("SELECT %s FROM enriched_metrics ORDER BY %s", strings.Join(metricColumns, ", "), metricOrder)
+	return r.query(query)
+}
+
+// queryPage filtra con un MetricFilter y pagina con límite y desplazamiento en la propia base de datos.
+func (r *SQLRepository) queryPage(filter MetricFilter, limit, offset int) ([]EnrichedMetric, error) {
+	where, args := r.filterClause(filter)
+	p := r.dialect.Placeholder
+	query := fmt.Sprintf("SELECT %s FROM enriched_metrics WHERE %s ORDER BY %s LIMIT %s OFFSET %s",
+		strings.Join(metricColumns, ", "), where, metricOrder, p(len(args)+1), p(len(args)+2))
+	return r.query(query, append(args, limit, offset)...)
+}
+
+// query ejecuta una consulta y escanea las filas como métricas.
+func (r *SQLRepository) query(query string, args ...interface{}) ([]EnrichedMetric, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query metrics: %w", err)
+	}
+	defer rows.Close()
+
+	metrics := []EnrichedMetric{}
+	for rows.Next() {
+		m, err := scanMetric(rows)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read metrics: %w", err)
+	}
+	return metrics, nil
+}
+
+// metricValues devuelve los valores de la métrica en el orden de metricColumns.
+func metricValues(m EnrichedMetric) []interface{} {
+	return []interface{}{
+		formatSQLDate(m.Date), m.CampaignID, m.Channel, m.UTMCampaign, m.UTMSource, m.UTMMedium,
+		m.Clicks, m.Impressions, m.Cost, m.Leads, m.Opportunities, m.ClosedWon, m.Revenue,
+		m.CPC, m.CPA, m.CVRLeadToOpp, m.CVROppToWon, m.ROAS,
+		m.LeadCredit, m.ClosedWonCredit, m.AttributionModel, m.OpportunityCredit, encodeFunnel(m.Funnel),
+		m.Currency, encodeJSONColumn(m.OriginalCost), encodeJSONColumn(m.OriginalRevenue),
+	}
+}
+
+// encodeJSONColumn serializa un valor opcional como JSON; vacío si es nil.
+func encodeJSONColumn(v interface{}) string {
+	raw, _ := json.Marshal(v)
+	if string(raw) == "null" {
+		return ""
+	}
+	return string(raw)
+}
+
+// decodeJSONColumn lee en dst un valor guardado con encodeJSONColumn; vacío lo deja sin cambios.
+func decodeJSONColumn(raw, column string, dst interface{}) error {
+	if raw == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(raw), dst); err != nil {
+		return fmt.Errorf("invalid stored %s: %w", column, err)
+	}
+	return nil
+}
+
+// encodeFunnel serializa las etapas del funnel como JSON; vacío si la métrica no tiene funnel.
+func encodeFunnel(steps []FunnelStep) string {
+	if steps == nil {
+		return ""
+	}
+	raw, _ := json.Marshal(steps)
+	return string(raw)
+}
+
+// decodeFunnel lee las etapas del funnel guardadas con encodeFunnel.
+func decodeFunnel(raw string) ([]FunnelStep, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	var steps []FunnelStep
+	if err := json.Unmarshal([]byte(raw), &steps); err != nil {
+		return nil, fmt.Errorf("invalid stored funnel: %w", err)
+	}
+	return steps, nil
+}
+
+// scanMetric lee una fila con las columnas de metricColumns.
+func scanMetric(rows *sql.Rows) (EnrichedMetric, error) {
+	var m EnrichedMetric
+	var date, funnel, originalCost, originalRevenue string
+	err := rows.Scan(
+		&date, &m.CampaignID, &m.Channel, &m.UTMCampaign, &m.UTMSource, &m.UTMMedium,
+		&m.Clicks, &m.Impressions, &m.Cost, &m.Leads, &m.Opportunities, &m.ClosedWon, &m.Revenue,
+		&m.CPC, &m.CPA, &m.CVRLeadToOpp, &m.CVROppToWon, &m.ROAS,
+		&m.LeadCredit, &m.ClosedWonCredit, &m.AttributionModel, &m.OpportunityCredit, &funnel,
+		&m.Currency, &originalCost, &originalRevenue,
+	)
+	if err != nil {
+		return m, fmt.Errorf("failed to scan metric: %w", err)
+	}
+	if err := decodeJSONColumn(originalCost, "original_cost", &m.OriginalCost); err != nil {
+		return m, err
+	}
+	if err := decodeJSONColumn(originalRevenue, "original_revenue", &m.OriginalRevenue); err != nil {
+		return m, err
+	}
+	if m.Funnel, err = decodeFunnel(funnel); err != nil {
+		return m, err
+	}
+	m.Date, err = time.Parse("2006-01-02", date)
+	if err != nil {
+		return m, fmt.Errorf("invalid stored date %q: %w", date, err)
+	}
+	return m, nil
+}
+
+// formatSQLDate guarda las fechas como texto YYYY-MM-DD, que ordena y compara igual en cualquier motor.
+// Se formatea el día calendario en la zona de t, como hace CalendarDate en el repositorio en memoria.
+func formatSQLDate(t time.Time) string {
+	return t.Format("2006-01-02")
+}
@@ -0,0 +1,162 @@
+package data
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+func newTestSQLRepository(t *testing.T) *SQLRepository {
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1) // Cada conexión a ":memory:" abre una base de datos distinta.
+	t.Cleanup(func() { db.Close() })
+
+	repo, err := NewSQLRepository(db, DialectSQLite)
+	require.NoError(t, err)
+	return repo
+}
+
+func TestSQLRepository_UpsertAndQuery(t *testing.T) {
+	repo := newTestSQLRepository(t)
+
+	require.NoError(t, repo.Save(sampleMetric("2025-08-02", "C-1002", 20)))
+	require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1001", 10)))
+	require.NoError(t, repo.Save(sampleMetric("2025-08-03", "C-1001", 30)))
+	// Misma clave (fecha, campaña, canal): actualiza en lugar de duplicar.
+	require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1001", 15)))
+
+	all, err := repo.GetAllMetrics()
+	require.NoError(t, err)
+	assert.Len(t, all, 3)
+
+	from, _ := time.Parse("2006-01-02", "2025-08-01")
+	to, _ := time.Parse("2006-01-02", "2025-08-02")
+
+	metrics, err := repo.GetMetricsByChannel(MetricFilter{Channel: "google_ads", From: from, To: to}, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, from, metrics[0].Date)
+	assert.Equal(t, 15, metrics[0].Clicks)
+	assert.Equal(t, "C-1002", metrics[1].CampaignID)
+
+	// La paginación se resuelve en SQL.
+	page, err := repo.GetMetricsByFunnel(MetricFilter{UTMCampaign: "summer_sale", From: from, To: to}, 1, 1)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	assert.Equal(t, "C-1002", page[0].CampaignID)
+}
+
+func TestSQLRepository_UnlabeledMetricsBelongToDefaultModel(t *testing.T) {
+	repo := newTestSQLRepository(t)
+
+	require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1001", 1)))
+	require.NoError(t, repo.Save(sampleMetric("2025-08-02", "C-1001", 2)))
+	recomputed := sampleMetric("2025-08-01", "C-1001", 5)
+	recomputed.AttributionModel = "last_touch"
+	require.NoError(t, repo.Save(recomputed))
+
+	from, _ := time.Parse("2006-01-02", "2025-08-01")
+	to, _ := time.Parse("2006-01-02", "2025-08-02")
+	filter := MetricFilter{Channel: "google_ads", AttributionModel: "last_touch", DefaultModel: "last_touch", From: from, To: to}
+
+	metrics, err := repo.GetMetricsByChannel(filter, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, 5, metrics[0].Clicks)
+
+	rows, err := repo.Aggregate(filter, []GroupByField{GroupByAttributionModel})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, "last_touch", rows[0].Group["attribution_model"])
+	assert.Equal(t, 7, rows[0].Clicks)
+
+	filter.AttributionModel = "linear"
+	metrics, err = repo.GetMetricsByChannel(filter, 10, 0)
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+}
+
+func TestMigrate_IsIdempotent(t *testing.T) {
+	repo := newTestSQLRepository(t)
+
+	require.NoError(t, Migrate(repo.db))
+
+	var applied int
+	require.NoError(t, repo.db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied))
+	assert.Equal(t, len(migrations), applied)
+}
+
+func TestSQLRepository_GetMetricsPage(t *testing.T) {
+	repo := newTestSQLRepository(t)
+	for _, m := range []EnrichedMetric{
+		sampleMetric("2025-08-01", "C-1001", 1),
+		sampleMetric("2025-08-01", "C-1002", 2),
+		sampleMetric("2025-08-02", "C-1001", 3),
+	} {
+		require.NoError(t, repo.Save(m))
+	}
+
+	from, _ := time.Parse("2006-01-02", "2025-08-01")
+	to, _ := time.Parse("2006-01-02", "2025-08-31")
+	filter := MetricFilter{UTMCampaign: "summer_sale", From: from, To: to}
+
+	var clicks []int
+	var cursor *MetricCursor
+	for {
+		page, err := repo.GetMetricsPage(filter, cursor, 2)
+		require.NoError(t, err)
+		assert.Equal(t, 3, page.Total)
+		for _, m := range page.Metrics {
+			clicks = append(clicks, m.Clicks)
+		}
+		if page.Next == nil {
+			break
+		}
+		cursor = page.Next
+	}
+	assert.Equal(t, []int{1, 2, 3}, clicks)
+}
+
+func TestSQLRepository_RoundTripsCurrency(t *testing.T) {
+	repo := newTestSQLRepository(t)
+
+	converted := sampleMetric("2025-08-01", "C-1001", 10)
+	converted.Currency = "USD"
+	converted.OriginalCost = &FXAmount{Currency: "EUR", Amount: 80, Rate: 1.25}
+	converted.OriginalRevenue = []FXAmount{{Currency: "MXN", Amount: 2000, Rate: 0.05}}
+	require.NoError(t, repo.Save(converted))
+	require.NoError(t, repo.Save(sampleMetric("2025-08-02", "C-1001", 10)))
+
+	all, err := repo.GetAllMetrics()
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	assert.Equal(t, "USD", all[0].Currency)
+	assert.Equal(t, converted.OriginalCost, all[0].OriginalCost)
+	assert.Equal(t, converted.OriginalRevenue, all[0].OriginalRevenue)
+	// Sin moneda de reporte las columnas quedan vacías.
+	assert.Empty(t, all[1].Currency)
+	assert.Nil(t, all[1].OriginalCost)
+	assert.Nil(t, all[1].OriginalRevenue)
+}
+
+func TestSQLRepository_ComparesCalendarDates(t *testing.T) {
+	repo := newTestSQLRepository(t)
+	require.NoError(t, repo.Save(sampleMetric("2025-07-31", "C-1001", 1)))
+	require.NoError(t, repo.Save(sampleMetric("2025-08-01", "C-1001", 2)))
+	require.NoError(t, repo.Save(sampleMetric("2025-08-02", "C-1001", 3)))
+
+	loc, err := time.LoadLocation("Europe/Madrid")
+	require.NoError(t, err)
+	day, _ := time.ParseInLocation("2006-01-02", "2025-08-01", loc) // 2025-07-31T22:00:00Z
+
+	page, err := repo.GetMetricsPage(MetricFilter{Channel: "google_ads", From: day, To: day}, nil, 10)
+	require.NoError(t, err)
+	require.Len(t, page.Metrics, 1)
+	assert.Equal(t, 2, page.Metrics[0].Clicks)
+}
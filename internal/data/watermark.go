@@ -0,0 +1,300 @@
+// Package data internal/data/watermark.go
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// watermarkLayout es un formato RFC 3339 de ancho fijo en UTC, para que en SQL el orden de texto coincida con el temporal.
+const watermarkLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// Watermark es la marca de agua de una fuente de ingesta: el instante del registro más reciente ya ingestado.
+type Watermark struct {
+	Source    string    `json:"source"`
+	Value     time.Time `json:"watermark"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// WatermarkStore persiste las marcas de agua de ingesta incremental por fuente.
+type WatermarkStore interface {
+	// GetWatermark devuelve la marca de agua de una fuente, o nil si aún no tiene.
+	GetWatermark(source string) (*time.Time, error)
+	// AdvanceWatermark fija la marca de agua de una fuente sólo si es posterior a la actual.
+	AdvanceWatermark(source string, value time.Time) error
+	// ResetWatermark fija la marca de agua de una fuente al valor indicado, aunque retroceda, o la borra si es nil.
+	ResetWatermark(source string, value *time.Time) error
+	// ListWatermarks devuelve todas las marcas de agua ordenadas por fuente.
+	ListWatermarks() ([]Watermark, error)
+}
+
+// InMemoryWatermarkStore guarda las marcas de agua en memoria; se pierden al reiniciar.
+type InMemoryWatermarkStore struct {
+	mu         sync.RWMutex
+	watermarks map[string]Watermark
+}
+
+// NewInMemoryWatermarkStore crea un almacén de marcas de agua vacío.
+func NewInMemoryWatermarkStore() *InMemoryWatermarkStore {
+	return &InMemoryWatermarkStore{watermarks: make(map[string]Watermark)}
+}
+
+// GetWatermark devuelve la marca de agua de una fuente, o nil si aún no tiene.
+func (s *InMemoryWatermarkStore) GetWatermark(source string) (*time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	wm, ok := s.watermarks[source]
+	if !ok {
+		return nil, nil
+	}
+	value := wm.Value
+	return &value, nil
+}
+
+// AdvanceWatermark fija la marca de agua de una fuente sólo si es posterior a la actual.
+func (s *InMemoryWatermarkStore) AdvanceWatermark(source string, value time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance(source, value)
+	return nil
+}
+
+// ResetWatermark fija la marca de agua de una fuente al valor indicado, o la borra si es nil.
+func (s *InMemoryWatermarkStore) ResetWatermark(source string, value *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reset(source, value)
+	return nil
+}
+
+// ListWatermarks devuelve todas las marcas de agua ordenadas por fuente.
+func (s *InMemoryWatermarkStore) ListWatermarks() ([]Watermark, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]Watermark, 0, len(s.watermarks))
+	for _, wm := range s.watermarks {
+		list = append(list, wm)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Source < list[j].Source })
+	return list, nil
+}
+
+// advance aplica AdvanceWatermark; el llamador debe tener el lock.
+func (s *InMemoryWatermarkStore) advance(source string, value time.Time) bool {
+	if current, ok := s.watermarks[source]; ok && !value.After(current.Value) {
+		return false
+	}
+	s.watermarks[source] = Watermark{Source: source, Value: value.UTC(), UpdatedAt: time.Now().UTC()}
+	return true
+}
+
+// reset aplica ResetWatermark; el llamador debe tener el lock.
+func (s *InMemoryWatermarkStore) reset(source string, value *time.Time) {
+	if value == nil {
+		delete(s.watermarks, source)
+		return
+	}
+	s.watermarks[source] = Watermark{Source: source, Value: value.UTC(), UpdatedAt: time.Now().UTC()}
+}
+
+// FileWatermarkStore persiste las marcas de agua en un archivo JSON, reescrito de forma atómica en cada cambio.
+type FileWatermarkStore struct {
+	mem  *InMemoryWatermarkStore
+	path string
+}
+
+// NewFileWatermarkStore abre (o crea) el almacén de marcas de agua en la ruta indicada.
+func NewFileWatermarkStore(path string) (*FileWatermarkStore, error) {
+	s := &FileWatermarkStore{mem: NewInMemoryWatermarkStore(), path: path}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open watermarks: %w", err)
+	}
+	defer f.Close()
+
+	var list []Watermark
+	if err := json.NewDecoder(f).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode watermarks: %w", err)
+	}
+	for _, wm := range list {
+		s.mem.watermarks[wm.Source] = wm
+	}
+	return s, nil
+}
+
+// GetWatermark devuelve la marca de agua de una fuente, o nil si aún no tiene.
+func (s *FileWatermarkStore) GetWatermark(source string) (*time.Time, error) {
+	return s.mem.GetWatermark(source)
+}
+
+// AdvanceWatermark fija la marca de agua de una fuente sólo si es posterior a la actual y la persiste.
+func (s *FileWatermarkStore) AdvanceWatermark(source string, value time.Time) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	if !s.mem.advance(source, value) {
+		return nil
+	}
+	return s.persist()
+}
+
+// ResetWatermark fija o borra la marca de agua de una fuente y la persiste.
+func (s *FileWatermarkStore) ResetWatermark(source string, value *time.Time) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	s.mem.reset(source, value)
+	return s.persist()
+}
+
+// ListWatermarks devuelve todas las marcas de agua ordenadas por fuente.
+func (s *FileWatermarkStore) ListWatermarks() ([]Watermark, error) {
+	return s.mem.ListWatermarks()
+}
+
+// persist reescribe el archivo con el estado actual; el llamador debe tener el lock.
+func (s *FileWatermarkStore) persist() error {
+	list := make([]Watermark, 0, len(s.mem.watermarks))
+	for _, wm := range s.mem.watermarks {
+		list = append(list, wm)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Source < list[j].Source })
+	return writeJSONAtomic(s.path, list)
+}
+
+// writeJSONAtomic escribe v como JSON en un archivo temporal y lo renombra, para no dejar nunca un archivo a medias.
+func writeJSONAtomic(path string, v interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create dir for %s: %w", path, err)
+	}
+	tmpPath := path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmpPath, err)
+	}
+	if err := json.NewEncoder(tmp).Encode(v); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to encode %s: %w", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %w", tmpPath, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to install %s: %w", path, err)
+	}
+	return nil
+}
+
+// SQLWatermarkStore persiste las marcas de agua en la tabla ingest_watermarks, compartida entre réplicas.
+type SQLWatermarkStore struct {
+	db      *sql.DB
+	dialect SQLDialect
+}
+
+// NewSQLWatermarkStore crea el almacén SQL de marcas de agua y aplica las migraciones pendientes.
+func NewSQLWatermarkStore(db *sql.DB, dialect SQLDialect) (*SQLWatermarkStore, error) {
+	if err := Migrate(db); err != nil {
+		return nil, err
+	}
+	return &SQLWatermarkStore{db: db, dialect: dialect}, nil
+}
+
+// GetWatermark devuelve la marca de agua de una fuente, o nil si aún no tiene.
+func (s *SQLWatermarkStore) GetWatermark(source string) (*time.Time, error) {
+	var raw string
+	err := s.db.QueryRow(
+		fmt.Sprintf("SELECT watermark FROM ingest_watermarks WHERE source = %s", s.dialect.Placeholder(1)),
+		source,
+	).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read watermark for %s: %w", source, err)
+	}
+	value, err := time.Parse(watermarkLayout, raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid watermark for %s: %w", source, err)
+	}
+	return &value, nil
+}
+
+// AdvanceWatermark fija la marca de agua de una fuente sólo si es posterior a la actual, en una única sentencia.
+func (s *SQLWatermarkStore) AdvanceWatermark(source string, value time.Time) error {
+	query := fmt.Sprintf(
+		"INSERT INTO ingest_watermarks (source, watermark, updated_at) VALUES (%s, %s, %s) "+
+			"ON CONFLICT (source) DO UPDATE SET watermark = excluded.watermark, updated_at = excluded.updated_at "+
+			"WHERE ingest_watermarks.watermark < excluded.watermark",
+		s.dialect.Placeholder(1), s.dialect.Placeholder(2), s.dialect.Placeholder(3),
+	)
+	if _, err := s.db.Exec(query, source, formatWatermark(value), formatWatermark(time.Now())); err != nil {
+		return fmt.Errorf("failed to advance watermark for %s: %w", source, err)
+	}
+	return nil
+}
+
+// ResetWatermark fija la marca de agua de una fuente al valor indicado, o la borra si es nil.
+func (s *SQLWatermarkStore) ResetWatermark(source string, value *time.Time) error {
+	if value == nil {
+		if _, err := s.db.Exec(fmt.Sprintf("DELETE FROM ingest_watermarks WHERE source = %s", s.dialect.Placeholder(1)), source); err != nil {
+			return fmt.Errorf("failed to reset watermark for %s: %w", source, err)
+		}
+		return nil
+	}
+	query := fmt.Sprintf(
+		"INSERT INTO ingest_watermarks (source, watermark, updated_at) VALUES (%s, %s, %s) "+
+			"ON CONFLICT (source) DO UPDATE SET watermark = excluded.watermark, updated_at = excluded.updated_at",
+		s.dialect.Placeholder(1), s.dialect.Placeholder(2), s.dialect.Placeholder(3),
+	)
+	if _, err := s.db.Exec(query, source, formatWatermark(*value), formatWatermark(time.Now())); err != nil {
+		return fmt.Errorf("failed to reset watermark for %s: %w", source, err)
+	}
+	return nil
+}
+
+// ListWatermarks devuelve todas las marcas de agua ordenadas por fuente.
+func (s *SQLWatermarkStore) ListWatermarks() ([]Watermark, error) {
+	rows, err := s.db.Query("SELECT source, watermark, updated_at FROM ingest_watermarks ORDER BY source")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list watermarks: %w", err)
+	}
+	defer rows.Close()
+
+	list := []Watermark{}
+	for rows.Next() {
+		var wm Watermark
+		var value, updatedAt string
+		if err := rows.Scan(&wm.Source, &value, &updatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan watermark: %w", err)
+		}
+		if wm.Value, err = time.Parse(watermarkLayout, value); err != nil {
+			return nil, fmt.Errorf("invalid watermark for %s: %w", wm.Source, err)
+		}
+		if wm.UpdatedAt, err = time.Parse(watermarkLayout, updatedAt); err != nil {
+			return nil, fmt.Errorf("invalid watermark update time for %s: %w", wm.Source, err)
+		}
+		list = append(list, wm)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list watermarks: %w", err)
+	}
+	return list, nil
+}
+
+// formatWatermark serializa un instante con watermarkLayout en UTC.
+func formatWatermark(t time.Time) string {
+	return t.UTC().Format(watermarkLayout)
+}
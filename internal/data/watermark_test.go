@@ -0,0 +1,80 @@
+package data
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatermarkStores_AdvanceOnlyForwardAndReset(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+	sqlStore, err := NewSQLWatermarkStore(db, DialectSQLite)
+	require.NoError(t, err)
+	fileStore, err := NewFileWatermarkStore(filepath.Join(t.TempDir(), "watermarks.json"))
+	require.NoError(t, err)
+
+	stores := map[string]WatermarkStore{
+		"memory": NewInMemoryWatermarkStore(),
+		"file":   fileStore,
+		"sql":    sqlStore,
+	}
+	aug1 := time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC)
+	aug3 := time.Date(2025, 8, 3, 12, 30, 0, 0, time.UTC)
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			wm, err := store.GetWatermark("ads")
+			require.NoError(t, err)
+			assert.Nil(t, wm)
+
+			require.NoError(t, store.AdvanceWatermark("ads", aug3))
+			require.NoError(t, store.AdvanceWatermark("ads", aug1)) // No retrocede.
+			require.NoError(t, store.AdvanceWatermark("crm", aug1))
+
+			wm, err = store.GetWatermark("ads")
+			require.NoError(t, err)
+			require.NotNil(t, wm)
+			assert.True(t, aug3.Equal(*wm))
+
+			list, err := store.ListWatermarks()
+			require.NoError(t, err)
+			require.Len(t, list, 2)
+			assert.Equal(t, "ads", list[0].Source)
+			assert.Equal(t, "crm", list[1].Source)
+
+			// Reset puede retroceder la marca de agua o borrarla.
+			require.NoError(t, store.ResetWatermark("ads", &aug1))
+			wm, err = store.GetWatermark("ads")
+			require.NoError(t, err)
+			assert.True(t, aug1.Equal(*wm))
+
+			require.NoError(t, store.ResetWatermark("ads", nil))
+			wm, err = store.GetWatermark("ads")
+			require.NoError(t, err)
+			assert.Nil(t, wm)
+		})
+	}
+}
+
+func TestFileWatermarkStore_PersistsAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watermarks.json")
+	store, err := NewFileWatermarkStore(path)
+	require.NoError(t, err)
+
+	value := time.Date(2025, 8, 2, 9, 15, 0, 0, time.UTC)
+	require.NoError(t, store.AdvanceWatermark("crm", value))
+
+	reopened, err := NewFileWatermarkStore(path)
+	require.NoError(t, err)
+	wm, err := reopened.GetWatermark("crm")
+	require.NoError(t, err)
+	require.NotNil(t, wm)
+	assert.True(t, value.Equal(*wm))
+}
@@ -0,0 +1,277 @@
+// Package etl internal/etl/attribution.go
+package etl
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/btors/admira-etl/internal/data"
+)
+
+// AttributionMode define cómo se acreditan las oportunidades de CRM a las filas de Ads.
+type AttributionMode string
+
+const (
+	// AttributionNaive cruza cada oportunidad con todas las filas de Ads que comparten su clave UTM.
+	// Se conserva para poder reproducir los números históricos.
+	AttributionNaive AttributionMode = "naive"
+	// AttributionWindow acredita cada oportunidad una única vez, repartida entre las filas de Ads
+	// con la misma clave UTM cuya fecha cae dentro de la ventana de lookback.
+	AttributionWindow AttributionMode = "window"
+)
+
+// DefaultLookbackDays es la ventana de atribución por defecto, en días.
+const DefaultLookbackDays = 30
+
+// ParseAttributionMode convierte una cadena en un AttributionMode válido.
+func ParseAttributionMode(mode string) (AttributionMode, error) {
+	switch AttributionMode(strings.ToLower(strings.TrimSpace(mode))) {
+	case AttributionNaive:
+		return AttributionNaive, nil
+	case AttributionWindow:
+		return AttributionWindow, nil
+	default:
+		return "", fmt.Errorf("unknown attribution mode: %q", mode)
+	}
+}
+
+// AttributionModel define cómo se reparte el crédito de una oportunidad entre los anuncios que tocó.
+type AttributionModel string
+
+const (
+	// LastTouch acredita todo al anuncio más reciente dentro de la ventana.
+	LastTouch AttributionModel = "last_touch"
+	// FirstTouch acredita todo al anuncio más antiguo dentro de la ventana.
+	FirstTouch AttributionModel = "first_touch"
+	// Linear reparte el crédito a partes iguales entre todos los anuncios de la ventana.
+	Linear AttributionModel = "linear"
+	// TimeDecay da más peso a los anuncios más cercanos a la creación de la oportunidad.
+	TimeDecay AttributionModel = "time_decay"
+	// PositionBased da el 40% al primer toque, el 40% al último y reparte el 20% restante entre los intermedios.
+	PositionBased AttributionModel = "position_based"
+)
+
+// MetricModel devuelve el modelo que figura en las métricas calculadas en el modo y con el modelo indicados:
+// naive en modo naive, donde el modelo no aplica.
+func MetricModel(mode AttributionMode, model AttributionModel) string {
+	if mode == AttributionNaive {
+		return string(AttributionNaive)
+	}
+	return string(model)
+}
+
+// DefaultHalfLifeDays es la vida media por defecto del modelo time_decay, en días.
+const DefaultHalfLifeDays = 7.0
+
+// ParseAttributionModel convierte una cadena en un AttributionModel válido.
+func ParseAttributionModel(model string) (AttributionModel, error) {
+	switch m := AttributionModel(strings.ToLower(strings.TrimSpace(model))); m {
+	case LastTouch, FirstTouch, Linear, TimeDecay, PositionBased:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown attribution model: %q", model)
+	}
+}
+
+// adCredit acumula el crédito de oportunidades asignado a una fila de Ads.
+type adCredit struct {
+	leads         float64
+	opportunities float64
+	closedWon     float64
+	revenue       float64
+	steps         []float64       // Crédito de las oportunidades que alcanzaron cada etapa del funnel.
+	lost          []float64       // Crédito de las oportunidades perdidas tras alcanzar cada etapa.
+	revenueFX     []data.FXAmount // Ingresos en su moneda original, por moneda y tipo aplicado.
+}
+
+// add suma a la fila el crédito ponderado de un grupo de oportunidades, en todas las etapas del funnel que
+// alcanzó: cada oportunidad del grupo aporta weight. g.amount ya está en la moneda de reporte; g.fx lleva el
+// importe original, vacío sin moneda de reporte. Devuelve false si la etapa de CRM del grupo no está en el funnel.
+func (c *adCredit) add(g *oppGroup, weight float64, funnel *Funnel) bool {
+	reached, lost, mapped := funnel.classify(g.stage)
+	if c.steps == nil {
+		c.steps = make([]float64, len(funnel.steps))
+		c.lost = make([]float64, len(funnel.steps))
+	}
+	credit := weight * float64(g.count)
+	for i := 0; i <= reached; i++ {
+		c.steps[i] += credit
+	}
+	if lost {
+		c.lost[reached] += credit
+	}
+
+	c.leads += credit
+	if reached >= funnel.opportunity {
+		c.opportunities += credit
+	}
+	// Cuenta las oportunidades ganadas y suma los ingresos.
+	if reached >= funnel.won {
+		c.closedWon += credit
+		c.revenue += g.amount * weight
+		if g.fx.Currency != "" {
+			c.addOriginalRevenue(g.fx, weight)
+		}
+	}
+	return mapped
+}
+
+// addOriginalRevenue suma el importe original ponderado al de su misma moneda y tipo.
+func (c *adCredit) addOriginalRevenue(fx data.FXAmount, weight float64) {
+	for i := range c.revenueFX {
+		if c.revenueFX[i].Currency == fx.Currency && c.revenueFX[i].Rate == fx.Rate {
+			c.revenueFX[i].Amount += fx.Amount * weight
+			return
+		}
+	}
+	c.revenueFX = append(c.revenueFX, data.FXAmount{Currency: fx.Currency, Amount: fx.Amount * weight, Rate: fx.Rate})
+}
+
+// touch es una fila de Ads que pudo influir en una oportunidad.
+type touch struct {
+	index  int
+	date   time.Time
+	oppDay time.Time // Día de la oportunidad en la zona de la cuenta de la fila de Ads.
+}
+
+// attributeNaive acredita cada grupo de oportunidades completo a todas las filas de Ads con su clave UTM.
+// Devuelve también, por grupo, el motivo por el que no se acreditó a ninguna fila, o "" si se acreditó.
+func (t *Transformer) attributeNaive(rows []*adRow, groups []*oppGroup) []string {
+	rowsByKey := rowsByUTMKey(rows)
+	orphans := make([]string, len(groups))
+	unmapped := make(map[string]bool)
+	for g, group := range groups {
+		matched := rowsByKey[group.key]
+		if len(matched) == 0 {
+			orphans[g] = data.OrphanNoAdsForKey
+			continue
+		}
+		for _, i := range matched {
+			if !rows[i].credit.add(group, 1, t.funnel) {
+				unmapped[group.stage] = true
+			}
+		}
+	}
+	logUnmappedStages(unmapped)
+	return orphans
+}
+
+// attributeWindow acredita cada oportunidad exactamente una vez, repartida según el modelo entre
+// las filas de Ads con la misma clave UTM cuya fecha esté entre CreatedAt menos la ventana y CreatedAt.
+// El día de CreatedAt se calcula en la zona de la cuenta de cada fila; todas las oportunidades de un grupo
+// caen en el mismo día en cada zona, así que se reparten igual.
+// Devuelve también, por grupo, el motivo por el que no se acreditó a ninguna fila, o "" si se acreditó.
+func (t *Transformer) attributeWindow(rows []*adRow, groups []*oppGroup, model AttributionModel) []string {
+	rowsByKey := rowsByUTMKey(rows)
+	orphans := make([]string, len(groups))
+	unmapped := make(map[string]bool)
+	unattributed := 0
+	for g, group := range groups {
+		// Reúne los toques dentro de la ventana, ordenados por fecha y orden de llegada.
+		var touches []touch
+		for _, i := range rowsByKey[group.key] {
+			row := rows[i]
+			oppDay := data.CalendarDate(group.createdAt.In(row.zone))
+			if row.date.After(oppDay) || row.date.Before(oppDay.AddDate(0, 0, -t.lookbackDays)) {
+				continue
+			}
+			touches = append(touches, touch{index: i, date: row.date, oppDay: oppDay})
+		}
+		if len(touches) == 0 {
+			unattributed += group.count
+			orphans[g] = data.OrphanOutsideWindow
+			if len(rowsByKey[group.key]) == 0 {
+				orphans[g] = data.OrphanNoAdsForKey
+			}
+			continue
+		}
+		sort.SliceStable(touches, func(a, b int) bool { return touches[a].date.Before(touches[b].date) })
+
+		weights := t.touchWeights(model, touches)
+		for w, tc := range touches {
+			if weights[w] > 0 && !rows[tc.index].credit.add(group, weights[w], t.funnel) {
+				unmapped[group.stage] = true
+			}
+		}
+	}
+
+	if unattributed > 0 {
+		log.Printf("INFO: %d opportunities could not be attributed to any ad within a %d-day lookback window.", unattributed, t.lookbackDays)
+	}
+	logUnmappedStages(unmapped)
+	return orphans
+}
+
+// rowsByUTMKey agrupa las posiciones de las filas de Ads por clave UTM, en orden de llegada.
+func rowsByUTMKey(rows []*adRow) map[string][]int {
+	byKey := make(map[string][]int)
+	for i, row := range rows {
+		for _, key := range row.keys {
+			byKey[key] = append(byKey[key], i)
+		}
+	}
+	return byKey
+}
+
+// logUnmappedStages avisa de las etapas de CRM que no están en el funnel; esas oportunidades sólo cuentan en la primera etapa.
+func logUnmappedStages(unmapped map[string]bool) {
+	if len(unmapped) == 0 {
+		return
+	}
+	stages := make([]string, 0, len(unmapped))
+	for stage := range unmapped {
+		stages = append(stages, fmt.Sprintf("%q", stage))
+	}
+	sort.Strings(stages)
+	log.Printf("WARN: CRM stages not mapped to any funnel step, counted only in the first step: %s", strings.Join(stages, ", "))
+}
+
+// touchWeights calcula el peso de cada toque según el modelo; los pesos siempre suman 1.
+func (t *Transformer) touchWeights(model AttributionModel, touches []touch) []float64 {
+	n := len(touches)
+	weights := make([]float64, n)
+
+	switch model {
+	case FirstTouch:
+		weights[0] = 1
+	case Linear:
+		for i := range weights {
+			weights[i] = 1 / float64(n)
+		}
+	case TimeDecay:
+		// Cada toque pesa 2^(-días/vida media) y luego se normaliza.
+		var total float64
+		for i, tc := range touches {
+			days := tc.oppDay.Sub(tc.date).Hours() / 24
+			weights[i] = math.Exp2(-days / t.halfLifeDays)
+			total += weights[i]
+		}
+		for i := range weights {
+			weights[i] /= total
+		}
+	case PositionBased:
+		switch n {
+		case 1:
+			weights[0] = 1
+		case 2:
+			weights[0], weights[1] = 0.5, 0.5
+		default:
+			weights[0], weights[n-1] = 0.4, 0.4
+			for i := 1; i < n-1; i++ {
+				weights[i] = 0.2 / float64(n-2)
+			}
+		}
+	default:
+		// LastTouch: el último día gana; en caso de empate, la primera fila recibida ese día.
+		last := n - 1
+		for last > 0 && touches[last-1].date.Equal(touches[n-1].date) {
+			last--
+		}
+		weights[last] = 1
+	}
+	return weights
+}
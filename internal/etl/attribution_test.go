@@ -0,0 +1,111 @@
+package etl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btors/admira-etl/internal/data"
+	"github.com/stretchr/testify/assert"
+)
+
+// attributionFixture devuelve cuatro días consecutivos de la misma campaña y una oportunidad ganada
+// creada el último día.
+func attributionFixture() ([]data.AdPerformance, []data.Opportunity) {
+	var adsData []data.AdPerformance
+	for _, date := range []string{"2025-08-01", "2025-08-02", "2025-08-03", "2025-08-04"} {
+		adsData = append(adsData, data.AdPerformance{
+			Date: date, CampaignID: "C-1001", Channel: "google_ads", Cost: 25.0,
+			UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc",
+		})
+	}
+	crmData := []data.Opportunity{
+		{
+			Stage: "closed_won", Amount: 1000.0, CreatedAt: time.Date(2025, 8, 4, 12, 0, 0, 0, time.UTC),
+			UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc",
+		},
+	}
+	return adsData, crmData
+}
+
+func TestCombineWithModel_Distribution(t *testing.T) {
+	transformer := NewTransformer(WithAttribution(AttributionWindow, 30), WithAttributionModel(LastTouch, 1))
+	adsData, crmData := attributionFixture()
+
+	tests := []struct {
+		model    AttributionModel
+		expected []float64 // Ingresos esperados por día
+	}{
+		{LastTouch, []float64{0, 0, 0, 1000}},
+		{FirstTouch, []float64{1000, 0, 0, 0}},
+		{Linear, []float64{250, 250, 250, 250}},
+		{PositionBased, []float64{400, 100, 100, 400}},
+		// Vida media de 1 día: pesos 1/8, 1/4, 1/2 y 1 normalizados por 15/8.
+		{TimeDecay, []float64{1000.0 / 15, 2000.0 / 15, 4000.0 / 15, 8000.0 / 15}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.model), func(t *testing.T) {
+			results, err := transformer.CombineWithModel(adsData, crmData, tt.model)
+			assert.NoError(t, err)
+			assert.Len(t, results, len(tt.expected))
+
+			var totalRevenue, totalLeads float64
+			for i, metric := range results {
+				assert.InDelta(t, tt.expected[i], metric.Revenue, 0.001)
+				assert.Equal(t, string(tt.model), metric.AttributionModel)
+				totalRevenue += metric.Revenue
+				totalLeads += metric.LeadCredit
+			}
+			// La oportunidad se acredita exactamente una vez, sea cual sea el modelo.
+			assert.InDelta(t, 1000.0, totalRevenue, 0.001)
+			assert.InDelta(t, 1.0, totalLeads, 0.001)
+		})
+	}
+}
+
+func TestCombineWithModel_RatiosUseFractionalCredit(t *testing.T) {
+	transformer := NewTransformer(WithAttribution(AttributionWindow, 30))
+	adsData, crmData := attributionFixture()
+
+	// Con linear cada día recibe 0,25 de crédito: el conteo redondeado es 0, pero los ratios no se pierden.
+	results, err := transformer.CombineWithModel(adsData, crmData, Linear)
+	assert.NoError(t, err)
+	for _, metric := range results {
+		assert.Equal(t, 0, metric.Leads)
+		assert.InDelta(t, 0.25, metric.LeadCredit, 0.001)
+		assert.InDelta(t, 1.0, metric.CVRLeadToOpp, 0.001)
+		assert.InDelta(t, 1.0, metric.CVROppToWon, 0.001)
+		assert.InDelta(t, 100.0, metric.CPA, 0.001)
+	}
+}
+
+func TestCombineWithModel_NaiveIgnoresModel(t *testing.T) {
+	transformer := NewTransformer(WithAttribution(AttributionNaive, 0))
+	adsData, crmData := attributionFixture()
+
+	results, err := transformer.CombineWithModel(adsData, crmData, Linear)
+
+	assert.NoError(t, err)
+	for _, metric := range results {
+		assert.Equal(t, "naive", metric.AttributionModel)
+		assert.Equal(t, 1000.0, metric.Revenue)
+	}
+}
+
+func TestParseAttributionModel(t *testing.T) {
+	model, err := ParseAttributionModel("Time_Decay")
+	assert.NoError(t, err)
+	assert.Equal(t, TimeDecay, model)
+
+	_, err = ParseAttributionModel("u_shaped")
+	assert.Error(t, err)
+}
+
+func TestParseAttributionMode(t *testing.T) {
+	mode, err := ParseAttributionMode(" Naive ")
+	assert.NoError(t, err)
+	assert.Equal(t, AttributionNaive, mode)
+
+	_, err = ParseAttributionMode("everything")
+	assert.Error(t, err)
+}
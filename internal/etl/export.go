@@ -2,76 +2,515 @@
 package etl
 
 import (
-	"bytes"
-	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/btors/admira-etl/internal/data"
+	"github.com/btors/admira-etl/pkg/signature"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-// Exporter es una estructura que maneja la exportación de métricas a un sistema externo.
+// Valores por defecto de la exportación por lotes.
+const (
+	DefaultExportBatchSize   = 500
+	DefaultExportMaxAttempts = 5
+	DefaultExportBaseDelay   = time.Second
+	DefaultExportMaxDelay    = 30 * time.Second
+)
+
+// DefaultSigningKeyID es el ID de la clave de firma construida a partir de SINK_SECRET.
+const DefaultSigningKeyID = "default"
+
+// IdempotencyKeyHeader es la cabecera con la que el sink reconoce un lote que ya recibió.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// ErrSinkNotConfigured se devuelve al reenviar lotes de la DLQ sin ningún sink configurado.
+var ErrSinkNotConfigured = errors.New("sink url not configured")
+
+var exportBatches = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "etl_export_batches_total",
+		Help: "Lotes de exportación por sink y resultado: delivered, failed o skipped (ya entregados sin cambios).",
+	},
+	[]string{"sink", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(exportBatches)
+}
+
+// RetryPolicy configura los reintentos de cada lote de exportación.
+type RetryPolicy struct {
+	MaxAttempts int           // Envíos por lote, incluido el primero.
+	BaseDelay   time.Duration // Espera antes del segundo envío; se duplica en cada reintento, con jitter.
+	MaxDelay    time.Duration // Espera máxima entre envíos. Un Retry-After mayor agota los reintentos del lote.
+}
+
+// Exporter es una estructura que maneja la exportación de métricas a uno o varios sinks.
 type Exporter struct {
-	sinkURL    string
-	sinkSecret string
-	client     *http.Client
+	sinks       []Sink
+	signingKey  signature.Key
+	batchSize   int
+	retry       RetryPolicy
+	deadLetters data.DeadLetterStore // nil si los lotes fallidos sólo se registran en el log.
+	ledger      data.DeliveryLedger  // nil si se envían todos los lotes, aunque ya se hubieran entregado.
+
+	sleep func(time.Duration) // Sustituible en las pruebas.
+}
+
+// ExporterOption permite personalizar un Exporter al crearlo.
+type ExporterOption func(*Exporter)
+
+// WithExportBatchSize fija cuántas métricas se envían como máximo en cada lote.
+func WithExportBatchSize(size int) ExporterOption {
+	return func(e *Exporter) {
+		if size > 0 {
+			e.batchSize = size
+		}
+	}
 }
 
-// NewExporter crea y devuelve una nueva instancia de Exporter.
-func NewExporter(sinkURL, sinkSecret string) *Exporter {
-	return &Exporter{
-		sinkURL:    sinkURL,
-		sinkSecret: sinkSecret,
-		client:     &http.Client{Timeout: 30 * time.Second}, // Configura un tiempo de espera de 30 segundos.
+// WithRetryPolicy configura los reintentos de cada lote; los valores no positivos conservan el valor por defecto.
+func WithRetryPolicy(policy RetryPolicy) ExporterOption {
+	return func(e *Exporter) {
+		if policy.MaxAttempts > 0 {
+			e.retry.MaxAttempts = policy.MaxAttempts
+		}
+		if policy.BaseDelay > 0 {
+			e.retry.BaseDelay = policy.BaseDelay
+		}
+		if policy.MaxDelay > 0 {
+			e.retry.MaxDelay = policy.MaxDelay
+		}
 	}
 }
 
-// ExportMetrics envía un conjunto de métricas al sistema de destino utilizando HMAC-SHA256 para la autenticación.
-func (e *Exporter) ExportMetrics(metrics []data.EnrichedMetric) error {
-	if e.sinkURL == "" {
-		log.Println("WARN: SINK_URL not configured. Skipping export.")
-		return nil
+// WithSigningKey firma las peticiones al sink de SINK_URL con key en lugar de con la clave derivada de SINK_SECRET.
+func WithSigningKey(key signature.Key) ExporterOption {
+	return func(e *Exporter) {
+		e.signingKey = key
+	}
+}
+
+// WithSinks exporta a sinks, en orden, en lugar de al sink HTTP de SINK_URL.
+func WithSinks(sinks ...Sink) ExporterOption {
+	return func(e *Exporter) {
+		e.sinks = sinks
+	}
+}
+
+// WithDeadLetters guarda en store los lotes que un sink no acepta tras agotar los reintentos.
+func WithDeadLetters(store data.DeadLetterStore) ExporterOption {
+	return func(e *Exporter) {
+		e.deadLetters = store
+	}
+}
+
+// WithDeliveryLedger registra en ledger los lotes entregados a cada sink y omite en las exportaciones
+// siguientes los que no cambiaron.
+func WithDeliveryLedger(ledger data.DeliveryLedger) ExporterOption {
+	return func(e *Exporter) {
+		e.ledger = ledger
 	}
+}
 
-	// 1. Convierte las métricas a formato JSON.
-	payload, err := json.Marshal(metrics)
-	if err != nil {
-		return fmt.Errorf("failed to marshal metrics: %w", err)
+// NewExporter crea y devuelve una nueva instancia de Exporter. Sin WithSinks exporta a un único sink HTTP,
+// DefaultSinkName, en sinkURL; si sinkURL está vacía no hay sink y la exportación no hace nada.
+func NewExporter(sinkURL, sinkSecret string, opts ...ExporterOption) *Exporter {
+	e := &Exporter{
+		signingKey: signature.Key{ID: DefaultSigningKeyID, Secret: sinkSecret},
+		batchSize:  DefaultExportBatchSize,
+		retry: RetryPolicy{
+			MaxAttempts: DefaultExportMaxAttempts,
+			BaseDelay:   DefaultExportBaseDelay,
+			MaxDelay:    DefaultExportMaxDelay,
+		},
+		sleep: time.Sleep,
+	}
+	for _, opt := range opts {
+		opt(e)
 	}
+	if e.sinks == nil && sinkURL != "" {
+		e.sinks = []Sink{NewHTTPSink(DefaultSinkName, sinkURL, e.signingKey)}
+	}
+	return e
+}
 
-	// 2. Calcula la firma HMAC-SHA256 del cuerpo de la solicitud.
-	mac := hmac.New(sha256.New, []byte(e.sinkSecret))
-	mac.Write(payload)
-	signature := hex.EncodeToString(mac.Sum(nil))
+// DeadLetters devuelve el almacén de lotes fallidos, o nil si no está configurado.
+func (e *Exporter) DeadLetters() data.DeadLetterStore {
+	return e.deadLetters
+}
+
+// BatchSize devuelve cuántas métricas se envían como máximo en cada lote.
+func (e *Exporter) BatchSize() int {
+	return e.batchSize
+}
 
-	// 3. Crea una nueva solicitud HTTP POST.
-	req, err := http.NewRequest("POST", e.sinkURL, bytes.NewBuffer(payload))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+// Configured indica si hay algún sink al que exportar.
+func (e *Exporter) Configured() bool {
+	return len(e.sinks) > 0
+}
+
+// SinkNames devuelve los nombres de los sinks configurados, en orden.
+func (e *Exporter) SinkNames() []string {
+	names := make([]string, len(e.sinks))
+	for i, sink := range e.sinks {
+		names[i] = sink.Name()
 	}
+	return names
+}
 
-	// 4. Configura los encabezados de la solicitud.
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Signature", signature)
+// SinkErrors son los errores de los sinks que no aceptaron un lote, por nombre de sink.
+type SinkErrors map[string]error
+
+// Error devuelve los errores de cada sink, ordenados por nombre.
+func (e SinkErrors) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	messages := make([]string, len(names))
+	for i, name := range names {
+		messages[i] = fmt.Sprintf("sink %s: %v", name, e[name])
+	}
+	return strings.Join(messages, "; ")
+}
 
-	// 5. Envía la solicitud al sistema de destino.
-	resp, err := e.client.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send request to sink: %w", err)
+// Unwrap devuelve los errores de cada sink, para errors.Is y errors.As.
+func (e SinkErrors) Unwrap() []error {
+	errs := make([]error, 0, len(e))
+	for _, err := range e {
+		errs = append(errs, err)
 	}
-	defer resp.Body.Close()
+	return errs
+}
 
-	// Verifica si el sistema de destino devolvió un código de estado 200 (éxito).
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("sink returned non-200 status code: %d", resp.StatusCode)
+// Send entrega un lote ya serializado de metrics métricas a los sinks, con la política de reintentos, y
+// devuelve los envíos realizados. Los sinks de delivered ya aceptaron el lote y se omiten, para que reenviarlo
+// sólo vaya a los que fallaron. Si algún sink no lo acepta devuelve SinkErrors. A diferencia de Export, un
+// lote fallido no se guarda en la DLQ: el llamador decide si lo reenvía o lo guarda en ella. La
+// Idempotency-Key depende sólo del contenido, así que reenviar el mismo lote repite la clave.
+func (e *Exporter) Send(payload []byte, metrics int, delivered ...string) (int, error) {
+	if len(e.sinks) == 0 {
+		return 0, ErrSinkNotConfigured
+	}
+	batch := SinkBatch{Key: outboxKey(payload), Metrics: metrics, Payload: payload}
+	total := 0
+	errs := SinkErrors{}
+	for _, sink := range e.sinks {
+		if slices.Contains(delivered, sink.Name()) {
+			continue
+		}
+		attempts, err := e.send(sink, batch)
+		total += attempts
+		if err != nil {
+			exportBatches.WithLabelValues(sink.Name(), "failed").Inc()
+			errs[sink.Name()] = err
+			continue
+		}
+		exportBatches.WithLabelValues(sink.Name(), "delivered").Inc()
+	}
+	if len(errs) > 0 {
+		return total, errs
 	}
+	return total, nil
+}
+
+// outboxKey devuelve la Idempotency-Key de un lote del outbox, que puede mezclar métricas de varios días.
+func outboxKey(payload []byte) string {
+	return "outbox-" + payloadID(payload)
+}
+
+// permanentSinkError indica si reenviar el lote no cambiaría el resultado: el sink lo rechazó con un error
+// que send no reintenta (en HTTP, una respuesta 4xx distinta de 408 y 429).
+func permanentSinkError(err error) bool {
+	var sinkErr *SinkError
+	return !errors.As(err, &sinkErr) || !sinkErr.Retryable
+}
+
+// IdempotencyKey devuelve la Idempotency-Key de un lote de exportación: el día, el índice del lote y el hash
+// de su contenido. Exportar de nuevo el mismo día sin cambios produce las mismas claves.
+func IdempotencyKey(date string, batch int, payload []byte) string {
+	return fmt.Sprintf("%s-%d-%s", date, batch, payloadID(payload))
+}
+
+// SinkSummary resume una exportación por lotes a un sink.
+type SinkSummary struct {
+	Batches      int // Lotes enviados.
+	Exported     int // Métricas aceptadas por el sink.
+	Failed       int // Lotes que el sink no aceptó tras los reintentos.
+	DeadLettered int // Lotes fallidos guardados en la DLQ.
+	Skipped      int // Lotes sin cambios desde su última entrega, que no se reenviaron.
+}
 
+// add suma los conteos de other.
+func (s *SinkSummary) add(other SinkSummary) {
+	s.Batches += other.Batches
+	s.Exported += other.Exported
+	s.Failed += other.Failed
+	s.DeadLettered += other.DeadLettered
+	s.Skipped += other.Skipped
+}
+
+// ExportSummary resume una exportación por lotes: los totales, sumados entre sinks, y el resumen de cada uno.
+type ExportSummary struct {
+	SinkSummary
+	Sinks  map[string]SinkSummary // Resumen por nombre de sink.
+	Errors map[string]string      // Último error de cada sink con algún lote fallido.
+}
+
+// ExportMetrics envía un conjunto de métricas a los sinks configurados.
+func (e *Exporter) ExportMetrics(metrics []data.EnrichedMetric) error {
+	_, err := e.Export(metrics, false)
+	return err
+}
+
+// Export envía las métricas a cada sink en lotes de como máximo batchSize, reintentando cada lote por
+// separado. Un lote que falla no detiene los siguientes ni los demás sinks: se guarda en la DLQ, si está
+// configurada, y Export devuelve un error al terminar. Con un registro de entregas, los lotes cuya
+// Idempotency-Key ya se entregó a un sink no se le reenvían, salvo con force.
+func (e *Exporter) Export(metrics []data.EnrichedMetric, force bool) (ExportSummary, error) {
+	summary := ExportSummary{Sinks: make(map[string]SinkSummary), Errors: make(map[string]string)}
+	if len(e.sinks) == 0 {
+		log.Println("WARN: No export sinks configured. Skipping export.")
+		return summary, nil
+	}
+	for _, sink := range e.sinks {
+		summary.Sinks[sink.Name()] = SinkSummary{}
+	}
+
+	var lastErr error
+	parts := make(map[string]int) // Partes de la partición de cada día exportado.
+	for start := 0; start < len(metrics); start += e.batchSize {
+		metricsBatch := metrics[start:min(start+e.batchSize, len(metrics))]
+
+		// Convierte el lote a formato JSON una sola vez; todos los sinks reciben el mismo cuerpo y la misma clave.
+		payload, err := json.Marshal(metricsBatch)
+		if err != nil {
+			return summary, fmt.Errorf("failed to marshal metrics: %w", err)
+		}
+		date := metricsBatch[0].Date.Format("2006-01-02")
+		index := start / e.batchSize
+		batch := SinkBatch{
+			Date: date, Index: index, Key: IdempotencyKey(date, index, payload), Metrics: len(metricsBatch), Payload: payload,
+		}
+		parts[date] = index + 1
+
+		for _, sink := range e.sinks {
+			name := sink.Name()
+			s := summary.Sinks[name]
+			if e.ledger != nil && !force {
+				delivered, err := e.ledger.GetDelivery(name, batch.Key)
+				if err != nil {
+					return summary, fmt.Errorf("failed to read delivery ledger: %w", err)
+				}
+				if delivered != nil {
+					s.Skipped++
+					summary.Sinks[name] = s
+					exportBatches.WithLabelValues(name, "skipped").Inc()
+					continue
+				}
+			}
+
+			s.Batches++
+			attempts, err := e.send(sink, batch)
+			if err == nil {
+				s.Exported += batch.Metrics
+				summary.Sinks[name] = s
+				exportBatches.WithLabelValues(name, "delivered").Inc()
+				e.recordDelivery(name, batch)
+				continue
+			}
+			s.Failed++
+			summary.Sinks[name] = s
+			summary.Errors[name] = err.Error()
+			lastErr = err
+			exportBatches.WithLabelValues(name, "failed").Inc()
+			log.Printf("ERROR: Export batch %d (%d metrics) to sink %s failed after %d attempts: %v", index, batch.Metrics, name, attempts, err)
+
+			if e.deadLetters == nil {
+				continue
+			}
+			now := time.Now().UTC()
+			if err := e.deadLetters.AddDeadLetter(data.DeadLetter{
+				ID:        deadLetterID(name, payload),
+				Sink:      name,
+				Date:      date,
+				Batch:     index,
+				Metrics:   batch.Metrics,
+				Payload:   payload,
+				Attempts:  attempts,
+				LastError: err.Error(),
+				CreatedAt: now,
+				UpdatedAt: now,
+			}); err != nil {
+				return summary, fmt.Errorf("failed to dead-letter export batch %d for sink %s: %w", index, name, err)
+			}
+			s.DeadLettered++
+			summary.Sinks[name] = s
+		}
+	}
+
+	// Retira de cada partición las partes de una exportación anterior con más lotes, aunque algún lote fallara.
+	partitionErrs := 0
+	for _, sink := range e.sinks {
+		ps, ok := sink.(PartitionSink)
+		if !ok {
+			continue
+		}
+		for date, n := range parts {
+			if err := ps.FinishPartition(date, n); err != nil {
+				log.Printf("ERROR: Failed to finish partition %s of sink %s: %v", date, sink.Name(), err)
+				summary.Errors[sink.Name()] = err.Error()
+				lastErr = err
+				partitionErrs++
+			}
+		}
+	}
+
+	for _, s := range summary.Sinks {
+		summary.add(s)
+	}
+	if summary.Failed > 0 {
+		return summary, fmt.Errorf("%d of %d export batches failed: %w", summary.Failed, summary.Batches, lastErr)
+	}
+	if partitionErrs > 0 {
+		return summary, fmt.Errorf("failed to finish %d export partitions: %w", partitionErrs, lastErr)
+	}
 	// Registra un mensaje indicando que las métricas se exportaron correctamente.
-	log.Printf("INFO: Successfully exported %d metrics to sink.", len(metrics))
-	return nil
+	log.Printf("INFO: Successfully exported %d metrics to %d sinks in %d batches (%d unchanged batches skipped).",
+		summary.Exported, len(e.sinks), summary.Batches, summary.Skipped)
+	return summary, nil
+}
+
+// recordDelivery registra en el ledger un lote que el sink aceptó. Un fallo sólo se registra en el log: el
+// lote ya está entregado y, si se exporta de nuevo, lleva la misma Idempotency-Key.
+func (e *Exporter) recordDelivery(sink string, batch SinkBatch) {
+	if e.ledger == nil {
+		return
+	}
+	if err := e.ledger.RecordDelivery(data.ExportDelivery{
+		Sink: sink, Key: batch.Key, Date: batch.Date, Batch: batch.Index, Metrics: batch.Metrics, DeliveredAt: time.Now().UTC(),
+	}); err != nil {
+		log.Printf("ERROR: Failed to record delivery of export batch %s to sink %s: %v", batch.Key, sink, err)
+	}
+}
+
+// ReplayDeadLetter reenvía un lote de la DLQ a su sink con la misma política de reintentos y la misma
+// Idempotency-Key que el envío original. Si el sink lo acepta queda como reenviado; si no, sigue pendiente
+// con los intentos sumados y el nuevo error.
+func (e *Exporter) ReplayDeadLetter(letter data.DeadLetter) error {
+	if len(e.sinks) == 0 {
+		return ErrSinkNotConfigured
+	}
+	name := letter.Sink
+	if name == "" {
+		name = DefaultSinkName
+	}
+	var sink Sink
+	for _, s := range e.sinks {
+		if s.Name() == name {
+			sink = s
+		}
+	}
+	if sink == nil {
+		return fmt.Errorf("%w: %q", ErrUnknownSink, name)
+	}
+
+	batch := SinkBatch{
+		Date: letter.Date, Index: letter.Batch, Key: IdempotencyKey(letter.Date, letter.Batch, letter.Payload),
+		Metrics: letter.Metrics, Payload: letter.Payload,
+	}
+	if letter.Date == "" {
+		batch.Key = outboxKey(letter.Payload)
+	}
+	attempts, err := e.send(sink, batch)
+	if err == nil {
+		e.recordDelivery(name, batch)
+		return e.deadLetters.ResolveDeadLetter(letter.ID, attempts)
+	}
+	letter.Attempts = attempts
+	letter.LastError = err.Error()
+	letter.UpdatedAt = time.Now().UTC()
+	if storeErr := e.deadLetters.AddDeadLetter(letter); storeErr != nil {
+		return fmt.Errorf("failed to update dead letter %s: %w", letter.ID, storeErr)
+	}
+	return err
+}
+
+// send entrega un lote a un sink hasta que lo acepta o se agotan los reintentos, y devuelve los envíos
+// realizados. Sólo se reintentan los *SinkError transitorios (en HTTP, errores de red y respuestas 408, 429 y
+// 5xx), con backoff exponencial y jitter; si el sink indica Retry-After se espera al menos ese tiempo. El resto
+// de errores no se reintentan, porque repetirlos no cambiaría el resultado. Todos los intentos llevan la misma
+// Idempotency-Key.
+func (e *Exporter) send(sink Sink, batch SinkBatch) (int, error) {
+	for attempt := 1; ; attempt++ {
+		err := sink.Deliver(batch)
+		if err == nil {
+			return attempt, nil
+		}
+		var sinkErr *SinkError
+		if !errors.As(err, &sinkErr) || !sinkErr.Retryable || attempt >= e.retry.MaxAttempts {
+			return attempt, err
+		}
+		delay := e.backoff(attempt)
+		if sinkErr.RetryAfter > e.retry.MaxDelay {
+			return attempt, fmt.Errorf("%w (Retry-After %s exceeds the maximum retry delay)", err, sinkErr.RetryAfter)
+		}
+		if sinkErr.RetryAfter > delay {
+			delay = sinkErr.RetryAfter
+		}
+		e.sleep(delay)
+	}
+}
+
+// backoff devuelve la espera tras el intento indicado: BaseDelay·2^(intento-1), como máximo MaxDelay,
+// de la que se descuenta al azar hasta la mitad para que los reintentos de varias réplicas no coincidan.
+func (e *Exporter) backoff(attempt int) time.Duration {
+	delay := e.retry.MaxDelay
+	if shift := attempt - 1; shift < 32 && e.retry.BaseDelay<<shift < delay {
+		delay = e.retry.BaseDelay << shift
+	}
+	half := delay / 2
+	return delay - half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// parseRetryAfter interpreta la cabecera Retry-After, en segundos o como fecha HTTP; 0 si falta o no es válida.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(at); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// payloadID identifica un lote por el hash de su cuerpo.
+func payloadID(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:16])
+}
+
+// deadLetterID identifica un lote fallido por su sink y el hash de su cuerpo, así que el mismo lote fallido
+// en dos sinks son dos entradas que se reenvían por separado.
+func deadLetterID(sink string, payload []byte) string {
+	return payloadID(append([]byte(sink+"\n"), payload...))
 }
@@ -1,13 +1,18 @@
 package etl
 
 import (
+	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/btors/admira-etl/internal/data"
+	"github.com/btors/admira-etl/pkg/signature"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // ParseDate convierte una cadena de fecha en formato "YYYY-MM-DD" a un objeto time.Time.
@@ -46,3 +51,236 @@ func TestExporter_ExportMetrics(t *testing.T) {
 
 	assert.NoError(t, err)
 }
+
+// exportMetrics genera n métricas de la misma fecha con campañas distintas.
+func exportMetrics(n int) []data.EnrichedMetric {
+	metrics := make([]data.EnrichedMetric, n)
+	for i := range metrics {
+		metrics[i] = data.EnrichedMetric{Date: ParseDate("2025-08-01"), CampaignID: string(rune('A' + i)), Channel: "google_ads"}
+	}
+	return metrics
+}
+
+// recordSleeps sustituye las esperas del exporter por el registro de su duración.
+func recordSleeps(e *Exporter) *[]time.Duration {
+	var sleeps []time.Duration
+	e.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	return &sleeps
+}
+
+func TestExporter_SplitsBatchesAndRetries(t *testing.T) {
+	var mu sync.Mutex
+	var sizes []int
+	calls := 0
+	sinkServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		// El primer envío falla con 503 y Retry-After; el resto se aceptan con 202.
+		if calls == 1 {
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []data.EnrichedMetric
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&batch))
+		sizes = append(sizes, len(batch))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer sinkServer.Close()
+
+	exporter := NewExporter(sinkServer.URL, "test_secret",
+		WithExportBatchSize(2),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: 10 * time.Second}),
+	)
+	sleeps := recordSleeps(exporter)
+
+	summary, err := exporter.Export(exportMetrics(5), false)
+	require.NoError(t, err)
+	assert.Equal(t, SinkSummary{Batches: 3, Exported: 5}, summary.SinkSummary)
+	assert.Equal(t, summary.SinkSummary, summary.Sinks[DefaultSinkName])
+	assert.Equal(t, []int{2, 2, 1}, sizes)
+	// El reintento espera lo que pide Retry-After, más que el backoff de 1s.
+	assert.Equal(t, []time.Duration{3 * time.Second}, *sleeps)
+}
+
+func TestExporter_BackoffGrowsWithJitter(t *testing.T) {
+	exporter := NewExporter("http://sink", "s", WithRetryPolicy(RetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: 5 * time.Second}))
+	for attempt, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 40: 5 * time.Second} {
+		delay := exporter.backoff(attempt)
+		assert.GreaterOrEqual(t, delay, max/2, attempt)
+		assert.LessOrEqual(t, delay, max, attempt)
+	}
+}
+
+func TestExporter_DeadLettersFailedBatchesAndReplays(t *testing.T) {
+	var mu sync.Mutex
+	status := map[string]int{"A": http.StatusBadRequest, "C": http.StatusBadGateway}
+	calls := map[string]int{}
+	sinkServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []data.EnrichedMetric
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&batch))
+		mu.Lock()
+		defer mu.Unlock()
+		first := batch[0].CampaignID
+		calls[first]++
+		if code, ok := status[first]; ok {
+			w.WriteHeader(code)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer sinkServer.Close()
+
+	store := data.NewInMemoryDeadLetterStore()
+	exporter := NewExporter(sinkServer.URL, "test_secret",
+		WithExportBatchSize(2),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}),
+		WithDeadLetters(store),
+	)
+	recordSleeps(exporter)
+
+	// Lotes [A B] (400, sin reintentos), [C D] (502, se agotan los reintentos) y [E] (aceptado).
+	summary, err := exporter.Export(exportMetrics(5), false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "2 of 3 export batches failed")
+	assert.Equal(t, SinkSummary{Batches: 3, Exported: 1, Failed: 2, DeadLettered: 2}, summary.SinkSummary)
+	assert.Equal(t, summary.SinkSummary, summary.Sinks[DefaultSinkName])
+	assert.Equal(t, map[string]int{"A": 1, "C": 3, "E": 1}, calls)
+
+	letters, err := store.ListDeadLetters(data.DeadLetterFilter{Status: data.DeadLetterPending})
+	require.NoError(t, err)
+	require.Len(t, letters, 2)
+	byBatch := map[int]data.DeadLetter{}
+	for _, l := range letters {
+		byBatch[l.Batch] = l
+	}
+	assert.Equal(t, 1, byBatch[0].Attempts)
+	assert.Equal(t, "2025-08-01", byBatch[0].Date)
+	assert.Contains(t, byBatch[0].LastError, "400")
+	assert.Equal(t, 3, byBatch[1].Attempts)
+	assert.Equal(t, DefaultSinkName, byBatch[1].Sink)
+	assert.Equal(t, 2, byBatch[1].Metrics)
+
+	// El sink vuelve a aceptar el lote [C D]: el reenvío lo marca como reenviado con el mismo cuerpo.
+	mu.Lock()
+	delete(status, "C")
+	mu.Unlock()
+	pipeline := NewPipeline(data.NewInMemoryRepository(), nil, nil, exporter)
+	result, err := pipeline.ReplayDeadLetters(letters)
+	require.Error(t, err)
+	assert.Equal(t, 1, result.Replayed)
+	assert.Equal(t, 1, result.Failed)
+	assert.Equal(t, 2, result.Metrics)
+
+	replayed, err := store.GetDeadLetter(byBatch[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, data.DeadLetterReplayed, replayed.Status)
+	assert.Equal(t, 4, replayed.Attempts)
+	stillPending, err := pipeline.DeadLettersToReplay(nil)
+	require.NoError(t, err)
+	require.Len(t, stillPending, 1)
+	assert.Equal(t, byBatch[0].ID, stillPending[0].ID)
+	assert.Equal(t, 2, stillPending[0].Attempts)
+
+	_, err = pipeline.DeadLettersToReplay([]string{"missing"})
+	assert.ErrorIs(t, err, data.ErrDeadLetterNotFound)
+	_, err = NewPipeline(data.NewInMemoryRepository(), nil, nil, NewExporter(sinkServer.URL, "s")).DeadLetters(data.DeadLetterFilter{})
+	assert.ErrorIs(t, err, ErrDeadLettersDisabled)
+}
+
+func TestExporter_RetryAfterBeyondMaxDelayStopsRetrying(t *testing.T) {
+	calls := 0
+	sinkServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer sinkServer.Close()
+
+	exporter := NewExporter(sinkServer.URL, "test_secret")
+	sleeps := recordSleeps(exporter)
+	err := exporter.ExportMetrics(exportMetrics(1))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Retry-After")
+	assert.Equal(t, 1, calls)
+	assert.Empty(t, *sleeps)
+}
+
+func TestExporter_SignsEachAttemptForVerify(t *testing.T) {
+	keys := []signature.Key{{ID: "k2", Secret: "new"}, {ID: "k1", Secret: "old"}}
+	nonces := signature.NewMemoryNonceCache()
+	calls := 0
+	sinkServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		// El reintento lleva otro nonce, así que la caché de nonces no lo rechaza.
+		assert.NoError(t, signature.Verify(r, body, keys, signature.VerifyOptions{Nonces: nonces}))
+		assert.Equal(t, "k2", r.Header.Get(signature.HeaderKeyID))
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer sinkServer.Close()
+
+	exporter := NewExporter(sinkServer.URL+"/ingest?tenant=admira", "unused", WithSigningKey(keys[0]))
+	recordSleeps(exporter)
+	require.NoError(t, exporter.ExportMetrics(exportMetrics(1)))
+	assert.Equal(t, 2, calls)
+}
+
+func TestExporter_SkipsUnchangedBatchesAlreadyDelivered(t *testing.T) {
+	var mu sync.Mutex
+	keys := map[string][]string{} // Idempotency-Key recibidas, por primera campaña del lote.
+	sinkServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []data.EnrichedMetric
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&batch))
+		mu.Lock()
+		keys[batch[0].CampaignID] = append(keys[batch[0].CampaignID], r.Header.Get(IdempotencyKeyHeader))
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer sinkServer.Close()
+
+	ledger := data.NewInMemoryDeliveryLedger()
+	exporter := NewExporter(sinkServer.URL, "test_secret", WithExportBatchSize(2), WithDeliveryLedger(ledger))
+
+	// Lotes [A B], [C D] y [E]: la clave es la fecha, el índice y el hash del contenido.
+	summary, err := exporter.Export(exportMetrics(5), false)
+	require.NoError(t, err)
+	assert.Equal(t, SinkSummary{Batches: 3, Exported: 5}, summary.SinkSummary)
+	assert.Equal(t, summary.SinkSummary, summary.Sinks[DefaultSinkName])
+	payload, err := json.Marshal(exportMetrics(5)[2:4])
+	require.NoError(t, err)
+	assert.Equal(t, []string{IdempotencyKey("2025-08-01", 1, payload)}, keys["C"])
+	delivery, err := ledger.GetDelivery(DefaultSinkName, keys["C"][0])
+	require.NoError(t, err)
+	require.NotNil(t, delivery)
+	assert.Equal(t, 1, delivery.Batch)
+	assert.Equal(t, 2, delivery.Metrics)
+
+	// Repetir la exportación sin cambios no envía nada; un cambio reenvía sólo su lote, con otra clave.
+	summary, err = exporter.Export(exportMetrics(5), false)
+	require.NoError(t, err)
+	assert.Equal(t, SinkSummary{Skipped: 3}, summary.SinkSummary)
+	assert.Equal(t, summary.SinkSummary, summary.Sinks[DefaultSinkName])
+	metrics := exportMetrics(5)
+	metrics[3].Clicks = 9
+	summary, err = exporter.Export(metrics, false)
+	require.NoError(t, err)
+	assert.Equal(t, SinkSummary{Batches: 1, Exported: 2, Skipped: 2}, summary.SinkSummary)
+	assert.Equal(t, summary.SinkSummary, summary.Sinks[DefaultSinkName])
+	require.Len(t, keys["C"], 2)
+	assert.NotEqual(t, keys["C"][0], keys["C"][1])
+
+	// Con force se reenvía todo, con las mismas claves para que el sink pueda reconocer los duplicados.
+	summary, err = exporter.Export(exportMetrics(5), true)
+	require.NoError(t, err)
+	assert.Equal(t, SinkSummary{Batches: 3, Exported: 5}, summary.SinkSummary)
+	assert.Equal(t, summary.SinkSummary, summary.Sinks[DefaultSinkName])
+	assert.Equal(t, keys["A"][0], keys["A"][1])
+	assert.Equal(t, keys["C"][0], keys["C"][2])
+}
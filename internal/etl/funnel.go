@@ -0,0 +1,178 @@
+// Package etl internal/etl/funnel.go
+package etl
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/btors/admira-etl/internal/data"
+)
+
+// FunnelStepConfig es una etapa del funnel y las etapas de CRM (Opportunity.Stage) que la representan.
+type FunnelStepConfig struct {
+	Name   string   `json:"name"`
+	Stages []string `json:"stages"`
+}
+
+// FunnelConfig define el funnel: etapas ordenadas de la entrada al cierre ganado. Una oportunidad en una
+// etapa cuenta también en todas las anteriores. Si la primera etapa no declara etapas de CRM, recoge todas
+// las que no aparecen en la configuración.
+type FunnelConfig struct {
+	Steps []FunnelStepConfig `json:"steps"`
+	// LostStages asigna cada etapa de CRM de pérdida a la última etapa del funnel que alcanzó la oportunidad.
+	LostStages map[string]string `json:"lost_stages"`
+	// OpportunityStep es la etapa que alimenta Opportunities; por defecto "opportunity" si existe, si no la primera.
+	OpportunityStep string `json:"opportunity_step,omitempty"`
+	// WonStep es la etapa que alimenta ClosedWon y Revenue; por defecto la última.
+	WonStep string `json:"won_step,omitempty"`
+}
+
+// DefaultFunnelConfig devuelve el funnel histórico: toda oportunidad es un lead y una oportunidad,
+// y sólo "closed_won" cuenta como ganada.
+func DefaultFunnelConfig() FunnelConfig {
+	return FunnelConfig{
+		Steps: []FunnelStepConfig{
+			{Name: "lead", Stages: []string{}},
+			{Name: "won", Stages: []string{"closed_won"}},
+		},
+		LostStages: map[string]string{"closed_lost": "lead"},
+	}
+}
+
+// LoadFunnelConfig lee la definición del funnel de un archivo JSON.
+func LoadFunnelConfig(path string) (FunnelConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return FunnelConfig{}, fmt.Errorf("failed to read funnel config: %w", err)
+	}
+	var cfg FunnelConfig
+	decoder := json.NewDecoder(strings.NewReader(string(raw)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return FunnelConfig{}, fmt.Errorf("failed to parse funnel config: %w", err)
+	}
+	return cfg, nil
+}
+
+// Funnel clasifica las etapas de CRM en las etapas ordenadas del funnel.
+type Funnel struct {
+	cfg         FunnelConfig // Configuración de la que se construyó, para archivarla con cada ingesta.
+	steps       []string
+	stageStep   map[string]int // Etapa de CRM normalizada → índice de la etapa alcanzada.
+	lostStep    map[string]int // Etapa de CRM de pérdida normalizada → índice de la última etapa alcanzada.
+	opportunity int
+	won         int
+	catchAll    bool // La primera etapa recoge las etapas de CRM desconocidas.
+}
+
+// NewFunnel valida la configuración y construye el Funnel.
+func NewFunnel(cfg FunnelConfig) (*Funnel, error) {
+	if len(cfg.Steps) < 2 {
+		return nil, fmt.Errorf("funnel needs at least two steps, got %d", len(cfg.Steps))
+	}
+	f := &Funnel{cfg: cfg, stageStep: make(map[string]int), lostStep: make(map[string]int)}
+	index := make(map[string]int, len(cfg.Steps))
+	for i, step := range cfg.Steps {
+		name := strings.TrimSpace(step.Name)
+		if name == "" {
+			return nil, fmt.Errorf("funnel step %d has no name", i+1)
+		}
+		if _, dup := index[name]; dup {
+			return nil, fmt.Errorf("duplicate funnel step %q", name)
+		}
+		index[name] = i
+		f.steps = append(f.steps, name)
+		for _, stage := range step.Stages {
+			key := normalizeStage(stage)
+			if key == "" {
+				return nil, fmt.Errorf("funnel step %q has an empty stage", name)
+			}
+			if other, dup := f.stageStep[key]; dup {
+				return nil, fmt.Errorf("stage %q is mapped to steps %q and %q", stage, f.steps[other], name)
+			}
+			f.stageStep[key] = i
+		}
+	}
+	for stage, step := range cfg.LostStages {
+		key := normalizeStage(stage)
+		if key == "" {
+			return nil, fmt.Errorf("lost_stages has an empty stage")
+		}
+		if _, dup := f.stageStep[key]; dup {
+			return nil, fmt.Errorf("stage %q is both a funnel stage and a lost stage", stage)
+		}
+		i, ok := index[strings.TrimSpace(step)]
+		if !ok {
+			return nil, fmt.Errorf("lost stage %q refers to unknown step %q", stage, step)
+		}
+		f.lostStep[key] = i
+	}
+
+	f.catchAll = len(cfg.Steps[0].Stages) == 0
+
+	f.opportunity = 0
+	if i, ok := index["opportunity"]; ok {
+		f.opportunity = i
+	}
+	if cfg.OpportunityStep != "" {
+		i, ok := index[cfg.OpportunityStep]
+		if !ok {
+			return nil, fmt.Errorf("unknown opportunity_step %q", cfg.OpportunityStep)
+		}
+		f.opportunity = i
+	}
+	f.won = len(f.steps) - 1
+	if cfg.WonStep != "" {
+		i, ok := index[cfg.WonStep]
+		if !ok {
+			return nil, fmt.Errorf("unknown won_step %q", cfg.WonStep)
+		}
+		f.won = i
+	}
+	if f.won <= f.opportunity {
+		return nil, fmt.Errorf("won_step %q must come after opportunity_step %q", f.steps[f.won], f.steps[f.opportunity])
+	}
+	return f, nil
+}
+
+// Steps devuelve los nombres de las etapas, en orden.
+func (f *Funnel) Steps() []string {
+	return append([]string(nil), f.steps...)
+}
+
+// classify devuelve el índice de la etapa más avanzada que alcanzó una oportunidad, si se perdió, y si su
+// etapa de CRM está en la configuración. Las etapas desconocidas cuentan sólo en la primera etapa, y sólo
+// se consideran configuradas si la primera etapa las recoge todas.
+func (f *Funnel) classify(stage string) (reached int, lost bool, mapped bool) {
+	key := normalizeStage(stage)
+	if i, ok := f.stageStep[key]; ok {
+		return i, false, true
+	}
+	if i, ok := f.lostStep[key]; ok {
+		return i, true, true
+	}
+	return 0, false, f.catchAll
+}
+
+// metricSteps construye el resumen por etapa de una fila de Ads a partir de su crédito.
+func (f *Funnel) metricSteps(credit adCredit) []data.FunnelStep {
+	steps := make([]data.FunnelStep, len(f.steps))
+	for i, name := range f.steps {
+		steps[i] = data.FunnelStep{Step: name}
+		if credit.steps != nil {
+			steps[i].Credit = credit.steps[i]
+			steps[i].Count = roundCredit(credit.steps[i])
+			steps[i].LostCredit = credit.lost[i]
+			steps[i].Lost = roundCredit(credit.lost[i])
+		}
+	}
+	data.ComputeFunnelRates(steps)
+	return steps
+}
+
+// normalizeStage compara las etapas de CRM sin distinguir mayúsculas ni espacios alrededor.
+func normalizeStage(stage string) string {
+	return strings.ToLower(strings.TrimSpace(stage))
+}
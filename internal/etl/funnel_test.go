@@ -0,0 +1,121 @@
+package etl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btors/admira-etl/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadFunnelConfig_Example(t *testing.T) {
+	cfg, err := LoadFunnelConfig("../../funnel.example.json")
+	require.NoError(t, err)
+	funnel, err := NewFunnel(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"lead", "mql", "sql", "opportunity", "won"}, funnel.Steps())
+}
+
+func TestNewFunnel_Validation(t *testing.T) {
+	steps := func(names ...string) []FunnelStepConfig {
+		var s []FunnelStepConfig
+		for _, name := range names {
+			s = append(s, FunnelStepConfig{Name: name, Stages: []string{name}})
+		}
+		return s
+	}
+	for name, cfg := range map[string]FunnelConfig{
+		"single step":         {Steps: steps("lead")},
+		"unnamed step":        {Steps: steps("lead", "")},
+		"duplicate step":      {Steps: steps("lead", "lead")},
+		"stage in two steps":  {Steps: []FunnelStepConfig{{Name: "lead", Stages: []string{"new"}}, {Name: "won", Stages: []string{"NEW"}}}},
+		"lost stage in steps": {Steps: steps("lead", "won"), LostStages: map[string]string{"won": "lead"}},
+		"lost unknown step":   {Steps: steps("lead", "won"), LostStages: map[string]string{"closed_lost": "sql"}},
+		"unknown won step":    {Steps: steps("lead", "won"), WonStep: "closed"},
+		"won before opp":      {Steps: steps("lead", "opportunity", "won"), OpportunityStep: "won", WonStep: "opportunity"},
+	} {
+		_, err := NewFunnel(cfg)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestCombineWithModel_ConfigurableFunnel(t *testing.T) {
+	funnel, err := NewFunnel(FunnelConfig{
+		Steps: []FunnelStepConfig{
+			{Name: "lead", Stages: []string{"lead"}},
+			{Name: "mql", Stages: []string{"mql"}},
+			{Name: "sql", Stages: []string{"sql"}},
+			{Name: "opportunity", Stages: []string{"opportunity", "Proposal"}},
+			{Name: "won", Stages: []string{"closed_won"}},
+		},
+		LostStages: map[string]string{"closed_lost": "opportunity", "disqualified": "mql"},
+	})
+	require.NoError(t, err)
+	transformer := NewTransformer(WithAttribution(AttributionWindow, 30), WithFunnel(funnel))
+
+	ads := []data.AdPerformance{{Date: "2025-08-01", CampaignID: "C-1", Channel: "google_ads", Clicks: 10, Cost: 100, UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"}}
+	created := time.Date(2025, 8, 2, 0, 0, 0, 0, time.UTC)
+	opp := func(stage string, amount float64) data.Opportunity {
+		return data.Opportunity{Stage: stage, Amount: amount, CreatedAt: created, UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"}
+	}
+	crm := []data.Opportunity{
+		opp("lead", 0), opp("lead", 0), opp("unknown_stage", 0),
+		opp("mql", 0), opp("disqualified", 0),
+		opp("sql", 0),
+		opp(" PROPOSAL ", 0), opp("closed_lost", 300),
+		opp("closed_won", 1000), opp("closed_won", 500),
+	}
+
+	metrics, err := transformer.CombineWithModel(ads, crm, LastTouch)
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	m := metrics[0]
+
+	// Cada oportunidad cuenta en su etapa y en todas las anteriores; las desconocidas sólo en la primera.
+	counts := make([]int, len(m.Funnel))
+	for i, step := range m.Funnel {
+		counts[i] = step.Count
+	}
+	assert.Equal(t, []int{10, 7, 5, 4, 2}, counts)
+	assert.Equal(t, 1, m.Funnel[1].Lost) // disqualified tras mql.
+	assert.Equal(t, 1, m.Funnel[3].Lost) // closed_lost tras opportunity.
+	assert.Zero(t, m.Funnel[0].ConversionRate)
+	assert.InDelta(t, 0.7, m.Funnel[1].ConversionRate, 0.001)
+	assert.InDelta(t, 0.5, m.Funnel[4].ConversionRate, 0.001)
+
+	assert.Equal(t, 10, m.Leads)
+	assert.Equal(t, 4, m.Opportunities)
+	assert.Equal(t, 2, m.ClosedWon)
+	assert.Equal(t, 1500.0, m.Revenue) // Sólo las ganadas suman ingresos.
+	assert.InDelta(t, 0.4, m.CVRLeadToOpp, 0.001)
+	assert.InDelta(t, 0.5, m.CVROppToWon, 0.001)
+}
+
+func TestCombineWithModel_FunnelSplitsCredit(t *testing.T) {
+	funnel, err := NewFunnel(FunnelConfig{Steps: []FunnelStepConfig{
+		{Name: "lead", Stages: []string{}},
+		{Name: "opportunity", Stages: []string{"opportunity"}},
+		{Name: "won", Stages: []string{"closed_won"}},
+	}})
+	require.NoError(t, err)
+	transformer := NewTransformer(WithAttribution(AttributionWindow, 30), WithFunnel(funnel))
+
+	ad := func(date string) data.AdPerformance {
+		return data.AdPerformance{Date: date, CampaignID: "C-" + date, Channel: "google_ads", Cost: 10, UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"}
+	}
+	crm := []data.Opportunity{{Stage: "closed_won", Amount: 100, CreatedAt: time.Date(2025, 8, 3, 0, 0, 0, 0, time.UTC),
+		UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"}}
+
+	// Con linear cada toque recibe la mitad del crédito en todas las etapas.
+	metrics, err := transformer.CombineWithModel([]data.AdPerformance{ad("2025-08-01"), ad("2025-08-02")}, crm, Linear)
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	for _, m := range metrics {
+		for _, step := range m.Funnel {
+			assert.InDelta(t, 0.5, step.Credit, 0.001, step.Step)
+		}
+		assert.InDelta(t, 0.5, m.OpportunityCredit, 0.001)
+		assert.InDelta(t, 1.0, m.CVROppToWon, 0.001)
+	}
+}
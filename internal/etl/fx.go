@@ -0,0 +1,219 @@
+// Package etl internal/etl/fx.go
+package etl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btors/admira-etl/internal/data"
+)
+
+// FXProvider obtiene tipos de cambio entre monedas (códigos ISO 4217).
+type FXProvider interface {
+	// Rate devuelve cuántas unidades de to equivalen a una unidad de from según el tipo vigente el día indicado.
+	Rate(from, to string, day time.Time) (float64, error)
+}
+
+// ErrFXRateNotFound se devuelve cuando no hay tipo de cambio para un par de monedas en una fecha.
+var ErrFXRateNotFound = errors.New("fx rate not found")
+
+// DefaultFXMaxAgeDays es la antigüedad máxima por defecto, en días, del tipo de cambio aplicado a una fecha.
+const DefaultFXMaxAgeDays = 7
+
+// FXRatesConfig es el contenido de un archivo de tipos de cambio diarios.
+type FXRatesConfig struct {
+	// Base es la moneda de referencia: cada tipo indica cuántas unidades de una moneda vale una unidad de Base.
+	Base string `json:"base"`
+	// MaxAgeDays es cuántos días puede usarse el último tipo publicado para fechas sin tipo propio
+	// (fines de semana, festivos); por defecto DefaultFXMaxAgeDays.
+	MaxAgeDays *int `json:"max_age_days,omitempty"`
+	// Rates asigna a cada día (YYYY-MM-DD) los tipos de ese día.
+	Rates map[string]map[string]float64 `json:"rates"`
+}
+
+// fxDay son los tipos de un día, respecto a la moneda base.
+type fxDay struct {
+	day   time.Time
+	rates map[string]float64
+}
+
+// fxTable son los tipos de cambio diarios ya validados, ordenados por día.
+type fxTable struct {
+	cfg    FXRatesConfig // Configuración de la que se construyó, para archivarla con cada ingesta.
+	base   string
+	maxAge int
+	days   []fxDay
+}
+
+// newFXTable valida la configuración y construye la tabla de tipos.
+func newFXTable(cfg FXRatesConfig) (*fxTable, error) {
+	base := NormalizeCurrency(cfg.Base)
+	if !validCurrency(base) {
+		return nil, fmt.Errorf("invalid base currency %q", cfg.Base)
+	}
+	t := &fxTable{cfg: cfg, base: base, maxAge: DefaultFXMaxAgeDays}
+	if cfg.MaxAgeDays != nil {
+		if *cfg.MaxAgeDays < 0 {
+			return nil, fmt.Errorf("max_age_days must be non-negative, got %d", *cfg.MaxAgeDays)
+		}
+		t.maxAge = *cfg.MaxAgeDays
+	}
+	for date, rates := range cfg.Rates {
+		day, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate date %q: %w", date, err)
+		}
+		normalized := make(map[string]float64, len(rates)+1)
+		for currency, rate := range rates {
+			code := NormalizeCurrency(currency)
+			if !validCurrency(code) {
+				return nil, fmt.Errorf("invalid currency %q on %s", currency, date)
+			}
+			if rate <= 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+				return nil, fmt.Errorf("invalid rate %g for %s on %s", rate, code, date)
+			}
+			normalized[code] = rate
+		}
+		normalized[base] = 1
+		t.days = append(t.days, fxDay{day: day, rates: normalized})
+	}
+	sort.Slice(t.days, func(i, j int) bool { return t.days[i].day.Before(t.days[j].day) })
+	return t, nil
+}
+
+// Rate implementa FXProvider con los tipos de la tabla; ver FileFXProvider.Rate.
+func (t *fxTable) Rate(from, to string, day time.Time) (float64, error) {
+	from, to = NormalizeCurrency(from), NormalizeCurrency(to)
+	if from == to {
+		return 1, nil
+	}
+	return t.rate(from, to, day)
+}
+
+// rate busca el día más reciente, no posterior a day ni más antiguo que maxAge, con tipo para ambas monedas.
+func (t *fxTable) rate(from, to string, day time.Time) (float64, error) {
+	day = data.CalendarDate(day)
+	oldest := day.AddDate(0, 0, -t.maxAge)
+	i := sort.Search(len(t.days), func(i int) bool { return t.days[i].day.After(day) })
+	for i--; i >= 0 && !t.days[i].day.Before(oldest); i-- {
+		fromRate, okFrom := t.days[i].rates[from]
+		toRate, okTo := t.days[i].rates[to]
+		if okFrom && okTo {
+			return toRate / fromRate, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s to %s on %s (looked back %d days)", ErrFXRateNotFound, from, to, day.Format("2006-01-02"), t.maxAge)
+}
+
+// LoadFXRatesConfig lee los tipos de cambio diarios de un archivo JSON.
+func LoadFXRatesConfig(path string) (FXRatesConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return FXRatesConfig{}, fmt.Errorf("failed to read fx rates: %w", err)
+	}
+	var cfg FXRatesConfig
+	decoder := json.NewDecoder(strings.NewReader(string(raw)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return FXRatesConfig{}, fmt.Errorf("failed to parse fx rates: %w", err)
+	}
+	return cfg, nil
+}
+
+// FileFXProvider sirve los tipos de cambio diarios de un archivo JSON y lo recarga cuando cambia,
+// de modo que basta con publicar en él los tipos de cada día.
+type FileFXProvider struct {
+	path    string
+	mu      sync.RWMutex // Protege table y modTime.
+	table   *fxTable
+	modTime time.Time
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewFileFXProvider carga los tipos de cambio del archivo indicado.
+func NewFileFXProvider(path string) (*FileFXProvider, error) {
+	p := &FileFXProvider{path: path, stop: make(chan struct{})}
+	if _, err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Rate devuelve cuántas unidades de to equivalen a una unidad de from el día indicado. Si ese día no tiene
+// tipo se usa el más reciente anterior dentro de max_age_days; los tipos cruzados se calculan vía la moneda base.
+func (p *FileFXProvider) Rate(from, to string, day time.Time) (float64, error) {
+	return p.current().Rate(from, to, day)
+}
+
+// current devuelve la tabla de tipos vigente. Es inmutable: una recarga crea otra.
+func (p *FileFXProvider) current() *fxTable {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.table
+}
+
+// Reload vuelve a leer el archivo si ha cambiado desde la última carga. Si no es válido conserva los tipos
+// vigentes y devuelve el error. Devuelve true si se cargaron tipos nuevos.
+func (p *FileFXProvider) Reload() (bool, error) {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read fx rates: %w", err)
+	}
+	p.mu.RLock()
+	unchanged := p.table != nil && info.ModTime().Equal(p.modTime)
+	p.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cfg, err := LoadFXRatesConfig(p.path)
+	if err != nil {
+		return false, err
+	}
+	table, err := newFXTable(cfg)
+	if err != nil {
+		return false, fmt.Errorf("invalid fx rates: %w", err)
+	}
+	p.mu.Lock()
+	p.table, p.modTime = table, info.ModTime()
+	p.mu.Unlock()
+	return true, nil
+}
+
+// Watch comprueba el archivo cada interval y lo recarga si ha cambiado, hasta que se llama a Stop.
+func (p *FileFXProvider) Watch(interval time.Duration) {
+	pollReload("FX rates", p.path, interval, p.stop, &p.wg, p.Reload)
+}
+
+// Stop detiene la recarga periódica.
+func (p *FileFXProvider) Stop() {
+	close(p.stop)
+	p.wg.Wait()
+}
+
+// NormalizeCurrency devuelve el código de moneda en mayúsculas y sin espacios alrededor.
+func NormalizeCurrency(currency string) string {
+	return strings.ToUpper(strings.TrimSpace(currency))
+}
+
+// validCurrency indica si el código tiene la forma de un código ISO 4217: tres letras mayúsculas.
+func validCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
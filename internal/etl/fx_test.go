@@ -0,0 +1,163 @@
+package etl
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btors/admira-etl/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// staticFX es un FXProvider fijo para las pruebas: rates[from] unidades de from valen una unidad de la moneda de reporte.
+type staticFX map[string]float64
+
+func (s staticFX) Rate(from, to string, _ time.Time) (float64, error) {
+	rate, ok := s[from]
+	if !ok {
+		return 0, ErrFXRateNotFound
+	}
+	return 1 / rate, nil
+}
+
+func fxDate(s string) time.Time {
+	d, _ := time.Parse("2006-01-02", s)
+	return d
+}
+
+func TestFileFXProvider_Example(t *testing.T) {
+	fx, err := NewFileFXProvider("../../fx_rates.example.json")
+	require.NoError(t, err)
+
+	rate, err := fx.Rate("usd", "EUR", fxDate("2025-08-01"))
+	require.NoError(t, err)
+	assert.InDelta(t, 0.92, rate, 1e-9)
+
+	// Tipo cruzado vía la moneda base.
+	rate, err = fx.Rate("EUR", "MXN", fxDate("2025-08-01"))
+	require.NoError(t, err)
+	assert.InDelta(t, 18.9/0.92, rate, 1e-9)
+
+	// El fin de semana usa el tipo del viernes; el lunes, el suyo.
+	rate, err = fx.Rate("EUR", "USD", time.Date(2025, 8, 3, 22, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.InDelta(t, 1/0.92, rate, 1e-9)
+	rate, err = fx.Rate("EUR", "USD", fxDate("2025-08-04"))
+	require.NoError(t, err)
+	assert.InDelta(t, 1/0.91, rate, 1e-9)
+
+	rate, err = fx.Rate("JPY", "JPY", fxDate("2020-01-01"))
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, rate)
+}
+
+func TestFileFXProvider_MissingOrStaleRate(t *testing.T) {
+	fx, err := NewFileFXProvider("../../fx_rates.example.json")
+	require.NoError(t, err)
+
+	_, err = fx.Rate("EUR", "USD", fxDate("2025-07-31")) // Anterior al primer tipo publicado.
+	assert.True(t, errors.Is(err, ErrFXRateNotFound))
+	_, err = fx.Rate("EUR", "USD", fxDate("2025-08-12")) // Más de max_age_days desde el último.
+	assert.True(t, errors.Is(err, ErrFXRateNotFound))
+	_, err = fx.Rate("JPY", "USD", fxDate("2025-08-01")) // Moneda sin tipo.
+	assert.True(t, errors.Is(err, ErrFXRateNotFound))
+}
+
+func TestNewFXTable_Validation(t *testing.T) {
+	negative := -1
+	for name, cfg := range map[string]FXRatesConfig{
+		"base":     {Base: "dollar"},
+		"max age":  {Base: "USD", MaxAgeDays: &negative},
+		"date":     {Base: "USD", Rates: map[string]map[string]float64{"01/08/2025": {"EUR": 0.92}}},
+		"currency": {Base: "USD", Rates: map[string]map[string]float64{"2025-08-01": {"EU": 0.92}}},
+		"rate":     {Base: "USD", Rates: map[string]map[string]float64{"2025-08-01": {"EUR": 0}}},
+	} {
+		_, err := newFXTable(cfg)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestFileFXProvider_ReloadKeepsPreviousRatesOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fx.json")
+	write := func(content string, mtime time.Time) {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+	start := time.Now().Add(-time.Hour)
+	write(`{"base": "USD", "rates": {"2025-08-01": {"EUR": 0.9}}}`, start)
+
+	fx, err := NewFileFXProvider(path)
+	require.NoError(t, err)
+
+	write(`{"base": "USD", "rates": {"2025-08-01": {"EUR": -1}}}`, start.Add(time.Minute))
+	_, err = fx.Reload()
+	assert.Error(t, err)
+	rate, err := fx.Rate("USD", "EUR", fxDate("2025-08-01"))
+	require.NoError(t, err)
+	assert.InDelta(t, 0.9, rate, 1e-9)
+
+	// Publicar un día nuevo basta para que se use.
+	write(`{"base": "USD", "rates": {"2025-08-01": {"EUR": 0.9}, "2025-08-02": {"EUR": 0.8}}}`, start.Add(2*time.Minute))
+	changed, err := fx.Reload()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	rate, err = fx.Rate("USD", "EUR", fxDate("2025-08-02"))
+	require.NoError(t, err)
+	assert.InDelta(t, 0.8, rate, 1e-9)
+}
+
+func TestCombine_ConvertsToReportingCurrency(t *testing.T) {
+	transformer := NewTransformer(
+		WithAttribution(AttributionNaive, 0),
+		WithReportingCurrency("usd", staticFX{"EUR": 0.8, "MXN": 20}),
+	)
+	ads := []data.AdPerformance{{
+		Date: "2025-08-01", CampaignID: "C-1", Clicks: 10, Cost: 80, Currency: "EUR",
+		UTMCampaign: "c", UTMSource: "s", UTMMedium: "m",
+	}}
+	opps := []data.Opportunity{
+		{OpportunityID: "O-1", Stage: "closed_won", Amount: 400, Currency: "EUR", UTMCampaign: "c", UTMSource: "s", UTMMedium: "m"},
+		{OpportunityID: "O-2", Stage: "closed_won", Amount: 2000, Currency: "mxn", UTMCampaign: "c", UTMSource: "s", UTMMedium: "m"},
+		{OpportunityID: "O-3", Stage: "closed_won", Amount: 50, UTMCampaign: "c", UTMSource: "s", UTMMedium: "m"}, // Sin moneda: ya en USD.
+	}
+
+	metrics, err := transformer.CombineWithModel(ads, opps, LastTouch)
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	m := metrics[0]
+
+	assert.Equal(t, "USD", m.Currency)
+	assert.InDelta(t, 100.0, m.Cost, 1e-9)
+	assert.InDelta(t, 500.0+100.0+50.0, m.Revenue, 1e-9)
+	assert.InDelta(t, 100.0/3, m.CPA, 1e-9)
+	assert.InDelta(t, 6.5, m.ROAS, 1e-9)
+	require.NotNil(t, m.OriginalCost)
+	assert.Equal(t, data.FXAmount{Currency: "EUR", Amount: 80, Rate: 1.25}, *m.OriginalCost)
+	assert.ElementsMatch(t, []data.FXAmount{
+		{Currency: "EUR", Amount: 400, Rate: 1.25},
+		{Currency: "MXN", Amount: 2000, Rate: 0.05},
+		{Currency: "USD", Amount: 50, Rate: 1},
+	}, m.OriginalRevenue)
+
+	// Los registros de entrada no se modifican.
+	assert.Equal(t, 80.0, ads[0].Cost)
+	assert.Equal(t, 400.0, opps[0].Amount)
+}
+
+func TestCombine_MissingFXRateFails(t *testing.T) {
+	transformer := NewTransformer(WithReportingCurrency("USD", staticFX{}))
+	ads := []data.AdPerformance{{Date: "2025-08-01", CampaignID: "C-1", Cost: 80, Currency: "GBP"}}
+
+	_, err := transformer.CombineWithModel(ads, nil, LastTouch)
+	assert.True(t, errors.Is(err, ErrFXRateNotFound))
+
+	// Sin moneda de reporte no se convierte nada.
+	metrics, err := NewTransformer().CombineWithModel(ads, nil, LastTouch)
+	require.NoError(t, err)
+	assert.Equal(t, 80.0, metrics[0].Cost)
+	assert.Empty(t, metrics[0].Currency)
+	assert.Nil(t, metrics[0].OriginalCost)
+}
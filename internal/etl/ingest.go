@@ -2,145 +2,343 @@
 package etl
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
+	"io"
+	"log"
 	"sync"
 	"time"
 
 	"github.com/btors/admira-etl/internal/data"
 )
 
+// Nombres de las fuentes históricas, usados como clave de sus marcas de agua.
+const (
+	SourceAds = "ads"
+	SourceCRM = "crm"
+)
+
 // Ingestor es una estructura que maneja la ingesta de datos desde servicios externos.
+// Descarga en paralelo todas las fuentes de Ads y CRM de su registro.
 type Ingestor struct {
-	adsURL string
-	crmURL string
-	client *http.Client
+	registry *SourceRegistry
 }
 
-// adsAPIResponse representa la estructura de la respuesta del servicio de anuncios.
-type adsAPIResponse struct {
-	External struct {
-		Ads struct {
-			Performance []data.AdPerformance `json:"performance"`
-		} `json:"ads"`
-	} `json:"external"`
+// FetchResult reúne los datos descargados de todas las fuentes.
+type FetchResult struct {
+	Ads           []data.AdPerformance // Sólo en Fetch; Stream entrega los registros al sink.
+	Opportunities []data.Opportunity   // Sólo en Fetch; Stream entrega los registros al sink.
+	Fetched       map[string]int       // Registros recibidos por fuente.
+	Latest        map[string]time.Time // Registro más reciente recibido por fuente; ausente si no trajo ninguno.
+	Errors        map[string]error     // Sólo en Fetch: error de cada fuente que falló; sus registros no se incluyen.
 }
 
-// crmAPIResponse representa la estructura de la respuesta del servicio CRM.
-type crmAPIResponse struct {
-	External struct {
-		CRM struct {
-			Opportunities []data.Opportunity `json:"opportunities"`
-		} `json:"crm"`
-	} `json:"external"`
+// NewIngestor crea y devuelve una nueva instancia de Ingestor con las dos fuentes históricas de Ads y CRM.
+func NewIngestor(adsURL, crmURL string) (*Ingestor, error) {
+	registry, err := LegacySourceRegistry(adsURL, crmURL, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return NewIngestorFromRegistry(registry), nil
 }
 
-// NewIngestor crea y devuelve una nueva instancia de Ingestor.
-func NewIngestor(adsURL, crmURL string) *Ingestor {
-	return &Ingestor{
-		adsURL: adsURL,
-		crmURL: crmURL,
-		client: &http.Client{Timeout: 10 * time.Second},
-	}
+// NewIngestorFromRegistry crea un Ingestor sobre las fuentes del registro.
+func NewIngestorFromRegistry(registry *SourceRegistry) *Ingestor {
+	return &Ingestor{registry: registry}
+}
+
+// Sources devuelve el registro de fuentes del Ingestor.
+func (i *Ingestor) Sources() *SourceRegistry {
+	return i.registry
 }
 
-// FetchData obtiene datos de los servicios de anuncios y CRM de forma concurrente.
+// FetchData obtiene datos de los servicios de anuncios y CRM de forma concurrente. Si alguna fuente falla,
+// devuelve su error junto con los datos de las fuentes que sí respondieron.
 func (i *Ingestor) FetchData(since *time.Time) ([]data.AdPerformance, []data.Opportunity, error) {
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	var adsData []data.AdPerformance
-	var crmData []data.Opportunity
-	var adsErr, crmErr error
-
-	go func() {
-		defer wg.Done()
-		var adsResponse adsAPIResponse
-		if err := i.fetchAndDecode(i.adsURL, &adsResponse); err != nil {
-			adsErr = fmt.Errorf("failed to fetch ads data: %w", err)
-			return
+	window := make(map[string]*time.Time)
+	for _, name := range i.registry.Names() {
+		window[name] = since
+	}
+	result, err := i.Fetch(window)
+	return result.Ads, result.Opportunities, err
+}
+
+// IngestSink recibe los lotes de registros de Stream. Stream serializa las llamadas, así que una
+// implementación no necesita sincronización propia aunque las fuentes se descarguen en paralelo.
+type IngestSink interface {
+	AddAds(source string, batch []data.AdPerformance) error
+	AddOpportunities(source string, batch []data.Opportunity) error
+}
+
+// collectSink acumula en memoria los lotes de cada fuente.
+type collectSink struct {
+	ads  map[string][]data.AdPerformance
+	opps map[string][]data.Opportunity
+}
+
+// AddAds añade un lote de filas de Ads.
+func (c *collectSink) AddAds(source string, batch []data.AdPerformance) error {
+	c.ads[source] = append(c.ads[source], batch...)
+	return nil
+}
+
+// AddOpportunities añade un lote de oportunidades.
+func (c *collectSink) AddOpportunities(source string, batch []data.Opportunity) error {
+	c.opps[source] = append(c.opps[source], batch...)
+	return nil
+}
+
+// Fetch descarga en paralelo todas las fuentes y devuelve en memoria los registros de las que respondieron,
+// en orden de registro. Una fuente que falla no impide devolver las demás: su error figura en result.Errors y
+// en el error devuelto, que los une todos, y sus registros se descartan aunque hubiera entregado alguno.
+func (i *Ingestor) Fetch(window map[string]*time.Time) (FetchResult, error) {
+	sink := &collectSink{ads: make(map[string][]data.AdPerformance), opps: make(map[string][]data.Opportunity)}
+	state := i.stream(window, DefaultBatchSize, sink, nil)
+
+	result := state.result
+	result.Errors = state.failed
+	for name := range state.failed {
+		delete(result.Fetched, name)
+		delete(result.Latest, name)
+	}
+	for _, source := range i.registry.AdsSources() {
+		if _, failed := state.failed[source.Name()]; !failed {
+			result.Ads = append(result.Ads, sink.ads[source.Name()]...)
 		}
-		adsData = adsResponse.External.Ads.Performance
-	}()
-
-	go func() {
-		defer wg.Done()
-		var crmResponse crmAPIResponse
-		if err := i.fetchAndDecode(i.crmURL, &crmResponse); err != nil {
-			crmErr = fmt.Errorf("failed to fetch crm data: %w", err)
-			return
+	}
+	for _, source := range i.registry.CRMSources() {
+		if _, failed := state.failed[source.Name()]; !failed {
+			result.Opportunities = append(result.Opportunities, sink.opps[source.Name()]...)
 		}
-		crmData = crmResponse.External.CRM.Opportunities
-	}()
+	}
+	return result, errors.Join(state.errs...)
+}
 
-	wg.Wait()
+// archivingAdsSource es una fuente de Ads capaz de archivar sus respuestas en bruto y de volver a procesarlas desde
+// el archivo, que además entrega en bruto los registros que no puede decodificar.
+type archivingAdsSource interface {
+	streamAdsArchived(since *time.Time, batchSize int, run *data.ArchiveRun, fn func([]data.AdPerformance) error, undecoded undecodedFunc) error
+	replayAds(pages payloadPages, since *time.Time, batchSize int, fn func([]data.AdPerformance) error, undecoded undecodedFunc) error
+}
+
+// archivingCRMSource es el equivalente de archivingAdsSource para fuentes de CRM.
+type archivingCRMSource interface {
+	streamOpportunitiesArchived(since *time.Time, batchSize int, run *data.ArchiveRun, fn func([]data.Opportunity) error, undecoded undecodedFunc) error
+	replayOpportunities(pages payloadPages, since *time.Time, batchSize int, fn func([]data.Opportunity) error, undecoded undecodedFunc) error
+}
+
+// undecodedSink lo implementa un IngestSink que recibe los registros que una fuente no pudo decodificar,
+// con sus bytes originales, en lugar de que la fuente los descarte.
+type undecodedSink interface {
+	RejectUndecoded(source, kind string, raw json.RawMessage, err error) error
+}
 
-	if adsErr != nil {
-		return nil, nil, adsErr
+// Stream descarga en paralelo todas las fuentes, cada una desde el inicio de su ventana (completa si no figura
+// en window), y entrega sus registros a sink en lotes de como mucho batchSize. El resultado sólo incluye los
+// conteos y el registro más reciente por fuente. Si falla cualquier fuente se devuelve error: una ingesta
+// parcial atribuiría mal las oportunidades. Con run, las respuestas en bruto se archivan en él.
+func (i *Ingestor) Stream(window map[string]*time.Time, batchSize int, sink IngestSink, run *data.ArchiveRun) (FetchResult, error) {
+	return i.stream(window, batchSize, sink, run).finish()
+}
+
+// stream descarga en paralelo todas las fuentes hacia sink y devuelve el estado con los conteos y los errores
+// de cada fuente.
+func (i *Ingestor) stream(window map[string]*time.Time, batchSize int, sink IngestSink, run *data.ArchiveRun) *streamState {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
 	}
-	if crmErr != nil {
-		return nil, nil, crmErr
+
+	var wg sync.WaitGroup
+	state := newStreamState(sink)
+
+	for _, source := range i.registry.AdsSources() {
+		name := source.Name()
+		stream := source.StreamAds
+		if archiving, ok := source.(archivingAdsSource); ok {
+			stream = func(since *time.Time, size int, fn func([]data.AdPerformance) error) error {
+				return archiving.streamAdsArchived(since, size, run, fn, state.undecoded(name, data.QuarantineKindAd))
+			}
+		} else if run != nil {
+			run.MarkIncomplete(fmt.Sprintf("source %s does not support archiving", name))
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := stream(window[name], batchSize, state.ads(name)); err != nil {
+				state.fail(name, fmt.Errorf("failed to fetch ads data from %s: %w", name, err))
+			}
+		}()
 	}
 
-	// Aplica un filtro basado en la fecha proporcionada en el parámetro 'since'.
-	transformer := NewTransformer()
-	if since != nil {
-		adsData = transformer.FilterAdsByDate(adsData, since)
-		crmData = transformer.FilterCRMByDate(crmData, since)
+	for _, source := range i.registry.CRMSources() {
+		name := source.Name()
+		stream := source.StreamOpportunities
+		if archiving, ok := source.(archivingCRMSource); ok {
+			stream = func(since *time.Time, size int, fn func([]data.Opportunity) error) error {
+				return archiving.streamOpportunitiesArchived(since, size, run, fn, state.undecoded(name, data.QuarantineKindOpportunity))
+			}
+		} else if run != nil {
+			run.MarkIncomplete(fmt.Sprintf("source %s does not support archiving", name))
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := stream(window[name], batchSize, state.opportunities(name)); err != nil {
+				state.fail(name, fmt.Errorf("failed to fetch crm data from %s: %w", name, err))
+			}
+		}()
 	}
 
-	return adsData, crmData, nil
+	wg.Wait()
+	return state
 }
 
-// fetchAndDecode realiza una solicitud HTTP GET y decodifica la respuesta JSON.
-func (i *Ingestor) fetchAndDecode(url string, target interface{}) error {
-	const maxRetries = 3
-	const baseDelay = 500 * time.Millisecond
-
-	// Intenta realizar la solicitud hasta el número máximo de reintentos.
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
+// Replay vuelve a procesar las respuestas archivadas de una ingesta sin acceder a la red: cada fuente de la
+// ingesta decodifica sus páginas con su configuración actual y las filtra con la ventana original. Las fuentes
+// se procesan de una en una y en orden, para que el resultado sea determinista.
+func (i *Ingestor) Replay(run *data.ArchivedRun, archive *data.PayloadArchive, batchSize int, sink IngestSink) (FetchResult, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	for name := range run.Window {
+		if !i.registry.Has(name) {
+			return FetchResult{}, fmt.Errorf("source %s of run %s is no longer configured", name, run.RunID)
+		}
+	}
 
-		// Crea una nueva solicitud HTTP GET.
-		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-		if err != nil {
-			return fmt.Errorf("failed to create request: %w", err)
+	state := newStreamState(sink)
+	for _, source := range i.registry.AdsSources() {
+		name := source.Name()
+		since, ok := run.Window[name]
+		if !ok {
+			continue
+		}
+		archiving, ok := source.(archivingAdsSource)
+		if !ok {
+			return FetchResult{}, fmt.Errorf("source %s does not support replay", name)
+		}
+		if err := archiving.replayAds(archivedPages(run, archive, name), since, batchSize, state.ads(name), state.undecoded(name, data.QuarantineKindAd)); err != nil {
+			return FetchResult{}, fmt.Errorf("failed to replay ads data from %s: %w", name, err)
 		}
+	}
+	for _, source := range i.registry.CRMSources() {
+		name := source.Name()
+		since, ok := run.Window[name]
+		if !ok {
+			continue
+		}
+		archiving, ok := source.(archivingCRMSource)
+		if !ok {
+			return FetchResult{}, fmt.Errorf("source %s does not support replay", name)
+		}
+		if err := archiving.replayOpportunities(archivedPages(run, archive, name), since, batchSize, state.opportunities(name), state.undecoded(name, data.QuarantineKindOpportunity)); err != nil {
+			return FetchResult{}, fmt.Errorf("failed to replay crm data from %s: %w", name, err)
+		}
+	}
+	return state.finish()
+}
 
-		// Realiza la solicitud HTTP.
-		resp, err := i.client.Do(req)
-		if err != nil {
-			if attempt < maxRetries {
-				time.Sleep(baseDelay * time.Duration(1<<attempt)) // Exponential backoff
+// archivedPages recorre en orden de página las respuestas archivadas de una fuente. Cada respuesta se lee
+// hasta el final para comprobar su hash.
+func archivedPages(run *data.ArchivedRun, archive *data.PayloadArchive, source string) payloadPages {
+	return func(fn func(io.Reader) error) error {
+		for _, payload := range run.Payloads {
+			if payload.Source != source {
 				continue
 			}
-			return fmt.Errorf("request failed after %d attempts: %w", attempt, err)
+			r, err := archive.Open(payload.SHA256)
+			if err != nil {
+				return err
+			}
+			err = fn(r)
+			if err == nil {
+				_, err = io.Copy(io.Discard, r)
+			}
+			r.Close()
+			if err != nil {
+				return err
+			}
 		}
+		return nil
+	}
+}
 
-		defer resp.Body.Close() // Cierra el cuerpo de la respuesta al finalizar
+// streamState acumula los conteos de una descarga y serializa las llamadas al sink de todas las fuentes.
+type streamState struct {
+	mu     sync.Mutex
+	sink   IngestSink
+	result FetchResult
+	errs   []error
+	failed map[string]error // Error de cada fuente que falló.
+}
 
-		if resp.StatusCode != http.StatusOK {
-			if attempt < maxRetries {
-				time.Sleep(baseDelay * time.Duration(1<<attempt)) // Exponential backoff
-				continue
+// newStreamState crea el estado de una descarga hacia sink.
+func newStreamState(sink IngestSink) *streamState {
+	return &streamState{
+		sink:   sink,
+		result: FetchResult{Fetched: make(map[string]int), Latest: make(map[string]time.Time)},
+		failed: make(map[string]error),
+	}
+}
+
+// ads devuelve la función que recibe los lotes de Ads de la fuente name.
+func (st *streamState) ads(name string) func([]data.AdPerformance) error {
+	return func(batch []data.AdPerformance) error {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		st.result.Fetched[name] += len(batch)
+		for _, ad := range batch {
+			if d, err := time.Parse("2006-01-02", ad.Date); err == nil && d.After(st.result.Latest[name]) {
+				st.result.Latest[name] = d
 			}
-			return fmt.Errorf("received non-200 status code: %d", resp.StatusCode)
 		}
+		return st.sink.AddAds(name, batch)
+	}
+}
 
-		if err := json.NewDecoder(resp.Body).Decode(target); err != nil {
-			if attempt < maxRetries {
-				time.Sleep(baseDelay * time.Duration(1<<attempt)) // Exponential backoff
-				continue
+// opportunities devuelve la función que recibe los lotes de oportunidades de la fuente name.
+func (st *streamState) opportunities(name string) func([]data.Opportunity) error {
+	return func(batch []data.Opportunity) error {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		st.result.Fetched[name] += len(batch)
+		for _, opp := range batch {
+			if opp.CreatedAt.After(st.result.Latest[name]) {
+				st.result.Latest[name] = opp.CreatedAt
 			}
-			return fmt.Errorf("failed to decode response: %w", err)
 		}
+		return st.sink.AddOpportunities(name, batch)
+	}
+}
 
-		return nil
+// undecoded devuelve la función que recibe los registros de la fuente name que no se pudieron decodificar:
+// los entrega al sink si los acepta y, si no, los descarta con un aviso.
+func (st *streamState) undecoded(name, kind string) undecodedFunc {
+	rejecter, ok := st.sink.(undecodedSink)
+	return func(raw json.RawMessage, err error) error {
+		if !ok {
+			log.Printf("WARN: Source %s: skipping %s record that could not be decoded: %v", name, kind, err)
+			return nil
+		}
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		return rejecter.RejectUndecoded(name, kind, raw, err)
 	}
+}
+
+// fail registra el error de la fuente name.
+func (st *streamState) fail(name string, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.errs = append(st.errs, err)
+	st.failed[name] = err
+}
 
-	return fmt.Errorf("exceeded maximum retries for URL: %s", url)
+// finish devuelve el resultado de la descarga, o los errores de todas las fuentes que fallaron.
+func (st *streamState) finish() (FetchResult, error) {
+	if len(st.errs) > 0 {
+		return FetchResult{}, errors.Join(st.errs...)
+	}
+	return st.result, nil
 }
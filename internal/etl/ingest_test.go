@@ -6,8 +6,17 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// newLegacyRegistry crea el registro de las dos fuentes históricas y falla el test si no puede.
+func newLegacyRegistry(t *testing.T, adsURL, crmURL, adsSinceParam, crmSinceParam string) *SourceRegistry {
+	t.Helper()
+	registry, err := LegacySourceRegistry(adsURL, crmURL, adsSinceParam, crmSinceParam)
+	require.NoError(t, err)
+	return registry
+}
+
 func TestIngestor_FetchData(t *testing.T) {
 	// Crea un servidor de prueba para simular la API de Ads.
 	adsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -62,10 +71,11 @@ func TestIngestor_FetchData(t *testing.T) {
 	defer crmServer.Close()
 
 	// Crea una instancia del Ingestor con las URLs de los servidores de prueba.
-	ingestor := NewIngestor(adsServer.URL, crmServer.URL)
+	ingestor, err := NewIngestor(adsServer.URL, crmServer.URL)
+	require.NoError(t, err)
 
 	// Llama al metodo FetchData para obtener los datos simulados de Ads y CRM.
-	adsData, crmData, err := ingestor.FetchData()
+	adsData, crmData, err := ingestor.FetchData(nil)
 
 	// Verifica que no se haya producido ningún error durante la obtención de datos.
 	assert.NoError(t, err)
@@ -78,3 +88,28 @@ func TestIngestor_FetchData(t *testing.T) {
 	// Verifica que el ID de la oportunidad en los datos de CRM sea el esperado.
 	assert.Equal(t, "O-9001", crmData[0].OpportunityID)
 }
+
+func TestIngestor_FetchKeepsSourcesThatSucceeded(t *testing.T) {
+	adsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"external": {"ads": {"performance": [
+			{"date": "2025-08-01", "campaign_id": "C-1001", "channel": "google_ads", "clicks": 100, "cost": 50.0, "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"}
+		]}}}`))
+	}))
+	defer adsServer.Close()
+	crmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer crmServer.Close()
+
+	ingestor := NewIngestorFromRegistry(newLegacyRegistry(t, adsServer.URL, crmServer.URL, "", ""))
+	result, err := ingestor.Fetch(nil)
+
+	// El fallo de CRM se informa, pero los datos de Ads siguen disponibles.
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "crm")
+	require.Len(t, result.Ads, 1)
+	assert.Empty(t, result.Opportunities)
+	assert.Equal(t, map[string]int{SourceAds: 1}, result.Fetched)
+	require.Contains(t, result.Errors, SourceCRM)
+	assert.NotContains(t, result.Errors, SourceAds)
+}
@@ -0,0 +1,134 @@
+// Package etl internal/etl/join.go
+package etl
+
+import (
+	"sort"
+	"time"
+
+	"github.com/btors/admira-etl/internal/data"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	joinOpportunities = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "etl_join_opportunities",
+			Help: "Oportunidades de CRM de la última ingesta, según se acreditaron a alguna fila de Ads (matched) o no (orphan).",
+		},
+		[]string{"status"},
+	)
+
+	joinOrphanAmount = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "etl_join_orphan_amount",
+			Help: "Importe total de las oportunidades de la última ingesta que no se acreditaron a ninguna fila de Ads.",
+		},
+	)
+
+	joinAdRows = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "etl_join_ad_rows",
+			Help: "Filas de Ads de la última ingesta, según recibieron alguna conversión (converted) o ninguna (unconverted).",
+		},
+		[]string{"status"},
+	)
+
+	joinReportTimestamp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "etl_join_report_timestamp_seconds",
+			Help: "Instante en que se generó el último informe de cruce, en segundos Unix.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(joinOpportunities)
+	prometheus.MustRegister(joinOrphanAmount)
+	prometheus.MustRegister(joinAdRows)
+	prometheus.MustRegister(joinReportTimestamp)
+}
+
+// publishJoinReport actualiza los gauges de Prometheus con el resumen del informe de cruce.
+func publishJoinReport(report data.JoinReport) {
+	joinOpportunities.WithLabelValues("matched").Set(float64(report.MatchedOpportunities))
+	joinOpportunities.WithLabelValues("orphan").Set(float64(report.OrphanOpportunities))
+	joinOrphanAmount.Set(report.OrphanAmount)
+	joinAdRows.WithLabelValues("converted").Set(float64(report.AdRows - report.AdsWithoutConversions))
+	joinAdRows.WithLabelValues("unconverted").Set(float64(report.AdsWithoutConversions))
+	joinReportTimestamp.Set(float64(report.GeneratedAt.Unix()))
+}
+
+// buildJoinReport construye el informe de cruce a partir de las filas de Ads agregadas, con su crédito,
+// los grupos de oportunidades y el motivo por el que cada grupo quedó sin acreditar ("" si se acreditó).
+func buildJoinReport(rows []*adRow, groups []*oppGroup, orphans []string) data.JoinReport {
+	report := data.JoinReport{
+		GeneratedAt:    time.Now().UTC(),
+		Keys:           []data.JoinKeyStats{},
+		Orphans:        []data.OrphanOpportunity{},
+		UnconvertedAds: []data.UnconvertedAd{},
+	}
+	byKey := make(map[string]*data.JoinKeyStats)
+	stats := func(key string) *data.JoinKeyStats {
+		if byKey[key] == nil {
+			byKey[key] = &data.JoinKeyStats{Key: key}
+		}
+		return byKey[key]
+	}
+
+	for _, row := range rows {
+		report.AdRows++
+		converted := row.credit.leads > 0
+		for _, key := range row.keys {
+			s := stats(key)
+			s.AdRows++
+			if converted {
+				s.ConvertedAdRows++
+			}
+		}
+		if converted {
+			continue
+		}
+		report.AdsWithoutConversions++
+		report.UnconvertedAds = append(report.UnconvertedAds, data.UnconvertedAd{
+			Date: row.ad.Date, CampaignID: row.ad.CampaignID, Channel: row.ad.Channel, Key: row.keys[0], Cost: row.ad.Cost,
+		})
+	}
+
+	for g, group := range groups {
+		report.Opportunities += group.count
+		s := stats(group.key)
+		s.Opportunities += group.count
+		if orphans[g] == "" {
+			report.MatchedOpportunities += group.count
+			s.MatchedOpportunities += group.count
+			continue
+		}
+		report.OrphanOpportunities += group.count
+		report.OrphanAmount += group.amount
+		s.UnmatchedOpportunities += group.count
+		s.UnmatchedAmount += group.amount
+		for _, m := range group.members {
+			report.Orphans = append(report.Orphans, data.OrphanOpportunity{
+				OpportunityID: m.id, Key: group.key, Stage: group.stage, Amount: m.amount,
+				CreatedAt: m.createdAt, Reason: orphans[g],
+			})
+		}
+	}
+
+	// Primero las claves que más importe pierden y, a igualdad, las que más oportunidades dejan sin cruzar.
+	for _, s := range byKey {
+		report.Keys = append(report.Keys, *s)
+	}
+	sort.Slice(report.Keys, func(i, j int) bool {
+		a, b := report.Keys[i], report.Keys[j]
+		if a.UnmatchedAmount != b.UnmatchedAmount {
+			return a.UnmatchedAmount > b.UnmatchedAmount
+		}
+		if a.UnmatchedOpportunities != b.UnmatchedOpportunities {
+			return a.UnmatchedOpportunities > b.UnmatchedOpportunities
+		}
+		return a.Key < b.Key
+	})
+	sort.SliceStable(report.Orphans, func(i, j int) bool { return report.Orphans[i].Amount > report.Orphans[j].Amount })
+	return report
+}
@@ -0,0 +1,58 @@
+package etl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btors/admira-etl/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCombineWithReport_OrphansAndUnconvertedAds(t *testing.T) {
+	ads := []data.AdPerformance{
+		{Date: "2025-08-10", CampaignID: "C-1", Channel: "google_ads", Cost: 50, UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"},
+		{Date: "2025-08-10", CampaignID: "C-2", Channel: "meta_ads", Cost: 30, UTMCampaign: "launch", UTMSource: "facebook", UTMMedium: "paid_social"},
+		{Date: "invalid", CampaignID: "C-3", Channel: "meta_ads", Cost: 99, UTMCampaign: "ignored"},
+	}
+	opp := func(id, campaign string, amount float64, created time.Time) data.Opportunity {
+		return data.Opportunity{OpportunityID: id, Stage: "closed_won", Amount: amount, CreatedAt: created, UTMCampaign: campaign, UTMSource: "google", UTMMedium: "cpc"}
+	}
+	aug := func(day int) time.Time { return time.Date(2025, 8, day, 12, 0, 0, 0, time.UTC) }
+	crm := []data.Opportunity{
+		opp("O-1", "summer_sale", 100, aug(12)),
+		opp("O-2", "summer_sale", 400, aug(5)), // Anterior a la fila de Ads: fuera de la ventana.
+		opp("O-3", "newsletter", 250, aug(12)), // Sin filas de Ads con su clave.
+	}
+
+	_, report, err := NewTransformer(WithAttribution(AttributionWindow, 30)).CombineWithReport(ads, crm, Linear)
+	require.NoError(t, err)
+	assert.Equal(t, "linear", report.Model)
+	assert.Equal(t, 2, report.AdRows) // La fila con fecha inválida no cuenta.
+	assert.Equal(t, 3, report.Opportunities)
+	assert.Equal(t, 1, report.MatchedOpportunities)
+	assert.Equal(t, 2, report.OrphanOpportunities)
+	assert.Equal(t, 650.0, report.OrphanAmount)
+
+	require.Len(t, report.Orphans, 2)
+	assert.Equal(t, data.OrphanOpportunity{OpportunityID: "O-2", Key: "summer_sale|google|cpc", Stage: "closed_won", Amount: 400, CreatedAt: aug(5), Reason: data.OrphanOutsideWindow}, report.Orphans[0])
+	assert.Equal(t, data.OrphanNoAdsForKey, report.Orphans[1].Reason)
+
+	assert.Equal(t, 1, report.AdsWithoutConversions)
+	require.Len(t, report.UnconvertedAds, 1)
+	assert.Equal(t, "C-2", report.UnconvertedAds[0].CampaignID)
+
+	// Las claves que más importe pierden van primero.
+	require.Len(t, report.Keys, 3)
+	assert.Equal(t, data.JoinKeyStats{Key: "summer_sale|google|cpc", AdRows: 1, ConvertedAdRows: 1, Opportunities: 2,
+		MatchedOpportunities: 1, UnmatchedOpportunities: 1, UnmatchedAmount: 400}, report.Keys[0])
+	assert.Equal(t, "newsletter|google|cpc", report.Keys[1].Key)
+	assert.Equal(t, data.JoinKeyStats{Key: "launch|facebook|paid_social", AdRows: 1}, report.Keys[2])
+
+	// En modo naive sólo quedan huérfanas las oportunidades sin filas de Ads con su clave.
+	_, report, err = NewTransformer(WithAttribution(AttributionNaive, 30)).CombineWithReport(ads, crm, LastTouch)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.MatchedOpportunities)
+	require.Len(t, report.Orphans, 1)
+	assert.Equal(t, "O-3", report.Orphans[0].OpportunityID)
+}
@@ -0,0 +1,259 @@
+// Package etl internal/etl/outbox.go
+package etl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btors/admira-etl/internal/data"
+)
+
+// DefaultOutboxMaxAttempts es el número de vaciados fallidos tras el cual una versión pendiente va a la DLQ.
+const DefaultOutboxMaxAttempts = 10
+
+// OutboxDispatcher vacía el outbox de exportación: envía a los sinks las versiones pendientes de las métricas,
+// en lotes del tamaño de exportación, y las marca como entregadas cuando todos los sinks las aceptan. La entrega es al menos
+// una vez: si el proceso cae entre el envío y la marca, el lote se reenvía en el siguiente vaciado.
+type OutboxDispatcher struct {
+	outbox      data.ExportOutbox
+	exporter    *Exporter
+	maxAttempts int // Vaciados fallidos de una versión antes de moverla a la DLQ.
+
+	mu   sync.Mutex // Evita dos vaciados simultáneos en la misma réplica.
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// OutboxDispatcherOption permite personalizar un OutboxDispatcher al crearlo.
+type OutboxDispatcherOption func(*OutboxDispatcher)
+
+// WithOutboxMaxAttempts fija cuántos vaciados fallidos admite una versión antes de moverla a la DLQ.
+func WithOutboxMaxAttempts(attempts int) OutboxDispatcherOption {
+	return func(d *OutboxDispatcher) {
+		if attempts > 0 {
+			d.maxAttempts = attempts
+		}
+	}
+}
+
+// NewOutboxDispatcher crea un dispatcher que envía con exporter los registros pendientes de outbox.
+func NewOutboxDispatcher(outbox data.ExportOutbox, exporter *Exporter, opts ...OutboxDispatcherOption) *OutboxDispatcher {
+	d := &OutboxDispatcher{outbox: outbox, exporter: exporter, maxAttempts: DefaultOutboxMaxAttempts, stop: make(chan struct{})}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// OutboxResult resume un vaciado del outbox.
+type OutboxResult struct {
+	Batches      int // Lotes enviados a los sinks.
+	Delivered    int // Registros entregados.
+	Failed       int // Registros que el sink no aceptó y siguen pendientes.
+	DeadLettered int // Registros movidos a la DLQ.
+}
+
+// Dispatch envía los registros pendientes hasta vaciar el outbox o hasta el primer lote que algún sink no
+// acepta tras los reintentos. Cada registro anota los sinks que ya lo aceptaron, y un reenvío sólo va a los que
+// faltan; los registros de un lote que no llegaron a los mismos sinks se envían por separado. Cada registro de
+// un lote fallido suma un intento fallido. Los que un sink rechaza de forma permanente, o que agotan los
+// intentos, se guardan en la DLQ de cada sink que no los aceptó y salen del outbox, para que no bloqueen a los
+// siguientes; el resto sigue pendiente y se reenvía en el siguiente vaciado. Tras un rechazo permanente el
+// vaciado continúa; tras un fallo transitorio se detiene, porque el sink no está disponible. Sin DLQ
+// configurada los registros nunca salen del outbox sin entregarse.
+func (d *OutboxDispatcher) Dispatch() (OutboxResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var result OutboxResult
+	batchSize := d.exporter.BatchSize()
+	for {
+		records, err := d.outbox.PendingOutbox(batchSize)
+		if err != nil {
+			return result, fmt.Errorf("failed to read outbox: %w", err)
+		}
+		if len(records) == 0 {
+			return result, nil
+		}
+
+		for _, batch := range groupByDelivered(records) {
+			if err := d.deliver(batch, &result); err != nil {
+				return result, err
+			}
+		}
+
+		// Un lote incompleto vacía el outbox; los cambios guardados mientras tanto esperan al siguiente vaciado.
+		if len(records) < batchSize {
+			return result, nil
+		}
+	}
+}
+
+// deliver envía un lote de registros que ya aceptaron los mismos sinks a los sinks que faltan. Devuelve error
+// si el lote sigue pendiente; un lote movido entero a la DLQ por un rechazo permanente no lo es.
+func (d *OutboxDispatcher) deliver(records []data.OutboxRecord, result *OutboxResult) error {
+	result.Batches++
+	delivered := records[0].DeliveredTo
+	_, err := d.exporter.Send(outboxPayload(records), len(records), delivered...)
+	if accepted := acceptedSinks(d.exporter.SinkNames(), delivered, err); err != nil && len(accepted) > 0 {
+		if markErr := d.outbox.MarkOutboxSinksDelivered(records, accepted); markErr != nil {
+			// Sin la anotación, el siguiente vaciado también los reenvía a esos sinks, con la misma clave.
+			log.Printf("ERROR: Failed to record outbox delivery to sinks %v: %v", accepted, markErr)
+		}
+	}
+	if err != nil {
+		if markErr := d.outbox.MarkOutboxFailed(records, err.Error()); markErr != nil {
+			log.Printf("ERROR: Failed to record outbox delivery failure: %v", markErr)
+		}
+		permanent, dead := d.deadLetters(records, err)
+		result.DeadLettered += dead
+		result.Failed += len(records) - dead
+		if permanent && dead == len(records) {
+			log.Printf("WARN: Sink rejected %d outbox records, moved to the dead-letter queue: %v", dead, err)
+			return nil
+		}
+		return fmt.Errorf("failed to deliver %d outbox records: %w", len(records), err)
+	}
+	if err := d.outbox.MarkOutboxDelivered(records); err != nil {
+		// Los sinks ya los aceptaron; seguirán pendientes y se reenviarán, como permite la entrega al menos una vez.
+		return fmt.Errorf("failed to mark outbox records as delivered: %w", err)
+	}
+	result.Delivered += len(records)
+	return nil
+}
+
+// groupByDelivered separa los registros según los sinks que ya los aceptaron, en el orden en que aparecen.
+func groupByDelivered(records []data.OutboxRecord) [][]data.OutboxRecord {
+	var groups [][]data.OutboxRecord
+	index := make(map[string]int)
+	for _, record := range records {
+		key := strings.Join(record.DeliveredTo, "\x00")
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], record)
+	}
+	return groups
+}
+
+// acceptedSinks devuelve los sinks que aceptaron un envío: los configurados que no lo tenían ya y no fallaron.
+func acceptedSinks(sinks, delivered []string, sendErr error) []string {
+	var failed SinkErrors
+	if sendErr != nil && !errors.As(sendErr, &failed) {
+		return nil
+	}
+	var accepted []string
+	for _, name := range sinks {
+		if _, ok := failed[name]; !ok && !slices.Contains(delivered, name) {
+			accepted = append(accepted, name)
+		}
+	}
+	return accepted
+}
+
+// deadLetters guarda en la DLQ los registros de un lote fallido que no deben reintentarse: todos si algún sink
+// lo rechazó de forma permanente, o los que agotaron los intentos, y los saca del outbox. Devuelve si el fallo
+// fue permanente y cuántos registros se movieron.
+func (d *OutboxDispatcher) deadLetters(records []data.OutboxRecord, sendErr error) (bool, int) {
+	var failed SinkErrors
+	if !errors.As(sendErr, &failed) {
+		return false, 0 // Sin sinks configurados no hay DLQ a la que moverlos.
+	}
+	permanent := false
+	for _, err := range failed {
+		permanent = permanent || permanentSinkError(err)
+	}
+	var dead []data.OutboxRecord
+	for _, record := range records {
+		if permanent || record.Attempts+1 >= d.maxAttempts {
+			dead = append(dead, record)
+		}
+	}
+	store := d.exporter.DeadLetters()
+	if len(dead) == 0 || store == nil {
+		return permanent, 0
+	}
+
+	payload := outboxPayload(dead)
+	attempts := 0
+	for _, record := range dead {
+		attempts = max(attempts, record.Attempts+1)
+	}
+	now := time.Now().UTC()
+	for name, err := range failed {
+		if storeErr := store.AddDeadLetter(data.DeadLetter{
+			ID:        deadLetterID(name, payload),
+			Sink:      name,
+			Metrics:   len(dead),
+			Payload:   payload,
+			Attempts:  attempts,
+			LastError: err.Error(),
+			CreatedAt: now,
+			UpdatedAt: now,
+		}); storeErr != nil {
+			log.Printf("ERROR: Failed to dead-letter %d outbox records for sink %s: %v", len(dead), name, storeErr)
+			return permanent, 0
+		}
+	}
+	if err := d.outbox.MarkOutboxDeadLettered(dead, sendErr.Error()); err != nil {
+		// Ya están en la DLQ; si siguen pendientes se reenviarán, como permite la entrega al menos una vez.
+		log.Printf("ERROR: Failed to mark outbox records as dead-lettered: %v", err)
+		return permanent, 0
+	}
+	return permanent, len(dead)
+}
+
+// Start vacía el outbox cada interval en una goroutine, hasta que se llama a Stop. No hace nada con interval 0.
+func (d *OutboxDispatcher) Start(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				result, err := d.Dispatch()
+				if err != nil {
+					log.Printf("ERROR: Outbox dispatch failed after delivering %d records: %v", result.Delivered, err)
+				} else if result.Delivered > 0 || result.DeadLettered > 0 {
+					log.Printf("INFO: Delivered %d outbox records in %d batches (%d moved to the dead-letter queue).", result.Delivered, result.Batches, result.DeadLettered)
+				}
+			}
+		}
+	}()
+}
+
+// Stop detiene el vaciado periódico y espera a que termine el vaciado en curso.
+func (d *OutboxDispatcher) Stop() {
+	close(d.stop)
+	d.wg.Wait()
+}
+
+// outboxPayload serializa las versiones encoladas como el array JSON de métricas que recibe el sink.
+func outboxPayload(records []data.OutboxRecord) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, record := range records {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(record.Metric)
+	}
+	buf.WriteByte(']')
+	return buf.Bytes()
+}
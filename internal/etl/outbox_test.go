@@ -0,0 +1,230 @@
+package etl
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btors/admira-etl/internal/data"
+	"github.com/btors/admira-etl/pkg/signature"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutboxDispatcher_DeliversChangedMetricsAtLeastOnce(t *testing.T) {
+	var mu sync.Mutex
+	down := true
+	var received []string
+	sinkServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []data.EnrichedMetric
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&batch))
+		for _, m := range batch {
+			received = append(received, m.CampaignID)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer sinkServer.Close()
+
+	repo := data.NewInMemoryRepository()
+	for _, m := range exportMetrics(3) {
+		require.NoError(t, repo.Save(m))
+	}
+	exporter := NewExporter(sinkServer.URL, "test_secret",
+		WithExportBatchSize(2),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}),
+		WithDeadLetters(data.NewInMemoryDeadLetterStore()),
+	)
+	recordSleeps(exporter)
+	dispatcher := NewOutboxDispatcher(repo, exporter)
+
+	// Con el sink caído nada se entrega: el primer lote sigue pendiente con el error y no va a la DLQ.
+	result, err := dispatcher.Dispatch()
+	require.Error(t, err)
+	assert.Equal(t, OutboxResult{Batches: 1, Failed: 2}, result)
+	pipeline := NewPipeline(repo, nil, nil, exporter, WithOutbox(repo))
+	record, err := pipeline.OutboxRecord("2025-08-01-A-google_ads")
+	require.NoError(t, err)
+	assert.Equal(t, data.OutboxPending, record.Status)
+	assert.Equal(t, 1, record.Attempts)
+	assert.Contains(t, record.LastError, "503")
+	letters, err := exporter.DeadLetters().ListDeadLetters(data.DeadLetterFilter{})
+	require.NoError(t, err)
+	assert.Empty(t, letters)
+
+	// El sink vuelve: se vacía todo el outbox en lotes de EXPORT_BATCH_SIZE.
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	result, err = dispatcher.Dispatch()
+	require.NoError(t, err)
+	assert.Equal(t, OutboxResult{Batches: 2, Delivered: 3}, result)
+	assert.Equal(t, []string{"A", "B", "C"}, received)
+
+	// Volver a guardar una métrica sin cambios no la reenvía; cambiarla sí.
+	metrics := exportMetrics(3)
+	require.NoError(t, repo.Save(metrics[0]))
+	metrics[1].Clicks = 7
+	require.NoError(t, repo.Save(metrics[1]))
+	result, err = dispatcher.Dispatch()
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Delivered)
+	assert.Equal(t, []string{"A", "B", "C", "B"}, received)
+
+	delivered, err := pipeline.Outbox(data.OutboxFilter{Status: data.OutboxDelivered})
+	require.NoError(t, err)
+	assert.Len(t, delivered, 3)
+	_, err = pipeline.OutboxRecord("missing")
+	assert.ErrorIs(t, err, ErrOutboxRecordNotFound)
+	_, err = NewPipeline(repo, nil, nil, exporter).Outbox(data.OutboxFilter{})
+	assert.ErrorIs(t, err, ErrOutboxDisabled)
+}
+
+func TestOutboxDispatcher_MovesRejectedAndExhaustedRecordsToDLQ(t *testing.T) {
+	var mu sync.Mutex
+	down := false
+	var received []string
+	sinkServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []data.EnrichedMetric
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&batch))
+		for _, m := range batch {
+			if m.CampaignID == "B" {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		for _, m := range batch {
+			received = append(received, m.CampaignID)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer sinkServer.Close()
+
+	repo := data.NewInMemoryRepository()
+	for _, m := range exportMetrics(3) {
+		require.NoError(t, repo.Save(m))
+	}
+	dlq := data.NewInMemoryDeadLetterStore()
+	exporter := NewExporter(sinkServer.URL, "test_secret",
+		WithExportBatchSize(2),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}),
+		WithDeadLetters(dlq),
+	)
+	recordSleeps(exporter)
+	dispatcher := NewOutboxDispatcher(repo, exporter, WithOutboxMaxAttempts(2))
+
+	// El sink rechaza el primer lote de forma permanente: va a la DLQ y el vaciado sigue con el siguiente.
+	result, err := dispatcher.Dispatch()
+	require.NoError(t, err)
+	assert.Equal(t, OutboxResult{Batches: 2, Delivered: 1, DeadLettered: 2}, result)
+	assert.Equal(t, []string{"C"}, received)
+	letters, err := dlq.ListDeadLetters(data.DeadLetterFilter{})
+	require.NoError(t, err)
+	require.Len(t, letters, 1)
+	assert.Equal(t, DefaultSinkName, letters[0].Sink)
+	assert.Equal(t, 2, letters[0].Metrics)
+	assert.Empty(t, letters[0].Date)
+	assert.Contains(t, letters[0].LastError, "422")
+	record, err := repo.GetOutboxRecord("2025-08-01-A-google_ads")
+	require.NoError(t, err)
+	assert.Equal(t, data.OutboxDeadLettered, record.Status)
+	assert.Equal(t, 1, record.Attempts)
+	assert.Nil(t, record.Metric)
+
+	// Con el sink caído una versión nueva sigue pendiente hasta agotar los intentos y después va a la DLQ.
+	mu.Lock()
+	down = true
+	mu.Unlock()
+	metrics := exportMetrics(1)
+	metrics[0].Clicks = 5
+	require.NoError(t, repo.Save(metrics[0]))
+	result, err = dispatcher.Dispatch()
+	require.Error(t, err)
+	assert.Equal(t, OutboxResult{Batches: 1, Failed: 1}, result)
+	result, err = dispatcher.Dispatch()
+	require.Error(t, err)
+	assert.Equal(t, OutboxResult{Batches: 1, DeadLettered: 1}, result)
+	pending, err := repo.PendingOutbox(0)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	letters, err = dlq.ListDeadLetters(data.DeadLetterFilter{})
+	require.NoError(t, err)
+	assert.Len(t, letters, 2)
+
+	// La versión movida a la DLQ se reenvía desde ella, sin fecha.
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	for _, letter := range letters {
+		if letter.Metrics == 1 {
+			require.NoError(t, exporter.ReplayDeadLetter(letter))
+		}
+	}
+	assert.Equal(t, []string{"C", "A"}, received)
+}
+
+func TestOutboxDispatcher_RetriesOnlyFailedSinks(t *testing.T) {
+	var mu sync.Mutex
+	down := true
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer httpServer.Close()
+
+	repo := data.NewInMemoryRepository()
+	for _, m := range exportMetrics(2) {
+		require.NoError(t, repo.Save(m))
+	}
+	var stdout bytes.Buffer
+	exporter := NewExporter("", "",
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}),
+		WithSinks(NewHTTPSink("http", httpServer.URL, signature.Key{}), NewStdoutSink("debug", &stdout)),
+		WithDeadLetters(data.NewInMemoryDeadLetterStore()),
+	)
+	recordSleeps(exporter)
+	dispatcher := NewOutboxDispatcher(repo, exporter)
+
+	// El sink de depuración acepta el lote y queda anotado; el HTTP falla y el lote sigue pendiente.
+	result, err := dispatcher.Dispatch()
+	require.Error(t, err)
+	assert.Equal(t, OutboxResult{Batches: 1, Failed: 2}, result)
+	record, err := repo.GetOutboxRecord("2025-08-01-A-google_ads")
+	require.NoError(t, err)
+	assert.Equal(t, data.OutboxPending, record.Status)
+	assert.Equal(t, []string{"debug"}, record.DeliveredTo)
+	assert.Equal(t, 1, strings.Count(stdout.String(), "\n"))
+
+	// Al reenviarlo sólo va al sink que falló.
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	result, err = dispatcher.Dispatch()
+	require.NoError(t, err)
+	assert.Equal(t, OutboxResult{Batches: 1, Delivered: 2}, result)
+	assert.Equal(t, 1, strings.Count(stdout.String(), "\n"))
+	record, err = repo.GetOutboxRecord("2025-08-01-A-google_ads")
+	require.NoError(t, err)
+	assert.Equal(t, data.OutboxDelivered, record.Status)
+}
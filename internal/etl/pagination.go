@@ -0,0 +1,187 @@
+// Package etl internal/etl/pagination.go
+package etl
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Estrategias de paginación de las fuentes HTTP.
+const (
+	PaginationNone   = "none"   // Una sola petición.
+	PaginationToken  = "token"  // La respuesta trae el token de la página siguiente en TokenPath.
+	PaginationLink   = "link"   // La cabecera Link trae la URL de la página siguiente (rel="next").
+	PaginationPage   = "page"   // Número de página en PageParam, empezando en StartPage.
+	PaginationOffset = "offset" // Desplazamiento en OffsetParam, avanzando por los registros recibidos.
+)
+
+// DefaultMaxPages es el límite de páginas por descarga si la fuente no indica otro.
+const DefaultMaxPages = 100
+
+// PaginationConfig configura cómo recorre una fuente HTTP sus páginas de resultados.
+type PaginationConfig struct {
+	Type string `json:"type"`
+	// MaxPages corta descargas que no terminan (por ejemplo, una API que repite siempre el mismo token).
+	// Superarlo es un error, para no avanzar la marca de agua con datos incompletos.
+	MaxPages int `json:"max_pages,omitempty"`
+
+	TokenPath  string `json:"token_path,omitempty"`  // token: ruta con puntos del token siguiente en la respuesta.
+	TokenParam string `json:"token_param,omitempty"` // token: parámetro de consulta con el que se envía.
+
+	PageParam   string `json:"page_param,omitempty"`   // page: por defecto "page".
+	StartPage   int    `json:"start_page,omitempty"`   // page: por defecto 1.
+	OffsetParam string `json:"offset_param,omitempty"` // offset: por defecto "offset".
+
+	// SizeParam y PageSize piden un tamaño de página (page, offset). Una página con menos registros
+	// que PageSize es la última; sin PageSize, la última es la primera página vacía.
+	SizeParam string `json:"size_param,omitempty"`
+	PageSize  int    `json:"page_size,omitempty"`
+}
+
+// validate comprueba que la configuración de paginación esté completa.
+func (p PaginationConfig) validate() error {
+	switch p.Type {
+	case "", PaginationNone, PaginationLink:
+	case PaginationToken:
+		if p.TokenPath == "" || p.TokenParam == "" {
+			return fmt.Errorf("token pagination requires token_path and token_param")
+		}
+	case PaginationPage, PaginationOffset:
+		if p.SizeParam != "" && p.PageSize <= 0 {
+			return fmt.Errorf("size_param requires a positive page_size")
+		}
+	default:
+		return fmt.Errorf("unknown pagination type %q", p.Type)
+	}
+	if p.MaxPages < 0 {
+		return fmt.Errorf("max_pages must be non-negative")
+	}
+	return nil
+}
+
+// maxPages devuelve el límite de páginas efectivo.
+func (p PaginationConfig) maxPages() int {
+	if p.MaxPages > 0 {
+		return p.MaxPages
+	}
+	return DefaultMaxPages
+}
+
+// pageParam devuelve el parámetro de número de página.
+func (p PaginationConfig) pageParam() string {
+	if p.PageParam != "" {
+		return p.PageParam
+	}
+	return "page"
+}
+
+// offsetParam devuelve el parámetro de desplazamiento.
+func (p PaginationConfig) offsetParam() string {
+	if p.OffsetParam != "" {
+		return p.OffsetParam
+	}
+	return "offset"
+}
+
+// firstPage devuelve la URL de la primera página.
+func (p PaginationConfig) firstPage(base *url.URL) *url.URL {
+	u := *base
+	query := u.Query()
+	switch p.Type {
+	case PaginationPage:
+		start := p.StartPage
+		if start == 0 {
+			start = 1
+		}
+		query.Set(p.pageParam(), strconv.Itoa(start))
+	case PaginationOffset:
+		query.Set(p.offsetParam(), "0")
+	default:
+		return &u
+	}
+	if p.SizeParam != "" {
+		query.Set(p.SizeParam, strconv.Itoa(p.PageSize))
+	}
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// nextPage devuelve la URL de la página siguiente a current, o false si current era la última.
+// captured contiene los valores capturados de la respuesta y records es el número de registros recibidos en current.
+func (p PaginationConfig) nextPage(current *url.URL, captured map[string]interface{}, header http.Header, records int) (*url.URL, bool, error) {
+	switch p.Type {
+	case PaginationToken:
+		node, ok := captured[p.TokenPath]
+		if !ok || node == nil {
+			return nil, false, nil
+		}
+		token := strings.TrimSpace(fmt.Sprint(node))
+		if token == "" || current.Query().Get(p.TokenParam) == token {
+			return nil, false, nil
+		}
+		return withQueryParam(current, p.TokenParam, token), true, nil
+
+	case PaginationLink:
+		next := nextLink(header.Values("Link"))
+		if next == "" {
+			return nil, false, nil
+		}
+		u, err := current.Parse(next) // Resuelve enlaces relativos respecto a la página actual.
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid next link %q: %w", next, err)
+		}
+		return u, true, nil
+
+	case PaginationPage, PaginationOffset:
+		if records == 0 || (p.PageSize > 0 && records < p.PageSize) {
+			return nil, false, nil
+		}
+		param, step := p.pageParam(), 1
+		if p.Type == PaginationOffset {
+			param, step = p.offsetParam(), records
+		}
+		value, err := strconv.Atoi(current.Query().Get(param))
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid %s in %s: %w", param, current, err)
+		}
+		return withQueryParam(current, param, strconv.Itoa(value+step)), true, nil
+	}
+	return nil, false, nil
+}
+
+// withQueryParam devuelve una copia de la URL con el parámetro de consulta fijado.
+func withQueryParam(u *url.URL, key, value string) *url.URL {
+	next := *u
+	query := next.Query()
+	query.Set(key, value)
+	next.RawQuery = query.Encode()
+	return &next
+}
+
+// nextLink extrae la URL con rel="next" de las cabeceras Link (RFC 8288).
+func nextLink(values []string) string {
+	for _, value := range values {
+		for _, link := range strings.Split(value, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				key, val, ok := strings.Cut(strings.TrimSpace(param), "=")
+				if !ok || !strings.EqualFold(strings.TrimSpace(key), "rel") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(strings.TrimSpace(val), `"`)) {
+					if strings.EqualFold(rel, "next") {
+						return target[1 : len(target)-1]
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
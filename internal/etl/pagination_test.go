@@ -0,0 +1,231 @@
+package etl
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// adRecord devuelve una fila de Ads en JSON con el ID de campaña indicado.
+func adRecord(id int) string {
+	return fmt.Sprintf(`{"date": "2025-08-01", "campaign_id": "C-%d", "channel": "google_ads", "clicks": 1}`, id)
+}
+
+// fetchCampaignIDs descarga la fuente y devuelve los IDs de campaña en orden.
+func fetchCampaignIDs(t *testing.T, cfg SourceConfig) ([]string, error) {
+	t.Helper()
+	source, err := NewHTTPAdsSource(cfg)
+	require.NoError(t, err)
+	ads, err := CollectAds(source, nil)
+	ids := make([]string, len(ads))
+	for i, ad := range ads {
+		ids[i] = ad.CampaignID
+	}
+	return ids, err
+}
+
+func TestHTTPSource_PaginationStrategies(t *testing.T) {
+	// Cinco registros servidos de dos en dos.
+	const total, size = 5, 2
+	page := func(from int) string {
+		body := "["
+		for i := from; i < from+size && i < total; i++ {
+			if i > from {
+				body += ","
+			}
+			body += adRecord(i)
+		}
+		return body + "]"
+	}
+	want := []string{"C-0", "C-1", "C-2", "C-3", "C-4"}
+
+	t.Run("token", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			from, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+			next := ""
+			if from+size < total {
+				next = strconv.Itoa(from + size)
+			}
+			fmt.Fprintf(w, `{"data": %s, "paging": {"next": %q}}`, page(from), next)
+		}))
+		defer server.Close()
+
+		ids, err := fetchCampaignIDs(t, SourceConfig{Name: "meta", URL: server.URL, RecordsPath: "data",
+			Pagination: PaginationConfig{Type: PaginationToken, TokenPath: "paging.next", TokenParam: "cursor"}})
+		require.NoError(t, err)
+		assert.Equal(t, want, ids)
+	})
+
+	t.Run("link", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			from, _ := strconv.Atoi(r.URL.Query().Get("from"))
+			if from+size < total {
+				w.Header().Add("Link", fmt.Sprintf(`</ads?from=%d>; rel="next", </ads?from=0>; rel="first"`, from+size))
+			}
+			fmt.Fprint(w, page(from))
+		}))
+		defer server.Close()
+
+		ids, err := fetchCampaignIDs(t, SourceConfig{Name: "linkedin", URL: server.URL + "/ads",
+			Pagination: PaginationConfig{Type: PaginationLink}})
+		require.NoError(t, err)
+		assert.Equal(t, want, ids)
+	})
+
+	t.Run("page", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n, _ := strconv.Atoi(r.URL.Query().Get("p"))
+			assert.Equal(t, "2", r.URL.Query().Get("per_page"))
+			fmt.Fprint(w, page((n-1)*size))
+		}))
+		defer server.Close()
+
+		ids, err := fetchCampaignIDs(t, SourceConfig{Name: "tiktok", URL: server.URL,
+			Pagination: PaginationConfig{Type: PaginationPage, PageParam: "p", SizeParam: "per_page", PageSize: size}})
+		require.NoError(t, err)
+		assert.Equal(t, want, ids)
+	})
+
+	t.Run("offset", func(t *testing.T) {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			from, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+			fmt.Fprint(w, page(from))
+		}))
+		defer server.Close()
+
+		// Sin page_size la descarga termina en la primera página vacía.
+		ids, err := fetchCampaignIDs(t, SourceConfig{Name: "crm_ads", URL: server.URL,
+			Pagination: PaginationConfig{Type: PaginationOffset}})
+		require.NoError(t, err)
+		assert.Equal(t, want, ids)
+		assert.Equal(t, 4, requests)
+	})
+}
+
+func TestHTTPSource_PaginationMaxPages(t *testing.T) {
+	// Una API que nunca deja de devolver páginas.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		fmt.Fprintf(w, "[%s]", adRecord(n))
+	}))
+	defer server.Close()
+
+	_, err := fetchCampaignIDs(t, SourceConfig{Name: "ads", URL: server.URL,
+		Pagination: PaginationConfig{Type: PaginationPage, MaxPages: 3}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "max_pages")
+}
+
+func TestHTTPSource_RetriesEachPageIndependently(t *testing.T) {
+	defer func(d time.Duration) { fetchRetryDelay = d }(fetchRetryDelay)
+	fetchRetryDelay = time.Millisecond
+
+	hits := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := r.URL.Query().Get("page")
+		hits[n]++
+		// La segunda página falla en su primer intento.
+		if n == "2" && hits[n] == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if n == "3" {
+			fmt.Fprint(w, "[]")
+			return
+		}
+		fmt.Fprintf(w, "[%s]", adRecord(len(hits)))
+	}))
+	defer server.Close()
+
+	ids, err := fetchCampaignIDs(t, SourceConfig{Name: "ads", URL: server.URL,
+		Pagination: PaginationConfig{Type: PaginationPage}})
+	require.NoError(t, err)
+	assert.Len(t, ids, 2)
+	assert.Equal(t, map[string]int{"1": 1, "2": 2, "3": 1}, hits)
+}
+
+func TestHTTPSource_RetriesPageTruncatedAfterRecords(t *testing.T) {
+	defer func(d time.Duration) { fetchRetryDelay = d }(fetchRetryDelay)
+	fetchRetryDelay = time.Millisecond
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		// El primer intento se corta después de un registro completo.
+		if requests == 1 {
+			fmt.Fprintf(w, "[%s, {\"campaign_id\": ", adRecord(1))
+			return
+		}
+		fmt.Fprintf(w, "[%s, %s]", adRecord(1), adRecord(2))
+	}))
+	defer server.Close()
+
+	ids, err := fetchCampaignIDs(t, SourceConfig{Name: "ads", URL: server.URL})
+	require.NoError(t, err)
+	// La página se reintenta y el registro ya entregado no se repite.
+	assert.Equal(t, []string{"C-1", "C-2"}, ids)
+	assert.Equal(t, 2, requests)
+}
+
+func TestHTTPSource_HonoursRetryAfter(t *testing.T) {
+	defer func(sleep func(time.Duration)) { fetchSleep = sleep }(fetchSleep)
+	var waits []time.Duration
+	fetchSleep = func(d time.Duration) { waits = append(waits, d) }
+
+	requests := 0
+	retryAfter := "5"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprintf(w, "[%s]", adRecord(1))
+	}))
+	defer server.Close()
+
+	ids, err := fetchCampaignIDs(t, SourceConfig{Name: "ads", URL: server.URL})
+	require.NoError(t, err)
+	assert.Len(t, ids, 1)
+	// Se espera lo que pide la fuente, más que el backoff de 1s.
+	assert.Equal(t, []time.Duration{5 * time.Second}, waits)
+
+	// Una espera mayor que fetchMaxRetryAfter no se respeta a ciegas: la página falla sin reintentar.
+	requests, waits = 0, nil
+	retryAfter = "3600"
+	_, err = fetchCampaignIDs(t, SourceConfig{Name: "ads", URL: server.URL})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Retry-After")
+	assert.Equal(t, 1, requests)
+	assert.Empty(t, waits)
+}
+
+func TestHTTPSource_DoesNotRetryClientErrors(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	_, err := fetchCampaignIDs(t, SourceConfig{Name: "ads", URL: server.URL})
+	require.Error(t, err)
+	assert.Equal(t, 1, requests)
+}
+
+func TestNextLink(t *testing.T) {
+	assert.Equal(t, "https://api.local/ads?page=3",
+		nextLink([]string{`<https://api.local/ads?page=1>; rel="prev", <https://api.local/ads?page=3>; rel="next"`}))
+	assert.Equal(t, "/ads?page=2", nextLink([]string{`</ads?page=2>; rel="next last"`}))
+	assert.Equal(t, "", nextLink([]string{`<https://api.local/ads?page=1>; rel="first"`}))
+	assert.Equal(t, "", nextLink(nil))
+}
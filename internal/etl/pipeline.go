@@ -0,0 +1,974 @@
+// Package etl internal/etl/pipeline.go
+package etl
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/btors/admira-etl/internal/data"
+	"github.com/btors/admira-etl/internal/jobs"
+)
+
+// Tipos de job que ejecuta el Pipeline.
+const (
+	JobKindIngest = "ingest"
+	JobKindReplay = "replay"
+	JobKindExport = "export"
+	// JobKindExportReplay reenvía lotes de la cola de exportaciones fallidas (DLQ).
+	JobKindExportReplay = "export_replay"
+)
+
+// Pipeline orquesta las etapas de ingesta, transformación, guardado y exportación,
+// para que puedan ejecutarse como jobs asíncronos fuera del ciclo de la petición HTTP.
+type Pipeline struct {
+	repo        data.MetricRepository
+	ingestor    *Ingestor
+	transformer *Transformer
+	exporter    *Exporter
+	watermarks  data.WatermarkStore // nil desactiva la ingesta incremental.
+	overlap     time.Duration       // Margen que se retrocede desde la marca de agua para recoger datos tardíos.
+	batchSize   int                 // Registros por lote entregados al transformer durante la ingesta.
+	validator   *Validator          // nil desactiva la validación.
+	quarantine  data.QuarantineStore
+	archive     *data.PayloadArchive // nil desactiva el archivo de respuestas en bruto.
+	joins       data.JoinReportStore // nil desactiva el guardado de los informes de cruce.
+	outbox      data.ExportOutbox    // nil si el repositorio no tiene outbox de exportación.
+	viaOutbox   bool                 // Las métricas sólo se entregan a los sinks a través del outbox.
+}
+
+// PipelineOption configura un Pipeline.
+type PipelineOption func(*Pipeline)
+
+// WithWatermarks activa la ingesta incremental: cada ingesta sin "since" explícito empieza en la marca de agua
+// de cada fuente menos overlap, y una ingesta exitosa avanza las marcas de agua al registro más reciente recibido.
+func WithWatermarks(store data.WatermarkStore, overlap time.Duration) PipelineOption {
+	return func(p *Pipeline) {
+		p.watermarks = store
+		p.overlap = overlap
+	}
+}
+
+// WithIngestBatchSize fija cuántos registros se entregan por lote al transformer durante la ingesta.
+func WithIngestBatchSize(size int) PipelineOption {
+	return func(p *Pipeline) {
+		if size > 0 {
+			p.batchSize = size
+		}
+	}
+}
+
+// WithValidation valida cada registro ingestado antes de la transformación; los rechazados se guardan en store.
+func WithValidation(validator *Validator, store data.QuarantineStore) PipelineOption {
+	return func(p *Pipeline) {
+		p.validator = validator
+		p.quarantine = store
+	}
+}
+
+// WithArchive archiva las respuestas en bruto de cada ingesta, para poder repetirla con RunReplay.
+func WithArchive(archive *data.PayloadArchive) PipelineOption {
+	return func(p *Pipeline) {
+		p.archive = archive
+	}
+}
+
+// WithJoinReports guarda en store el informe de cruce entre Ads y CRM de cada ingesta.
+func WithJoinReports(store data.JoinReportStore) PipelineOption {
+	return func(p *Pipeline) {
+		p.joins = store
+	}
+}
+
+// WithOutbox permite consultar el outbox de exportación del repositorio.
+func WithOutbox(outbox data.ExportOutbox) PipelineOption {
+	return func(p *Pipeline) {
+		p.outbox = outbox
+	}
+}
+
+// WithOutboxDelivery hace del outbox la única vía de entrega a los sinks: con su dispatcher activo, RunExport
+// enviaría de nuevo las mismas métricas a los mismos sinks, así que devuelve ErrExportViaOutbox.
+func WithOutboxDelivery() PipelineOption {
+	return func(p *Pipeline) {
+		p.viaOutbox = true
+	}
+}
+
+// ErrUnknownSource se devuelve al operar sobre la marca de agua de una fuente que no existe.
+var ErrUnknownSource = errors.New("unknown ingestion source")
+
+// ErrIncrementalDisabled se devuelve al operar sobre marcas de agua sin ingesta incremental configurada.
+var ErrIncrementalDisabled = errors.New("incremental ingestion is not configured")
+
+// ErrQuarantineDisabled se devuelve al operar sobre la cuarentena sin validación configurada.
+var ErrQuarantineDisabled = errors.New("record validation is not configured")
+
+// ErrArchiveDisabled se devuelve al operar sobre el archivo de respuestas sin archivo configurado.
+var ErrArchiveDisabled = errors.New("payload archive is not configured")
+
+// ErrRunNotReplayable se devuelve al repetir una ingesta cuyas respuestas no se archivaron completas.
+var ErrRunNotReplayable = errors.New("archived run is incomplete and cannot be replayed")
+
+// ErrNoUTMMatch se devuelve al pedir el informe de cruce de UTMs antes de la primera transformación.
+var ErrNoUTMMatch = errors.New("no ingestion has been transformed since startup")
+
+// ErrJoinReportsDisabled se devuelve al consultar informes de cruce sin almacén configurado.
+var ErrJoinReportsDisabled = errors.New("join reports are not configured")
+
+// ErrJoinReportNotFound se devuelve al consultar el informe de cruce de una ingesta que no lo tiene.
+var ErrJoinReportNotFound = errors.New("join report not found")
+
+// ErrDeadLettersDisabled se devuelve al operar sobre la DLQ de exportación sin almacén configurado.
+var ErrDeadLettersDisabled = errors.New("export dead-letter queue is not configured")
+
+// ErrOutboxDisabled se devuelve al consultar el outbox de exportación sin outbox configurado.
+var ErrOutboxDisabled = errors.New("export outbox is not configured")
+
+// ErrOutboxRecordNotFound se devuelve al consultar el registro del outbox de una métrica que no lo tiene.
+var ErrOutboxRecordNotFound = errors.New("outbox record not found")
+
+// ErrExportViaOutbox se devuelve al exportar por fecha cuando las métricas se entregan a través del outbox.
+var ErrExportViaOutbox = errors.New("metrics are delivered through the export outbox; direct export is disabled")
+
+// IngestionResult resume una ejecución de ingesta.
+type IngestionResult struct {
+	RunID         string // Identifica la ingesta en el archivo de respuestas.
+	Archived      bool   // Las respuestas en bruto se archivaron bajo RunID.
+	Model         AttributionModel
+	Window        map[string]*time.Time // Inicio de la ventana pedida a cada fuente; nil para una ingesta completa.
+	RecomputeFrom *time.Time            // Primer día cuyas métricas se guardan; las anteriores son sólo contexto. Nil guarda todas.
+	Fetched       map[string]int        // Registros recibidos por fuente.
+	AdsFetched    int
+	OppsFetched   int
+	Accepted      int            // Registros que superaron la validación.
+	Rejected      int            // Registros rechazados y enviados a la cuarentena.
+	Rejects       map[string]int // Registros rechazados por fuente.
+	Corrected     int            // Registros sustituidos por su corrección reenviada desde la cuarentena.
+	MetricsSaved  int
+	SaveFailures  int
+	SkippedAdRows int
+	// Resumen del informe de cruce entre Ads y CRM.
+	MatchedOpps    int
+	OrphanOpps     int
+	OrphanAmount   float64
+	UnconvertedAds int
+	Warnings       []string
+}
+
+// ExportResult resume una ejecución de exportación.
+type ExportResult struct {
+	Date         time.Time
+	Exported     int
+	Batches      int                    // Lotes enviados, sumados entre sinks.
+	DeadLettered int                    // Lotes fallidos guardados en la DLQ.
+	Skipped      int                    // Lotes ya entregados sin cambios, que no se reenviaron.
+	Sinks        map[string]SinkSummary // Resultado de cada sink.
+	SinkErrors   map[string]string      // Último error de cada sink con algún lote fallido.
+	Warnings     []string
+}
+
+// NewPipeline crea un Pipeline con sus dependencias.
+func NewPipeline(repo data.MetricRepository, ingestor *Ingestor, transformer *Transformer, exporter *Exporter, opts ...PipelineOption) *Pipeline {
+	p := &Pipeline{
+		repo:        repo,
+		ingestor:    ingestor,
+		transformer: transformer,
+		exporter:    exporter,
+		batchSize:   DefaultBatchSize,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// DefaultModel devuelve el modelo de atribución configurado por defecto.
+func (p *Pipeline) DefaultModel() AttributionModel {
+	return p.transformer.DefaultModel()
+}
+
+// DefaultMetricModel devuelve el modelo que figura en las métricas calculadas con el modelo por defecto.
+func (p *Pipeline) DefaultMetricModel() string {
+	return p.transformer.DefaultMetricModel()
+}
+
+// Timezones devuelve las zonas horarias de reporte con las que se interpretan las fechas.
+func (p *Pipeline) Timezones() *Timezones {
+	return p.transformer.Timezones()
+}
+
+// UTMMatch devuelve el informe de claves UTM sin cruce de la última transformación y el estado de las reglas.
+// Devuelve ErrNoUTMMatch si aún no se ha transformado nada desde el arranque.
+func (p *Pipeline) UTMMatch() (*UTMMatchReport, UTMRulesStatus, error) {
+	status := p.transformer.UTMNormalizer().Status()
+	report := p.transformer.LastUTMMatch()
+	if report == nil {
+		return nil, status, ErrNoUTMMatch
+	}
+	return report, status, nil
+}
+
+// RunIngestion obtiene los datos de Ads y CRM, calcula las métricas con el modelo indicado y las guarda.
+// Un "since" explícito es un día: Ads empieza en ese día y CRM en su primer instante en cualquiera de las
+// zonas de reporte. Sin "since" explícito y con marcas de agua configuradas, la ingesta es incremental.
+func (p *Pipeline) RunIngestion(since *time.Time, model AttributionModel) (IngestionResult, error) {
+	runID, err := newRunID()
+	if err != nil {
+		return IngestionResult{}, err
+	}
+	result := IngestionResult{RunID: runID, Model: model, Window: make(map[string]*time.Time)}
+	for _, name := range p.ingestor.Sources().Names() {
+		result.Window[name] = nil
+	}
+	if since != nil {
+		result.Window = p.dayWindow(data.CalendarDate(*since))
+	}
+	if since == nil && p.watermarks != nil {
+		if result.Window, result.RecomputeFrom, err = p.incrementalWindow(); err != nil {
+			return result, err
+		}
+	}
+	for name, start := range result.Window {
+		if start != nil {
+			log.Printf("INFO: Ingesting source %s since %s.", name, start.Format(time.RFC3339))
+		}
+	}
+	if result.RecomputeFrom != nil {
+		log.Printf("INFO: Recomputing metrics since %s.", result.RecomputeFrom.Format("2006-01-02"))
+	}
+
+	// Descarga todas las fuentes en streaming y entrega sus registros al transformer por lotes,
+	// pasando antes por la validación si está configurada, y archiva las respuestas en bruto
+	// junto con la configuración con la que se procesan
+	cfg, err := p.currentConfig()
+	if err != nil {
+		return result, err
+	}
+	combiner := cfg.transformer.NewCombiner(model)
+	sink, validation := p.ingestSink(combiner, cfg)
+	var run *data.ArchiveRun
+	if p.archive != nil {
+		if run, err = p.archive.Begin(runID, string(model), result.Window); err != nil {
+			return result, err
+		}
+		run.SetRecomputeFrom(result.RecomputeFrom)
+		if err := attachSnapshot(run, cfg, combiner); err != nil {
+			log.Printf("WARN: Failed to archive the config of run %s: %v", runID, err)
+			run.MarkIncomplete("config snapshot not archived")
+		}
+	}
+	fetched, err := cfg.ingestor.Stream(result.Window, p.batchSize, sink, run)
+	if run != nil {
+		if archiveErr := run.Finish(err); archiveErr != nil {
+			log.Printf("WARN: Failed to archive run %s: %v", runID, archiveErr)
+			result.Warnings = append(result.Warnings, "raw payloads could not be archived")
+		} else {
+			result.Archived = true
+		}
+	}
+	if err != nil {
+		return result, fmt.Errorf("data ingestion failed: %w", err)
+	}
+
+	processed, err := p.transformAndSave(&result, fetched, combiner, validation, cfg)
+	if err != nil {
+		return result, err
+	}
+
+	// Avanza las marcas de agua sólo si todo se guardó, para que la siguiente ingesta reintente lo fallido.
+	if p.watermarks != nil && result.SaveFailures == 0 {
+		if err := p.advanceWatermarks(fetched.Latest); err != nil {
+			return result, err
+		}
+	}
+
+	log.Printf("INFO: Ingestion process completed successfully. Processed %d metrics with model %s.", processed, model)
+	return result, nil
+}
+
+// RunReplay vuelve a calcular y guardar las métricas de una ingesta archivada a partir de sus respuestas en bruto,
+// sin acceder a la red ni mover las marcas de agua. Sin modelo se usa el de la ingesta original. Las fuentes,
+// las reglas y las correcciones de la cuarentena son las archivadas con la ingesta; las ingestas archivadas
+// sin su configuración se repiten con la actual, con una advertencia.
+func (p *Pipeline) RunReplay(runID string, model AttributionModel) (IngestionResult, error) {
+	run, err := p.ArchivedRun(runID)
+	if err != nil {
+		return IngestionResult{RunID: runID}, err
+	}
+	if !run.Complete {
+		return IngestionResult{RunID: runID}, fmt.Errorf("%w: %s", ErrRunNotReplayable, run.Error)
+	}
+	if model == "" {
+		if model, err = ParseAttributionModel(run.Model); err != nil {
+			return IngestionResult{RunID: runID}, err
+		}
+	}
+	result := IngestionResult{RunID: runID, Model: model, Window: run.Window, RecomputeFrom: run.RecomputeFrom}
+	log.Printf("INFO: Replaying archived run %s with model %s.", runID, model)
+
+	cfg, err := p.currentConfig()
+	if err != nil {
+		return result, err
+	}
+	snapshot, err := loadSnapshot(p.archive, run)
+	if err != nil {
+		return result, err
+	}
+	if snapshot == nil {
+		log.Printf("WARN: Archived run %s has no config snapshot; replaying with the current config.", runID)
+		result.Warnings = append(result.Warnings, "run was archived without its config; replayed with the current config")
+	} else {
+		var warnings []string
+		if cfg, warnings, err = snapshot.config(cfg, run); err != nil {
+			return result, err
+		}
+		result.Warnings = append(result.Warnings, warnings...)
+	}
+
+	combiner := cfg.transformer.NewCombiner(model)
+	sink, validation := p.ingestSink(combiner, cfg)
+	fetched, err := cfg.ingestor.Replay(run, p.archive, p.batchSize, sink)
+	if err != nil {
+		return result, fmt.Errorf("replay failed: %w", err)
+	}
+	processed, err := p.transformAndSave(&result, fetched, combiner, validation, cfg)
+	if err != nil {
+		return result, err
+	}
+
+	log.Printf("INFO: Replay of run %s completed successfully. Processed %d metrics with model %s.", runID, processed, model)
+	return result, nil
+}
+
+// currentConfig devuelve los componentes configurados y las correcciones reenviadas de la cuarentena.
+func (p *Pipeline) currentConfig() (runConfig, error) {
+	cfg := runConfig{ingestor: p.ingestor, transformer: p.transformer, validator: p.validator}
+	if p.validator != nil {
+		var err error
+		if cfg.corrections, err = loadCorrections(p.quarantine); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// ingestSink devuelve el sink que entrega los registros al Combiner, precedido de la validación si cfg la incluye.
+func (p *Pipeline) ingestSink(combiner *Combiner, cfg runConfig) (IngestSink, *validatingSink) {
+	var sink IngestSink = combinerSink{combiner}
+	if cfg.validator == nil {
+		return sink, nil
+	}
+	validation := newValidatingSink(cfg.validator, p.quarantine, sink, cfg.corrections)
+	return validation, validation
+}
+
+// transformAndSave completa los conteos de result, calcula las métricas de los registros del Combiner y guarda
+// las fechadas a partir de result.RecomputeFrom. Antes entrega al Combiner las correcciones de la cuarentena de
+// la ventana que la descarga no sustituyó.
+// Devuelve el número de métricas calculadas.
+func (p *Pipeline) transformAndSave(result *IngestionResult, fetched FetchResult, combiner *Combiner, validation *validatingSink, cfg runConfig) (int, error) {
+	if validation != nil {
+		if err := validation.injectCorrections(result.Window); err != nil {
+			return 0, fmt.Errorf("failed to ingest quarantine corrections: %w", err)
+		}
+	}
+	result.Fetched = fetched.Fetched
+	for _, source := range cfg.ingestor.Sources().AdsSources() {
+		result.AdsFetched += fetched.Fetched[source.Name()]
+	}
+	for _, source := range cfg.ingestor.Sources().CRMSources() {
+		result.OppsFetched += fetched.Fetched[source.Name()]
+	}
+	result.Accepted = combiner.AdsCount() + combiner.OpportunitiesCount()
+	if validation != nil {
+		result.Rejected, result.Rejects, result.Corrected = validation.rejected, validation.rejects, validation.replaced
+		if result.Rejected > 0 {
+			log.Printf("WARN: %d records rejected by validation and quarantined.", result.Rejected)
+			result.Warnings = append(result.Warnings, fmt.Sprintf("%d records rejected by validation and quarantined", result.Rejected))
+		}
+	}
+
+	// Combina y calcula las métricas a partir de los datos obtenidos
+	enrichedData, err := combiner.Metrics()
+	if err != nil {
+		return 0, fmt.Errorf("data transformation failed: %w", err)
+	}
+	result.SkippedAdRows = combiner.SkippedAdsCount()
+	if result.SkippedAdRows > 0 {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("%d ad rows skipped due to invalid dates", result.SkippedAdRows))
+	}
+	p.recordJoinReport(result, combiner.JoinReport())
+
+	// Guarda las métricas enriquecidas en el repositorio
+	for _, metric := range enrichedData {
+		if result.RecomputeFrom != nil && metric.Date.Before(*result.RecomputeFrom) {
+			continue // Sólo es contexto: no se descargaron todas las oportunidades que pueden atribuírsele.
+		}
+		if err := p.repo.Save(metric); err != nil {
+			log.Printf("WARN: Failed to save metric for campaign %s: %v", metric.CampaignID, err)
+			result.SaveFailures++
+			continue
+		}
+		result.MetricsSaved++
+	}
+	if result.SaveFailures > 0 {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("%d metrics failed to save", result.SaveFailures))
+	}
+	return len(enrichedData), nil
+}
+
+// recordJoinReport completa result con el resumen del informe de cruce, publica sus gauges y lo guarda.
+// Un fallo al guardarlo no hace fallar la ingesta.
+func (p *Pipeline) recordJoinReport(result *IngestionResult, report data.JoinReport) {
+	report.RunID = result.RunID
+	result.MatchedOpps = report.MatchedOpportunities
+	result.OrphanOpps = report.OrphanOpportunities
+	result.OrphanAmount = report.OrphanAmount
+	result.UnconvertedAds = report.AdsWithoutConversions
+	if report.OrphanOpportunities > 0 {
+		log.Printf("WARN: %d opportunities (amount %.2f) were not attributed to any ad row.", report.OrphanOpportunities, report.OrphanAmount)
+		result.Warnings = append(result.Warnings, fmt.Sprintf("%d opportunities with a total amount of %.2f were not attributed to any ad row", report.OrphanOpportunities, report.OrphanAmount))
+	}
+	publishJoinReport(report)
+
+	if p.joins == nil {
+		return
+	}
+	if err := p.joins.SaveJoinReport(report); err != nil {
+		log.Printf("WARN: Failed to save join report for run %s: %v", result.RunID, err)
+		result.Warnings = append(result.Warnings, "join report could not be saved")
+	}
+}
+
+// JoinReport devuelve el informe de cruce completo de una ingesta.
+func (p *Pipeline) JoinReport(runID string) (*data.JoinReport, error) {
+	if p.joins == nil {
+		return nil, ErrJoinReportsDisabled
+	}
+	report, err := p.joins.GetJoinReport(runID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read join report %s: %w", runID, err)
+	}
+	if report == nil {
+		return nil, fmt.Errorf("%w: %q", ErrJoinReportNotFound, runID)
+	}
+	return report, nil
+}
+
+// JoinReports devuelve el resumen de hasta limit informes de cruce, del más reciente al más antiguo.
+func (p *Pipeline) JoinReports(limit int) ([]data.JoinReport, error) {
+	if p.joins == nil {
+		return nil, ErrJoinReportsDisabled
+	}
+	reports, err := p.joins.ListJoinReports(limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list join reports: %w", err)
+	}
+	for i := range reports {
+		reports[i] = reports[i].Summary()
+	}
+	return reports, nil
+}
+
+// RunExport envía al sink las métricas de la fecha indicada calculadas con el modelo por defecto, para no
+// exportar la misma fila una vez por modelo. Los lotes que ya se entregaron sin cambios se omiten salvo con force.
+func (p *Pipeline) RunExport(date time.Time, force bool) (ExportResult, error) {
+	result := ExportResult{Date: date}
+	if p.viaOutbox {
+		return result, ErrExportViaOutbox
+	}
+
+	// Recuperar las métricas de la fecha especificada
+	model := p.DefaultMetricModel()
+	metrics, err := p.repo.GetMetricsByDate(date, model)
+	if err != nil {
+		return result, fmt.Errorf("failed to retrieve metrics from repository: %w", err)
+	}
+	// Las métricas guardadas sin modelo se exportan con el modelo por defecto, al que pertenecen.
+	for i := range metrics {
+		if metrics[i].AttributionModel == "" {
+			metrics[i].AttributionModel = model
+		}
+	}
+
+	// Verificar si no se encontraron métricas para la fecha especificada
+	if len(metrics) == 0 {
+		log.Printf("WARN: No metrics found for the specified date: %s", date.Format("2006-01-02"))
+		result.Warnings = append(result.Warnings, "no metrics found for the specified date")
+		return result, nil
+	}
+
+	// Exportar las métricas filtradas; los lotes enviados antes de un fallo cuentan como exportados.
+	summary, err := p.exporter.Export(metrics, force)
+	result.Exported = summary.Exported
+	result.Batches = summary.Batches
+	result.DeadLettered = summary.DeadLettered
+	result.Skipped = summary.Skipped
+	result.Sinks = summary.Sinks
+	result.SinkErrors = summary.Errors
+	if err != nil {
+		return result, fmt.Errorf("export failed: %w", err)
+	}
+
+	log.Printf("INFO: Export process completed successfully. Exported %d metrics.", len(metrics))
+	return result, nil
+}
+
+// DeadLetters devuelve los lotes de exportación fallidos que cumplen el filtro.
+func (p *Pipeline) DeadLetters(filter data.DeadLetterFilter) ([]data.DeadLetter, error) {
+	if p.exporter.DeadLetters() == nil {
+		return nil, ErrDeadLettersDisabled
+	}
+	return p.exporter.DeadLetters().ListDeadLetters(filter)
+}
+
+// DeadLettersToReplay devuelve los lotes de la DLQ con los IDs indicados, o todos los pendientes si no se
+// indica ninguno. Un ID desconocido devuelve data.ErrDeadLetterNotFound.
+func (p *Pipeline) DeadLettersToReplay(ids []string) ([]data.DeadLetter, error) {
+	store := p.exporter.DeadLetters()
+	if store == nil {
+		return nil, ErrDeadLettersDisabled
+	}
+	if len(ids) == 0 {
+		return store.ListDeadLetters(data.DeadLetterFilter{Status: data.DeadLetterPending})
+	}
+	letters := make([]data.DeadLetter, 0, len(ids))
+	for _, id := range ids {
+		letter, err := store.GetDeadLetter(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dead letter %s: %w", id, err)
+		}
+		if letter == nil {
+			return nil, fmt.Errorf("%w: %q", data.ErrDeadLetterNotFound, id)
+		}
+		letters = append(letters, *letter)
+	}
+	return letters, nil
+}
+
+// ExportsViaOutbox indica si las métricas sólo se entregan a los sinks a través del outbox.
+func (p *Pipeline) ExportsViaOutbox() bool {
+	return p.viaOutbox
+}
+
+// Outbox devuelve los registros del outbox de exportación que cumplen el filtro.
+func (p *Pipeline) Outbox(filter data.OutboxFilter) ([]data.OutboxRecord, error) {
+	if p.outbox == nil {
+		return nil, ErrOutboxDisabled
+	}
+	return p.outbox.ListOutbox(filter)
+}
+
+// OutboxRecord devuelve el registro del outbox de una métrica, identificado por su clave (fecha-campaña-canal-modelo).
+func (p *Pipeline) OutboxRecord(id string) (*data.OutboxRecord, error) {
+	if p.outbox == nil {
+		return nil, ErrOutboxDisabled
+	}
+	record, err := p.outbox.GetOutboxRecord(id)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, fmt.Errorf("%w: %q", ErrOutboxRecordNotFound, id)
+	}
+	return record, nil
+}
+
+// DeadLetterReplayResult resume un reenvío de lotes de la DLQ.
+type DeadLetterReplayResult struct {
+	Replayed int // Lotes aceptados por el sink.
+	Failed   int // Lotes que siguen pendientes.
+	Metrics  int // Métricas de los lotes aceptados.
+	Warnings []string
+}
+
+// ReplayDeadLetters reenvía al sink los lotes indicados. Un lote que vuelve a fallar sigue pendiente y no
+// detiene los demás.
+func (p *Pipeline) ReplayDeadLetters(letters []data.DeadLetter) (DeadLetterReplayResult, error) {
+	var result DeadLetterReplayResult
+	if p.exporter.DeadLetters() == nil {
+		return result, ErrDeadLettersDisabled
+	}
+	for _, letter := range letters {
+		if err := p.exporter.ReplayDeadLetter(letter); err != nil {
+			if errors.Is(err, ErrSinkNotConfigured) {
+				return result, err
+			}
+			result.Failed++
+			result.Warnings = append(result.Warnings, fmt.Sprintf("dead letter %s: %v", letter.ID, err))
+			continue
+		}
+		result.Replayed++
+		result.Metrics += letter.Metrics
+	}
+	log.Printf("INFO: Replayed %d of %d dead-lettered export batches.", result.Replayed, len(letters))
+	if result.Failed > 0 {
+		return result, fmt.Errorf("%d of %d dead-lettered batches failed again", result.Failed, len(letters))
+	}
+	return result, nil
+}
+
+// combinerSink entrega al Combiner los lotes de todas las fuentes.
+type combinerSink struct {
+	combiner *Combiner
+}
+
+// AddAds entrega un lote de filas de Ads al Combiner.
+func (s combinerSink) AddAds(_ string, batch []data.AdPerformance) error {
+	s.combiner.AddAds(batch)
+	return nil
+}
+
+// AddOpportunities entrega un lote de oportunidades al Combiner.
+func (s combinerSink) AddOpportunities(_ string, batch []data.Opportunity) error {
+	s.combiner.AddOpportunities(batch)
+	return nil
+}
+
+// Watermarks devuelve las marcas de agua actuales de las fuentes.
+func (p *Pipeline) Watermarks() ([]data.Watermark, error) {
+	if p.watermarks == nil {
+		return nil, ErrIncrementalDisabled
+	}
+	return p.watermarks.ListWatermarks()
+}
+
+// ResetWatermark fija la marca de agua de una fuente al valor indicado, o la borra si es nil,
+// de modo que la siguiente ingesta vuelva a pedir los datos desde ese punto (o el histórico completo).
+func (p *Pipeline) ResetWatermark(source string, value *time.Time) error {
+	if p.watermarks == nil {
+		return ErrIncrementalDisabled
+	}
+	if !p.ingestor.Sources().Has(source) {
+		return fmt.Errorf("%w: %q", ErrUnknownSource, source)
+	}
+	if err := p.watermarks.ResetWatermark(source, value); err != nil {
+		return err
+	}
+	log.Printf("INFO: Watermark for source %s reset.", source)
+	return nil
+}
+
+// Quarantine devuelve los registros en cuarentena que cumplen el filtro.
+func (p *Pipeline) Quarantine(filter data.QuarantineFilter) ([]data.QuarantinedRecord, error) {
+	if p.validator == nil || p.quarantine == nil {
+		return nil, ErrQuarantineDisabled
+	}
+	return p.quarantine.ListQuarantined(filter)
+}
+
+// Resultados de reenviar un registro en cuarentena.
+const (
+	ResubmitAccepted = "accepted"
+	ResubmitRejected = "rejected"
+	ResubmitNotFound = "not_found"
+)
+
+// ResubmitRequest pide reenviar un registro en cuarentena. Record es la versión corregida;
+// si se omite se vuelve a validar el registro guardado (por ejemplo, tras relajar una regla).
+type ResubmitRequest struct {
+	ID     string          `json:"id"`
+	Record json.RawMessage `json:"record,omitempty"`
+}
+
+// ResubmitOutcome es el resultado de reenviar un registro.
+type ResubmitOutcome struct {
+	ID      string   `json:"id"`
+	Status  string   `json:"status"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// ResubmitResult resume un reenvío de registros en cuarentena.
+type ResubmitResult struct {
+	Outcomes []ResubmitOutcome
+	Accepted int
+	// Since es el inicio de la ingesta que recalcula las métricas afectadas por los registros aceptados; nil si no hay ninguno.
+	Since *time.Time
+}
+
+// ResubmitQuarantined vuelve a validar registros en cuarentena, con su corrección si se indica. Los aceptados
+// quedan como reenviados y cada ingesta cuya ventana cubre su fecha ingiere directamente la corrección: en lugar
+// del registro original si la fuente lo vuelve a enviar y, si no, por sí sola. Para que entren en las métricas
+// hay que ejecutar una ingesta desde result.Since.
+func (p *Pipeline) ResubmitQuarantined(requests []ResubmitRequest) (ResubmitResult, error) {
+	var result ResubmitResult
+	if p.validator == nil || p.quarantine == nil {
+		return result, ErrQuarantineDisabled
+	}
+
+	for _, req := range requests {
+		record, err := p.quarantine.GetQuarantined(req.ID)
+		if err != nil {
+			return result, fmt.Errorf("failed to read quarantined record %s: %w", req.ID, err)
+		}
+		if record == nil {
+			result.Outcomes = append(result.Outcomes, ResubmitOutcome{ID: req.ID, Status: ResubmitNotFound})
+			continue
+		}
+
+		payload := req.Record
+		if len(payload) == 0 {
+			payload = record.Correction
+		}
+		if len(payload) == 0 {
+			payload = record.Record
+		}
+		correction, start, reasons := p.revalidate(record.Kind, payload)
+		if len(reasons) > 0 {
+			result.Outcomes = append(result.Outcomes, ResubmitOutcome{ID: req.ID, Status: ResubmitRejected, Reasons: reasons})
+			continue
+		}
+		if err := p.quarantine.ResolveQuarantined(req.ID, correction); err != nil {
+			return result, fmt.Errorf("failed to resolve quarantined record %s: %w", req.ID, err)
+		}
+		result.Outcomes = append(result.Outcomes, ResubmitOutcome{ID: req.ID, Status: ResubmitAccepted})
+		result.Accepted++
+		if start != nil && (result.Since == nil || start.Before(*result.Since)) {
+			result.Since = start
+		}
+	}
+	if result.Accepted > 0 {
+		log.Printf("INFO: %d quarantined records resubmitted.", result.Accepted)
+	}
+	return result, nil
+}
+
+// revalidate decodifica y valida un registro reenviado. Devuelve el registro normalizado y el inicio de la
+// ingesta que recalcula las métricas a las que afecta: la fecha de una fila de Ads, o la creación de una
+// oportunidad menos la ventana de lookback, que es la fila de Ads más antigua a la que puede atribuirse.
+func (p *Pipeline) revalidate(kind string, payload json.RawMessage) (json.RawMessage, *time.Time, []string) {
+	decoder := json.NewDecoder(strings.NewReader(string(payload)))
+	decoder.DisallowUnknownFields()
+
+	switch kind {
+	case data.QuarantineKindAd:
+		var ad data.AdPerformance
+		if err := decoder.Decode(&ad); err != nil {
+			return nil, nil, []string{"record: " + err.Error()}
+		}
+		if reasons := p.validator.ValidateAd(ad); len(reasons) > 0 {
+			return nil, nil, reasons
+		}
+		var start *time.Time
+		if date, err := time.Parse("2006-01-02", ad.Date); err == nil {
+			start = &date
+		}
+		return encodeAd(ad), start, nil
+
+	case data.QuarantineKindOpportunity:
+		var opp data.Opportunity
+		if err := decoder.Decode(&opp); err != nil {
+			return nil, nil, []string{"record: " + err.Error()}
+		}
+		if reasons := p.validator.ValidateOpportunity(opp); len(reasons) > 0 {
+			return nil, nil, reasons
+		}
+		start := p.transformer.timezones.EarliestDay(opp.CreatedAt).AddDate(0, 0, -p.transformer.lookbackDays)
+		return encodeOpportunity(opp), &start, nil
+	}
+	return nil, nil, []string{fmt.Sprintf("unknown record kind %q", kind)}
+}
+
+// dayWindow es la ventana de una ingesta desde el día indicado para todas las fuentes.
+func (p *Pipeline) dayWindow(day time.Time) map[string]*time.Time {
+	window := make(map[string]*time.Time)
+	crmStart := p.transformer.timezones.StartOfDay(day)
+	for _, source := range p.ingestor.Sources().AdsSources() {
+		window[source.Name()] = &day
+	}
+	for _, source := range p.ingestor.Sources().CRMSources() {
+		window[source.Name()] = &crmStart
+	}
+	return window
+}
+
+// incrementalWindow calcula el inicio de la ventana de cada fuente a partir de su marca de agua y el primer día
+// cuyas métricas se recalculan: la marca de agua de Ads más atrasada menos el solape y los días de lookback,
+// porque una oportunidad nueva puede atribuirse a anuncios de hasta esos días antes. CRM empieza en ese día (o
+// antes, si su propia marca de agua lo pide), de modo que se descargan todas las oportunidades de los anuncios
+// recalculados, y Ads retrocede otro lookback desde el inicio de CRM para que cada oportunidad descargada tenga
+// todos sus toques; las filas anteriores a ese día sólo sirven para repartir el crédito y no se guardan.
+// Si alguna fuente de Ads no tiene marca de agua, o en modo naive, donde una oportunidad se atribuye a las filas
+// de su clave UTM de cualquier fecha, la ventana queda vacía y la ingesta es completa.
+func (p *Pipeline) incrementalWindow() (map[string]*time.Time, *time.Time, error) {
+	window := make(map[string]*time.Time)
+	if p.transformer.mode == AttributionNaive {
+		return window, nil, nil
+	}
+	lookback := p.transformer.lookbackDays
+
+	var recomputeFrom *time.Time
+	for _, source := range p.ingestor.Sources().AdsSources() {
+		wm, err := p.watermarks.GetWatermark(source.Name())
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read watermark for %s: %w", source.Name(), err)
+		}
+		if wm == nil {
+			return window, nil, nil
+		}
+		start := wm.Add(-p.overlap).UTC().Truncate(24*time.Hour).AddDate(0, 0, -lookback) // Los datos de Ads son diarios.
+		if recomputeFrom == nil || start.Before(*recomputeFrom) {
+			recomputeFrom = &start
+		}
+	}
+	if recomputeFrom == nil {
+		return window, nil, nil
+	}
+
+	earliestCRM := p.transformer.timezones.StartOfDay(*recomputeFrom)
+	for _, source := range p.ingestor.Sources().CRMSources() {
+		wm, err := p.watermarks.GetWatermark(source.Name())
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read watermark for %s: %w", source.Name(), err)
+		}
+		start := p.transformer.timezones.StartOfDay(*recomputeFrom)
+		if wm != nil {
+			if c := wm.Add(-p.overlap).UTC(); c.Before(start) {
+				start = c
+			}
+		}
+		window[source.Name()] = &start
+		if start.Before(earliestCRM) {
+			earliestCRM = start
+		}
+	}
+
+	adsStart := p.transformer.timezones.EarliestDay(earliestCRM).AddDate(0, 0, -lookback)
+	for _, source := range p.ingestor.Sources().AdsSources() {
+		window[source.Name()] = &adsStart
+	}
+	return window, recomputeFrom, nil
+}
+
+// advanceWatermarks avanza la marca de agua de cada fuente al registro más reciente recibido.
+func (p *Pipeline) advanceWatermarks(latest map[string]time.Time) error {
+	for source, value := range latest {
+		if err := p.watermarks.AdvanceWatermark(source, value); err != nil {
+			return fmt.Errorf("failed to advance watermark for %s: %w", source, err)
+		}
+	}
+	return nil
+}
+
+// IngestionJob devuelve el trabajo asíncrono que ejecuta RunIngestion y resume su resultado.
+func (p *Pipeline) IngestionJob(since *time.Time, model AttributionModel) jobs.Func {
+	return func() (jobs.Report, error) {
+		result, err := p.RunIngestion(since, model)
+		return jobs.Report{
+			Records:  ingestionRecords(result),
+			Warnings: result.Warnings,
+			Details:  map[string]string{"run_id": result.RunID},
+		}, err
+	}
+}
+
+// ingestionRecords resume los conteos de una ingesta, incluidos los registros recibidos de cada fuente.
+func ingestionRecords(result IngestionResult) map[string]int {
+	records := map[string]int{
+		"ads_fetched":           result.AdsFetched,
+		"opportunities_fetched": result.OppsFetched,
+		"records_accepted":      result.Accepted,
+		"records_rejected":      result.Rejected,
+		"records_corrected":     result.Corrected,
+		"metrics_saved":         result.MetricsSaved,
+		"save_failures":         result.SaveFailures,
+		"skipped_ad_rows":       result.SkippedAdRows,
+		"opportunities_matched": result.MatchedOpps,
+		"opportunities_orphan":  result.OrphanOpps,
+		"ads_unconverted":       result.UnconvertedAds,
+	}
+	for source, n := range result.Fetched {
+		records["fetched."+source] = n
+	}
+	for source, n := range result.Rejects {
+		records["rejected."+source] = n
+	}
+	return records
+}
+
+// ReplayJob devuelve el trabajo asíncrono que ejecuta RunReplay y resume su resultado.
+func (p *Pipeline) ReplayJob(runID string, model AttributionModel) jobs.Func {
+	return func() (jobs.Report, error) {
+		result, err := p.RunReplay(runID, model)
+		return jobs.Report{
+			Records:  ingestionRecords(result),
+			Warnings: result.Warnings,
+			Details:  map[string]string{"replayed_run_id": runID, "model": string(result.Model)},
+		}, err
+	}
+}
+
+// ArchivedRun devuelve el manifiesto de una ingesta archivada.
+func (p *Pipeline) ArchivedRun(runID string) (*data.ArchivedRun, error) {
+	if p.archive == nil {
+		return nil, ErrArchiveDisabled
+	}
+	return p.archive.Run(runID)
+}
+
+// ArchivedRuns devuelve los manifiestos de las ingestas archivadas, de la más reciente a la más antigua.
+func (p *Pipeline) ArchivedRuns() ([]data.ArchivedRun, error) {
+	if p.archive == nil {
+		return nil, ErrArchiveDisabled
+	}
+	return p.archive.ListRuns()
+}
+
+// newRunID genera un identificador aleatorio para una ingesta.
+func newRunID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate run id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ExportJob devuelve el trabajo asíncrono que ejecuta RunExport y resume su resultado.
+func (p *Pipeline) ExportJob(date time.Time, force bool) jobs.Func {
+	return func() (jobs.Report, error) {
+		result, err := p.RunExport(date, force)
+		records := map[string]int{
+			"metrics_exported":      result.Exported,
+			"batches":               result.Batches,
+			"batches_dead_lettered": result.DeadLettered,
+			"batches_skipped":       result.Skipped,
+		}
+		// Con varios sinks, cada uno tiene sus conteos bajo su nombre y su último error en Details.
+		var details map[string]string
+		for name, s := range result.Sinks {
+			records[name+".metrics_exported"] = s.Exported
+			records[name+".batches"] = s.Batches
+			records[name+".batches_failed"] = s.Failed
+			records[name+".batches_dead_lettered"] = s.DeadLettered
+			records[name+".batches_skipped"] = s.Skipped
+		}
+		for name, message := range result.SinkErrors {
+			if details == nil {
+				details = make(map[string]string)
+			}
+			details[name+".error"] = message
+		}
+		return jobs.Report{Records: records, Warnings: result.Warnings, Details: details}, err
+	}
+}
+
+// DeadLetterReplayJob devuelve el trabajo asíncrono que ejecuta ReplayDeadLetters y resume su resultado.
+func (p *Pipeline) DeadLetterReplayJob(letters []data.DeadLetter) jobs.Func {
+	return func() (jobs.Report, error) {
+		result, err := p.ReplayDeadLetters(letters)
+		return jobs.Report{
+			Records: map[string]int{
+				"batches_replayed": result.Replayed,
+				"batches_failed":   result.Failed,
+				"metrics_exported": result.Metrics,
+			},
+			Warnings: result.Warnings,
+		}, err
+	}
+}
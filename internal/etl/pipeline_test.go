@@ -0,0 +1,356 @@
+package etl
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btors/admira-etl/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeline_IncrementalIngestionWithWatermarks(t *testing.T) {
+	var adsQueries, crmQueries []string
+
+	adsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		adsQueries = append(adsQueries, r.URL.Query().Get("since"))
+		w.Write([]byte(`{"external": {"ads": {"performance": [
+			{"date": "2025-07-20", "campaign_id": "C-1001", "channel": "google_ads", "clicks": 10, "cost": 5.0, "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"},
+			{"date": "2025-08-01", "campaign_id": "C-1001", "channel": "google_ads", "clicks": 100, "cost": 50.0, "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"}
+		]}}}`))
+	}))
+	defer adsServer.Close()
+
+	crmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		crmQueries = append(crmQueries, r.URL.Query().Get("updated_after"))
+		w.Write([]byte(`{"external": {"crm": {"opportunities": [
+			{"opportunity_id": "O-9001", "stage": "closed_won", "amount": 750.0, "created_at": "2025-08-01T15:00:00Z", "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"}
+		]}}}`))
+	}))
+	defer crmServer.Close()
+
+	store := data.NewInMemoryWatermarkStore()
+	pipeline := NewPipeline(
+		data.NewInMemoryRepository(),
+		NewIngestorFromRegistry(newLegacyRegistry(t, adsServer.URL, crmServer.URL, "since", "updated_after")),
+		NewTransformer(WithAttribution(AttributionWindow, 7)),
+		NewExporter("", ""),
+		WithWatermarks(store, 48*time.Hour),
+	)
+
+	// Primera ejecución: sin marcas de agua la ingesta es completa.
+	first, err := pipeline.RunIngestion(nil, LastTouch)
+	require.NoError(t, err)
+	assert.Nil(t, first.Window[SourceAds])
+	assert.Equal(t, 2, first.AdsFetched)
+	assert.Equal(t, []string{""}, adsQueries)
+
+	adsWM, err := store.GetWatermark(SourceAds)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC), *adsWM)
+	crmWM, err := store.GetWatermark(SourceCRM)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 8, 1, 15, 0, 0, 0, time.UTC), *crmWM)
+
+	// Segunda ejecución: recalcula desde la marca de agua menos el solape y los 7 días de lookback, que es donde
+	// empieza CRM; Ads retrocede otros 7 días para tener todos los toques, pero esas filas no se guardan.
+	second, err := pipeline.RunIngestion(nil, LastTouch)
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 7, 23, 0, 0, 0, 0, time.UTC), *second.RecomputeFrom)
+	assert.Equal(t, "2025-07-16", adsQueries[1])
+	assert.Equal(t, "2025-07-23T00:00:00Z", crmQueries[1])
+	assert.Equal(t, 2, second.AdsFetched)
+	assert.Equal(t, 1, second.OppsFetched)
+	assert.Equal(t, 1, second.MetricsSaved)
+
+	// Tras el reset la siguiente ingesta vuelve a ser completa.
+	require.NoError(t, pipeline.ResetWatermark(SourceAds, nil))
+	third, err := pipeline.RunIngestion(nil, LastTouch)
+	require.NoError(t, err)
+	assert.Nil(t, third.Window[SourceAds])
+	assert.Equal(t, 2, third.AdsFetched)
+
+	assert.ErrorIs(t, pipeline.ResetWatermark("tiktok", nil), ErrUnknownSource)
+}
+
+func TestPipeline_IncrementalIngestionMatchesFullIngestion(t *testing.T) {
+	adsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"external": {"ads": {"performance": [
+			{"date": "2025-08-01", "campaign_id": "C-A", "channel": "google_ads", "clicks": 10, "cost": 5.0, "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"},
+			{"date": "2025-08-26", "campaign_id": "C-B", "channel": "google_ads", "clicks": 20, "cost": 10.0, "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"},
+			{"date": "2025-09-26", "campaign_id": "C-C", "channel": "google_ads", "clicks": 30, "cost": 15.0, "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"}
+		]}}}`))
+	}))
+	defer adsServer.Close()
+	crmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"external": {"crm": {"opportunities": [
+			{"opportunity_id": "O-1", "stage": "closed_won", "amount": 500.0, "created_at": "2025-08-28T10:00:00Z", "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"},
+			{"opportunity_id": "O-2", "stage": "closed_won", "amount": 300.0, "created_at": "2025-09-27T10:00:00Z", "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"}
+		]}}}`))
+	}))
+	defer crmServer.Close()
+
+	run := func(t *testing.T, mode AttributionMode, model AttributionModel, runs int) (*data.InMemoryRepository, IngestionResult) {
+		repo := data.NewInMemoryRepository()
+		pipeline := NewPipeline(
+			repo,
+			NewIngestorFromRegistry(newLegacyRegistry(t, adsServer.URL, crmServer.URL, "", "")),
+			NewTransformer(WithAttribution(mode, 30)),
+			NewExporter("", ""),
+			WithWatermarks(data.NewInMemoryWatermarkStore(), 48*time.Hour),
+		)
+		var result IngestionResult
+		for i := 0; i < runs; i++ {
+			var err error
+			result, err = pipeline.RunIngestion(nil, model)
+			require.NoError(t, err)
+		}
+		return repo, result
+	}
+
+	for _, mode := range []AttributionMode{AttributionWindow, AttributionNaive} {
+		for _, model := range []AttributionModel{FirstTouch, LastTouch, Linear, TimeDecay, PositionBased} {
+			t.Run(string(mode)+"/"+string(model), func(t *testing.T) {
+				fullRepo, _ := run(t, mode, model, 1)
+				want, err := fullRepo.GetAllMetrics()
+				require.NoError(t, err)
+				require.Len(t, want, 3)
+
+				// La segunda ingesta sobre los mismos datos es incremental y no debe cambiar nada de lo guardado.
+				incrementalRepo, incremental := run(t, mode, model, 2)
+				if mode == AttributionWindow {
+					require.NotNil(t, incremental.RecomputeFrom)
+					assert.Equal(t, time.Date(2025, 8, 25, 0, 0, 0, 0, time.UTC), *incremental.RecomputeFrom)
+					assert.Equal(t, 2, incremental.MetricsSaved) // La fila del 1 de agosto es sólo contexto.
+				} else {
+					assert.Nil(t, incremental.RecomputeFrom) // En modo naive la ingesta es siempre completa.
+				}
+				got, err := incrementalRepo.GetAllMetrics()
+				require.NoError(t, err)
+				assert.ElementsMatch(t, want, got)
+			})
+		}
+	}
+}
+
+func TestPipeline_ReplayFromArchive(t *testing.T) {
+	adsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"external": {"ads": {"performance": [
+			{"date": "2025-08-01", "campaign_id": "C-1001", "channel": "google_ads", "clicks": 100, "impressions": 1000, "cost": 50.0, "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"},
+			{"date": "2025-08-02", "campaign_id": "C-1002", "channel": "meta_ads", "clicks": 40, "impressions": 900, "cost": 30.0, "utm_campaign": "back_to_school", "utm_source": "facebook", "utm_medium": "paid_social"}
+		]}}}`))
+	}))
+	crmFails := false
+	crmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if crmFails {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"external": {"crm": {"opportunities": [
+			{"opportunity_id": "O-1", "stage": "closed_won", "amount": 750.0, "created_at": "2025-08-01T15:00:00Z", "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"}
+		]}}}`))
+	}))
+
+	archive, err := data.NewPayloadArchive(t.TempDir(), 0)
+	require.NoError(t, err)
+	registry := newLegacyRegistry(t, adsServer.URL, crmServer.URL, "", "")
+	repo := data.NewInMemoryRepository()
+	pipeline := NewPipeline(repo, NewIngestorFromRegistry(registry), NewTransformer(), NewExporter("", ""), WithArchive(archive))
+
+	original, err := pipeline.RunIngestion(nil, LastTouch)
+	require.NoError(t, err)
+	require.True(t, original.Archived)
+	want, err := repo.GetAllMetrics()
+	require.NoError(t, err)
+	require.Len(t, want, 2)
+
+	// Una ingesta fallida queda archivada pero no puede repetirse.
+	crmFails = true
+	failed, err := pipeline.RunIngestion(nil, LastTouch)
+	require.Error(t, err)
+	require.True(t, failed.Archived)
+	_, err = pipeline.RunReplay(failed.RunID, "")
+	assert.ErrorIs(t, err, ErrRunNotReplayable)
+
+	// Sin red, la repetición sobre un repositorio vacío produce las mismas métricas.
+	adsServer.Close()
+	crmServer.Close()
+	replayRepo := data.NewInMemoryRepository()
+	replayer := NewPipeline(replayRepo, NewIngestorFromRegistry(registry), NewTransformer(), NewExporter("", ""), WithArchive(archive))
+	replayed, err := replayer.RunReplay(original.RunID, "")
+	require.NoError(t, err)
+	assert.Equal(t, LastTouch, replayed.Model)
+	assert.Equal(t, original.AdsFetched, replayed.AdsFetched)
+	assert.Equal(t, original.OppsFetched, replayed.OppsFetched)
+	got, err := replayRepo.GetAllMetrics()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, want, got)
+
+	runs, err := replayer.ArchivedRuns()
+	require.NoError(t, err)
+	assert.Len(t, runs, 2)
+	_, err = replayer.RunReplay("unknown", "")
+	assert.ErrorIs(t, err, data.ErrArchivedRunNotFound)
+
+	// Sin archivo configurado no hay nada que repetir.
+	_, err = NewPipeline(replayRepo, NewIngestorFromRegistry(registry), NewTransformer(), NewExporter("", "")).RunReplay(original.RunID, "")
+	assert.ErrorIs(t, err, ErrArchiveDisabled)
+}
+
+func TestPipeline_ReplayUsesArchivedConfig(t *testing.T) {
+	adsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"date": "2025-08-01", "campaign_id": "C-1001", "channel": "google_ads", "clicks": 100, "cost": 50.0, "utm_campaign": "Summer-Sale", "utm_source": "google", "utm_medium": "cpc"}]`))
+	}))
+	crmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"opportunity_id": "O-1", "stage": "closed_won", "amount": 750.0, "created_at": "2025-08-01T15:00:00Z", "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"}]`))
+	}))
+	registry, err := NewSourceRegistryFromConfig(SourcesConfig{
+		Ads: []SourceConfig{{Name: "google", URL: adsServer.URL + "?key=s3cret", Auth: AuthConfig{Type: AuthBearer, Token: "s3cret"}}},
+		CRM: []SourceConfig{{Name: "hubspot", URL: crmServer.URL}},
+	})
+	require.NoError(t, err)
+
+	// La ingesta original cruza las campañas gracias a un alias que después se retira.
+	rules, err := NewUTMRules(UTMRulesConfig{Campaign: UTMFieldRules{Aliases: map[string]string{"summer-sale": "summer_sale"}}})
+	require.NoError(t, err)
+	dir := t.TempDir()
+	archive, err := data.NewPayloadArchive(dir, 0)
+	require.NoError(t, err)
+	repo := data.NewInMemoryRepository()
+	pipeline := NewPipeline(repo, NewIngestorFromRegistry(registry), NewTransformer(WithUTMNormalizer(NewUTMNormalizer(rules))), NewExporter("", ""), WithArchive(archive))
+	original, err := pipeline.RunIngestion(nil, LastTouch)
+	require.NoError(t, err)
+	want, err := repo.GetAllMetrics()
+	require.NoError(t, err)
+	require.Len(t, want, 1)
+	require.Equal(t, 750.0, want[0].Revenue)
+
+	run, err := archive.Run(original.RunID)
+	require.NoError(t, err)
+	require.NotEmpty(t, run.Snapshot)
+	reader, err := archive.Open(run.Snapshot)
+	require.NoError(t, err)
+	snapshot, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	assert.NotContains(t, string(snapshot), "s3cret", "credentials are not archived")
+
+	// Sin red y con las reglas actuales sin alias, la repetición usa las reglas archivadas.
+	adsServer.Close()
+	crmServer.Close()
+	replayRepo := data.NewInMemoryRepository()
+	replayer := NewPipeline(replayRepo, NewIngestorFromRegistry(NewSourceRegistry()), NewTransformer(), NewExporter("", ""), WithArchive(archive))
+	replayed, err := replayer.RunReplay(original.RunID, "")
+	require.NoError(t, err)
+	assert.Empty(t, replayed.Warnings)
+	got, err := replayRepo.GetAllMetrics()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, want, got)
+
+	// Una ingesta archivada sin su configuración se repite con la actual y lo advierte.
+	run.Snapshot = ""
+	raw, err := json.Marshal(run)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "runs", original.RunID+".json"), raw, 0o644))
+	legacy := NewPipeline(data.NewInMemoryRepository(), NewIngestorFromRegistry(registry), NewTransformer(), NewExporter("", ""), WithArchive(archive))
+	replayed, err = legacy.RunReplay(original.RunID, "")
+	require.NoError(t, err)
+	assert.Contains(t, replayed.Warnings, "run was archived without its config; replayed with the current config")
+	assert.Equal(t, 0, replayed.MatchedOpps)
+}
+
+func TestPipeline_SavesJoinReportPerRun(t *testing.T) {
+	adsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"external": {"ads": {"performance": [
+			{"date": "2025-08-01", "campaign_id": "C-1001", "channel": "google_ads", "clicks": 100, "cost": 50.0, "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"}
+		]}}}`))
+	}))
+	defer adsServer.Close()
+	crmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"external": {"crm": {"opportunities": [
+			{"opportunity_id": "O-1", "stage": "closed_won", "amount": 750.0, "created_at": "2025-08-01T15:00:00Z", "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"},
+			{"opportunity_id": "O-2", "stage": "closed_won", "amount": 300.0, "created_at": "2025-08-01T16:00:00Z", "utm_campaign": "newsletter", "utm_source": "mailchimp", "utm_medium": "email"}
+		]}}}`))
+	}))
+	defer crmServer.Close()
+
+	registry := newLegacyRegistry(t, adsServer.URL, crmServer.URL, "", "")
+	withoutStore := NewPipeline(data.NewInMemoryRepository(), NewIngestorFromRegistry(registry), NewTransformer(), NewExporter("", ""))
+	_, err := withoutStore.JoinReports(10)
+	assert.ErrorIs(t, err, ErrJoinReportsDisabled)
+
+	pipeline := NewPipeline(data.NewInMemoryRepository(), NewIngestorFromRegistry(registry), NewTransformer(), NewExporter("", ""),
+		WithJoinReports(data.NewInMemoryJoinReportStore(10)))
+	result, err := pipeline.RunIngestion(nil, LastTouch)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.MatchedOpps)
+	assert.Equal(t, 1, result.OrphanOpps)
+	assert.Equal(t, 300.0, result.OrphanAmount)
+	assert.NotEmpty(t, result.Warnings)
+
+	report, err := pipeline.JoinReport(result.RunID)
+	require.NoError(t, err)
+	require.Len(t, report.Orphans, 1)
+	assert.Equal(t, "O-2", report.Orphans[0].OpportunityID)
+
+	// El listado devuelve sólo el resumen.
+	reports, err := pipeline.JoinReports(10)
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	assert.Equal(t, result.RunID, reports[0].RunID)
+	assert.Equal(t, 1, reports[0].OrphanOpportunities)
+	assert.Nil(t, reports[0].Orphans)
+
+	_, err = pipeline.JoinReport("missing")
+	assert.ErrorIs(t, err, ErrJoinReportNotFound)
+}
+
+func TestPipeline_ExportsOnlyDefaultModel(t *testing.T) {
+	repo := data.NewInMemoryRepository()
+	day := time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC)
+	for _, model := range []string{"", "last_touch", "linear"} {
+		campaign := "C-" + model
+		require.NoError(t, repo.Save(data.EnrichedMetric{Date: day, CampaignID: campaign, Channel: "google_ads", AttributionModel: model}))
+	}
+
+	var stdout bytes.Buffer
+	exporter := NewExporter("", "", WithSinks(NewStdoutSink("debug", &stdout)))
+	pipeline := NewPipeline(repo, NewIngestorFromRegistry(NewSourceRegistry()), NewTransformer(), exporter)
+
+	result, err := pipeline.RunExport(day, false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Exported)
+
+	// La métrica sin modelo se exporta con el modelo por defecto, y la de linear no se exporta.
+	var line struct {
+		Payload []data.EnrichedMetric `json:"payload"`
+	}
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &line))
+	metrics := line.Payload
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "last_touch", metrics[0].AttributionModel)
+	assert.Equal(t, "last_touch", metrics[1].AttributionModel)
+}
+
+func TestPipeline_ExportViaOutboxDisablesDirectExport(t *testing.T) {
+	repo := data.NewInMemoryRepository()
+	day := time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, repo.Save(data.EnrichedMetric{Date: day, CampaignID: "C-1001", Channel: "google_ads"}))
+
+	var stdout bytes.Buffer
+	exporter := NewExporter("", "", WithSinks(NewStdoutSink("debug", &stdout)))
+	pipeline := NewPipeline(repo, NewIngestorFromRegistry(NewSourceRegistry()), NewTransformer(), exporter,
+		WithOutbox(repo), WithOutboxDelivery())
+
+	assert.True(t, pipeline.ExportsViaOutbox())
+	_, err := pipeline.RunExport(day, true)
+	assert.ErrorIs(t, err, ErrExportViaOutbox)
+	assert.Zero(t, stdout.Len())
+}
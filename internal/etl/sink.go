@@ -0,0 +1,558 @@
+// Package etl internal/etl/sink.go
+package etl
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btors/admira-etl/internal/data"
+	"github.com/btors/admira-etl/pkg/signature"
+)
+
+// Tipos de sink admitidos en SINKS_CONFIG.
+const (
+	SinkTypeHTTP       = "http"
+	SinkTypeFilesystem = "filesystem"
+	SinkTypeS3         = "s3"
+	SinkTypeStdout     = "stdout"
+)
+
+// DefaultSinkName es el nombre del sink HTTP construido a partir de SINK_URL.
+const DefaultSinkName = data.LegacySinkName
+
+// ErrUnknownSink se devuelve al reenviar un lote de la DLQ cuyo sink ya no está configurado.
+var ErrUnknownSink = errors.New("export sink not configured")
+
+// Sink es un destino de exportación. El nombre es único entre los sinks configurados y se usa como clave de
+// sus entregas y de sus lotes fallidos.
+type Sink interface {
+	Name() string
+	// Deliver entrega un lote completo. Un *SinkError indica si el fallo es transitorio; el resto de errores
+	// no se reintentan.
+	Deliver(batch SinkBatch) error
+}
+
+// PartitionSink es un Sink que publica cada día exportado como una partición de partes numeradas. Al terminar
+// la exportación de un día, Export llama a FinishPartition con su número de partes para que retire las que
+// sobran de una exportación anterior con más lotes y anote el número vigente en el manifiesto del día.
+type PartitionSink interface {
+	Sink
+	FinishPartition(date string, parts int) error
+}
+
+// partitionManifest es el manifiesto de una partición diaria (date=YYYY-MM-DD/_manifest.json): sus partes
+// vigentes son part-0.json … part-<Parts-1>.json.
+type partitionManifest struct {
+	Date      string    `json:"date"`
+	Parts     int       `json:"parts"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// manifestPath devuelve la ruta relativa del manifiesto de la partición de un día.
+func manifestPath(date string) string {
+	return "date=" + date + "/_manifest.json"
+}
+
+// SinkBatch es un lote de métricas ya serializado como array JSON.
+type SinkBatch struct {
+	Date    string // Día exportado (YYYY-MM-DD); vacío en los lotes del outbox, que pueden mezclar días.
+	Index   int    // Índice del lote dentro de la exportación, desde 0.
+	Key     string // Idempotency-Key del lote.
+	Metrics int    // Métricas del lote.
+	Payload []byte
+}
+
+// SinkError es un fallo de entrega que indica si repetirla puede cambiar el resultado.
+type SinkError struct {
+	Err        error
+	Retryable  bool
+	RetryAfter time.Duration // Espera mínima pedida por el destino; 0 si no la indica.
+}
+
+// Error devuelve el mensaje del error original.
+func (e *SinkError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap devuelve el error original.
+func (e *SinkError) Unwrap() error {
+	return e.Err
+}
+
+// statusError clasifica una respuesta HTTP no 2xx: se reintentan 408, 429 y 5xx, respetando Retry-After.
+func statusError(resp *http.Response) *SinkError {
+	code := resp.StatusCode
+	return &SinkError{
+		Err:        fmt.Errorf("sink returned status code: %d", code),
+		Retryable:  code >= 500 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// HTTPSink envía cada lote en un POST firmado (ver pkg/signature) con su Idempotency-Key.
+type HTTPSink struct {
+	name   string
+	url    string
+	key    signature.Key
+	client *http.Client
+}
+
+// NewHTTPSink crea un sink HTTP que firma las peticiones con key.
+func NewHTTPSink(name, sinkURL string, key signature.Key) *HTTPSink {
+	return &HTTPSink{
+		name:   name,
+		url:    sinkURL,
+		key:    key,
+		client: &http.Client{Timeout: 30 * time.Second}, // Configura un tiempo de espera de 30 segundos.
+	}
+}
+
+// Name devuelve el nombre del sink.
+func (s *HTTPSink) Name() string {
+	return s.name
+}
+
+// Deliver realiza un único envío del lote.
+func (s *HTTPSink) Deliver(batch SinkBatch) error {
+	// Crea la solicitud HTTP POST y configura sus encabezados.
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(batch.Payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(IdempotencyKeyHeader, batch.Key)
+
+	// Firma método, ruta, timestamp, nonce y cuerpo; cada intento lleva su propio timestamp y nonce.
+	if err := signature.Sign(req, batch.Payload, s.key); err != nil {
+		return err
+	}
+
+	// Envía la solicitud al sistema de destino.
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return &SinkError{Err: fmt.Errorf("failed to send request to sink: %w", err), Retryable: true}
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16)) // Permite reutilizar la conexión.
+
+	// Cualquier respuesta 2xx cuenta como éxito.
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return statusError(resp)
+}
+
+// partitionPath devuelve la ruta relativa de un lote: date=YYYY-MM-DD/part-N.json para las exportaciones y
+// outbox/<Idempotency-Key>.json para los lotes del outbox. Reexportar un día sobrescribe sus partes, y
+// FinishPartition retira las que sobran.
+func partitionPath(batch SinkBatch) string {
+	if batch.Date == "" {
+		return "outbox/" + batch.Key + ".json"
+	}
+	return fmt.Sprintf("date=%s/part-%d.json", batch.Date, batch.Index)
+}
+
+// FileSink escribe cada lote en un archivo de un directorio particionado por día.
+type FileSink struct {
+	name string
+	dir  string
+}
+
+// NewFileSink crea un sink que escribe los lotes bajo dir.
+func NewFileSink(name, dir string) *FileSink {
+	return &FileSink{name: name, dir: dir}
+}
+
+// Name devuelve el nombre del sink.
+func (s *FileSink) Name() string {
+	return s.name
+}
+
+// Deliver escribe el lote de forma atómica: un lector nunca ve una parte a medio escribir.
+func (s *FileSink) Deliver(batch SinkBatch) error {
+	return s.publish(partitionPath(batch), batch.Payload)
+}
+
+// FinishPartition borra las partes del día con índice parts o mayor y después publica el manifiesto.
+func (s *FileSink) FinishPartition(date string, parts int) error {
+	dir := filepath.Join(s.dir, "date="+date)
+	files, err := filepath.Glob(filepath.Join(dir, "part-*.json"))
+	if err != nil {
+		return fmt.Errorf("failed to list partition files: %w", err)
+	}
+	for _, file := range files {
+		index, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "part-"), ".json"))
+		if err != nil || index < parts {
+			continue
+		}
+		if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove stale partition file: %w", err)
+		}
+	}
+	manifest, err := json.Marshal(partitionManifest{Date: date, Parts: parts, UpdatedAt: time.Now().UTC()})
+	if err != nil {
+		return fmt.Errorf("failed to encode partition manifest: %w", err)
+	}
+	return s.publish(manifestPath(date), manifest)
+}
+
+// publish escribe contenido en la ruta relativa indicada a través de un temporal que después se renombra.
+func (s *FileSink) publish(relPath string, content []byte) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(relPath))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create partition directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".part-*")
+	if err != nil {
+		return fmt.Errorf("failed to create partition file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write partition file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write partition file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to publish partition file: %w", err)
+	}
+	return nil
+}
+
+// S3Config configura un sink de objetos compatible con S3.
+type S3Config struct {
+	Endpoint        string `json:"endpoint"` // URL base, p. ej. https://s3.eu-west-1.amazonaws.com o http://localhost:9000.
+	Bucket          string `json:"bucket"`
+	Region          string `json:"region"`
+	Prefix          string `json:"prefix"` // Prefijo de las claves de los objetos, p. ej. "metrics/".
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+}
+
+// S3Sink sube cada lote como un objeto, con las mismas claves particionadas que FileSink. Usa URLs de estilo
+// ruta (endpoint/bucket/clave) y firma AWS Signature V4, así que también funciona con MinIO y similares.
+type S3Sink struct {
+	name   string
+	cfg    S3Config
+	client *http.Client
+	now    func() time.Time // Sustituible en las pruebas.
+}
+
+// NewS3Sink crea un sink S3. La región por defecto es us-east-1.
+func NewS3Sink(name string, cfg S3Config) *S3Sink {
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+	return &S3Sink{name: name, cfg: cfg, client: &http.Client{Timeout: 30 * time.Second}, now: time.Now}
+}
+
+// Name devuelve el nombre del sink.
+func (s *S3Sink) Name() string {
+	return s.name
+}
+
+// Deliver sube el lote con un PUT firmado. La Idempotency-Key viaja como metadato del objeto.
+func (s *S3Sink) Deliver(batch SinkBatch) error {
+	resp, err := s.do(http.MethodPut, partitionPath(batch), batch.Payload, batch.Key)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return statusError(resp)
+}
+
+// FinishPartition borra las partes que el manifiesto anterior del día tenía de más y después sube el nuevo.
+// Las partes de una exportación anterior sin manifiesto no se conocen, así que no se borran.
+func (s *S3Sink) FinishPartition(date string, parts int) error {
+	previous := 0
+	resp, err := s.do(http.MethodGet, manifestPath(date), nil, "")
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		var manifest partitionManifest
+		err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&manifest)
+		if err != nil {
+			resp.Body.Close()
+			return fmt.Errorf("failed to decode partition manifest: %w", err)
+		}
+		previous = manifest.Parts
+	default:
+		resp.Body.Close()
+		return statusError(resp)
+	}
+	resp.Body.Close()
+
+	for index := parts; index < previous; index++ {
+		part := SinkBatch{Date: date, Index: index}
+		if err := s.expect(s.do(http.MethodDelete, partitionPath(part), nil, "")); err != nil {
+			return fmt.Errorf("failed to remove stale partition object: %w", err)
+		}
+	}
+	manifest, err := json.Marshal(partitionManifest{Date: date, Parts: parts, UpdatedAt: s.now().UTC()})
+	if err != nil {
+		return fmt.Errorf("failed to encode partition manifest: %w", err)
+	}
+	if err := s.expect(s.do(http.MethodPut, manifestPath(date), manifest, "")); err != nil {
+		return fmt.Errorf("failed to upload partition manifest: %w", err)
+	}
+	return nil
+}
+
+// do envía una petición firmada sobre el objeto key, relativo al prefijo. idempotencyKey, si no está vacía,
+// viaja como metadato del objeto.
+func (s *S3Sink) do(method, key string, body []byte, idempotencyKey string) (*http.Response, error) {
+	objectPath := "/" + s.cfg.Bucket + "/" + s.cfg.Prefix + key
+	req, err := http.NewRequest(method, s.cfg.Endpoint+s3EscapePath(objectPath), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if method == http.MethodPut {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("X-Amz-Meta-Idempotency-Key", idempotencyKey)
+	}
+	s.sign(req, body)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, &SinkError{Err: fmt.Errorf("failed to send request to object store: %w", err), Retryable: true}
+	}
+	return resp, nil
+}
+
+// expect cierra la respuesta de do y devuelve un error si no es 2xx.
+func (s *S3Sink) expect(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return statusError(resp)
+}
+
+// sign firma la petición con AWS Signature V4, firmando todas las cabeceras que lleva.
+func (s *S3Sink) sign(req *http.Request, payload []byte) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	bodyHash := sha256.Sum256(payload)
+	payloadHash := hex.EncodeToString(bodyHash[:])
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	scope := day + "/" + s.cfg.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretAccessKey), day)
+	for _, part := range []string{s.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+// s3EscapePath codifica la ruta como exige Signature V4: todo salvo los caracteres no reservados y "/", así
+// que "date=…" viaja como "date%3D…".
+func s3EscapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// hmacSHA256 devuelve el HMAC-SHA256 de msg con key.
+func hmacSHA256(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// StdoutSink escribe cada lote como una línea JSON, para depurar la exportación sin un destino real.
+type StdoutSink struct {
+	name string
+	mu   sync.Mutex
+	w    io.Writer
+}
+
+// NewStdoutSink crea un sink que escribe en w (os.Stdout si es nil).
+func NewStdoutSink(name string, w io.Writer) *StdoutSink {
+	if w == nil {
+		w = os.Stdout
+	}
+	return &StdoutSink{name: name, w: w}
+}
+
+// Name devuelve el nombre del sink.
+func (s *StdoutSink) Name() string {
+	return s.name
+}
+
+// Deliver escribe el lote con su fecha, índice y clave.
+func (s *StdoutSink) Deliver(batch SinkBatch) error {
+	line, err := json.Marshal(struct {
+		Sink    string          `json:"sink"`
+		Date    string          `json:"date,omitempty"`
+		Batch   int             `json:"batch"`
+		Key     string          `json:"idempotency_key"`
+		Payload json.RawMessage `json:"payload"`
+	}{s.name, batch.Date, batch.Index, batch.Key, batch.Payload})
+	if err != nil {
+		return fmt.Errorf("failed to encode batch: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write batch: %w", err)
+	}
+	return nil
+}
+
+// SinkConfig configura un sink de SINKS_CONFIG. Los campos que se usan dependen de Type.
+type SinkConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // http, filesystem, s3 o stdout.
+
+	// http: URL y claves de firma "id:secreto" separadas por comas; se firma con la primera.
+	URL         string `json:"url,omitempty"`
+	SigningKeys string `json:"signing_keys,omitempty"`
+
+	// filesystem: directorio raíz de las particiones.
+	Dir string `json:"dir,omitempty"`
+
+	// s3: bucket y credenciales.
+	S3 *S3Config `json:"s3,omitempty"`
+}
+
+// SinksConfig es el contenido del archivo SINKS_CONFIG.
+type SinksConfig struct {
+	Sinks []SinkConfig `json:"sinks"`
+}
+
+// LoadSinksConfig lee la configuración de sinks de un archivo JSON, expandiendo las variables de entorno
+// (${VAR}) para no guardar secretos en el archivo.
+func LoadSinksConfig(path string) (SinksConfig, error) {
+	var cfg SinksConfig
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read sinks config: %w", err)
+	}
+	decoder := json.NewDecoder(strings.NewReader(os.ExpandEnv(string(raw))))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse sinks config: %w", err)
+	}
+	return cfg, nil
+}
+
+// NewSinksFromConfig crea un sink por cada entrada de la configuración, en orden.
+func NewSinksFromConfig(cfg SinksConfig) ([]Sink, error) {
+	if len(cfg.Sinks) == 0 {
+		return nil, fmt.Errorf("at least one sink is required")
+	}
+	seen := make(map[string]bool)
+	sinks := make([]Sink, 0, len(cfg.Sinks))
+	for _, sc := range cfg.Sinks {
+		if sc.Name == "" {
+			return nil, fmt.Errorf("sink name is required")
+		}
+		if seen[sc.Name] {
+			return nil, fmt.Errorf("duplicate sink name %q", sc.Name)
+		}
+		seen[sc.Name] = true
+
+		sink, err := newSink(sc)
+		if err != nil {
+			return nil, fmt.Errorf("sink %q: %w", sc.Name, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// newSink crea el sink de una entrada de la configuración.
+func newSink(sc SinkConfig) (Sink, error) {
+	switch sc.Type {
+	case SinkTypeHTTP:
+		if sc.URL == "" {
+			return nil, fmt.Errorf("url is required")
+		}
+		keys, err := signature.ParseKeys(sc.SigningKeys)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("signing_keys is required")
+		}
+		return NewHTTPSink(sc.Name, sc.URL, keys[0]), nil
+	case SinkTypeFilesystem:
+		if sc.Dir == "" {
+			return nil, fmt.Errorf("dir is required")
+		}
+		return NewFileSink(sc.Name, sc.Dir), nil
+	case SinkTypeS3:
+		if sc.S3 == nil || sc.S3.Endpoint == "" || sc.S3.Bucket == "" {
+			return nil, fmt.Errorf("s3.endpoint and s3.bucket are required")
+		}
+		if sc.S3.AccessKeyID == "" || sc.S3.SecretAccessKey == "" {
+			return nil, fmt.Errorf("s3.access_key_id and s3.secret_access_key are required")
+		}
+		return NewS3Sink(sc.Name, *sc.S3), nil
+	case SinkTypeStdout:
+		return NewStdoutSink(sc.Name, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown sink type %q, use http, filesystem, s3 or stdout", sc.Type)
+	}
+}
@@ -0,0 +1,195 @@
+// Package etl internal/etl/snapshot.go
+package etl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/btors/admira-etl/internal/data"
+)
+
+// runConfig son los componentes con los que se ejecuta una ingesta: los configurados, o los reconstruidos de
+// la configuración archivada de la ingesta que se repite.
+type runConfig struct {
+	ingestor    *Ingestor
+	transformer *Transformer
+	validator   *Validator               // nil desactiva la validación.
+	corrections []data.QuarantinedRecord // Registros reenviados desde la cuarentena, con su corrección.
+}
+
+// runSnapshot es la configuración con la que se ejecutó una ingesta. Se archiva junto a sus respuestas para que
+// RunReplay repita la ingesta con las mismas reglas aunque la configuración haya cambiado después.
+type runSnapshot struct {
+	// Sources son las fuentes HTTP de la ingesta, sin credenciales: al repetirla no se accede a la red.
+	Sources          SourcesConfig     `json:"sources"`
+	Mode             AttributionMode   `json:"mode"`
+	Model            AttributionModel  `json:"model"`
+	LookbackDays     int               `json:"lookback_days"`
+	HalfLifeDays     float64           `json:"half_life_days"`
+	Funnel           FunnelConfig      `json:"funnel"`
+	UTMRules         UTMRulesConfig    `json:"utm_rules"`
+	Currency         string            `json:"currency,omitempty"`
+	FXRates          *FXRatesConfig    `json:"fx_rates,omitempty"` // nil si los tipos no vienen de un archivo.
+	Timezone         string            `json:"timezone"`
+	AccountTimezones map[string]string `json:"account_timezones,omitempty"`
+	// Validation son las reglas de validación; nil si la ingesta no validaba.
+	Validation  *ValidationConfig        `json:"validation,omitempty"`
+	Corrections []data.QuarantinedRecord `json:"corrections,omitempty"`
+}
+
+// snapshot devuelve la configuración de c que se archiva con la ingesta; rules son las reglas de UTM con las
+// que se creó su Combiner, que pueden no ser ya las vigentes si el archivo de reglas se ha recargado.
+func (c runConfig) snapshot(rules *UTMRules) runSnapshot {
+	t := c.transformer
+	s := runSnapshot{
+		Mode:         t.mode,
+		Model:        t.model,
+		LookbackDays: t.lookbackDays,
+		HalfLifeDays: t.halfLifeDays,
+		Funnel:       t.funnel.cfg,
+		UTMRules:     rules.cfg,
+		Currency:     t.currency,
+		Corrections:  c.corrections,
+	}
+	s.Timezone, s.AccountTimezones = t.timezones.names()
+	switch fx := t.fx.(type) {
+	case *FileFXProvider:
+		s.FXRates = &fx.current().cfg
+	case *fxTable:
+		s.FXRates = &fx.cfg
+	}
+	if c.validator != nil {
+		s.Validation = &c.validator.cfg
+	}
+	for _, source := range c.ingestor.Sources().AdsSources() {
+		if src, ok := source.(*httpAdsSource); ok {
+			s.Sources.Ads = append(s.Sources.Ads, src.redactedConfig())
+		}
+	}
+	for _, source := range c.ingestor.Sources().CRMSources() {
+		if src, ok := source.(*httpCRMSource); ok {
+			s.Sources.CRM = append(s.Sources.CRM, src.redactedConfig())
+		}
+	}
+	return s
+}
+
+// redactedConfig devuelve la configuración de la fuente sin credenciales: sin autenticación y con la URL
+// sin usuario ni parámetros de consulta, que pueden llevar tokens.
+func (s *httpSource) redactedConfig() SourceConfig {
+	cfg := s.cfg
+	cfg.Auth = AuthConfig{}
+	if u, err := url.Parse(cfg.URL); err == nil {
+		u.User, u.RawQuery = nil, ""
+		cfg.URL = u.String()
+	} else {
+		cfg.URL = ""
+	}
+	return cfg
+}
+
+// config reconstruye los componentes de la ingesta archivada. Las partes que no se archivaron (fuentes que no
+// son HTTP, tipos de cambio que no vienen de un archivo) se toman de current y se avisa en las advertencias.
+func (s runSnapshot) config(current runConfig, run *data.ArchivedRun) (runConfig, []string, error) {
+	var warnings []string
+	funnel, err := NewFunnel(s.Funnel)
+	if err != nil {
+		return runConfig{}, nil, fmt.Errorf("invalid archived funnel: %w", err)
+	}
+	rules, err := NewUTMRules(s.UTMRules)
+	if err != nil {
+		return runConfig{}, nil, fmt.Errorf("invalid archived utm rules: %w", err)
+	}
+	timezones, err := NewTimezones(s.Timezone, s.AccountTimezones)
+	if err != nil {
+		return runConfig{}, nil, fmt.Errorf("invalid archived timezones: %w", err)
+	}
+	fx := current.transformer.fx
+	if s.FXRates != nil {
+		table, err := newFXTable(*s.FXRates)
+		if err != nil {
+			return runConfig{}, nil, fmt.Errorf("invalid archived fx rates: %w", err)
+		}
+		fx = table
+	} else if s.Currency != "" {
+		warnings = append(warnings, fmt.Sprintf("fx rates were not archived with run %s; replayed with the current rates", run.RunID))
+	}
+	c := runConfig{
+		transformer: NewTransformer(
+			WithAttribution(s.Mode, s.LookbackDays),
+			WithAttributionModel(s.Model, s.HalfLifeDays),
+			WithFunnel(funnel),
+			WithUTMNormalizer(NewUTMNormalizer(rules)),
+			WithReportingCurrency(s.Currency, fx),
+			WithTimezones(timezones),
+		),
+		corrections: s.Corrections,
+	}
+	if s.Validation != nil {
+		if c.validator, err = NewValidator(*s.Validation); err != nil {
+			return runConfig{}, nil, fmt.Errorf("invalid archived validation rules: %w", err)
+		}
+	}
+
+	registry := NewSourceRegistry()
+	for _, cfg := range s.Sources.Ads {
+		if err := registry.RegisterAds(&httpAdsSource{newHTTPSource(cfg)}); err != nil {
+			return runConfig{}, nil, fmt.Errorf("invalid archived source: %w", err)
+		}
+	}
+	for _, cfg := range s.Sources.CRM {
+		if err := registry.RegisterCRM(&httpCRMSource{newHTTPSource(cfg)}); err != nil {
+			return runConfig{}, nil, fmt.Errorf("invalid archived source: %w", err)
+		}
+	}
+	for _, source := range current.ingestor.Sources().AdsSources() {
+		if _, archived := run.Window[source.Name()]; archived && !registry.Has(source.Name()) {
+			warnings = append(warnings, fmt.Sprintf("source %s was not archived with run %s; replayed with its current configuration", source.Name(), run.RunID))
+			if err := registry.RegisterAds(source); err != nil {
+				return runConfig{}, nil, err
+			}
+		}
+	}
+	for _, source := range current.ingestor.Sources().CRMSources() {
+		if _, archived := run.Window[source.Name()]; archived && !registry.Has(source.Name()) {
+			warnings = append(warnings, fmt.Sprintf("source %s was not archived with run %s; replayed with its current configuration", source.Name(), run.RunID))
+			if err := registry.RegisterCRM(source); err != nil {
+				return runConfig{}, nil, err
+			}
+		}
+	}
+	c.ingestor = NewIngestorFromRegistry(registry)
+	return c, warnings, nil
+}
+
+// attachSnapshot archiva con la ingesta la configuración de c con la que se creó combiner.
+func attachSnapshot(run *data.ArchiveRun, c runConfig, combiner *Combiner) error {
+	raw, err := json.Marshal(c.snapshot(combiner.rules))
+	if err != nil {
+		return fmt.Errorf("failed to encode run snapshot: %w", err)
+	}
+	return run.AttachSnapshot(raw)
+}
+
+// loadSnapshot lee la configuración archivada con una ingesta; nil si se archivó sin ella.
+func loadSnapshot(archive *data.PayloadArchive, run *data.ArchivedRun) (*runSnapshot, error) {
+	if run.Snapshot == "" {
+		return nil, nil
+	}
+	r, err := archive.Open(run.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run snapshot: %w", err)
+	}
+	var s runSnapshot
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("failed to decode run snapshot: %w", err)
+	}
+	return &s, nil
+}
@@ -0,0 +1,723 @@
+// Package etl internal/etl/source.go
+package etl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/btors/admira-etl/internal/data"
+)
+
+// Source es un conector de ingesta. El nombre es único y se usa como clave de su marca de agua.
+type Source interface {
+	Name() string
+}
+
+// AdsSource obtiene filas de rendimiento de una plataforma de anuncios.
+type AdsSource interface {
+	Source
+	// StreamAds entrega a fn, en lotes de como mucho batchSize filas, las filas con fecha igual o
+	// posterior a since (todas si es nil). Un error de fn detiene la descarga.
+	StreamAds(since *time.Time, batchSize int, fn func([]data.AdPerformance) error) error
+}
+
+// CRMSource obtiene oportunidades de un CRM.
+type CRMSource interface {
+	Source
+	// StreamOpportunities entrega a fn, en lotes de como mucho batchSize, las oportunidades creadas
+	// en since o después (todas si es nil). Un error de fn detiene la descarga.
+	StreamOpportunities(since *time.Time, batchSize int, fn func([]data.Opportunity) error) error
+}
+
+// CollectAds descarga todas las filas de una fuente de Ads en un único slice.
+func CollectAds(source AdsSource, since *time.Time) ([]data.AdPerformance, error) {
+	var ads []data.AdPerformance
+	err := source.StreamAds(since, DefaultBatchSize, func(batch []data.AdPerformance) error {
+		ads = append(ads, batch...)
+		return nil
+	})
+	return ads, err
+}
+
+// CollectOpportunities descarga todas las oportunidades de una fuente de CRM en un único slice.
+func CollectOpportunities(source CRMSource, since *time.Time) ([]data.Opportunity, error) {
+	var opps []data.Opportunity
+	err := source.StreamOpportunities(since, DefaultBatchSize, func(batch []data.Opportunity) error {
+		opps = append(opps, batch...)
+		return nil
+	})
+	return opps, err
+}
+
+// SourceRegistry contiene las fuentes de Ads y CRM configuradas, con nombres únicos entre ambas.
+type SourceRegistry struct {
+	ads   []AdsSource
+	crm   []CRMSource
+	names map[string]bool
+}
+
+// NewSourceRegistry crea un registro de fuentes vacío.
+func NewSourceRegistry() *SourceRegistry {
+	return &SourceRegistry{names: make(map[string]bool)}
+}
+
+// RegisterAds añade una fuente de Ads.
+func (r *SourceRegistry) RegisterAds(source AdsSource) error {
+	if err := r.claim(source.Name()); err != nil {
+		return err
+	}
+	r.ads = append(r.ads, source)
+	return nil
+}
+
+// RegisterCRM añade una fuente de CRM.
+func (r *SourceRegistry) RegisterCRM(source CRMSource) error {
+	if err := r.claim(source.Name()); err != nil {
+		return err
+	}
+	r.crm = append(r.crm, source)
+	return nil
+}
+
+// AdsSources devuelve las fuentes de Ads en orden de registro.
+func (r *SourceRegistry) AdsSources() []AdsSource {
+	return r.ads
+}
+
+// CRMSources devuelve las fuentes de CRM en orden de registro.
+func (r *SourceRegistry) CRMSources() []CRMSource {
+	return r.crm
+}
+
+// Has indica si hay una fuente registrada con ese nombre.
+func (r *SourceRegistry) Has(name string) bool {
+	return r.names[name]
+}
+
+// Names devuelve los nombres de todas las fuentes, ordenados.
+func (r *SourceRegistry) Names() []string {
+	names := make([]string, 0, len(r.names))
+	for name := range r.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// claim reserva el nombre de una fuente.
+func (r *SourceRegistry) claim(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("source name is required")
+	}
+	if r.names[name] {
+		return fmt.Errorf("source %q already registered", name)
+	}
+	r.names[name] = true
+	return nil
+}
+
+// Tipos de autenticación admitidos por las fuentes HTTP.
+const (
+	AuthNone   = "none"
+	AuthBearer = "bearer" // Authorization: Bearer <token>
+	AuthBasic  = "basic"  // Authorization: Basic <username:password>
+	AuthHeader = "header" // <key>: <token>
+	AuthQuery  = "query"  // ?<key>=<token>
+)
+
+// AuthConfig describe cómo se autentica una fuente HTTP.
+type AuthConfig struct {
+	Type     string `json:"type"`
+	Token    string `json:"token,omitempty"`
+	Key      string `json:"key,omitempty"` // Nombre de la cabecera o del parámetro de consulta.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// validate comprueba que la configuración de autenticación esté completa.
+func (a AuthConfig) validate() error {
+	switch a.Type {
+	case "", AuthNone:
+	case AuthBearer:
+		if a.Token == "" {
+			return fmt.Errorf("bearer auth requires token")
+		}
+	case AuthBasic:
+		if a.Username == "" {
+			return fmt.Errorf("basic auth requires username")
+		}
+	case AuthHeader, AuthQuery:
+		if a.Key == "" || a.Token == "" {
+			return fmt.Errorf("%s auth requires key and token", a.Type)
+		}
+	default:
+		return fmt.Errorf("unknown auth type %q", a.Type)
+	}
+	return nil
+}
+
+// apply añade las credenciales a la petición.
+func (a AuthConfig) apply(req *http.Request) {
+	switch a.Type {
+	case AuthBearer:
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+	case AuthBasic:
+		req.SetBasicAuth(a.Username, a.Password)
+	case AuthHeader:
+		req.Header.Set(a.Key, a.Token)
+	case AuthQuery:
+		query := req.URL.Query()
+		query.Set(a.Key, a.Token)
+		req.URL.RawQuery = query.Encode()
+	}
+}
+
+// SourceConfig configura una fuente HTTP genérica.
+type SourceConfig struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// RecordsPath es la ruta, separada por puntos, hasta el array de registros en la respuesta
+	// (por ejemplo "external.ads.performance"). Vacía si la respuesta es directamente el array.
+	RecordsPath string `json:"records_path"`
+	// SinceParam es el parámetro de consulta con el que la API acepta el inicio de la ventana; vacío si no lo admite.
+	SinceParam string `json:"since_param,omitempty"`
+	// Channel se asigna a las filas de Ads que no traen canal.
+	Channel string `json:"channel,omitempty"`
+	// Currency se asigna a los registros que no traen moneda.
+	Currency   string           `json:"currency,omitempty"`
+	Auth       AuthConfig       `json:"auth,omitempty"`
+	Pagination PaginationConfig `json:"pagination,omitempty"`
+	// Fields mapea cada campo del modelo (por su nombre JSON, por ejemplo "cost") a la ruta del campo
+	// en el registro de origen (por ejemplo "metrics.spend"). Los campos sin mapear se leen con su mismo nombre.
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// validate comprueba que la configuración de la fuente esté completa.
+func (c SourceConfig) validate() error {
+	if strings.TrimSpace(c.Name) == "" {
+		return fmt.Errorf("source name is required")
+	}
+	if _, err := url.ParseRequestURI(c.URL); err != nil {
+		return fmt.Errorf("source %s: invalid url: %w", c.Name, err)
+	}
+	if err := c.Auth.validate(); err != nil {
+		return fmt.Errorf("source %s: %w", c.Name, err)
+	}
+	if err := c.Pagination.validate(); err != nil {
+		return fmt.Errorf("source %s: %w", c.Name, err)
+	}
+	return nil
+}
+
+// httpSource implementa la descarga y el mapeo de campos comunes a las fuentes HTTP.
+type httpSource struct {
+	cfg    SourceConfig
+	client *http.Client
+}
+
+// httpAdsSource es una fuente de Ads servida por una API HTTP JSON.
+type httpAdsSource struct {
+	httpSource
+}
+
+// httpCRMSource es una fuente de CRM servida por una API HTTP JSON.
+type httpCRMSource struct {
+	httpSource
+}
+
+// NewHTTPAdsSource crea una fuente de Ads HTTP a partir de su configuración.
+func NewHTTPAdsSource(cfg SourceConfig) (AdsSource, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &httpAdsSource{newHTTPSource(cfg)}, nil
+}
+
+// NewHTTPCRMSource crea una fuente de CRM HTTP a partir de su configuración.
+func NewHTTPCRMSource(cfg SourceConfig) (CRMSource, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &httpCRMSource{newHTTPSource(cfg)}, nil
+}
+
+// newHTTPSource crea la parte común de una fuente HTTP.
+func newHTTPSource(cfg SourceConfig) httpSource {
+	return httpSource{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Name devuelve el nombre de la fuente.
+func (s *httpSource) Name() string {
+	return s.cfg.Name
+}
+
+// StreamAds descarga las filas de Ads sin cargar la respuesta completa en memoria y las entrega en lotes,
+// tras aplicar el mapeo de campos y el canal por defecto.
+func (s *httpAdsSource) StreamAds(since *time.Time, batchSize int, fn func([]data.AdPerformance) error) error {
+	return s.streamAdsArchived(since, batchSize, nil, fn, nil)
+}
+
+// streamAdsArchived es StreamAds archivando cada respuesta en run, si no es nil, y entregando a undecoded
+// los registros que no se pudieron decodificar (nil los descarta).
+func (s *httpAdsSource) streamAdsArchived(since *time.Time, batchSize int, run *data.ArchiveRun, fn func([]data.AdPerformance) error, undecoded undecodedFunc) error {
+	onRecord, flush := s.adsBatcher(since, batchSize, fn, undecoded)
+	if err := s.streamRecords(since, "2006-01-02", run, onRecord); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// replayAds procesa como StreamAds las respuestas archivadas que entrega pages, sin acceder a la red.
+func (s *httpAdsSource) replayAds(pages payloadPages, since *time.Time, batchSize int, fn func([]data.AdPerformance) error, undecoded undecodedFunc) error {
+	onRecord, flush := s.adsBatcher(since, batchSize, fn, undecoded)
+	if err := s.replayRecords(pages, onRecord); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// adsBatcher decodifica los registros de Ads de la fuente, los filtra por since y los agrupa en lotes para fn.
+// Los registros que no se pueden decodificar se entregan en bruto a undecoded o, si es nil, se descartan.
+// flush entrega el último lote incompleto.
+func (s *httpAdsSource) adsBatcher(since *time.Time, batchSize int, fn func([]data.AdPerformance) error, undecoded undecodedFunc) (onRecord func(json.RawMessage) error, flush func() error) {
+	batch := make([]data.AdPerformance, 0, batchSize)
+	n := 0
+	onRecord = func(raw json.RawMessage) error {
+		n++
+		var ad data.AdPerformance
+		if err := s.decodeRecord(raw, &ad); err != nil {
+			if undecoded != nil {
+				return undecoded(raw, err)
+			}
+			log.Printf("WARN: Source %s: skipping ad record %d: %v", s.cfg.Name, n, err)
+			return nil
+		}
+		if ad.Channel == "" {
+			ad.Channel = s.cfg.Channel
+		}
+		if ad.Currency == "" {
+			ad.Currency = s.cfg.Currency
+		}
+		// Se filtra también localmente por si la fuente ignora el parámetro "since". Una fecha inválida
+		// no se descarta aquí, para que la validación la envíe a la cuarentena.
+		if since != nil {
+			if d, err := time.Parse("2006-01-02", ad.Date); err == nil && d.Before(*since) {
+				return nil
+			}
+		}
+		batch = append(batch, ad)
+		if len(batch) < batchSize {
+			return nil
+		}
+		if err := fn(batch); err != nil {
+			return err
+		}
+		batch = make([]data.AdPerformance, 0, batchSize)
+		return nil
+	}
+	flush = func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		return fn(batch)
+	}
+	return onRecord, flush
+}
+
+// StreamOpportunities descarga las oportunidades sin cargar la respuesta completa en memoria y las entrega en lotes.
+func (s *httpCRMSource) StreamOpportunities(since *time.Time, batchSize int, fn func([]data.Opportunity) error) error {
+	return s.streamOpportunitiesArchived(since, batchSize, nil, fn, nil)
+}
+
+// streamOpportunitiesArchived es StreamOpportunities archivando cada respuesta en run, si no es nil, y
+// entregando a undecoded los registros que no se pudieron decodificar (nil los descarta).
+func (s *httpCRMSource) streamOpportunitiesArchived(since *time.Time, batchSize int, run *data.ArchiveRun, fn func([]data.Opportunity) error, undecoded undecodedFunc) error {
+	onRecord, flush := s.opportunitiesBatcher(since, batchSize, fn, undecoded)
+	if err := s.streamRecords(since, time.RFC3339, run, onRecord); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// replayOpportunities procesa como StreamOpportunities las respuestas archivadas que entrega pages.
+func (s *httpCRMSource) replayOpportunities(pages payloadPages, since *time.Time, batchSize int, fn func([]data.Opportunity) error, undecoded undecodedFunc) error {
+	onRecord, flush := s.opportunitiesBatcher(since, batchSize, fn, undecoded)
+	if err := s.replayRecords(pages, onRecord); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// opportunitiesBatcher decodifica las oportunidades de la fuente, las filtra por since y las agrupa en lotes para fn.
+// Los registros que no se pueden decodificar se entregan en bruto a undecoded o, si es nil, se descartan.
+func (s *httpCRMSource) opportunitiesBatcher(since *time.Time, batchSize int, fn func([]data.Opportunity) error, undecoded undecodedFunc) (onRecord func(json.RawMessage) error, flush func() error) {
+	batch := make([]data.Opportunity, 0, batchSize)
+	n := 0
+	onRecord = func(raw json.RawMessage) error {
+		n++
+		var opp data.Opportunity
+		if err := s.decodeRecord(raw, &opp); err != nil {
+			if undecoded != nil {
+				return undecoded(raw, err)
+			}
+			log.Printf("WARN: Source %s: skipping opportunity record %d: %v", s.cfg.Name, n, err)
+			return nil
+		}
+		if opp.Currency == "" {
+			opp.Currency = s.cfg.Currency
+		}
+		if since != nil && opp.CreatedAt.Before(*since) {
+			return nil
+		}
+		batch = append(batch, opp)
+		if len(batch) < batchSize {
+			return nil
+		}
+		if err := fn(batch); err != nil {
+			return err
+		}
+		batch = make([]data.Opportunity, 0, batchSize)
+		return nil
+	}
+	flush = func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		return fn(batch)
+	}
+	return onRecord, flush
+}
+
+// undecodedFunc recibe un registro de la fuente, tal como llegó, que no se pudo decodificar.
+type undecodedFunc func(raw json.RawMessage, err error) error
+
+// payloadPages recorre en orden las respuestas archivadas de una fuente, entregando cada una a fn.
+type payloadPages func(fn func(io.Reader) error) error
+
+// replayRecords entrega uno a uno los registros de RecordsPath de cada respuesta archivada.
+func (s *httpSource) replayRecords(pages payloadPages, onRecord func(json.RawMessage) error) error {
+	n := 0
+	return pages(func(r io.Reader) error {
+		n++
+		if _, err := streamDocument(r, s.cfg.RecordsPath, nil, onRecord); err != nil {
+			if errors.Is(err, errNotArray) {
+				return fmt.Errorf("page %d: records_path %q is not an array", n, s.cfg.RecordsPath)
+			}
+			return fmt.Errorf("page %d: %w", n, err)
+		}
+		return nil
+	})
+}
+
+// streamRecords recorre las páginas de la fuente y entrega uno a uno los registros de RecordsPath.
+// Cada página se reintenta por separado, así que un fallo puntual no reinicia la descarga.
+// Con run, cada respuesta leída entera se archiva como una página de la fuente.
+func (s *httpSource) streamRecords(since *time.Time, sinceLayout string, run *data.ArchiveRun, onRecord func(json.RawMessage) error) error {
+	u, err := url.Parse(s.cfg.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if s.cfg.SinceParam != "" && since != nil {
+		u = withQueryParam(u, s.cfg.SinceParam, since.UTC().Format(sinceLayout))
+	}
+
+	pagination := s.cfg.Pagination
+	var capture []string
+	if pagination.Type == PaginationToken {
+		capture = []string{pagination.TokenPath}
+	}
+
+	page := pagination.firstPage(u)
+	for n := 1; ; n++ {
+		if n > pagination.maxPages() {
+			return fmt.Errorf("pagination exceeded max_pages (%d)", pagination.maxPages())
+		}
+
+		records := 0
+		captured, header, err := s.fetchAndDecode(page.String(), capture, pageArchive{run, n}, func(raw json.RawMessage) error {
+			records++
+			return onRecord(raw)
+		})
+		if err != nil {
+			return fmt.Errorf("page %d: %w", n, err)
+		}
+
+		next, ok, err := pagination.nextPage(page, captured, header, records)
+		if err != nil {
+			return fmt.Errorf("page %d: %w", n, err)
+		}
+		if !ok {
+			return nil
+		}
+		page = next
+	}
+}
+
+// decodeRecord aplica el mapeo de campos a un registro y lo decodifica en target.
+func (s *httpSource) decodeRecord(raw json.RawMessage, target interface{}) error {
+	if len(s.cfg.Fields) == 0 {
+		return json.Unmarshal(raw, target)
+	}
+
+	// UseNumber conserva los números tal cual para volver a codificarlos tras el mapeo.
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return err
+	}
+	if fields == nil {
+		return fmt.Errorf("record is not an object")
+	}
+	mapped := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		mapped[k] = v
+	}
+	for field, path := range s.cfg.Fields {
+		if v, ok := lookupPath(fields, path); ok {
+			mapped[field] = v
+		}
+	}
+
+	remapped, err := json.Marshal(mapped)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(remapped, target)
+}
+
+// fetchRetryDelay es el retardo base del backoff exponencial entre reintentos de una petición.
+var fetchRetryDelay = 500 * time.Millisecond
+
+// fetchMaxRetryAfter es la espera máxima que se acepta de un Retry-After; si la fuente pide más, la página falla.
+var fetchMaxRetryAfter = time.Minute
+
+// fetchSleep espera entre reintentos; los tests la sustituyen para no esperar.
+var fetchSleep = time.Sleep
+
+// sourceStatusError es una respuesta no 200 de una fuente, con la espera que pide su cabecera Retry-After.
+type sourceStatusError struct {
+	StatusCode int
+	RetryAfter time.Duration // 0 si la respuesta no la indica.
+}
+
+// Error describe el código de estado recibido.
+func (e *sourceStatusError) Error() string {
+	return fmt.Sprintf("received non-200 status code: %d", e.StatusCode)
+}
+
+// fetchAndDecode realiza una solicitud HTTP GET autenticada, recorre la respuesta JSON en streaming entregando
+// cada registro a onRecord según se decodifica, y devuelve los valores de capture y las cabeceras.
+// Reintenta los errores de red, las respuestas 5xx y 429 y los cuerpos que no se pueden decodificar, esperando
+// al menos lo que indique Retry-After (o fallando si pide más de fetchMaxRetryAfter); el resto de respuestas
+// 4xx no se reintentan porque repetirlas no cambiaría el resultado. Un reintento tras un fallo a mitad de la
+// respuesta omite los registros que ya se entregaron, contando que la misma URL devuelve los mismos registros
+// en el mismo orden, así que no entrega duplicados y la memoria no depende del tamaño de la respuesta.
+func (s *httpSource) fetchAndDecode(url string, capture []string, archive pageArchive, onRecord func(json.RawMessage) error) (map[string]interface{}, http.Header, error) {
+	const maxRetries = 3
+
+	var lastErr error
+	delivered := 0 // Registros de la página ya entregados a onRecord en intentos anteriores.
+	// Intenta realizar la solicitud hasta el número máximo de reintentos.
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		if attempt > 1 {
+			delay := fetchRetryDelay * time.Duration(1<<(attempt-1)) // Exponential backoff
+			var statusErr *sourceStatusError
+			if errors.As(lastErr, &statusErr) && statusErr.RetryAfter > delay {
+				if statusErr.RetryAfter > fetchMaxRetryAfter {
+					return nil, nil, fmt.Errorf("%w (Retry-After %s exceeds the maximum wait of %s)", lastErr, statusErr.RetryAfter, fetchMaxRetryAfter)
+				}
+				delay = statusErr.RetryAfter
+			}
+			fetchSleep(delay)
+		}
+
+		seen := 0
+		var recordErr error // Error de onRecord: no se reintenta.
+		captured, header, retry, err := s.fetchOnce(url, capture, archive, func(raw json.RawMessage) error {
+			seen++
+			if seen <= delivered {
+				return nil
+			}
+			if recordErr = onRecord(raw); recordErr != nil {
+				return recordErr
+			}
+			delivered++
+			return nil
+		})
+		if recordErr != nil {
+			return nil, nil, recordErr
+		}
+		if err == nil {
+			return captured, header, nil
+		}
+		if !retry {
+			return nil, nil, err
+		}
+		lastErr = err
+	}
+
+	return nil, nil, fmt.Errorf("request failed after %d attempts: %w", maxRetries, lastErr)
+}
+
+// fetchOnce realiza un único intento de fetchAndDecode, entrega a onRecord los registros de la página e indica
+// si el error admite reintento.
+func (s *httpSource) fetchOnce(url string, capture []string, archive pageArchive, onRecord func(json.RawMessage) error) (map[string]interface{}, http.Header, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Crea una nueva solicitud HTTP GET.
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("failed to create request: %w", err)
+	}
+	s.cfg.Auth.apply(req)
+
+	// Realiza la solicitud HTTP.
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, true, err
+	}
+	defer resp.Body.Close() // Cierra el cuerpo de la respuesta al finalizar
+
+	if resp.StatusCode != http.StatusOK {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, nil, retry, &sourceStatusError{StatusCode: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	// Con archivo, la respuesta se copia mientras se decodifica; sólo se conserva si se lee entera sin errores.
+	// Un fallo del archivo no detiene la ingesta, pero la deja marcada como no repetible.
+	var body io.Reader = resp.Body
+	var payload *data.PayloadCapture
+	if archive.run != nil {
+		if payload, err = archive.run.Capture(s.cfg.Name, archive.page, resp.Body); err != nil {
+			archive.fail(s.cfg.Name, err)
+		} else {
+			defer payload.Discard()
+			body = payload
+		}
+	}
+
+	captured, err := streamDocument(body, s.cfg.RecordsPath, capture, onRecord)
+	if errors.Is(err, errNotArray) {
+		return nil, nil, false, fmt.Errorf("records_path %q is not an array", s.cfg.RecordsPath)
+	}
+	if err != nil {
+		return nil, nil, true, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if payload != nil {
+		if err := payload.Commit(); err != nil {
+			archive.fail(s.cfg.Name, err)
+		}
+	}
+	return captured, resp.Header, false, nil
+}
+
+// pageArchive indica dónde archivar una respuesta: la página page de la ingesta run (nil para no archivar).
+type pageArchive struct {
+	run  *data.ArchiveRun
+	page int
+}
+
+// fail registra que la página no pudo archivarse.
+func (a pageArchive) fail(source string, err error) {
+	log.Printf("WARN: Source %s: could not archive page %d: %v", source, a.page, err)
+	a.run.MarkIncomplete(fmt.Sprintf("%s page %d not archived: %v", source, a.page, err))
+}
+
+// lookupPath recorre un documento JSON decodificado siguiendo una ruta separada por puntos.
+// Una ruta vacía devuelve el propio documento.
+func lookupPath(doc interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return doc, true
+	}
+	node := doc
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if node, ok = obj[key]; !ok {
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+// SourcesConfig es el archivo de configuración de fuentes (SOURCES_CONFIG).
+type SourcesConfig struct {
+	Ads []SourceConfig `json:"ads"`
+	CRM []SourceConfig `json:"crm"`
+}
+
+// LoadSourcesConfig lee la configuración de fuentes de un archivo JSON. Las referencias ${VAR}
+// se sustituyen por variables de entorno, para no guardar credenciales en el archivo.
+func LoadSourcesConfig(path string) (SourcesConfig, error) {
+	var cfg SourcesConfig
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read sources config: %w", err)
+	}
+	decoder := json.NewDecoder(strings.NewReader(os.ExpandEnv(string(raw))))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse sources config: %w", err)
+	}
+	return cfg, nil
+}
+
+// LegacySourceRegistry registra las dos fuentes históricas ("ads" y "crm", desde ADS_API_URL y CRM_API_URL),
+// con sus sobres de respuesta "external.ads.performance" y "external.crm.opportunities".
+// Como antes, una URL vacía no impide arrancar: la ingesta fallará al descargarla.
+func LegacySourceRegistry(adsURL, crmURL, adsSinceParam, crmSinceParam string) (*SourceRegistry, error) {
+	registry := NewSourceRegistry()
+	if err := registry.RegisterAds(&httpAdsSource{newHTTPSource(SourceConfig{
+		Name: SourceAds, URL: adsURL, RecordsPath: "external.ads.performance", SinceParam: adsSinceParam,
+	})}); err != nil {
+		return nil, err
+	}
+	if err := registry.RegisterCRM(&httpCRMSource{newHTTPSource(SourceConfig{
+		Name: SourceCRM, URL: crmURL, RecordsPath: "external.crm.opportunities", SinceParam: crmSinceParam,
+	})}); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// NewSourceRegistryFromConfig crea y registra una fuente HTTP por cada entrada de la configuración.
+func NewSourceRegistryFromConfig(cfg SourcesConfig) (*SourceRegistry, error) {
+	if len(cfg.Ads) == 0 || len(cfg.CRM) == 0 {
+		return nil, fmt.Errorf("at least one ads source and one crm source are required")
+	}
+	registry := NewSourceRegistry()
+	for _, sc := range cfg.Ads {
+		source, err := NewHTTPAdsSource(sc)
+		if err != nil {
+			return nil, err
+		}
+		if err := registry.RegisterAds(source); err != nil {
+			return nil, err
+		}
+	}
+	for _, sc := range cfg.CRM {
+		source, err := NewHTTPCRMSource(sc)
+		if err != nil {
+			return nil, err
+		}
+		if err := registry.RegisterCRM(source); err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
@@ -0,0 +1,120 @@
+package etl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIngestor_FansOutAcrossConfiguredSources(t *testing.T) {
+	// Meta: respuesta en la raíz, token bearer y nombres de campo propios.
+	metaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer meta-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`[
+			{"date_start": "2025-08-01", "campaign": {"id": "M-1"}, "clicks": 40, "spend": 12.5, "utm_campaign": "summer_sale", "utm_source": "facebook", "utm_medium": "paid_social"}
+		]`))
+	}))
+	defer metaServer.Close()
+
+	// TikTok: sobre propio y autenticación por cabecera.
+	tiktokServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Access-Token") != "tt-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"data": {"list": [
+			{"date": "2025-08-01", "campaign_id": "T-1", "channel": "tiktok_ads", "clicks": 15, "cost": 3.0, "utm_campaign": "summer_sale", "utm_source": "tiktok", "utm_medium": "paid_social"}
+		]}}`))
+	}))
+	defer tiktokServer.Close()
+
+	crmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"external": {"crm": {"opportunities": [
+			{"opportunity_id": "O-1", "stage": "lead", "created_at": "2025-08-01T10:00:00Z", "utm_campaign": "summer_sale", "utm_source": "facebook", "utm_medium": "paid_social"}
+		]}}}`))
+	}))
+	defer crmServer.Close()
+
+	// Las credenciales se leen de variables de entorno referenciadas en el archivo.
+	t.Setenv("META_TOKEN", "meta-token")
+	path := filepath.Join(t.TempDir(), "sources.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"ads": [
+			{"name": "meta", "url": "`+metaServer.URL+`", "channel": "meta_ads",
+			 "auth": {"type": "bearer", "token": "${META_TOKEN}"},
+			 "fields": {"date": "date_start", "campaign_id": "campaign.id", "cost": "spend"}},
+			{"name": "tiktok", "url": "`+tiktokServer.URL+`", "records_path": "data.list",
+			 "auth": {"type": "header", "key": "Access-Token", "token": "tt-token"}}
+		],
+		"crm": [
+			{"name": "crm", "url": "`+crmServer.URL+`", "records_path": "external.crm.opportunities"}
+		]
+	}`), 0o644))
+
+	cfg, err := LoadSourcesConfig(path)
+	require.NoError(t, err)
+	registry, err := NewSourceRegistryFromConfig(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"crm", "meta", "tiktok"}, registry.Names())
+
+	result, err := NewIngestorFromRegistry(registry).Fetch(nil)
+	require.NoError(t, err)
+	require.Len(t, result.Ads, 2)
+	require.Len(t, result.Opportunities, 1)
+	assert.Equal(t, map[string]int{"meta": 1, "tiktok": 1, "crm": 1}, result.Fetched)
+
+	byCampaign := make(map[string]int)
+	for i, ad := range result.Ads {
+		byCampaign[ad.CampaignID] = i
+	}
+	meta := result.Ads[byCampaign["M-1"]]
+	assert.Equal(t, "2025-08-01", meta.Date)
+	assert.Equal(t, "meta_ads", meta.Channel) // Canal por defecto de la fuente.
+	assert.Equal(t, 12.5, meta.Cost)
+	assert.Equal(t, 40, meta.Clicks)
+	assert.Equal(t, "tiktok_ads", result.Ads[byCampaign["T-1"]].Channel)
+}
+
+func TestIngestor_FailsWhenAnySourceFails(t *testing.T) {
+	okServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	}))
+	defer okServer.Close()
+	downServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer downServer.Close()
+
+	registry, err := NewSourceRegistryFromConfig(SourcesConfig{
+		Ads: []SourceConfig{{Name: "meta", URL: okServer.URL}, {Name: "linkedin", URL: downServer.URL}},
+		CRM: []SourceConfig{{Name: "crm", URL: okServer.URL}},
+	})
+	require.NoError(t, err)
+
+	_, err = NewIngestorFromRegistry(registry).Fetch(nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "linkedin")
+}
+
+func TestNewSourceRegistryFromConfig_Validation(t *testing.T) {
+	valid := SourceConfig{Name: "crm", URL: "http://crm.local/opportunities"}
+
+	cases := map[string]SourcesConfig{
+		"duplicate name": {Ads: []SourceConfig{{Name: "crm", URL: "http://ads.local"}}, CRM: []SourceConfig{valid}},
+		"missing url":    {Ads: []SourceConfig{{Name: "meta"}}, CRM: []SourceConfig{valid}},
+		"bad auth":       {Ads: []SourceConfig{{Name: "meta", URL: "http://ads.local", Auth: AuthConfig{Type: "bearer"}}}, CRM: []SourceConfig{valid}},
+		"no crm source":  {Ads: []SourceConfig{{Name: "meta", URL: "http://ads.local"}}},
+	}
+	for name, cfg := range cases {
+		_, err := NewSourceRegistryFromConfig(cfg)
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,166 @@
+// Package etl internal/etl/stream.go
+package etl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DefaultBatchSize es el número de registros por lote que se entregan al transformer si no se configura otro.
+const DefaultBatchSize = 500
+
+// errNotArray indica que el valor en records_path no es un array.
+var errNotArray = errors.New("records_path is not an array")
+
+// documentWalker recorre un documento JSON token a token sin materializarlo: entrega uno a uno los
+// elementos del array en recordsPath, captura los escalares de capturePaths y descarta todo lo demás.
+type documentWalker struct {
+	dec          *json.Decoder
+	recordsPath  string
+	capturePaths []string
+	captured     map[string]interface{}
+	onRecord     func(json.RawMessage) error
+}
+
+// streamDocument recorre el documento de r. La memoria usada no depende del tamaño del documento,
+// sólo del mayor registro individual. Devuelve los valores capturados (por ejemplo, el token de la página siguiente).
+func streamDocument(r io.Reader, recordsPath string, capturePaths []string, onRecord func(json.RawMessage) error) (map[string]interface{}, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	w := &documentWalker{
+		dec:          dec,
+		recordsPath:  recordsPath,
+		capturePaths: capturePaths,
+		captured:     make(map[string]interface{}),
+		onRecord:     onRecord,
+	}
+	if err := w.value(""); err != nil {
+		return nil, err
+	}
+	return w.captured, nil
+}
+
+// value consume el siguiente valor del documento, situado en path.
+func (w *documentWalker) value(path string) error {
+	tok, err := w.dec.Token()
+	if err != nil {
+		return err
+	}
+
+	delim, isDelim := tok.(json.Delim)
+	if !isDelim {
+		// Escalar: se guarda si es una ruta capturada.
+		for _, p := range w.capturePaths {
+			if p == path {
+				w.captured[path] = tok
+			}
+		}
+		if path == w.recordsPath && tok != nil {
+			return errNotArray
+		}
+		return nil
+	}
+
+	switch delim {
+	case '[':
+		if path == w.recordsPath {
+			return w.records()
+		}
+		return w.skipRest()
+	case '{':
+		if path == w.recordsPath {
+			return errNotArray
+		}
+		if !w.relevant(path) {
+			return w.skipRest()
+		}
+		for w.dec.More() {
+			keyTok, err := w.dec.Token()
+			if err != nil {
+				return err
+			}
+			key, _ := keyTok.(string)
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			if w.relevant(child) {
+				if err := w.value(child); err != nil {
+					return err
+				}
+			} else if err := w.skip(); err != nil {
+				return err
+			}
+		}
+		_, err := w.dec.Token() // '}'
+		return err
+	}
+	return fmt.Errorf("unexpected delimiter %v", delim)
+}
+
+// records entrega uno a uno los elementos del array de registros, ya abierto.
+func (w *documentWalker) records() error {
+	for w.dec.More() {
+		var raw json.RawMessage
+		if err := w.dec.Decode(&raw); err != nil {
+			return err
+		}
+		if err := w.onRecord(raw); err != nil {
+			return err
+		}
+	}
+	_, err := w.dec.Token() // ']'
+	return err
+}
+
+// relevant indica si en path, o dentro de él, hay algo que entregar o capturar.
+func (w *documentWalker) relevant(path string) bool {
+	if isPathPrefix(path, w.recordsPath) {
+		return true
+	}
+	for _, p := range w.capturePaths {
+		if isPathPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// skip descarta el siguiente valor completo sin decodificarlo.
+func (w *documentWalker) skip() error {
+	tok, err := w.dec.Token()
+	if err != nil {
+		return err
+	}
+	if _, ok := tok.(json.Delim); ok {
+		return w.skipRest()
+	}
+	return nil
+}
+
+// skipRest descarta el resto de un objeto o array ya abierto.
+func (w *documentWalker) skipRest() error {
+	for depth := 1; depth > 0; {
+		tok, err := w.dec.Token()
+		if err != nil {
+			return err
+		}
+		if delim, ok := tok.(json.Delim); ok {
+			switch delim {
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+			}
+		}
+	}
+	return nil
+}
+
+// isPathPrefix indica si prefix es target o uno de sus ancestros en una ruta separada por puntos.
+func isPathPrefix(prefix, target string) bool {
+	return prefix == "" || prefix == target || strings.HasPrefix(target, prefix+".")
+}
@@ -0,0 +1,312 @@
+package etl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btors/admira-etl/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamDocument(t *testing.T) {
+	doc := `{
+		"meta": {"huge": [[1, 2], {"a": [3]}], "note": "ignored"},
+		"external": {"ads": {"performance": [{"campaign_id": "C-1"}, {"campaign_id": "C-2"}], "other": 1}},
+		"paging": {"next": "abc", "prev": null}
+	}`
+
+	var ids []string
+	captured, err := streamDocument(strings.NewReader(doc), "external.ads.performance", []string{"paging.next"}, func(raw json.RawMessage) error {
+		var ad data.AdPerformance
+		require.NoError(t, json.Unmarshal(raw, &ad))
+		ids = append(ids, ad.CampaignID)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"C-1", "C-2"}, ids)
+	assert.Equal(t, "abc", captured["paging.next"])
+
+	// Array en la raíz.
+	count := 0
+	_, err = streamDocument(strings.NewReader(`[{}, {}, {}]`), "", nil, func(json.RawMessage) error { count++; return nil })
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	// Un array ausente o nulo es una página vacía; un objeto en su lugar es un error.
+	_, err = streamDocument(strings.NewReader(`{"data": null}`), "data", nil, func(json.RawMessage) error { return nil })
+	assert.NoError(t, err)
+	_, err = streamDocument(strings.NewReader(`{"other": []}`), "data", nil, func(json.RawMessage) error { return nil })
+	assert.NoError(t, err)
+	_, err = streamDocument(strings.NewReader(`{"data": {"rows": []}}`), "data", nil, func(json.RawMessage) error { return nil })
+	assert.ErrorIs(t, err, errNotArray)
+
+	// Un documento truncado es un error de decodificación.
+	_, err = streamDocument(strings.NewReader(`{"data": [{"campaign_id": "C-1"}, {"camp`), "data", nil, func(json.RawMessage) error { return nil })
+	assert.Error(t, err)
+}
+
+func TestHTTPSource_StreamsInBoundedBatches(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, newAdsPayload(7))
+	}))
+	defer server.Close()
+
+	source, err := NewHTTPAdsSource(SourceConfig{Name: "ads", URL: server.URL, RecordsPath: "external.ads.performance"})
+	require.NoError(t, err)
+
+	var sizes []int
+	require.NoError(t, source.StreamAds(nil, 3, func(batch []data.AdPerformance) error {
+		sizes = append(sizes, len(batch))
+		return nil
+	}))
+	assert.Equal(t, []int{3, 3, 1}, sizes)
+}
+
+// adsPayload genera al vuelo una respuesta de Ads con n filas, sin tenerla entera en memoria.
+type adsPayload struct {
+	n, next int
+	buf     []byte
+	done    bool
+}
+
+func newAdsPayload(n int) *adsPayload {
+	return &adsPayload{n: n, buf: []byte(`{"external": {"ads": {"performance": [`)}
+}
+
+func (p *adsPayload) Read(b []byte) (int, error) {
+	for len(p.buf) == 0 {
+		switch {
+		case p.done:
+			return 0, io.EOF
+		case p.next == p.n:
+			p.buf = []byte(`]}}}`)
+			p.done = true
+		default:
+			sep := ","
+			if p.next == 0 {
+				sep = ""
+			}
+			p.buf = []byte(fmt.Sprintf(`%s{"date": "2025-08-01", "campaign_id": "C-%d", "channel": "google_ads", "clicks": 100, "impressions": 1000, "cost": 50.5, "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"}`, sep, p.next))
+			p.next++
+		}
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+// oppsPayload genera al vuelo una respuesta de CRM con n oportunidades repartidas en 30 días y 500 campañas.
+type oppsPayload struct {
+	n, next int
+	buf     []byte
+	done    bool
+}
+
+func newOppsPayload(n int) *oppsPayload {
+	return &oppsPayload{n: n, buf: []byte(`{"external": {"crm": {"opportunities": [`)}
+}
+
+func (p *oppsPayload) Read(b []byte) (int, error) {
+	for len(p.buf) == 0 {
+		switch {
+		case p.done:
+			return 0, io.EOF
+		case p.next == p.n:
+			p.buf = []byte(`]}}}`)
+			p.done = true
+		default:
+			sep := ","
+			if p.next == 0 {
+				sep = ""
+			}
+			stage := [...]string{"lead", "opportunity", "closed_won", "closed_lost"}[p.next%4]
+			p.buf = []byte(fmt.Sprintf(`%s{"opportunity_id": "O-%d", "stage": "%s", "amount": 250.0, "created_at": "2025-08-%02dT%02d:00:00Z", "utm_campaign": "campaign_%d", "utm_source": "google", "utm_medium": "cpc"}`,
+				sep, p.next, stage, 1+p.next%30, p.next%24, p.next%500))
+			p.next++
+		}
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+// campaignAdsPayload genera al vuelo una respuesta de Ads con n filas repartidas en 30 días y 500 campañas,
+// de modo que varias filas caen en el mismo día, campaña y canal.
+func campaignAdsPayload(n int) io.Reader {
+	return io.MultiReader(strings.NewReader(`{"external": {"ads": {"performance": [`), &campaignAds{n: n}, strings.NewReader(`]}}}`))
+}
+
+// campaignAds genera las filas de campaignAdsPayload, separadas por comas.
+type campaignAds struct {
+	n, next int
+	buf     []byte
+}
+
+func (p *campaignAds) Read(b []byte) (int, error) {
+	for len(p.buf) == 0 {
+		if p.next == p.n {
+			return 0, io.EOF
+		}
+		sep := ","
+		if p.next == 0 {
+			sep = ""
+		}
+		p.buf = []byte(fmt.Sprintf(`%s{"date": "2025-08-%02d", "campaign_id": "C-%d", "channel": "google_ads", "clicks": 100, "impressions": 1000, "cost": 50.5, "utm_campaign": "campaign_%d", "utm_source": "google", "utm_medium": "cpc"}`,
+			sep, 1+p.next%30, p.next%500, p.next%500))
+		p.next++
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+// heapSampler registra el máximo de memoria de heap en uso observado durante una decodificación.
+type heapSampler struct {
+	base, peak uint64
+}
+
+func newHeapSampler() *heapSampler {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return &heapSampler{base: m.HeapAlloc}
+}
+
+func (s *heapSampler) sample() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	if m.HeapAlloc > s.base && m.HeapAlloc-s.base > s.peak {
+		s.peak = m.HeapAlloc - s.base
+	}
+}
+
+// BenchmarkDecodeAds compara la memoria de heap máxima al decodificar respuestas de Ads de tamaño creciente:
+// "buffered" decodifica el sobre completo como hacía fetchAndDecode antes del streaming, y "streaming"
+// descarga la respuesta sin paginar de un servidor HTTP con httpSource.fetchAndDecode, entregando lotes de
+// DefaultBatchSize filas a un consumidor que no las retiene. peak-heap-MB crece con el tamaño en "buffered" y
+// se mantiene plano en "streaming".
+func BenchmarkDecodeAds(b *testing.B) {
+	for _, n := range []int{10_000, 100_000, 500_000} {
+		b.Run(fmt.Sprintf("buffered/records=%d", n), func(b *testing.B) {
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				sampler := newHeapSampler()
+				var body interface{}
+				decoder := json.NewDecoder(newAdsPayload(n))
+				decoder.UseNumber()
+				if err := decoder.Decode(&body); err != nil {
+					b.Fatal(err)
+				}
+				sampler.sample()
+				runtime.KeepAlive(body)
+				if sampler.peak > peak {
+					peak = sampler.peak
+				}
+			}
+			b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+		})
+
+		b.Run(fmt.Sprintf("streaming/records=%d", n), func(b *testing.B) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(w, newAdsPayload(n))
+			}))
+			defer server.Close()
+			source := newHTTPSource(SourceConfig{Name: "ads", URL: server.URL, RecordsPath: "external.ads.performance"})
+
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				sampler := newHeapSampler()
+				batch := make([]data.AdPerformance, 0, DefaultBatchSize)
+				_, _, err := source.fetchAndDecode(server.URL, nil, pageArchive{}, func(raw json.RawMessage) error {
+					var ad data.AdPerformance
+					if err := json.Unmarshal(raw, &ad); err != nil {
+						return err
+					}
+					batch = append(batch, ad)
+					if len(batch) == DefaultBatchSize {
+						sampler.sample()
+						batch = batch[:0]
+					}
+					return nil
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if sampler.peak > peak {
+					peak = sampler.peak
+				}
+			}
+			b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+		})
+	}
+}
+
+// BenchmarkPipelineIngestion mide una ingesta completa (descarga en streaming, validación, Combiner, atribución
+// y guardado) con respuestas de Ads y CRM de tamaño creciente, dentro del timeout de 10s de las fuentes HTTP. Los registros se reparten en 30 días y 500
+// campañas, así que el Combiner agrega en como mucho 15.000 filas y grupos por día y etapa: peak-heap-MB debe
+// crecer con las filas agregadas y no con los registros recibidos.
+func BenchmarkPipelineIngestion(b *testing.B) {
+	for _, n := range []int{10_000, 50_000, 200_000} {
+		b.Run(fmt.Sprintf("records=%d", n), func(b *testing.B) {
+			adsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(w, campaignAdsPayload(n))
+			}))
+			defer adsServer.Close()
+			crmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(w, newOppsPayload(n))
+			}))
+			defer crmServer.Close()
+
+			registry, err := LegacySourceRegistry(adsServer.URL, crmServer.URL, "", "")
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				pipeline := NewPipeline(data.NewInMemoryRepository(), NewIngestorFromRegistry(registry),
+					NewTransformer(WithAttribution(AttributionWindow, 30)), NewExporter("", ""))
+
+				// Muestrea el heap en segundo plano: la ingesta no expone puntos intermedios.
+				sampler := newHeapSampler()
+				stop := make(chan struct{})
+				var wg sync.WaitGroup
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ticker := time.NewTicker(5 * time.Millisecond)
+					defer ticker.Stop()
+					for {
+						select {
+						case <-stop:
+							return
+						case <-ticker.C:
+							sampler.sample()
+						}
+					}
+				}()
+
+				_, err := pipeline.RunIngestion(nil, LastTouch)
+				close(stop)
+				wg.Wait()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if sampler.peak > peak {
+					peak = sampler.peak
+				}
+			}
+			b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+		})
+	}
+}
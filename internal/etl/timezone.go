@@ -0,0 +1,106 @@
+// Package etl internal/etl/timezone.go
+package etl
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+	_ "time/tzdata" // Base de datos de zonas horarias embebida, por si la imagen no la incluye.
+
+	"github.com/btors/admira-etl/internal/data"
+)
+
+// Timezones resuelve la zona horaria de reporte de cada cuenta de Ads (su canal, por ejemplo "google_ads").
+// Las fechas de Ads son días calendario en la zona de su cuenta; los instantes de CRM se asignan al día
+// calendario que corresponde en esa misma zona.
+type Timezones struct {
+	def      *time.Location
+	accounts map[string]*time.Location
+}
+
+// NewTimezones carga la zona por defecto y las de cada cuenta (nombres IANA, por ejemplo "America/Mexico_City").
+// Una zona por defecto vacía equivale a UTC.
+func NewTimezones(def string, accounts map[string]string) (*Timezones, error) {
+	loc, err := time.LoadLocation(def)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reporting timezone %q: %w", def, err)
+	}
+	z := &Timezones{def: loc, accounts: make(map[string]*time.Location, len(accounts))}
+	for account, name := range accounts {
+		if z.accounts[account], err = time.LoadLocation(name); err != nil {
+			return nil, fmt.Errorf("invalid timezone %q for account %s: %w", name, account, err)
+		}
+	}
+	return z, nil
+}
+
+// utcTimezones es la configuración por defecto: todas las cuentas en UTC.
+func utcTimezones() *Timezones {
+	return &Timezones{def: time.UTC, accounts: map[string]*time.Location{}}
+}
+
+// names devuelve los nombres IANA de la zona por defecto y de las zonas de cada cuenta, con los que
+// NewTimezones vuelve a crear la misma configuración.
+func (z *Timezones) names() (string, map[string]string) {
+	accounts := make(map[string]string, len(z.accounts))
+	for account, loc := range z.accounts {
+		accounts[account] = loc.String()
+	}
+	return z.def.String(), accounts
+}
+
+// Location devuelve la zona de la cuenta indicada, o la zona por defecto si no tiene una propia.
+func (z *Timezones) Location(account string) *time.Location {
+	if loc, ok := z.accounts[account]; ok {
+		return loc
+	}
+	return z.def
+}
+
+// Day devuelve el día calendario de ts en la zona de la cuenta, como medianoche UTC (ver data.CalendarDate).
+func (z *Timezones) Day(ts time.Time, account string) time.Time {
+	return data.CalendarDate(ts.In(z.Location(account)))
+}
+
+// ParseDate interpreta una fecha YYYY-MM-DD como la medianoche de ese día en la zona de la cuenta.
+func (z *Timezones) ParseDate(s, account string) (time.Time, error) {
+	return time.ParseInLocation("2006-01-02", s, z.Location(account))
+}
+
+// EarliestDay devuelve el día calendario más temprano al que alguna de las zonas configuradas asigna ts.
+func (z *Timezones) EarliestDay(ts time.Time) time.Time {
+	day := z.Day(ts, "")
+	for account := range z.accounts {
+		if d := z.Day(ts, account); d.Before(day) {
+			day = d
+		}
+	}
+	return day
+}
+
+// StartOfDay devuelve el primer instante del día calendario indicado en cualquiera de las zonas configuradas,
+// es decir, su medianoche en la zona más adelantada. Una descarga de CRM que empieza ahí incluye todas las
+// oportunidades que alguna cuenta asigna a ese día.
+func (z *Timezones) StartOfDay(day time.Time) time.Time {
+	y, m, d := day.Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, z.def)
+	for _, loc := range z.accounts {
+		if s := time.Date(y, m, d, 0, 0, 0, 0, loc); s.Before(start) {
+			start = s
+		}
+	}
+	return start
+}
+
+// locations devuelve las zonas configuradas distintas: la zona por defecto y luego las de las cuentas, por nombre.
+func (z *Timezones) locations() []*time.Location {
+	locs := []*time.Location{z.def}
+	for _, loc := range z.accounts {
+		if !slices.ContainsFunc(locs, func(l *time.Location) bool { return l.String() == loc.String() }) {
+			locs = append(locs, loc)
+		}
+	}
+	sort.Slice(locs[1:], func(i, j int) bool { return locs[1+i].String() < locs[1+j].String() })
+	return locs
+}
@@ -0,0 +1,112 @@
+package etl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/btors/admira-etl/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimezones_DayAcrossDST(t *testing.T) {
+	z, err := NewTimezones("America/New_York", map[string]string{"meta_ads": "Europe/Madrid"})
+	require.NoError(t, err)
+
+	for ts, want := range map[string]string{
+		// Cambio a horario de verano (2025-03-09 02:00 EST → 03:00 EDT): la medianoche es aún UTC-5 y las 23:30 ya UTC-4.
+		"2025-03-09T04:59:00Z": "2025-03-08",
+		"2025-03-09T05:00:00Z": "2025-03-09",
+		"2025-03-10T03:30:00Z": "2025-03-09",
+		"2025-03-10T04:00:00Z": "2025-03-10",
+		// Vuelta al horario estándar (2025-11-02 02:00 EDT → 01:00 EST).
+		"2025-11-02T03:30:00Z": "2025-11-01",
+		"2025-11-02T04:00:00Z": "2025-11-02",
+		"2025-11-03T04:59:00Z": "2025-11-02",
+		"2025-11-03T05:00:00Z": "2025-11-03",
+	} {
+		instant, _ := time.Parse(time.RFC3339, ts)
+		assert.Equal(t, want, z.Day(instant, "").Format("2006-01-02"), ts)
+	}
+
+	// Las cuentas sin zona propia usan la zona por defecto; Europa cambia de hora otro día (2025-03-30).
+	instant, _ := time.Parse(time.RFC3339, "2025-03-29T23:30:00Z")
+	assert.Equal(t, "2025-03-30", z.Day(instant, "meta_ads").Format("2006-01-02"))
+	assert.Equal(t, "2025-03-29", z.Day(instant, "google_ads").Format("2006-01-02"))
+
+	// Un día con cambio de hora dura 23 o 25 horas.
+	start, err := z.ParseDate("2025-03-09", "")
+	require.NoError(t, err)
+	end, err := z.ParseDate("2025-03-10", "")
+	require.NoError(t, err)
+	assert.Equal(t, 23*time.Hour, end.Sub(start))
+	start, _ = z.ParseDate("2025-11-02", "")
+	end, _ = z.ParseDate("2025-11-03", "")
+	assert.Equal(t, 25*time.Hour, end.Sub(start))
+}
+
+func TestTimezones_EarliestDayAndStartOfDay(t *testing.T) {
+	z, err := NewTimezones("America/Mexico_City", map[string]string{"meta_ads": "Europe/Madrid"})
+	require.NoError(t, err)
+
+	// 2025-08-01T23:30:00Z es el 1 en México y ya el 2 en Madrid.
+	instant, _ := time.Parse(time.RFC3339, "2025-08-01T23:30:00Z")
+	assert.Equal(t, "2025-08-01", z.EarliestDay(instant).Format("2006-01-02"))
+
+	// El 2 de agosto empieza antes en Madrid (UTC+2) que en México (UTC-6).
+	day, _ := time.Parse("2006-01-02", "2025-08-02")
+	assert.Equal(t, time.Date(2025, 8, 1, 22, 0, 0, 0, time.UTC), z.StartOfDay(day).UTC())
+
+	_, err = NewTimezones("Mars/Olympus_Mons", nil)
+	assert.Error(t, err)
+	_, err = NewTimezones("UTC", map[string]string{"google_ads": "Nowhere"})
+	assert.Error(t, err)
+}
+
+func TestCombine_BucketsOpportunitiesInAccountTimezone(t *testing.T) {
+	ads := []data.AdPerformance{
+		{Date: "2025-08-01", CampaignID: "C-1", Channel: "google_ads", Cost: 10, UTMCampaign: "c", UTMSource: "s", UTMMedium: "m"},
+		{Date: "2025-08-02", CampaignID: "C-1", Channel: "google_ads", Cost: 10, UTMCampaign: "c", UTMSource: "s", UTMMedium: "m"},
+	}
+	// Creada el 1 de agosto a las 21:30 en Ciudad de México; el CRM la envía en UTC, ya el 2 de agosto.
+	createdAt, _ := time.Parse(time.RFC3339, "2025-08-02T03:30:00Z")
+	opps := []data.Opportunity{{OpportunityID: "O-1", Stage: "closed_won", Amount: 100, CreatedAt: createdAt, UTMCampaign: "c", UTMSource: "s", UTMMedium: "m"}}
+
+	revenueByDate := func(z *Timezones) map[string]float64 {
+		metrics, err := NewTransformer(WithTimezones(z)).CombineWithModel(ads, opps, LastTouch)
+		require.NoError(t, err)
+		revenue := make(map[string]float64)
+		for _, m := range metrics {
+			revenue[m.Date.Format("2006-01-02")] = m.Revenue
+		}
+		return revenue
+	}
+
+	// En UTC la venta cae el día 2; con la zona de la cuenta, el día 1, el último día con anuncios en la ventana.
+	assert.Equal(t, map[string]float64{"2025-08-01": 0, "2025-08-02": 100}, revenueByDate(nil))
+	mexico, err := NewTimezones("UTC", map[string]string{"google_ads": "America/Mexico_City"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"2025-08-01": 100, "2025-08-02": 0}, revenueByDate(mexico))
+}
+
+func TestCombine_BucketsOpportunitiesAcrossDST(t *testing.T) {
+	ads := []data.AdPerformance{
+		{Date: "2025-11-01", CampaignID: "C-1", Channel: "google_ads", Cost: 10, UTMCampaign: "c", UTMSource: "s", UTMMedium: "m"},
+		{Date: "2025-11-02", CampaignID: "C-1", Channel: "google_ads", Cost: 10, UTMCampaign: "c", UTMSource: "s", UTMMedium: "m"},
+	}
+	// 23:30 EDT del 1 de noviembre y 23:30 EST del 2: el desfase cambia entre ambas.
+	beforeChange, _ := time.Parse(time.RFC3339, "2025-11-02T03:30:00Z")
+	afterChange, _ := time.Parse(time.RFC3339, "2025-11-03T04:30:00Z")
+	opps := []data.Opportunity{
+		{OpportunityID: "O-1", Stage: "closed_won", Amount: 100, CreatedAt: beforeChange, UTMCampaign: "c", UTMSource: "s", UTMMedium: "m"},
+		{OpportunityID: "O-2", Stage: "closed_won", Amount: 50, CreatedAt: afterChange, UTMCampaign: "c", UTMSource: "s", UTMMedium: "m"},
+	}
+	z, err := NewTimezones("America/New_York", nil)
+	require.NoError(t, err)
+
+	metrics, err := NewTransformer(WithTimezones(z)).CombineWithModel(ads, opps, LastTouch)
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, 100.0, metrics[0].Revenue)
+	assert.Equal(t, 50.0, metrics[1].Revenue)
+}
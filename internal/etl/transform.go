@@ -5,123 +5,515 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/btors/admira-etl/internal/data"
 )
 
 // Transformer contiene la lógica para transformar y combinar los datos.
-type Transformer struct{}
+type Transformer struct {
+	mode         AttributionMode
+	model        AttributionModel
+	lookbackDays int
+	halfLifeDays float64
+	funnel       *Funnel
+	utm          *UTMNormalizer
+	currency     string     // Moneda de reporte; vacía para no convertir importes.
+	fx           FXProvider // nil si sólo se aceptan importes en la moneda de reporte.
+	timezones    *Timezones
+
+	mu        sync.Mutex // Protege lastMatch.
+	lastMatch *UTMMatchReport
+}
+
+// TransformerOption permite personalizar un Transformer al crearlo.
+type TransformerOption func(*Transformer)
+
+// WithAttribution configura el modo de atribución y la ventana de lookback en días.
+func WithAttribution(mode AttributionMode, lookbackDays int) TransformerOption {
+	return func(t *Transformer) {
+		t.mode = mode
+		if lookbackDays >= 0 {
+			t.lookbackDays = lookbackDays
+		}
+	}
+}
+
+// WithAttributionModel configura el modelo de atribución por defecto y la vida media de time_decay.
+func WithAttributionModel(model AttributionModel, halfLifeDays float64) TransformerOption {
+	return func(t *Transformer) {
+		t.model = model
+		if halfLifeDays > 0 {
+			t.halfLifeDays = halfLifeDays
+		}
+	}
+}
+
+// WithFunnel configura el funnel con el que se clasifican las etapas de CRM.
+func WithFunnel(funnel *Funnel) TransformerOption {
+	return func(t *Transformer) {
+		if funnel != nil {
+			t.funnel = funnel
+		}
+	}
+}
+
+// WithUTMNormalizer configura las reglas de normalización de UTMs con las que se cruzan Ads y CRM.
+func WithUTMNormalizer(utm *UTMNormalizer) TransformerOption {
+	return func(t *Transformer) {
+		if utm != nil {
+			t.utm = utm
+		}
+	}
+}
+
+// WithReportingCurrency convierte costes e importes a la moneda indicada con los tipos de fx antes de
+// calcular las métricas. Los registros sin moneda se consideran ya en la moneda de reporte.
+func WithReportingCurrency(currency string, fx FXProvider) TransformerOption {
+	return func(t *Transformer) {
+		t.currency = NormalizeCurrency(currency)
+		t.fx = fx
+	}
+}
+
+// WithTimezones configura la zona horaria de reporte de cada cuenta de Ads, con la que se asigna a un día
+// la creación de cada oportunidad.
+func WithTimezones(timezones *Timezones) TransformerOption {
+	return func(t *Transformer) {
+		if timezones != nil {
+			t.timezones = timezones
+		}
+	}
+}
 
 // NewTransformer crea una nueva instancia de Transformer.
-func NewTransformer() *Transformer {
-	return &Transformer{}
+func NewTransformer(opts ...TransformerOption) *Transformer {
+	t := &Transformer{
+		mode:         AttributionWindow,
+		model:        LastTouch,
+		lookbackDays: DefaultLookbackDays,
+		halfLifeDays: DefaultHalfLifeDays,
+		timezones:    utcTimezones(),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if t.funnel == nil {
+		t.funnel, _ = NewFunnel(DefaultFunnelConfig())
+	}
+	if t.utm == nil {
+		rules, _ := NewUTMRules(UTMRulesConfig{})
+		t.utm = NewUTMNormalizer(rules)
+	}
+	return t
 }
 
-// CombineAndCalculateMetrics cruza los datos de Ads y CRM y calcula las métricas.
+// UTMNormalizer devuelve el normalizador de UTMs configurado.
+func (t *Transformer) UTMNormalizer() *UTMNormalizer {
+	return t.utm
+}
+
+// LastUTMMatch devuelve el informe de claves UTM sin cruce de la última transformación, o nil si aún no hubo ninguna.
+func (t *Transformer) LastUTMMatch() *UTMMatchReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastMatch
+}
+
+// Funnel devuelve el funnel configurado.
+func (t *Transformer) Funnel() *Funnel {
+	return t.funnel
+}
+
+// Timezones devuelve las zonas horarias de reporte configuradas.
+func (t *Transformer) Timezones() *Timezones {
+	return t.timezones
+}
+
+// DefaultModel devuelve el modelo de atribución configurado por defecto.
+func (t *Transformer) DefaultModel() AttributionModel {
+	return t.model
+}
+
+// DefaultMetricModel devuelve el modelo que figura en las métricas calculadas con el modelo por defecto: naive en
+// modo naive, donde el modelo no aplica.
+func (t *Transformer) DefaultMetricModel() string {
+	return MetricModel(t.mode, t.model)
+}
+
+// CombineAndCalculateMetrics cruza los datos de Ads y CRM y calcula las métricas con el modelo por defecto.
 func (t *Transformer) CombineAndCalculateMetrics(adsData []data.AdPerformance, crmData []data.Opportunity) ([]data.EnrichedMetric, error) {
+	return t.CombineWithModel(adsData, crmData, t.model)
+}
 
-	// Verifica que los datos de Ads no estén vacíos.
-	if len(adsData) == 0 {
-		return nil, errors.New("ads data is empty")
+// CombineWithModel cruza los datos de Ads y CRM y calcula las métricas con el modelo de atribución indicado.
+func (t *Transformer) CombineWithModel(adsData []data.AdPerformance, crmData []data.Opportunity, model AttributionModel) ([]data.EnrichedMetric, error) {
+	metrics, _, err := t.CombineWithReport(adsData, crmData, model)
+	return metrics, err
+}
+
+// CombineWithReport es CombineWithModel y devuelve además el informe de cruce entre Ads y CRM, sin RunID.
+func (t *Transformer) CombineWithReport(adsData []data.AdPerformance, crmData []data.Opportunity, model AttributionModel) ([]data.EnrichedMetric, data.JoinReport, error) {
+	combiner := t.NewCombiner(model)
+	combiner.AddAds(adsData)
+	combiner.AddOpportunities(crmData)
+	metrics, err := combiner.Metrics()
+	if err != nil {
+		return nil, data.JoinReport{}, err
 	}
+	return metrics, combiner.JoinReport(), nil
+}
 
-	// Crea un mapa para buscar oportunidades de CRM eficientemente por su clave UTM.
-	crmMap := make(map[string][]data.Opportunity)
-	for _, opp := range crmData {
-		// Normaliza los UTMs para crear una clave consistente.
-		key := t.createUTMKey(opp.UTMCampaign, opp.UTMSource, opp.UTMMedium)
-		crmMap[key] = append(crmMap[key], opp)
+// metric crea la métrica enriquecida de una fila de Ads agregada con el crédito que recibió.
+func (t *Transformer) metric(row *adRow, modelName string) data.EnrichedMetric {
+	ad, credit := row.ad, row.credit
+
+	// Los conteos enteros son el crédito redondeado, sólo para mostrar: los ratios se calculan con el
+	// crédito fraccionario, que no pierde decimales.
+	metric := data.EnrichedMetric{
+		Date:              row.date,
+		Channel:           ad.Channel,
+		CampaignID:        ad.CampaignID,
+		UTMCampaign:       ad.UTMCampaign,
+		UTMSource:         ad.UTMSource,
+		UTMMedium:         ad.UTMMedium,
+		Clicks:            ad.Clicks,
+		Impressions:       ad.Impressions,
+		Cost:              ad.Cost,
+		Leads:             roundCredit(credit.leads),
+		Opportunities:     roundCredit(credit.opportunities),
+		ClosedWon:         roundCredit(credit.closedWon),
+		Revenue:           credit.revenue,
+		LeadCredit:        credit.leads,
+		OpportunityCredit: credit.opportunities,
+		ClosedWonCredit:   credit.closedWon,
+		AttributionModel:  modelName,
+		Funnel:            t.funnel.metricSteps(credit),
+		Currency:          t.currency,
+		OriginalCost:      row.costFX,
+		OriginalRevenue:   credit.revenueFX,
 	}
 
-	var results []data.EnrichedMetric
+	// Calculamos las métricas derivadas de forma segura, a partir del crédito fraccionario.
+	if metric.Clicks > 0 {
+		metric.CPC = metric.Cost / float64(metric.Clicks)
+	}
+	if metric.LeadCredit > 0 {
+		metric.CPA = metric.Cost / metric.LeadCredit
+		// Tasa de conversión de leads a oportunidades.
+		metric.CVRLeadToOpp = metric.OpportunityCredit / metric.LeadCredit
+	}
+	if metric.OpportunityCredit > 0 {
+		// Tasa de conversión de oportunidades a cerradas.
+		metric.CVROppToWon = metric.ClosedWonCredit / metric.OpportunityCredit
+	}
+	if metric.Cost > 0 {
+		// ROAS (retorno sobre el gasto publicitario).
+		metric.ROAS = metric.Revenue / metric.Cost
+	}
+	return metric
+}
 
-	// Itera sobre cada registro de rendimiento de anuncios.
-	for _, ad := range adsData {
-		// Genera la clave UTM para buscar coincidencias en CRM.
-		key := t.createUTMKey(ad.UTMCampaign, ad.UTMSource, ad.UTMMedium)
+// convert busca el tipo de un importe a la moneda de reporte; sin moneda se considera ya en la de reporte.
+func (t *Transformer) convert(amount float64, currency string, day time.Time) (data.FXAmount, error) {
+	currency = NormalizeCurrency(currency)
+	if currency == "" || currency == t.currency {
+		return data.FXAmount{Currency: t.currency, Amount: amount, Rate: 1}, nil
+	}
+	if t.fx == nil {
+		return data.FXAmount{}, fmt.Errorf("%w: no fx provider configured for %s to %s", ErrFXRateNotFound, currency, t.currency)
+	}
+	rate, err := t.fx.Rate(currency, t.currency, day)
+	if err != nil {
+		return data.FXAmount{}, err
+	}
+	return data.FXAmount{Currency: currency, Amount: amount, Rate: rate}, nil
+}
 
-		// Buscamos las oportunidades que coincidan con la clave UTM del anuncio.
-		matchingOpportunities := crmMap[key]
+// roundCredit convierte un crédito fraccionario en un conteo entero.
+func roundCredit(credit float64) int {
+	return int(math.Round(credit))
+}
 
-		// Calcula las métricas basadas en los datos cruzados.
-		leads := len(matchingOpportunities)
-		closedWon := 0
-		var revenue float64
-		for _, opp := range matchingOpportunities {
-			// Cuenta las oportunidades cerradas y suma los ingresos.
-			if opp.Stage == "closed_won" {
-				closedWon++
-				revenue += opp.Amount
-			}
-		}
+// Combiner agrega los registros de Ads y CRM a medida que llegan por lotes durante una ingesta en streaming y
+// calcula las métricas al final. Ningún registro se conserva entero: las filas de Ads se suman al llegar en una
+// por (fecha, campaña, canal), ya convertidas a la moneda de reporte, y las oportunidades en grupos que la
+// atribución no distingue (misma clave UTM, etapa, moneda y día en cada zona horaria configurada). De las
+// maxOrphanDetail oportunidades de mayor importe de cada grupo se guarda su ID, su fecha y su importe, para
+// el detalle de huérfanas del informe de cruce.
+// El reparto se hace en Metrics porque necesita todas las filas de Ads de la ventana de cada oportunidad.
+type Combiner struct {
+	transformer *Transformer
+	model       AttributionModel
+	rules       *UTMRules        // Reglas de UTM fijadas al crear el Combiner, aunque se recarguen durante la ingesta.
+	zones       []*time.Location // Zonas configuradas, con las que se agrupan las oportunidades por día.
 
-		// Parseamos la fecha del anuncio.
-		adDate, err := time.Parse("2006-01-02", ad.Date)
+	rows      []*adRow       // Filas de Ads agregadas, en orden de llegada.
+	rowIndex  map[string]int // Posición en rows por fecha, campaña y canal.
+	adRecords int            // Filas de Ads recibidas, incluidas las descartadas.
+	skipped   int            // Filas de Ads descartadas por fecha inválida.
+
+	groups     []*oppGroup    // Grupos de oportunidades, en orden de llegada.
+	groupIndex map[string]int // Posición en groups por groupID.
+	oppRecords int            // Oportunidades recibidas.
+
+	adUTM  map[string]*utmKeyStats // Registros y variantes de cada clave UTM de Ads, para el informe de claves sin cruce.
+	oppUTM map[string]*utmKeyStats // Lo mismo para CRM.
+	err    error                   // Primer error al convertir un importe; Metrics lo devuelve.
+	report data.JoinReport
+}
+
+// adRow es la suma de las filas de Ads de un mismo día, campaña y canal.
+type adRow struct {
+	ad     data.AdPerformance // Primera fila recibida, con Clicks, Impressions y Cost sumados en la moneda de reporte.
+	date   time.Time
+	zone   *time.Location
+	keys   []string       // Claves UTM de las filas sumadas; normalmente una.
+	costFX *data.FXAmount // Coste original; nil sin moneda de reporte o si las filas mezclan monedas o tipos.
+	credit adCredit
+}
+
+// merge suma a la fila otra fila de Ads del mismo día, campaña y canal.
+func (r *adRow) merge(ad data.AdPerformance, key string, costFX *data.FXAmount) {
+	r.ad.Clicks += ad.Clicks
+	r.ad.Impressions += ad.Impressions
+	r.ad.Cost += ad.Cost
+	if !slices.Contains(r.keys, key) {
+		r.keys = append(r.keys, key)
+	}
+	// El coste original sólo puede sumarse si está en la misma moneda y con el mismo tipo.
+	if r.costFX != nil && costFX != nil && r.costFX.Currency == costFX.Currency && r.costFX.Rate == costFX.Rate {
+		r.costFX.Amount += costFX.Amount
+	} else {
+		r.costFX = nil
+	}
+}
+
+// oppGroup suma las oportunidades que la atribución trata igual: misma clave UTM, etapa, moneda y tipo, y mismo
+// día de creación en todas las zonas configuradas, así que reciben los mismos toques con los mismos pesos.
+type oppGroup struct {
+	key       string
+	stage     string
+	createdAt time.Time     // Creación de la primera oportunidad; las demás caen en los mismos días.
+	count     int           // Oportunidades del grupo.
+	amount    float64       // Suma de los importes, en la moneda de reporte.
+	fx        data.FXAmount // Moneda y tipo del grupo, con la suma de los importes originales; vacío sin moneda de reporte.
+	members   []oppRef      // Las oportunidades de mayor importe del grupo, para el detalle de huérfanas.
+}
+
+// oppRef es lo que se conserva de cada oportunidad para el informe de cruce.
+type oppRef struct {
+	id        string
+	createdAt time.Time
+	amount    float64 // En la moneda de reporte.
+}
+
+// NewCombiner crea un Combiner que calculará las métricas con el modelo de atribución indicado.
+func (t *Transformer) NewCombiner(model AttributionModel) *Combiner {
+	return &Combiner{
+		transformer: t,
+		model:       model,
+		rules:       t.utm.Rules(),
+		zones:       t.timezones.locations(),
+		rowIndex:    make(map[string]int),
+		groupIndex:  make(map[string]int),
+		adUTM:       make(map[string]*utmKeyStats),
+		oppUTM:      make(map[string]*utmKeyStats),
+	}
+}
+
+// AddAds suma un lote de filas de Ads a la fila de su día, campaña y canal. Las filas con fecha inválida
+// se descartan; la fecha es un día calendario en la zona de la cuenta de la fila.
+func (c *Combiner) AddAds(batch []data.AdPerformance) {
+	t := c.transformer
+	for _, ad := range batch {
+		c.adRecords++
+		date, err := time.Parse("2006-01-02", ad.Date)
 		if err != nil {
 			log.Printf("WARN: could not parse date for campaign %s: %v. Skipping record.", ad.CampaignID, err)
-			continue // Si la fecha es inválida, saltamos este registro.
+			c.skipped++
+			continue
 		}
+		key := c.rules.Key(ad.UTMCampaign, ad.UTMSource, ad.UTMMedium)
+		keyStats(c.adUTM, key).add(ad.UTMCampaign, ad.UTMSource, ad.UTMMedium)
 
-		// Crea una métrica enriquecida con los datos calculados.
-		metric := data.EnrichedMetric{
-			Date:          adDate,
-			Channel:       ad.Channel,
-			CampaignID:    ad.CampaignID,
-			UTMCampaign:   ad.UTMCampaign,
-			UTMSource:     ad.UTMSource,
-			UTMMedium:     ad.UTMMedium,
-			Clicks:        ad.Clicks,
-			Impressions:   ad.Impressions,
-			Cost:          ad.Cost,
-			Leads:         leads,
-			Opportunities: len(matchingOpportunities), // Asumimos que 1 oportunidad = 1 lead.
-			ClosedWon:     closedWon,
-			Revenue:       revenue,
+		// Convierte el coste a la moneda de reporte antes de sumarlo, para que CPA y ROAS comparen
+		// magnitudes en la misma moneda.
+		var costFX *data.FXAmount
+		if t.currency != "" {
+			fx, err := t.convert(ad.Cost, ad.Currency, date)
+			if err != nil {
+				c.fail(fmt.Errorf("failed to convert cost of campaign %s on %s: %w", ad.CampaignID, ad.Date, err))
+				continue
+			}
+			costFX = &fx
+			ad.Cost = fx.Amount * fx.Rate
+			ad.Currency = t.currency
 		}
 
-		// Calculamos las métricas derivadas de forma segura.
-		if metric.Clicks > 0 {
-			metric.CPC = metric.Cost / float64(metric.Clicks)
-		} else {
-			metric.CPC = 0.0
+		id := ad.Date + "|" + ad.CampaignID + "|" + ad.Channel
+		if i, ok := c.rowIndex[id]; ok {
+			c.rows[i].merge(ad, key, costFX)
+			continue
 		}
+		c.rowIndex[id] = len(c.rows)
+		c.rows = append(c.rows, &adRow{ad: ad, date: date, zone: t.timezones.Location(ad.Channel), keys: []string{key}, costFX: costFX})
+	}
+}
 
-		if metric.Leads > 0 {
-			metric.CPA = metric.Cost / float64(metric.Leads)
-		} else {
-			metric.CPA = 0.0
-		}
+// AddOpportunities suma un lote de oportunidades a su grupo, con el importe ya en la moneda de reporte.
+func (c *Combiner) AddOpportunities(batch []data.Opportunity) {
+	t := c.transformer
+	for _, opp := range batch {
+		c.oppRecords++
+		key := c.rules.Key(opp.UTMCampaign, opp.UTMSource, opp.UTMMedium)
+		keyStats(c.oppUTM, key).add(opp.UTMCampaign, opp.UTMSource, opp.UTMMedium)
 
-		if metric.Leads > 0 {
-			// Calcula la tasa de conversión de leads a oportunidades.
-			metric.CVRLeadToOpp = float64(metric.Opportunities) / float64(metric.Leads)
-		} else {
-			metric.CVRLeadToOpp = 0.0
+		// El importe se convierte con el tipo del día de creación en la zona de reporte.
+		var fx data.FXAmount
+		if t.currency != "" {
+			var err error
+			if fx, err = t.convert(opp.Amount, opp.Currency, t.timezones.Day(opp.CreatedAt, "")); err != nil {
+				c.fail(fmt.Errorf("failed to convert amount of opportunity %s: %w", opp.OpportunityID, err))
+				continue
+			}
+			opp.Amount = fx.Amount * fx.Rate
 		}
 
-		if metric.Opportunities > 0 {
-			// Calcula la tasa de conversión de oportunidades a cerradas.
-			metric.CVROppToWon = float64(metric.ClosedWon) / float64(metric.Opportunities)
-		} else {
-			metric.CVROppToWon = 0.0
+		id := c.groupID(key, opp.Stage, fx, opp.CreatedAt)
+		i, ok := c.groupIndex[id]
+		if !ok {
+			i = len(c.groups)
+			c.groupIndex[id] = i
+			c.groups = append(c.groups, &oppGroup{key: key, stage: opp.Stage, createdAt: opp.CreatedAt, fx: data.FXAmount{Currency: fx.Currency, Rate: fx.Rate}})
 		}
+		g := c.groups[i]
+		g.count++
+		g.amount += opp.Amount
+		g.fx.Amount += fx.Amount
+		g.keep(oppRef{id: opp.OpportunityID, createdAt: opp.CreatedAt, amount: opp.Amount})
+	}
+}
 
-		if metric.Cost > 0 {
-			// Calcula el ROAS (retorno sobre el gasto publicitario).
-			metric.ROAS = metric.Revenue / metric.Cost
-		} else {
-			metric.ROAS = 0.0
+// maxOrphanDetail es el máximo de oportunidades por grupo que se conservan para el detalle de huérfanas del
+// informe de cruce. Los conteos e importes del informe siguen siendo exactos.
+const maxOrphanDetail = 20
+
+// keep conserva la oportunidad para el detalle de huérfanas si está entre las maxOrphanDetail de mayor importe
+// del grupo, de modo que la memoria crece con los grupos y no con las oportunidades recibidas.
+func (g *oppGroup) keep(ref oppRef) {
+	if len(g.members) < maxOrphanDetail {
+		g.members = append(g.members, ref)
+		return
+	}
+	smallest := 0
+	for i := range g.members {
+		if g.members[i].amount < g.members[smallest].amount {
+			smallest = i
 		}
+	}
+	if ref.amount > g.members[smallest].amount {
+		g.members[smallest] = ref
+	}
+}
 
-		// Agrega la métrica enriquecida a los resultados.
-		results = append(results, metric)
+// groupID identifica el grupo de una oportunidad: su clave UTM, su etapa, su moneda y tipo originales y su día
+// de creación en cada zona configurada, que es lo único que la atribución mira de ella.
+func (c *Combiner) groupID(key, stage string, fx data.FXAmount, createdAt time.Time) string {
+	var b strings.Builder
+	b.WriteString(key)
+	b.WriteByte(0)
+	b.WriteString(stage)
+	b.WriteByte(0)
+	b.WriteString(fx.Currency)
+	b.WriteByte(0)
+	b.WriteString(strconv.FormatFloat(fx.Rate, 'g', -1, 64))
+	for _, loc := range c.zones {
+		b.WriteByte(0)
+		b.WriteString(createdAt.In(loc).Format("2006-01-02"))
 	}
+	return b.String()
+}
+
+// fail registra el primer error de conversión; los siguientes registros se siguen contando.
+func (c *Combiner) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// keyStats devuelve las estadísticas de la clave en stats, creándolas si no existen.
+func keyStats(stats map[string]*utmKeyStats, key string) *utmKeyStats {
+	if stats[key] == nil {
+		stats[key] = &utmKeyStats{}
+	}
+	return stats[key]
+}
+
+// AdsCount devuelve el número de filas de Ads recibidas, incluidas las descartadas.
+func (c *Combiner) AdsCount() int {
+	return c.adRecords
+}
+
+// SkippedAdsCount devuelve el número de filas de Ads descartadas por tener una fecha inválida.
+func (c *Combiner) SkippedAdsCount() int {
+	return c.skipped
+}
+
+// OpportunitiesCount devuelve el número de oportunidades recibidas.
+func (c *Combiner) OpportunitiesCount() int {
+	return c.oppRecords
+}
+
+// Metrics reparte las oportunidades agregadas entre las filas de Ads según el modo y el modelo de atribución
+// y calcula una métrica por fila, en orden de llegada. Falla si no llegó ninguna fila de Ads o si faltó el
+// tipo de cambio de algún registro, para no mezclar monedas en las métricas.
+func (c *Combiner) Metrics() ([]data.EnrichedMetric, error) {
+	if c.adRecords == 0 {
+		return nil, errors.New("ads data is empty")
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	t := c.transformer
+
+	match := newUTMMatchReport(c.adUTM, c.oppUTM)
+	t.mu.Lock()
+	t.lastMatch = &match
+	t.mu.Unlock()
+
+	for _, row := range c.rows {
+		row.credit = adCredit{}
+	}
+	var orphans []string
+	modelName := MetricModel(t.mode, c.model)
+	switch t.mode {
+	case AttributionNaive:
+		// El modelo no aplica: cada fila recibe el crédito completo.
+		orphans = t.attributeNaive(c.rows, c.groups)
+	default:
+		orphans = t.attributeWindow(c.rows, c.groups, c.model)
+	}
+	c.report = buildJoinReport(c.rows, c.groups, orphans)
+	c.report.Model = modelName
 
+	results := make([]data.EnrichedMetric, 0, len(c.rows))
+	for _, row := range c.rows {
+		results = append(results, t.metric(row, modelName))
+	}
 	return results, nil
 }
 
+// JoinReport devuelve el informe de cruce calculado por la última llamada a Metrics.
+func (c *Combiner) JoinReport() data.JoinReport {
+	return c.report
+}
+
 // FilterAdsByDate filtra los datos de Ads según la fecha proporcionada.
 func (t *Transformer) FilterAdsByDate(ads []data.AdPerformance, since *time.Time) []data.AdPerformance {
 	var filtered []data.AdPerformance
@@ -146,23 +538,3 @@ func (t *Transformer) FilterCRMByDate(crm []data.Opportunity, since *time.Time)
 	}
 	return filtered
 }
-
-// createUTMKey genera una clave consistente para el cruce, normalizando los datos.
-func (t *Transformer) createUTMKey(campaign, source, medium string) string {
-	// Asignar valores predeterminados si faltan UTMs
-	if strings.TrimSpace(campaign) == "" {
-		campaign = "unknown"
-	}
-	if strings.TrimSpace(source) == "" {
-		source = "unknown"
-	}
-	if strings.TrimSpace(medium) == "" {
-		medium = "unknown"
-	}
-
-	// Normalizar y generar la clave
-	c := strings.ToLower(strings.TrimSpace(campaign))
-	s := strings.ToLower(strings.TrimSpace(source))
-	m := strings.ToLower(strings.TrimSpace(medium))
-	return fmt.Sprintf("%s|%s|%s", c, s, m)
-}
@@ -9,7 +9,8 @@ import (
 )
 
 func TestCombineAndCalculateMetrics(t *testing.T) {
-	transformer := NewTransformer()
+	// El modo naive reproduce el cruce histórico por clave UTM, sin mirar fechas.
+	transformer := NewTransformer(WithAttribution(AttributionNaive, 0))
 
 	// Datos de prueba para Ads.
 	adsData := []data.AdPerformance{
@@ -64,3 +65,106 @@ func TestCombineAndCalculateMetrics(t *testing.T) {
 	assert.InDelta(t, 0.5, metric.CVROppToWon, 0.001)  // Verifica la tasa de conversión de oportunidad a ganada.
 	assert.InDelta(t, 15.0, metric.ROAS, 0.001)        // Verifica el retorno sobre el gasto publicitario (ROAS).
 }
+
+func TestCombineAndCalculateMetrics_WindowAttribution(t *testing.T) {
+	transformer := NewTransformer(WithAttribution(AttributionWindow, 7))
+
+	// La misma campaña corre tres días seguidos.
+	adsData := []data.AdPerformance{
+		{Date: "2025-08-01", CampaignID: "C-1001", Channel: "google_ads", Cost: 10.0, UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"},
+		{Date: "2025-08-02", CampaignID: "C-1001", Channel: "google_ads", Cost: 10.0, UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"},
+		{Date: "2025-08-03", CampaignID: "C-1001", Channel: "google_ads", Cost: 10.0, UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"},
+	}
+
+	crmData := []data.Opportunity{
+		// Creada el día 2: se acredita sólo a la fila del día 2.
+		{Stage: "closed_won", Amount: 100.0, CreatedAt: time.Date(2025, 8, 2, 15, 0, 0, 0, time.UTC), UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"},
+		// Creada después de la última fila, dentro de la ventana: se acredita al día 3.
+		{Stage: "closed_lost", Amount: 50.0, CreatedAt: time.Date(2025, 8, 6, 9, 0, 0, 0, time.UTC), UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"},
+		// Creada antes de cualquier anuncio: no se acredita.
+		{Stage: "closed_won", Amount: 999.0, CreatedAt: time.Date(2025, 7, 30, 9, 0, 0, 0, time.UTC), UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"},
+		// Fuera de la ventana de 7 días: no se acredita.
+		{Stage: "closed_won", Amount: 999.0, CreatedAt: time.Date(2025, 8, 20, 9, 0, 0, 0, time.UTC), UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"},
+	}
+
+	results, err := transformer.CombineAndCalculateMetrics(adsData, crmData)
+
+	assert.NoError(t, err)
+	assert.Len(t, results, 3)
+
+	assert.Equal(t, 0, results[0].Leads)
+	assert.Equal(t, 1, results[1].Leads)
+	assert.Equal(t, 1, results[1].ClosedWon)
+	assert.Equal(t, 100.0, results[1].Revenue)
+	assert.Equal(t, 1, results[2].Leads)
+	assert.Equal(t, 0, results[2].ClosedWon)
+
+	// Cada oportunidad atribuida se cuenta una sola vez en total.
+	totalLeads := 0
+	var totalRevenue float64
+	for _, m := range results {
+		totalLeads += m.Leads
+		totalRevenue += m.Revenue
+	}
+	assert.Equal(t, 2, totalLeads)
+	assert.Equal(t, 100.0, totalRevenue)
+}
+
+func TestCombiner_AggregatesIncrementally(t *testing.T) {
+	transformer := NewTransformer(WithAttribution(AttributionWindow, 7))
+	combiner := transformer.NewCombiner(Linear)
+
+	// Dos filas del mismo día, campaña y canal llegan en lotes distintos: se suman en una sola métrica.
+	combiner.AddAds([]data.AdPerformance{
+		{Date: "2025-08-01", CampaignID: "C-1001", Channel: "google_ads", Clicks: 10, Cost: 5.0, UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"},
+		{Date: "not-a-date", CampaignID: "C-1001", Channel: "google_ads", UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"},
+	})
+	combiner.AddOpportunities([]data.Opportunity{
+		{OpportunityID: "O-1", Stage: "closed_won", Amount: 100.0, CreatedAt: time.Date(2025, 8, 2, 9, 0, 0, 0, time.UTC), UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"},
+		{OpportunityID: "O-2", Stage: "closed_won", Amount: 300.0, CreatedAt: time.Date(2025, 8, 20, 9, 0, 0, 0, time.UTC), UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"},
+	})
+	combiner.AddAds([]data.AdPerformance{
+		{Date: "2025-08-01", CampaignID: "C-1001", Channel: "google_ads", Clicks: 30, Cost: 15.0, UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"},
+		{Date: "2025-08-02", CampaignID: "C-1001", Channel: "google_ads", Clicks: 20, Cost: 10.0, UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"},
+	})
+	// Misma clave, etapa y día que O-1: se reparte igual entre los dos días.
+	combiner.AddOpportunities([]data.Opportunity{
+		{OpportunityID: "O-3", Stage: "closed_won", Amount: 50.0, CreatedAt: time.Date(2025, 8, 2, 18, 0, 0, 0, time.UTC), UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"},
+	})
+
+	metrics, err := combiner.Metrics()
+	assert.NoError(t, err)
+	assert.Len(t, metrics, 2)
+	assert.Equal(t, 4, combiner.AdsCount())
+	assert.Equal(t, 1, combiner.SkippedAdsCount())
+	assert.Equal(t, 3, combiner.OpportunitiesCount())
+
+	assert.Equal(t, 40, metrics[0].Clicks)
+	assert.Equal(t, 20.0, metrics[0].Cost)
+	assert.InDelta(t, 1.0, metrics[0].LeadCredit, 0.001)
+	assert.InDelta(t, 75.0, metrics[0].Revenue, 0.001)
+	assert.InDelta(t, 1.0, metrics[1].LeadCredit, 0.001)
+	assert.InDelta(t, 75.0, metrics[1].Revenue, 0.001)
+
+	report := combiner.JoinReport()
+	assert.Equal(t, 2, report.AdRows)
+	assert.Equal(t, 3, report.Opportunities)
+	assert.Equal(t, 2, report.MatchedOpportunities)
+	assert.Equal(t, 1, report.OrphanOpportunities)
+	assert.Equal(t, 300.0, report.OrphanAmount)
+	if assert.Len(t, report.Orphans, 1) {
+		assert.Equal(t, "O-2", report.Orphans[0].OpportunityID)
+	}
+
+	// El mismo resultado que con todos los registros de una vez.
+	batch, _, err := transformer.CombineWithReport([]data.AdPerformance{
+		{Date: "2025-08-01", CampaignID: "C-1001", Channel: "google_ads", Clicks: 40, Cost: 20.0, UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"},
+		{Date: "2025-08-02", CampaignID: "C-1001", Channel: "google_ads", Clicks: 20, Cost: 10.0, UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"},
+	}, []data.Opportunity{
+		{OpportunityID: "O-1", Stage: "closed_won", Amount: 100.0, CreatedAt: time.Date(2025, 8, 2, 9, 0, 0, 0, time.UTC), UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"},
+		{OpportunityID: "O-3", Stage: "closed_won", Amount: 50.0, CreatedAt: time.Date(2025, 8, 2, 18, 0, 0, 0, time.UTC), UTMCampaign: "summer_sale", UTMSource: "google", UTMMedium: "cpc"},
+	}, Linear)
+	assert.NoError(t, err)
+	assert.Equal(t, batch[0].Funnel, metrics[0].Funnel)
+	assert.InDelta(t, batch[1].Revenue, metrics[1].Revenue, 0.001)
+}
@@ -0,0 +1,331 @@
+// Package etl internal/etl/utm.go
+package etl
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UTMRewrite sustituye las coincidencias de Pattern (expresión regular de Go) por Replace, que admite $1, $2…
+type UTMRewrite struct {
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace"`
+}
+
+// UTMFieldRules son las reglas de un campo UTM. Los alias se comparan con el valor ya normalizado
+// (decodificado, en minúsculas y sin espacios alrededor); las reescrituras se aplican después, en orden.
+type UTMFieldRules struct {
+	Aliases  map[string]string `json:"aliases"`
+	Rewrites []UTMRewrite      `json:"rewrites"`
+}
+
+// UTMRulesConfig agrupa las reglas de normalización de los tres campos UTM.
+type UTMRulesConfig struct {
+	// URLDecode decodifica %XX y "+" antes de aplicar el resto de reglas; por defecto true.
+	URLDecode *bool         `json:"url_decode,omitempty"`
+	Campaign  UTMFieldRules `json:"campaign"`
+	Source    UTMFieldRules `json:"source"`
+	Medium    UTMFieldRules `json:"medium"`
+}
+
+// LoadUTMRulesConfig lee las reglas de normalización de un archivo JSON.
+func LoadUTMRulesConfig(path string) (UTMRulesConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return UTMRulesConfig{}, fmt.Errorf("failed to read utm rules: %w", err)
+	}
+	var cfg UTMRulesConfig
+	decoder := json.NewDecoder(strings.NewReader(string(raw)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return UTMRulesConfig{}, fmt.Errorf("failed to parse utm rules: %w", err)
+	}
+	return cfg, nil
+}
+
+// fieldRules son las reglas ya compiladas de un campo UTM.
+type fieldRules struct {
+	aliases  map[string]string
+	patterns []*regexp.Regexp
+	replaces []string
+}
+
+// UTMRules normaliza los campos UTM para el cruce entre Ads y CRM. Es inmutable: una recarga crea otra.
+type UTMRules struct {
+	cfg       UTMRulesConfig // Configuración de la que se compilaron, para archivarla con cada ingesta.
+	urlDecode bool
+	campaign  fieldRules
+	source    fieldRules
+	medium    fieldRules
+}
+
+// NewUTMRules compila las reglas; falla si alguna expresión regular no es válida.
+func NewUTMRules(cfg UTMRulesConfig) (*UTMRules, error) {
+	r := &UTMRules{cfg: cfg, urlDecode: cfg.URLDecode == nil || *cfg.URLDecode}
+	var err error
+	if r.campaign, err = compileFieldRules(cfg.Campaign); err != nil {
+		return nil, fmt.Errorf("invalid campaign rules: %w", err)
+	}
+	if r.source, err = compileFieldRules(cfg.Source); err != nil {
+		return nil, fmt.Errorf("invalid source rules: %w", err)
+	}
+	if r.medium, err = compileFieldRules(cfg.Medium); err != nil {
+		return nil, fmt.Errorf("invalid medium rules: %w", err)
+	}
+	return r, nil
+}
+
+// compileFieldRules normaliza las claves de los alias y compila las reescrituras.
+func compileFieldRules(cfg UTMFieldRules) (fieldRules, error) {
+	rules := fieldRules{aliases: make(map[string]string, len(cfg.Aliases))}
+	for from, to := range cfg.Aliases {
+		key := strings.ToLower(strings.TrimSpace(from))
+		if key == "" {
+			return rules, fmt.Errorf("empty alias")
+		}
+		rules.aliases[key] = strings.ToLower(strings.TrimSpace(to))
+	}
+	for _, rw := range cfg.Rewrites {
+		re, err := regexp.Compile(rw.Pattern)
+		if err != nil {
+			return rules, fmt.Errorf("invalid rewrite pattern %q: %w", rw.Pattern, err)
+		}
+		rules.patterns = append(rules.patterns, re)
+		rules.replaces = append(rules.replaces, rw.Replace)
+	}
+	return rules, nil
+}
+
+// Key devuelve la clave de cruce de una terna UTM normalizada; los campos vacíos pasan a "unknown".
+func (r *UTMRules) Key(campaign, source, medium string) string {
+	return fmt.Sprintf("%s|%s|%s", r.normalize(campaign, r.campaign), r.normalize(source, r.source), r.normalize(medium, r.medium))
+}
+
+// normalize aplica a un valor la decodificación, el paso a minúsculas, los alias y las reescrituras.
+func (r *UTMRules) normalize(value string, rules fieldRules) string {
+	if r.urlDecode {
+		if decoded, err := url.QueryUnescape(value); err == nil {
+			value = decoded
+		}
+	}
+	value = strings.ToLower(strings.TrimSpace(value))
+	if alias, ok := rules.aliases[value]; ok {
+		value = alias
+	}
+	for i, re := range rules.patterns {
+		value = re.ReplaceAllString(value, rules.replaces[i])
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
+
+// UTMNormalizer mantiene las reglas vigentes y, si vienen de un archivo, las recarga cuando este cambia.
+type UTMNormalizer struct {
+	rules atomic.Pointer[UTMRules]
+
+	path     string
+	modTime  time.Time
+	loadedAt time.Time
+	lastErr  string
+	mu       sync.Mutex // Protege modTime, loadedAt y lastErr.
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewUTMNormalizer crea un normalizador con reglas fijas.
+func NewUTMNormalizer(rules *UTMRules) *UTMNormalizer {
+	n := &UTMNormalizer{stop: make(chan struct{}), loadedAt: time.Now().UTC()}
+	n.rules.Store(rules)
+	return n
+}
+
+// LoadUTMNormalizer crea un normalizador con las reglas del archivo indicado; Reload y Watch las recargan.
+func LoadUTMNormalizer(path string) (*UTMNormalizer, error) {
+	n := &UTMNormalizer{path: path, stop: make(chan struct{})}
+	if _, err := n.Reload(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Rules devuelve las reglas vigentes. Una transformación debe usar las mismas reglas de principio a fin.
+func (n *UTMNormalizer) Rules() *UTMRules {
+	return n.rules.Load()
+}
+
+// Reload vuelve a leer el archivo de reglas. Si no es válido conserva las reglas vigentes y devuelve el error.
+// Devuelve true si el archivo había cambiado desde la última carga.
+func (n *UTMNormalizer) Reload() (bool, error) {
+	if n.path == "" {
+		return false, nil
+	}
+	info, err := os.Stat(n.path)
+	if err != nil {
+		return false, n.fail(fmt.Errorf("failed to read utm rules: %w", err))
+	}
+
+	n.mu.Lock()
+	unchanged := n.rules.Load() != nil && info.ModTime().Equal(n.modTime)
+	n.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cfg, err := LoadUTMRulesConfig(n.path)
+	if err != nil {
+		return false, n.fail(err)
+	}
+	rules, err := NewUTMRules(cfg)
+	if err != nil {
+		return false, n.fail(fmt.Errorf("invalid utm rules: %w", err))
+	}
+	n.rules.Store(rules)
+
+	n.mu.Lock()
+	n.modTime = info.ModTime()
+	n.loadedAt = time.Now().UTC()
+	n.lastErr = ""
+	n.mu.Unlock()
+	return true, nil
+}
+
+// fail registra el error de la última recarga.
+func (n *UTMNormalizer) fail(err error) error {
+	n.mu.Lock()
+	n.lastErr = err.Error()
+	n.mu.Unlock()
+	return err
+}
+
+// Watch comprueba el archivo de reglas cada interval y lo recarga si ha cambiado, hasta que se llama a Stop.
+func (n *UTMNormalizer) Watch(interval time.Duration) {
+	pollReload("UTM rules", n.path, interval, n.stop, &n.wg, n.Reload)
+}
+
+// pollReload llama a reload cada interval en una goroutine hasta que se cierra stop. Un error se registra y
+// se conserva la configuración vigente. No hace nada sin archivo o con interval 0.
+func pollReload(what, path string, interval time.Duration, stop <-chan struct{}, wg *sync.WaitGroup, reload func() (bool, error)) {
+	if path == "" || interval <= 0 {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				changed, err := reload()
+				if err != nil {
+					log.Printf("ERROR: Failed to reload %s from %s, keeping previous version: %v", what, path, err)
+				} else if changed {
+					log.Printf("INFO: Reloaded %s from %s.", what, path)
+				}
+			}
+		}
+	}()
+}
+
+// Stop detiene la recarga periódica.
+func (n *UTMNormalizer) Stop() {
+	close(n.stop)
+	n.wg.Wait()
+}
+
+// UTMRulesStatus describe el origen y la última carga de las reglas.
+type UTMRulesStatus struct {
+	Path      string    `json:"path,omitempty"`
+	LoadedAt  time.Time `json:"loaded_at"`
+	LastError string    `json:"last_error,omitempty"` // Error de la última recarga; las reglas vigentes son las anteriores.
+}
+
+// Status devuelve el origen y la última carga de las reglas.
+func (n *UTMNormalizer) Status() UTMRulesStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return UTMRulesStatus{Path: n.path, LoadedAt: n.loadedAt, LastError: n.lastErr}
+}
+
+// maxUTMVariants limita los valores originales que se guardan por clave en el informe de claves sin cruce.
+const maxUTMVariants = 5
+
+// UnmatchedUTMKey es una clave UTM presente sólo en un lado del cruce.
+type UnmatchedUTMKey struct {
+	Key      string   `json:"key"`
+	Records  int      `json:"records"`
+	Variants []string `json:"variants"` // Ternas originales (campaign|source|medium) que produjeron la clave.
+}
+
+// UTMMatchReport resume las claves UTM de una transformación que sólo aparecen en Ads o sólo en CRM.
+type UTMMatchReport struct {
+	GeneratedAt  time.Time         `json:"generated_at"`
+	AdsKeys      int               `json:"ads_keys"`
+	CRMKeys      int               `json:"crm_keys"`
+	MatchedKeys  int               `json:"matched_keys"`
+	UnmatchedAds []UnmatchedUTMKey `json:"unmatched_ads"`
+	UnmatchedCRM []UnmatchedUTMKey `json:"unmatched_crm"`
+}
+
+// utmKeyStats acumula los registros y las variantes originales de una clave.
+type utmKeyStats struct {
+	records  int
+	variants []string
+}
+
+// add cuenta un registro con la terna original indicada.
+func (s *utmKeyStats) add(campaign, source, medium string) {
+	s.records++
+	raw := campaign + "|" + source + "|" + medium
+	if len(s.variants) < maxUTMVariants && !slices.Contains(s.variants, raw) {
+		s.variants = append(s.variants, raw)
+	}
+}
+
+// newUTMMatchReport calcula las claves sin cruce de una transformación a partir de las estadísticas de las
+// claves ya normalizadas de cada lado. Las filas de Ads con fecha inválida no cuentan.
+func newUTMMatchReport(adStats, oppStats map[string]*utmKeyStats) UTMMatchReport {
+	report := UTMMatchReport{
+		GeneratedAt:  time.Now().UTC(),
+		AdsKeys:      len(adStats),
+		CRMKeys:      len(oppStats),
+		UnmatchedAds: unmatchedKeys(adStats, oppStats),
+		UnmatchedCRM: unmatchedKeys(oppStats, adStats),
+	}
+	report.MatchedKeys = report.AdsKeys - len(report.UnmatchedAds)
+	return report
+}
+
+// unmatchedKeys devuelve las claves de side que no están en other, de la que más registros tiene a la que menos.
+func unmatchedKeys(side, other map[string]*utmKeyStats) []UnmatchedUTMKey {
+	keys := []UnmatchedUTMKey{}
+	for key, stats := range side {
+		if _, ok := other[key]; ok {
+			continue
+		}
+		keys = append(keys, UnmatchedUTMKey{Key: key, Records: stats.records, Variants: stats.variants})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Records != keys[j].Records {
+			return keys[i].Records > keys[j].Records
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys
+}
@@ -0,0 +1,136 @@
+package etl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btors/admira-etl/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUTMRules_Example(t *testing.T) {
+	cfg, err := LoadUTMRulesConfig("../../utm_rules.example.json")
+	require.NoError(t, err)
+	rules, err := NewUTMRules(cfg)
+	require.NoError(t, err)
+
+	for raw, want := range map[[3]string]string{
+		{"Summer Sale", "Google Ads", "paid_search"}:     "summer_sale|google|cpc",
+		{"summer%20sale", "adwords", "CPC"}:              "summer_sale|google|cpc",
+		{"summer+sale+2025", "www.google.com", "ppc"}:    "summer_sale|google|cpc",
+		{" summer-sale ", "Google%20Ads", "Paid+Search"}: "summer_sale|google|cpc",
+		{"", "", ""}:                     "unknown|unknown|unknown",
+		{"100%off", "fb", "paid_social"}: "100%off|facebook|paid-social", // Un % inválido se conserva sin decodificar.
+	} {
+		assert.Equal(t, want, rules.Key(raw[0], raw[1], raw[2]), raw)
+	}
+}
+
+func TestNewUTMRules_Validation(t *testing.T) {
+	_, err := NewUTMRules(UTMRulesConfig{Source: UTMFieldRules{Rewrites: []UTMRewrite{{Pattern: "("}}}})
+	assert.Error(t, err)
+	_, err = NewUTMRules(UTMRulesConfig{Medium: UTMFieldRules{Aliases: map[string]string{" ": "cpc"}}})
+	assert.Error(t, err)
+
+	// Sin reglas sólo se decodifica, se recortan espacios y se pasa a minúsculas; url_decode=false lo desactiva.
+	rules, err := NewUTMRules(UTMRulesConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, "summer sale|google|cpc", rules.Key("Summer%20Sale", " Google ", "cpc"))
+	off := false
+	rules, err = NewUTMRules(UTMRulesConfig{URLDecode: &off})
+	require.NoError(t, err)
+	assert.Equal(t, "summer%20sale|google|cpc", rules.Key("Summer%20Sale", "google", "cpc"))
+}
+
+func TestUTMNormalizer_ReloadKeepsPreviousRulesOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "utm.json")
+	write := func(content string, mtime time.Time) {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+	start := time.Now().Add(-time.Hour)
+	write(`{"source": {"aliases": {"adwords": "google"}}}`, start)
+
+	n, err := LoadUTMNormalizer(path)
+	require.NoError(t, err)
+	assert.Equal(t, "c|google|m", n.Rules().Key("c", "adwords", "m"))
+
+	// Sin cambios en el archivo no se recarga.
+	changed, err := n.Reload()
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	// Un archivo inválido no sustituye las reglas vigentes.
+	write(`{"source": {"rewrites": [{"pattern": "("}]}}`, start.Add(time.Minute))
+	_, err = n.Reload()
+	assert.Error(t, err)
+	assert.NotEmpty(t, n.Status().LastError)
+	assert.Equal(t, "c|google|m", n.Rules().Key("c", "adwords", "m"))
+
+	write(`{"source": {"aliases": {"adwords": "google_ads"}}}`, start.Add(2*time.Minute))
+	changed, err = n.Reload()
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Empty(t, n.Status().LastError)
+	assert.Equal(t, "c|google_ads|m", n.Rules().Key("c", "adwords", "m"))
+}
+
+func TestUTMNormalizer_WatchReloadsChangedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "utm.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{}`), 0o644))
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(path, old, old))
+
+	n, err := LoadUTMNormalizer(path)
+	require.NoError(t, err)
+	n.Watch(10 * time.Millisecond)
+	defer n.Stop()
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"medium": {"aliases": {"paid_search": "cpc"}}}`), 0o644))
+	assert.Eventually(t, func() bool {
+		return n.Rules().Key("c", "s", "paid_search") == "c|s|cpc"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCombineWithModel_UTMRulesAndUnmatchedReport(t *testing.T) {
+	cfg, err := LoadUTMRulesConfig("../../utm_rules.example.json")
+	require.NoError(t, err)
+	rules, err := NewUTMRules(cfg)
+	require.NoError(t, err)
+	transformer := NewTransformer(WithAttribution(AttributionWindow, 30), WithUTMNormalizer(NewUTMNormalizer(rules)))
+	assert.Nil(t, transformer.LastUTMMatch())
+
+	ads := []data.AdPerformance{
+		{Date: "2025-08-01", CampaignID: "C-1", Channel: "google_ads", Cost: 10, UTMCampaign: "Summer Sale", UTMSource: "Google Ads", UTMMedium: "paid_search"},
+		{Date: "2025-08-01", CampaignID: "C-2", Channel: "tiktok", Cost: 10, UTMCampaign: "launch", UTMSource: "tiktok", UTMMedium: "cpc"},
+	}
+	created := time.Date(2025, 8, 2, 0, 0, 0, 0, time.UTC)
+	crm := []data.Opportunity{
+		{Stage: "closed_won", Amount: 100, CreatedAt: created, UTMCampaign: "summer+sale", UTMSource: "adwords", UTMMedium: "cpc"},
+		{Stage: "lead", CreatedAt: created, UTMCampaign: "newsletter", UTMSource: "mailchimp", UTMMedium: "E-Mail"},
+		{Stage: "lead", CreatedAt: created, UTMCampaign: "Newsletter", UTMSource: "mailchimp", UTMMedium: "email"},
+	}
+
+	metrics, err := transformer.CombineWithModel(ads, crm, LastTouch)
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, 1, metrics[0].ClosedWon) // Las variantes de Google y cpc cruzan gracias a los alias.
+	assert.Zero(t, metrics[1].Leads)
+
+	report := transformer.LastUTMMatch()
+	require.NotNil(t, report)
+	assert.Equal(t, 2, report.AdsKeys)
+	assert.Equal(t, 2, report.CRMKeys)
+	assert.Equal(t, 1, report.MatchedKeys)
+	require.Len(t, report.UnmatchedAds, 1)
+	assert.Equal(t, "launch|tiktok|cpc", report.UnmatchedAds[0].Key)
+	require.Len(t, report.UnmatchedCRM, 1)
+	assert.Equal(t, UnmatchedUTMKey{
+		Key:      "newsletter|mailchimp|email",
+		Records:  2,
+		Variants: []string{"newsletter|mailchimp|E-Mail", "Newsletter|mailchimp|email"},
+	}, report.UnmatchedCRM[0])
+}
@@ -0,0 +1,595 @@
+// Package etl internal/etl/validate.go
+package etl
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/mail"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/btors/admira-etl/internal/data"
+)
+
+// Comprobaciones disponibles en las reglas de validación.
+const (
+	CheckRequired    = "required"     // Texto no vacío o instante no nulo.
+	CheckNonNegative = "non_negative" // Número mayor o igual que cero.
+	CheckFinite      = "finite"       // Número distinto de NaN e infinito.
+	CheckDate        = "date"         // Texto con formato YYYY-MM-DD.
+	CheckEmail       = "email"        // Dirección de correo válida; un campo vacío la cumple (combinar con required).
+	CheckOneOf       = "one_of"       // Texto incluido en Values; un campo vacío la cumple (combinar con required).
+)
+
+// ValidationRule es una regla declarativa: el campo (por su nombre JSON) debe cumplir la comprobación.
+type ValidationRule struct {
+	Field  string   `json:"field"`
+	Check  string   `json:"check"`
+	Values []string `json:"values,omitempty"` // Valores admitidos por one_of.
+}
+
+// ValidationConfig agrupa las reglas de cada tipo de registro.
+type ValidationConfig struct {
+	Ads           []ValidationRule `json:"ads"`
+	Opportunities []ValidationRule `json:"opportunities"`
+}
+
+// DefaultValidationConfig devuelve las reglas por defecto: lo mínimo para que un registro produzca una métrica coherente.
+func DefaultValidationConfig() ValidationConfig {
+	return ValidationConfig{
+		Ads: []ValidationRule{
+			{Field: "date", Check: CheckDate},
+			{Field: "campaign_id", Check: CheckRequired},
+			{Field: "clicks", Check: CheckNonNegative},
+			{Field: "impressions", Check: CheckNonNegative},
+			{Field: "cost", Check: CheckFinite},
+			{Field: "cost", Check: CheckNonNegative},
+		},
+		Opportunities: []ValidationRule{
+			{Field: "opportunity_id", Check: CheckRequired},
+			{Field: "created_at", Check: CheckRequired},
+			{Field: "amount", Check: CheckFinite},
+			{Field: "amount", Check: CheckNonNegative},
+		},
+	}
+}
+
+// LoadValidationConfig lee las reglas de un archivo JSON. Un tipo ausente en el archivo conserva sus reglas
+// por defecto; una lista vacía lo deja sin reglas.
+func LoadValidationConfig(path string) (ValidationConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return ValidationConfig{}, fmt.Errorf("failed to read validation rules: %w", err)
+	}
+	var cfg ValidationConfig
+	decoder := json.NewDecoder(strings.NewReader(string(raw)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return ValidationConfig{}, fmt.Errorf("failed to parse validation rules: %w", err)
+	}
+	defaults := DefaultValidationConfig()
+	if cfg.Ads == nil {
+		cfg.Ads = defaults.Ads
+	}
+	if cfg.Opportunities == nil {
+		cfg.Opportunities = defaults.Opportunities
+	}
+	return cfg, nil
+}
+
+// adFields expone los campos de una fila de Ads por su nombre JSON.
+var adFields = map[string]func(data.AdPerformance) interface{}{
+	"date":         func(a data.AdPerformance) interface{} { return a.Date },
+	"campaign_id":  func(a data.AdPerformance) interface{} { return a.CampaignID },
+	"channel":      func(a data.AdPerformance) interface{} { return a.Channel },
+	"clicks":       func(a data.AdPerformance) interface{} { return a.Clicks },
+	"impressions":  func(a data.AdPerformance) interface{} { return a.Impressions },
+	"cost":         func(a data.AdPerformance) interface{} { return a.Cost },
+	"utm_campaign": func(a data.AdPerformance) interface{} { return a.UTMCampaign },
+	"utm_source":   func(a data.AdPerformance) interface{} { return a.UTMSource },
+	"utm_medium":   func(a data.AdPerformance) interface{} { return a.UTMMedium },
+	"currency":     func(a data.AdPerformance) interface{} { return a.Currency },
+}
+
+// opportunityFields expone los campos de una oportunidad por su nombre JSON.
+var opportunityFields = map[string]func(data.Opportunity) interface{}{
+	"opportunity_id": func(o data.Opportunity) interface{} { return o.OpportunityID },
+	"contact_email":  func(o data.Opportunity) interface{} { return o.ContactEmail },
+	"stage":          func(o data.Opportunity) interface{} { return o.Stage },
+	"amount":         func(o data.Opportunity) interface{} { return o.Amount },
+	"created_at":     func(o data.Opportunity) interface{} { return o.CreatedAt },
+	"utm_campaign":   func(o data.Opportunity) interface{} { return o.UTMCampaign },
+	"utm_source":     func(o data.Opportunity) interface{} { return o.UTMSource },
+	"utm_medium":     func(o data.Opportunity) interface{} { return o.UTMMedium },
+	"currency":       func(o data.Opportunity) interface{} { return o.Currency },
+}
+
+// fieldCheck es una regla ya compilada: devuelve el motivo del rechazo, o "" si el valor la cumple.
+type fieldCheck struct {
+	field string
+	check func(value interface{}) string
+}
+
+// Validator aplica las reglas de validación a los registros ingestados.
+type Validator struct {
+	cfg  ValidationConfig // Reglas de las que se compiló, para archivarlas con cada ingesta.
+	ads  []fieldCheck
+	opps []fieldCheck
+}
+
+// NewValidator compila las reglas; falla si alguna usa un campo o una comprobación desconocidos,
+// o una comprobación que no aplica al tipo del campo.
+func NewValidator(cfg ValidationConfig) (*Validator, error) {
+	sampleAd := make(map[string]interface{}, len(adFields))
+	for name, get := range adFields {
+		sampleAd[name] = get(data.AdPerformance{})
+	}
+	sampleOpp := make(map[string]interface{}, len(opportunityFields))
+	for name, get := range opportunityFields {
+		sampleOpp[name] = get(data.Opportunity{})
+	}
+
+	v := &Validator{cfg: cfg}
+	var err error
+	if v.ads, err = compileRules(cfg.Ads, sampleAd); err != nil {
+		return nil, fmt.Errorf("invalid ads validation rules: %w", err)
+	}
+	if v.opps, err = compileRules(cfg.Opportunities, sampleOpp); err != nil {
+		return nil, fmt.Errorf("invalid opportunities validation rules: %w", err)
+	}
+	return v, nil
+}
+
+// compileRules traduce las reglas a comprobaciones, usando sample (valores cero por campo) para conocer el tipo de cada campo.
+func compileRules(rules []ValidationRule, sample map[string]interface{}) ([]fieldCheck, error) {
+	checks := make([]fieldCheck, 0, len(rules))
+	for _, rule := range rules {
+		zero, ok := sample[rule.Field]
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", rule.Field)
+		}
+		check, err := compileCheck(rule, zero)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", rule.Field, err)
+		}
+		checks = append(checks, fieldCheck{field: rule.Field, check: check})
+	}
+	return checks, nil
+}
+
+// compileCheck devuelve la función que aplica la comprobación de la regla a un campo del tipo de zero.
+func compileCheck(rule ValidationRule, zero interface{}) (func(interface{}) string, error) {
+	_, isString := zero.(string)
+	_, isTime := zero.(time.Time)
+	_, isInt := zero.(int)
+	_, isFloat := zero.(float64)
+
+	switch rule.Check {
+	case CheckRequired:
+		if !isString && !isTime {
+			return nil, fmt.Errorf("check %q requires a text or time field", rule.Check)
+		}
+		return func(v interface{}) string {
+			switch value := v.(type) {
+			case string:
+				if strings.TrimSpace(value) == "" {
+					return "is required"
+				}
+			case time.Time:
+				if value.IsZero() {
+					return "is required"
+				}
+			}
+			return ""
+		}, nil
+
+	case CheckNonNegative:
+		if !isInt && !isFloat {
+			return nil, fmt.Errorf("check %q requires a numeric field", rule.Check)
+		}
+		return func(v interface{}) string {
+			switch value := v.(type) {
+			case int:
+				if value < 0 {
+					return fmt.Sprintf("must be non-negative (got %d)", value)
+				}
+			case float64:
+				if value < 0 {
+					return fmt.Sprintf("must be non-negative (got %g)", value)
+				}
+			}
+			return ""
+		}, nil
+
+	case CheckFinite:
+		if !isFloat {
+			return nil, fmt.Errorf("check %q requires a decimal field", rule.Check)
+		}
+		return func(v interface{}) string {
+			if value := v.(float64); math.IsNaN(value) || math.IsInf(value, 0) {
+				return fmt.Sprintf("must be a finite number (got %g)", value)
+			}
+			return ""
+		}, nil
+
+	case CheckDate:
+		if !isString {
+			return nil, fmt.Errorf("check %q requires a text field", rule.Check)
+		}
+		return func(v interface{}) string {
+			if _, err := time.Parse("2006-01-02", v.(string)); err != nil {
+				return fmt.Sprintf("must be a date in format YYYY-MM-DD (got %q)", v)
+			}
+			return ""
+		}, nil
+
+	case CheckEmail:
+		if !isString {
+			return nil, fmt.Errorf("check %q requires a text field", rule.Check)
+		}
+		return func(v interface{}) string {
+			value := strings.TrimSpace(v.(string))
+			if value == "" {
+				return ""
+			}
+			if addr, err := mail.ParseAddress(value); err != nil || addr.Address != value {
+				return fmt.Sprintf("must be a valid email address (got %q)", value)
+			}
+			return ""
+		}, nil
+
+	case CheckOneOf:
+		if !isString {
+			return nil, fmt.Errorf("check %q requires a text field", rule.Check)
+		}
+		if len(rule.Values) == 0 {
+			return nil, fmt.Errorf("check %q requires values", rule.Check)
+		}
+		allowed := make(map[string]bool, len(rule.Values))
+		for _, value := range rule.Values {
+			allowed[value] = true
+		}
+		return func(v interface{}) string {
+			if value := v.(string); value != "" && !allowed[value] {
+				return fmt.Sprintf("must be one of %s (got %q)", strings.Join(rule.Values, ", "), value)
+			}
+			return ""
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown check %q", rule.Check)
+}
+
+// ValidateAd devuelve los motivos por los que se rechaza una fila de Ads; vacío si es válida.
+func (v *Validator) ValidateAd(ad data.AdPerformance) []string {
+	var reasons []string
+	for _, c := range v.ads {
+		if reason := c.check(adFields[c.field](ad)); reason != "" {
+			reasons = append(reasons, c.field+": "+reason)
+		}
+	}
+	return reasons
+}
+
+// ValidateOpportunity devuelve los motivos por los que se rechaza una oportunidad; vacío si es válida.
+func (v *Validator) ValidateOpportunity(opp data.Opportunity) []string {
+	var reasons []string
+	for _, c := range v.opps {
+		if reason := c.check(opportunityFields[c.field](opp)); reason != "" {
+			reasons = append(reasons, c.field+": "+reason)
+		}
+	}
+	return reasons
+}
+
+// encodeAd serializa una fila de Ads para la cuarentena. Un coste NaN o infinito no es JSON válido, así que se guarda como texto.
+func encodeAd(ad data.AdPerformance) json.RawMessage {
+	raw, _ := json.Marshal(struct {
+		data.AdPerformance
+		Cost interface{} `json:"cost"`
+	}{ad, jsonFloat(ad.Cost)})
+	return raw
+}
+
+// encodeOpportunity serializa una oportunidad para la cuarentena, con el mismo tratamiento de los importes no finitos.
+func encodeOpportunity(opp data.Opportunity) json.RawMessage {
+	raw, _ := json.Marshal(struct {
+		data.Opportunity
+		Amount interface{} `json:"amount"`
+	}{opp, jsonFloat(opp.Amount)})
+	return raw
+}
+
+// jsonFloat devuelve f, o su representación textual si no es representable en JSON.
+func jsonFloat(f float64) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Sprint(f)
+	}
+	return f
+}
+
+// quarantineID identifica un registro por su tipo, su fuente y su contenido, de modo que el mismo registro
+// rechazado en varias ingestas ocupe una sola entrada y su corrección pueda aplicarse al volver a recibirlo.
+func quarantineID(kind, source string, record json.RawMessage) string {
+	sum := sha256.Sum256([]byte(kind + "\x00" + source + "\x00" + string(record)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// validatingSink valida cada lote antes de entregarlo a next: los registros rechazados, y los que la fuente no
+// pudo decodificar, van a la cuarentena, y los que tienen una corrección reenviada se sustituyen por ella.
+// Las correcciones cuyo registro original no vuelve a llegar en la ingesta se entregan con injectCorrections.
+type validatingSink struct {
+	validator   *Validator
+	store       data.QuarantineStore // nil sólo cuenta los rechazos.
+	next        IngestSink
+	corrections map[string]json.RawMessage // Correcciones reenviadas por ID de cuarentena.
+	pending     map[string]correction      // Correcciones aún no aplicadas en esta ingesta, por ID de cuarentena.
+	identities  map[string]string          // ID de cuarentena de cada corrección pendiente, por recordIdentity.
+	now         time.Time
+	rejected    int
+	rejects     map[string]int // Registros rechazados por fuente.
+	replaced    int            // Registros sustituidos por su corrección o entregados a partir de ella.
+}
+
+// correction es un registro corregido desde la cuarentena, ya decodificado.
+type correction struct {
+	kind   string
+	source string
+	raw    json.RawMessage // Registro original en cuarentena.
+	ad     data.AdPerformance
+	opp    data.Opportunity
+}
+
+// identity identifica el registro corregido por su fuente y su clave natural, para reconocer cuándo la fuente
+// envía su propia versión del registro.
+func (c correction) identity() string {
+	if c.kind == data.QuarantineKindAd {
+		return adIdentity(c.source, c.ad)
+	}
+	return opportunityIdentity(c.source, c.opp)
+}
+
+// adIdentity es la clave natural de una fila de Ads de una fuente: fecha, campaña y canal.
+func adIdentity(source string, ad data.AdPerformance) string {
+	return data.QuarantineKindAd + "\x00" + source + "\x00" + ad.Date + "|" + ad.CampaignID + "|" + ad.Channel
+}
+
+// opportunityIdentity es la clave natural de una oportunidad de una fuente: su ID.
+func opportunityIdentity(source string, opp data.Opportunity) string {
+	return data.QuarantineKindOpportunity + "\x00" + source + "\x00" + opp.OpportunityID
+}
+
+// newValidatingSink crea el sink con las correcciones reenviadas desde la cuarentena (ver loadCorrections).
+func newValidatingSink(validator *Validator, store data.QuarantineStore, next IngestSink, resubmitted []data.QuarantinedRecord) *validatingSink {
+	s := &validatingSink{
+		validator:   validator,
+		store:       store,
+		next:        next,
+		corrections: make(map[string]json.RawMessage),
+		pending:     make(map[string]correction),
+		identities:  make(map[string]string),
+		now:         time.Now().UTC(),
+		rejects:     make(map[string]int),
+	}
+	for _, record := range resubmitted {
+		if len(record.Correction) == 0 {
+			continue
+		}
+		s.corrections[record.ID] = record.Correction
+		c := correction{kind: record.Kind, source: record.Source, raw: record.Record}
+		var err error
+		switch record.Kind {
+		case data.QuarantineKindAd:
+			err = json.Unmarshal(record.Correction, &c.ad)
+		case data.QuarantineKindOpportunity:
+			err = json.Unmarshal(record.Correction, &c.opp)
+		default:
+			continue
+		}
+		if err == nil {
+			s.pending[record.ID] = c
+			s.identities[c.identity()] = record.ID
+		}
+	}
+	return s
+}
+
+// loadCorrections devuelve los registros reenviados de la cuarentena con su corrección; nil sin almacén.
+func loadCorrections(store data.QuarantineStore) ([]data.QuarantinedRecord, error) {
+	if store == nil {
+		return nil, nil
+	}
+	resubmitted, err := store.ListQuarantined(data.QuarantineFilter{Status: data.QuarantineResubmitted})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load quarantine corrections: %w", err)
+	}
+	corrections := make([]data.QuarantinedRecord, 0, len(resubmitted))
+	for _, record := range resubmitted {
+		if len(record.Correction) > 0 {
+			corrections = append(corrections, record)
+		}
+	}
+	return corrections, nil
+}
+
+// consume marca como aplicada la corrección con el ID de cuarentena indicado.
+func (s *validatingSink) consume(id string) {
+	if c, ok := s.pending[id]; ok {
+		delete(s.identities, c.identity())
+		delete(s.pending, id)
+	}
+}
+
+// consumeIdentity marca como aplicada la corrección pendiente del registro con la clave natural indicada:
+// la fuente ha enviado su propia versión y ésta prevalece.
+func (s *validatingSink) consumeIdentity(identity string) {
+	if id, ok := s.identities[identity]; ok {
+		s.consume(id)
+	}
+}
+
+// AddAds valida un lote de filas de Ads y entrega las válidas.
+func (s *validatingSink) AddAds(source string, batch []data.AdPerformance) error {
+	accepted := make([]data.AdPerformance, 0, len(batch))
+	var rejected []data.QuarantinedRecord
+	for _, ad := range batch {
+		var raw json.RawMessage
+		if len(s.corrections) > 0 {
+			raw = encodeAd(ad)
+			id := quarantineID(data.QuarantineKindAd, source, raw)
+			if correction, ok := s.corrections[id]; ok {
+				var fixed data.AdPerformance
+				if err := json.Unmarshal(correction, &fixed); err == nil {
+					ad = fixed
+					s.replaced++
+				}
+				s.consume(id)
+			}
+			s.consumeIdentity(adIdentity(source, ad))
+		}
+		if reasons := s.validator.ValidateAd(ad); len(reasons) > 0 {
+			if raw == nil {
+				raw = encodeAd(ad)
+			}
+			rejected = append(rejected, s.reject(data.QuarantineKindAd, source, raw, reasons))
+			continue
+		}
+		accepted = append(accepted, ad)
+	}
+	if err := s.flush(source, rejected); err != nil {
+		return err
+	}
+	return s.next.AddAds(source, accepted)
+}
+
+// AddOpportunities valida un lote de oportunidades y entrega las válidas.
+func (s *validatingSink) AddOpportunities(source string, batch []data.Opportunity) error {
+	accepted := make([]data.Opportunity, 0, len(batch))
+	var rejected []data.QuarantinedRecord
+	for _, opp := range batch {
+		var raw json.RawMessage
+		if len(s.corrections) > 0 {
+			raw = encodeOpportunity(opp)
+			id := quarantineID(data.QuarantineKindOpportunity, source, raw)
+			if correction, ok := s.corrections[id]; ok {
+				var fixed data.Opportunity
+				if err := json.Unmarshal(correction, &fixed); err == nil {
+					opp = fixed
+					s.replaced++
+				}
+				s.consume(id)
+			}
+			s.consumeIdentity(opportunityIdentity(source, opp))
+		}
+		if reasons := s.validator.ValidateOpportunity(opp); len(reasons) > 0 {
+			if raw == nil {
+				raw = encodeOpportunity(opp)
+			}
+			rejected = append(rejected, s.reject(data.QuarantineKindOpportunity, source, raw, reasons))
+			continue
+		}
+		accepted = append(accepted, opp)
+	}
+	if err := s.flush(source, rejected); err != nil {
+		return err
+	}
+	return s.next.AddOpportunities(source, accepted)
+}
+
+// RejectUndecoded envía a la cuarentena un registro que la fuente no pudo decodificar, con sus bytes originales.
+// Si el registro tiene una corrección reenviada, se entrega la corrección en su lugar.
+func (s *validatingSink) RejectUndecoded(source, kind string, raw json.RawMessage, err error) error {
+	id := quarantineID(kind, source, raw)
+	if c, ok := s.pending[id]; ok {
+		s.consume(id)
+		s.replaced++
+		return s.deliver(c)
+	}
+	return s.flush(source, []data.QuarantinedRecord{s.reject(kind, source, raw, []string{"record: " + err.Error()})})
+}
+
+// deliver valida una corrección y la entrega a next; si ya no cumple las reglas, su registro original vuelve
+// a la cuarentena como rechazado.
+func (s *validatingSink) deliver(c correction) error {
+	var reasons []string
+	if c.kind == data.QuarantineKindAd {
+		reasons = s.validator.ValidateAd(c.ad)
+	} else {
+		reasons = s.validator.ValidateOpportunity(c.opp)
+	}
+	if len(reasons) > 0 {
+		return s.flush(c.source, []data.QuarantinedRecord{s.reject(c.kind, c.source, c.raw, reasons)})
+	}
+	if c.kind == data.QuarantineKindAd {
+		return s.next.AddAds(c.source, []data.AdPerformance{c.ad})
+	}
+	return s.next.AddOpportunities(c.source, []data.Opportunity{c.opp})
+}
+
+// injectCorrections entrega las correcciones reenviadas cuyo registro original no llegó en esta ingesta, de
+// modo que un registro corregido entra en las métricas aunque la fuente no vuelva a enviarlo, o haya dejado
+// de poder decodificarse. Sólo se entregan las de fuentes de la ingesta cuya fecha cae en su ventana: la
+// fecha de una fila de Ads, o la creación de una oportunidad, a partir del inicio de la fuente en window.
+func (s *validatingSink) injectCorrections(window map[string]*time.Time) error {
+	ids := make([]string, 0, len(s.pending))
+	for id := range s.pending {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		c := s.pending[id]
+		start, ok := window[c.source]
+		if !ok {
+			continue
+		}
+		if start != nil {
+			if c.kind == data.QuarantineKindAd {
+				if d, err := time.Parse("2006-01-02", c.ad.Date); err != nil || d.Before(*start) {
+					continue
+				}
+			} else if c.opp.CreatedAt.Before(*start) {
+				continue
+			}
+		}
+		s.consume(id)
+		s.replaced++
+		if err := s.deliver(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reject construye la entrada de cuarentena de un registro rechazado. raw es el registro original,
+// así que una corrección que vuelve a fallar se guarda bajo el ID del original.
+func (s *validatingSink) reject(kind, source string, raw json.RawMessage, reasons []string) data.QuarantinedRecord {
+	return data.QuarantinedRecord{
+		ID:        quarantineID(kind, source, raw),
+		Kind:      kind,
+		Source:    source,
+		Record:    raw,
+		Reasons:   reasons,
+		FirstSeen: s.now,
+		LastSeen:  s.now,
+	}
+}
+
+// flush cuenta y guarda en la cuarentena los rechazos de un lote.
+func (s *validatingSink) flush(source string, rejected []data.QuarantinedRecord) error {
+	if len(rejected) == 0 {
+		return nil
+	}
+	s.rejected += len(rejected)
+	s.rejects[source] += len(rejected)
+	if s.store == nil {
+		return nil
+	}
+	if err := s.store.QuarantineRecords(rejected); err != nil {
+		return fmt.Errorf("failed to quarantine records from %s: %w", source, err)
+	}
+	return nil
+}
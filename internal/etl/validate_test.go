@@ -0,0 +1,230 @@
+package etl
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btors/admira-etl/internal/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidator_DefaultRules(t *testing.T) {
+	validator, err := NewValidator(DefaultValidationConfig())
+	require.NoError(t, err)
+
+	valid := data.AdPerformance{Date: "2025-08-01", CampaignID: "C-1", Clicks: 10, Impressions: 100, Cost: 5}
+	assert.Empty(t, validator.ValidateAd(valid))
+
+	bad := data.AdPerformance{Date: "2025/08/01", Clicks: -3, Impressions: 100, Cost: math.NaN()}
+	assert.Equal(t, []string{
+		`date: must be a date in format YYYY-MM-DD (got "2025/08/01")`,
+		"campaign_id: is required",
+		"clicks: must be non-negative (got -3)",
+		"cost: must be a finite number (got NaN)",
+	}, validator.ValidateAd(bad))
+
+	assert.Equal(t, []string{"opportunity_id: is required", "created_at: is required", "amount: must be non-negative (got -1)"},
+		validator.ValidateOpportunity(data.Opportunity{Amount: -1}))
+}
+
+func TestValidator_ConfigurableRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"opportunities": [
+		{"field": "contact_email", "check": "email"},
+		{"field": "stage", "check": "one_of", "values": ["lead", "closed_won", "closed_lost"]}
+	]}`), 0o644))
+
+	cfg, err := LoadValidationConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultValidationConfig().Ads, cfg.Ads) // Las reglas no indicadas conservan las de por defecto.
+
+	validator, err := NewValidator(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		`contact_email: must be a valid email address (got "not-an-email")`,
+		`stage: must be one of lead, closed_won, closed_lost (got "won")`,
+	}, validator.ValidateOpportunity(data.Opportunity{ContactEmail: "not-an-email", Stage: "won"}))
+	assert.Empty(t, validator.ValidateOpportunity(data.Opportunity{ContactEmail: "ana@example.com", Stage: "lead"}))
+
+	// Campos o comprobaciones desconocidos, o que no aplican al tipo del campo, se rechazan al arrancar.
+	for _, rule := range []ValidationRule{
+		{Field: "budget", Check: CheckRequired},
+		{Field: "clicks", Check: "positive"},
+		{Field: "clicks", Check: CheckFinite},
+		{Field: "date", Check: CheckNonNegative},
+		{Field: "channel", Check: CheckOneOf},
+	} {
+		_, err := NewValidator(ValidationConfig{Ads: []ValidationRule{rule}})
+		assert.Error(t, err, "%+v", rule)
+	}
+}
+
+func TestPipeline_QuarantineAndResubmit(t *testing.T) {
+	adsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"external": {"ads": {"performance": [
+			{"date": "2025-08-01", "campaign_id": "C-1001", "channel": "google_ads", "clicks": 100, "impressions": 1000, "cost": 50.0, "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"},
+			{"date": "2025-08-02", "campaign_id": "C-1002", "channel": "google_ads", "clicks": -5, "impressions": 1000, "cost": 20.0, "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"},
+			{"date": "not-a-date", "campaign_id": "", "channel": "google_ads", "clicks": 1, "cost": 1.0}
+		]}}}`))
+	}))
+	defer adsServer.Close()
+
+	crmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"external": {"crm": {"opportunities": [
+			{"opportunity_id": "O-1", "stage": "closed_won", "amount": 750.0, "created_at": "2025-08-02T15:00:00Z", "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"}
+		]}}}`))
+	}))
+	defer crmServer.Close()
+
+	validator, err := NewValidator(DefaultValidationConfig())
+	require.NoError(t, err)
+	store := data.NewInMemoryQuarantineStore()
+	repo := data.NewInMemoryRepository()
+	pipeline := NewPipeline(repo,
+		NewIngestorFromRegistry(newLegacyRegistry(t, adsServer.URL, crmServer.URL, "", "")),
+		NewTransformer(), NewExporter("", ""),
+		WithValidation(validator, store),
+	)
+
+	result, err := pipeline.RunIngestion(nil, LastTouch)
+	require.NoError(t, err)
+	assert.Equal(t, 3, result.AdsFetched)
+	assert.Equal(t, 2, result.Accepted)
+	assert.Equal(t, 2, result.Rejected)
+	assert.Equal(t, map[string]int{SourceAds: 2}, result.Rejects)
+	assert.Equal(t, 1, result.MetricsSaved)
+	assert.Equal(t, 2, ingestionRecords(result)["rejected."+SourceAds])
+
+	quarantined, err := pipeline.Quarantine(data.QuarantineFilter{})
+	require.NoError(t, err)
+	require.Len(t, quarantined, 2)
+
+	// Una segunda ingesta no duplica las entradas: el ID depende del contenido del registro.
+	_, err = pipeline.RunIngestion(nil, LastTouch)
+	require.NoError(t, err)
+	quarantined, err = pipeline.Quarantine(data.QuarantineFilter{Kind: data.QuarantineKindAd})
+	require.NoError(t, err)
+	require.Len(t, quarantined, 2)
+
+	var negative data.QuarantinedRecord
+	for _, r := range quarantined {
+		if len(r.Reasons) == 1 {
+			negative = r
+		}
+	}
+	assert.Equal(t, []string{"clicks: must be non-negative (got -5)"}, negative.Reasons)
+
+	// Una corrección que sigue siendo inválida se rechaza; un ID inexistente se informa.
+	resubmit, err := pipeline.ResubmitQuarantined([]ResubmitRequest{
+		{ID: negative.ID, Record: json.RawMessage(`{"date": "2025-08-02", "campaign_id": "C-1002", "clicks": -1}`)},
+		{ID: "missing"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, ResubmitRejected, resubmit.Outcomes[0].Status)
+	assert.Equal(t, ResubmitNotFound, resubmit.Outcomes[1].Status)
+	assert.Zero(t, resubmit.Accepted)
+	assert.Nil(t, resubmit.Since)
+
+	// La corrección válida se acepta y la ingesta desde Since la usa en lugar del registro de la fuente.
+	resubmit, err = pipeline.ResubmitQuarantined([]ResubmitRequest{{ID: negative.ID, Record: json.RawMessage(
+		`{"date": "2025-08-02", "campaign_id": "C-1002", "channel": "google_ads", "clicks": 5, "impressions": 1000, "cost": 20.0, "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"}`,
+	)}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, resubmit.Accepted)
+	require.NotNil(t, resubmit.Since)
+	assert.Equal(t, time.Date(2025, 8, 2, 0, 0, 0, 0, time.UTC), *resubmit.Since)
+
+	result, err = pipeline.RunIngestion(resubmit.Since, LastTouch)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Corrected)
+	assert.Equal(t, 1, result.Rejected) // Sólo queda el registro sin fecha ni campaña.
+
+	metrics, err := repo.GetMetricsByDate(time.Date(2025, 8, 2, 0, 0, 0, 0, time.UTC), "")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "C-1002", metrics[0].CampaignID)
+	assert.Equal(t, 5, metrics[0].Clicks)
+	assert.Equal(t, 1, metrics[0].ClosedWon)
+
+	resolved, err := pipeline.Quarantine(data.QuarantineFilter{Status: data.QuarantineResubmitted})
+	require.NoError(t, err)
+	require.Len(t, resolved, 1)
+	assert.Equal(t, negative.ID, resolved[0].ID)
+}
+
+func TestPipeline_QuarantinesUndecodableRecordsAndIngestsCorrections(t *testing.T) {
+	adsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"external": {"ads": {"performance": [
+			{"date": "2025-08-02", "campaign_id": "C-1001", "channel": "google_ads", "clicks": 100, "impressions": 1000, "cost": 50.0, "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"}
+		]}}}`))
+	}))
+	defer adsServer.Close()
+
+	// La oportunidad llega con un importe que no es un número; después la fuente deja de enviarla.
+	broken := `{"opportunity_id": "O-1", "stage": "closed_won", "amount": "750,00", "created_at": "2025-08-02T15:00:00Z", "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"}`
+	sendBroken := true
+	crmServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		records := ""
+		if sendBroken {
+			records = broken
+		}
+		w.Write([]byte(`{"external": {"crm": {"opportunities": [` + records + `]}}}`))
+	}))
+	defer crmServer.Close()
+
+	validator, err := NewValidator(DefaultValidationConfig())
+	require.NoError(t, err)
+	repo := data.NewInMemoryRepository()
+	pipeline := NewPipeline(repo,
+		NewIngestorFromRegistry(newLegacyRegistry(t, adsServer.URL, crmServer.URL, "", "")),
+		NewTransformer(), NewExporter("", ""),
+		WithValidation(validator, data.NewInMemoryQuarantineStore()),
+	)
+
+	result, err := pipeline.RunIngestion(nil, LastTouch)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{SourceCRM: 1}, result.Rejects)
+
+	// Se guarda tal como llegó de la fuente, con el error de decodificación como motivo.
+	quarantined, err := pipeline.Quarantine(data.QuarantineFilter{Kind: data.QuarantineKindOpportunity})
+	require.NoError(t, err)
+	require.Len(t, quarantined, 1)
+	assert.JSONEq(t, broken, string(quarantined[0].Record))
+	require.Len(t, quarantined[0].Reasons, 1)
+	assert.Contains(t, quarantined[0].Reasons[0], "record: ")
+
+	resubmit, err := pipeline.ResubmitQuarantined([]ResubmitRequest{{ID: quarantined[0].ID, Record: json.RawMessage(
+		`{"opportunity_id": "O-1", "stage": "closed_won", "amount": 750.0, "created_at": "2025-08-02T15:00:00Z", "utm_campaign": "summer_sale", "utm_source": "google", "utm_medium": "cpc"}`,
+	)}})
+	require.NoError(t, err)
+	require.Equal(t, 1, resubmit.Accepted)
+
+	// La fuente ya no envía el registro: la corrección se ingiere por sí sola.
+	sendBroken = false
+	result, err = pipeline.RunIngestion(resubmit.Since, LastTouch)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Corrected)
+	assert.Zero(t, result.Rejected)
+
+	metrics, err := repo.GetMetricsByDate(time.Date(2025, 8, 2, 0, 0, 0, 0, time.UTC), "")
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, 1, metrics[0].ClosedWon)
+	assert.Equal(t, 750.0, metrics[0].Revenue)
+
+	// Con la fuente enviando de nuevo el original, se sustituye por la corrección una sola vez.
+	sendBroken = true
+	result, err = pipeline.RunIngestion(resubmit.Since, LastTouch)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Corrected)
+	metrics, err = repo.GetMetricsByDate(time.Date(2025, 8, 2, 0, 0, 0, 0, time.UTC), "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, metrics[0].ClosedWon)
+}
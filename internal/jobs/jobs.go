@@ -0,0 +1,241 @@
+// Package jobs internal/jobs/jobs.go
+package jobs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// State representa el estado de un job.
+type State string
+
+const (
+	StateQueued    State = "queued"
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+)
+
+// ErrQueueFull se devuelve cuando no caben más jobs en la cola.
+var ErrQueueFull = errors.New("job queue is full")
+
+// Report es el resumen que devuelve un job al terminar: conteos de registros, advertencias y otros datos
+// de la ejecución (por ejemplo, el ID con el que se archivó una ingesta).
+type Report struct {
+	Records  map[string]int
+	Warnings []string
+	Details  map[string]string
+}
+
+// Func es el trabajo que ejecuta un job.
+type Func func() (Report, error)
+
+// Job describe una ejecución asíncrona (ingesta o exportación) y su resultado.
+type Job struct {
+	ID         string            `json:"id"`
+	Kind       string            `json:"kind"`
+	State      State             `json:"state"`
+	Params     map[string]string `json:"params,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+	StartedAt  *time.Time        `json:"started_at,omitempty"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+	DurationMS int64             `json:"duration_ms,omitempty"`
+	Records    map[string]int    `json:"records,omitempty"`
+	Warnings   []string          `json:"warnings,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// queuedJob asocia un job con el trabajo que debe ejecutar.
+type queuedJob struct {
+	id string
+	fn Func
+}
+
+// Manager encola jobs, los ejecuta con un número fijo de workers y conserva el historial reciente en memoria.
+type Manager struct {
+	mu         sync.RWMutex
+	jobs       map[string]*Job
+	order      []string // IDs en orden de creación, para recortar el historial.
+	maxHistory int
+	queue      chan queuedJob
+	wg         sync.WaitGroup
+}
+
+// NewManager crea un Manager y arranca sus workers.
+func NewManager(workers, queueSize, maxHistory int) *Manager {
+	if workers <= 0 {
+		workers = 1
+	}
+	if queueSize <= 0 {
+		queueSize = 100
+	}
+	if maxHistory <= 0 {
+		maxHistory = 100
+	}
+
+	m := &Manager{
+		jobs:       make(map[string]*Job),
+		maxHistory: maxHistory,
+		queue:      make(chan queuedJob, queueSize),
+	}
+	for i := 0; i < workers; i++ {
+		m.wg.Add(1)
+		go m.worker()
+	}
+	return m
+}
+
+// Submit encola un job y devuelve una copia de su estado inicial sin esperar a que termine.
+func (m *Manager) Submit(kind string, params map[string]string, fn Func) (Job, error) {
+	id, err := newID()
+	if err != nil {
+		return Job{}, err
+	}
+	job := &Job{
+		ID:        id,
+		Kind:      kind,
+		State:     StateQueued,
+		Params:    params,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	m.mu.Lock()
+	select {
+	case m.queue <- queuedJob{id: id, fn: fn}:
+	default:
+		m.mu.Unlock()
+		return Job{}, ErrQueueFull
+	}
+	m.jobs[id] = job
+	m.order = append(m.order, id)
+	m.trim()
+	snapshot := *job
+	m.mu.Unlock()
+
+	log.Printf("INFO: Job %s (%s) queued.", id, kind)
+	return snapshot, nil
+}
+
+// Get devuelve una copia del job con el ID indicado.
+func (m *Manager) Get(id string) (Job, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	job, ok := m.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// List devuelve los jobs más recientes primero, opcionalmente filtrados por tipo.
+func (m *Manager) List(kind string, limit int) []Job {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := []Job{}
+	for i := len(m.order) - 1; i >= 0; i-- {
+		job := m.jobs[m.order[i]]
+		if kind != "" && job.Kind != kind {
+			continue
+		}
+		result = append(result, *job)
+		if limit > 0 && len(result) == limit {
+			break
+		}
+	}
+	return result
+}
+
+// Close espera a que terminen los jobs encolados. No se debe llamar a Submit después de Close.
+func (m *Manager) Close() {
+	close(m.queue)
+	m.wg.Wait()
+}
+
+// worker ejecuta jobs de la cola hasta que se cierra.
+func (m *Manager) worker() {
+	defer m.wg.Done()
+	for q := range m.queue {
+		m.run(q)
+	}
+}
+
+// run ejecuta un job y registra su resultado, recuperándose de un posible panic.
+func (m *Manager) run(q queuedJob) {
+	started := time.Now().UTC()
+	m.update(q.id, func(job *Job) {
+		job.State = StateRunning
+		job.StartedAt = &started
+	})
+
+	report, err := func() (report Report, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("job panicked: %v", r)
+			}
+		}()
+		return q.fn()
+	}()
+
+	finished := time.Now().UTC()
+	m.update(q.id, func(job *Job) {
+		job.FinishedAt = &finished
+		job.DurationMS = finished.Sub(started).Milliseconds()
+		job.Records = report.Records
+		job.Warnings = report.Warnings
+		job.Details = report.Details
+		if err != nil {
+			job.State = StateFailed
+			job.Error = err.Error()
+			log.Printf("ERROR: Job %s (%s) failed: %v", job.ID, job.Kind, err)
+			return
+		}
+		job.State = StateSucceeded
+		log.Printf("INFO: Job %s (%s) succeeded in %dms.", job.ID, job.Kind, job.DurationMS)
+	})
+}
+
+// update aplica un cambio al job bajo el lock, si sigue en el historial.
+func (m *Manager) update(id string, change func(*Job)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if job, ok := m.jobs[id]; ok {
+		change(job)
+	}
+}
+
+// trim elimina del historial los jobs terminados más antiguos por encima de maxHistory.
+// Los jobs pendientes o en curso nunca se descartan.
+func (m *Manager) trim() {
+	excess := len(m.order) - m.maxHistory
+	if excess <= 0 {
+		return
+	}
+	kept := m.order[:0]
+	for _, id := range m.order {
+		state := m.jobs[id].State
+		if excess > 0 && (state == StateSucceeded || state == StateFailed) {
+			delete(m.jobs, id)
+			excess--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	m.order = kept
+}
+
+// newID genera un identificador aleatorio para un job.
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate job id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,79 @@
+package jobs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitForState espera hasta que el job alcance un estado terminal.
+func waitForState(t *testing.T, m *Manager, id string) Job {
+	t.Helper()
+	var job Job
+	require.Eventually(t, func() bool {
+		job, _ = m.Get(id)
+		return job.State == StateSucceeded || job.State == StateFailed
+	}, time.Second, 5*time.Millisecond)
+	return job
+}
+
+func TestManager_RunsJobsAsynchronously(t *testing.T) {
+	m := NewManager(1, 10, 10)
+	defer m.Close()
+
+	release := make(chan struct{})
+	job, err := m.Submit("ingest", map[string]string{"since": "2025-08-01"}, func() (Report, error) {
+		<-release
+		return Report{Records: map[string]int{"metrics_saved": 3}, Warnings: []string{"1 ad row skipped"}}, nil
+	})
+	require.NoError(t, err)
+
+	// Submit vuelve antes de que el trabajo termine.
+	assert.Equal(t, StateQueued, job.State)
+	close(release)
+
+	done := waitForState(t, m, job.ID)
+	assert.Equal(t, StateSucceeded, done.State)
+	assert.Equal(t, 3, done.Records["metrics_saved"])
+	assert.Equal(t, []string{"1 ad row skipped"}, done.Warnings)
+	assert.NotNil(t, done.StartedAt)
+	assert.NotNil(t, done.FinishedAt)
+}
+
+func TestManager_RecordsFailuresAndPanics(t *testing.T) {
+	m := NewManager(1, 10, 10)
+	defer m.Close()
+
+	failed, err := m.Submit("export", nil, func() (Report, error) { return Report{}, errors.New("sink down") })
+	require.NoError(t, err)
+	panicked, err := m.Submit("export", nil, func() (Report, error) { panic("boom") })
+	require.NoError(t, err)
+
+	assert.Equal(t, "sink down", waitForState(t, m, failed.ID).Error)
+	assert.Contains(t, waitForState(t, m, panicked.ID).Error, "boom")
+}
+
+func TestManager_ListTrimsFinishedHistory(t *testing.T) {
+	m := NewManager(1, 10, 2)
+	defer m.Close()
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		job, err := m.Submit("ingest", nil, func() (Report, error) { return Report{}, nil })
+		require.NoError(t, err)
+		waitForState(t, m, job.ID)
+		ids = append(ids, job.ID)
+	}
+	_, err := m.Submit("export", nil, func() (Report, error) { return Report{}, nil })
+	require.NoError(t, err)
+
+	// El historial conserva los más recientes, del más nuevo al más antiguo.
+	ingests := m.List("ingest", 0)
+	require.Len(t, ingests, 1)
+	assert.Equal(t, ids[2], ingests[0].ID)
+	_, ok := m.Get(ids[0])
+	assert.False(t, ok)
+}
@@ -0,0 +1,163 @@
+// Package scheduler internal/scheduler/cron.go
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron es una expresión cron estándar de cinco campos: minuto, hora, día del mes, mes y día de la semana.
+// Admite "*", listas ("1,15"), rangos ("1-5"), pasos ("*/15", "10-50/10") y los atajos
+// @hourly, @daily, @weekly y @monthly. Se evalúa siempre en UTC.
+type Cron struct {
+	spec       string
+	minutes    [60]bool
+	hours      [24]bool
+	days       [32]bool
+	months     [13]bool
+	weekdays   [7]bool
+	anyDay     bool // El campo día del mes es "*".
+	anyWeekday bool // El campo día de la semana es "*".
+}
+
+// cronMacros traduce los atajos a su expresión equivalente.
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// ParseCron valida y compila una expresión cron.
+func ParseCron(spec string) (*Cron, error) {
+	expr := strings.TrimSpace(spec)
+	if macro, ok := cronMacros[expr]; ok {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields, got %d", spec, len(fields))
+	}
+
+	c := &Cron{spec: spec, anyDay: fields[2] == "*", anyWeekday: fields[4] == "*"}
+	if err := parseCronField(fields[0], 0, 59, c.minutes[:]); err != nil {
+		return nil, fmt.Errorf("invalid cron minute in %q: %w", spec, err)
+	}
+	if err := parseCronField(fields[1], 0, 23, c.hours[:]); err != nil {
+		return nil, fmt.Errorf("invalid cron hour in %q: %w", spec, err)
+	}
+	if err := parseCronField(fields[2], 1, 31, c.days[:]); err != nil {
+		return nil, fmt.Errorf("invalid cron day of month in %q: %w", spec, err)
+	}
+	if err := parseCronField(fields[3], 1, 12, c.months[:]); err != nil {
+		return nil, fmt.Errorf("invalid cron month in %q: %w", spec, err)
+	}
+	// El domingo puede escribirse como 0 o como 7.
+	var weekdays [8]bool
+	if err := parseCronField(fields[4], 0, 7, weekdays[:]); err != nil {
+		return nil, fmt.Errorf("invalid cron day of week in %q: %w", spec, err)
+	}
+	copy(c.weekdays[:], weekdays[:7])
+	c.weekdays[0] = c.weekdays[0] || weekdays[7]
+
+	return c, nil
+}
+
+// String devuelve la expresión original.
+func (c *Cron) String() string {
+	return c.spec
+}
+
+// Next devuelve el primer instante estrictamente posterior a t que cumple la expresión,
+// o el tiempo cero si no hay ninguno en los próximos cinco años (por ejemplo, "0 0 30 2 *").
+func (c *Cron) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if !c.months[t.Month()] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !c.hours[t.Hour()] {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if !c.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// dayMatches aplica la regla clásica de cron: si se restringen tanto el día del mes como el de la semana,
+// basta con que coincida uno de los dos.
+func (c *Cron) dayMatches(t time.Time) bool {
+	dom := c.days[t.Day()]
+	dow := c.weekdays[t.Weekday()]
+	switch {
+	case c.anyDay && c.anyWeekday:
+		return true
+	case c.anyDay:
+		return dow
+	case c.anyWeekday:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// parseCronField marca en set los valores que cubre un campo de la expresión.
+func parseCronField(field string, min, max int, set []bool) error {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return fmt.Errorf("invalid step in %q", part)
+			}
+			step = s
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return fmt.Errorf("invalid range %q", part)
+			}
+			if hi, err = strconv.Atoi(bounds[1]); err != nil {
+				return fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			v, err := strconv.Atoi(part)
+			if err != nil {
+				return fmt.Errorf("invalid value %q", part)
+			}
+			lo, hi = v, v
+			if step > 1 {
+				hi = max // "5/10" equivale a "5-max/10".
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return fmt.Errorf("value out of range [%d-%d] in %q", min, max, part)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCron_Next(t *testing.T) {
+	from := time.Date(2025, 8, 1, 10, 17, 30, 0, time.UTC) // Viernes.
+
+	cases := []struct {
+		spec string
+		want time.Time
+	}{
+		{"0 * * * *", time.Date(2025, 8, 1, 11, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2025, 8, 1, 10, 30, 0, 0, time.UTC)},
+		{"30 1 * * *", time.Date(2025, 8, 2, 1, 30, 0, 0, time.UTC)},
+		{"@daily", time.Date(2025, 8, 2, 0, 0, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2025, 8, 4, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2025, 8, 3, 0, 0, 0, 0, time.UTC)},
+		// Con día del mes y día de la semana restringidos basta con que coincida uno.
+		{"0 0 15 * 1", time.Date(2025, 8, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.spec, func(t *testing.T) {
+			c, err := ParseCron(tc.spec)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, c.Next(from))
+		})
+	}
+}
+
+func TestCron_NextWithoutFutureRuns(t *testing.T) {
+	c, err := ParseCron("0 0 30 2 *")
+	require.NoError(t, err)
+	assert.True(t, c.Next(time.Now()).IsZero())
+}
+
+func TestParseCron_Invalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *", "@yearly"} {
+		_, err := ParseCron(spec)
+		assert.Error(t, err, spec)
+	}
+}
@@ -0,0 +1,270 @@
+// Package scheduler internal/scheduler/scheduler.go
+package scheduler
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/btors/admira-etl/internal/etl"
+	"github.com/btors/admira-etl/internal/jobs"
+)
+
+// TaskFunc construye el job de una ejecución programada. Recibe el inicio de la última ejecución
+// exitosa (nil si aún no hubo ninguna) y el instante programado.
+type TaskFunc func(lastSuccess *time.Time, scheduledAt time.Time) (params map[string]string, fn jobs.Func)
+
+// Status describe el estado de una tarea programada para GET /schedules.
+type Status struct {
+	Name        string     `json:"name"`
+	Cron        string     `json:"cron"`
+	Kind        string     `json:"kind"`
+	NextRun     *time.Time `json:"next_run,omitempty"`
+	LastRun     *time.Time `json:"last_run,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastJobID   string     `json:"last_job_id,omitempty"`
+	LastState   jobs.State `json:"last_state,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	Running     bool       `json:"running"`
+	Skipped     int        `json:"skipped_overlapping_runs"`
+}
+
+// entry es una tarea registrada y su estado de ejecución.
+type entry struct {
+	name        string
+	kind        string
+	cron        *Cron
+	task        TaskFunc
+	next        time.Time
+	lastRun     *time.Time
+	lastSuccess *time.Time
+	lastJobID   string
+	lastState   jobs.State
+	lastError   string
+	running     bool
+	skipped     int
+}
+
+// Scheduler dispara jobs periódicos según expresiones cron, con jitter y sin solapar
+// ejecuciones de una misma tarea.
+type Scheduler struct {
+	mu      sync.Mutex
+	manager *jobs.Manager
+	jitter  time.Duration
+	entries []*entry
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// New crea un Scheduler que encola sus ejecuciones en el jobs.Manager indicado.
+func New(manager *jobs.Manager, jitter time.Duration) *Scheduler {
+	return &Scheduler{
+		manager: manager,
+		jitter:  jitter,
+		stop:    make(chan struct{}),
+	}
+}
+
+// Add registra una tarea. Debe llamarse antes de Start.
+func (s *Scheduler) Add(name, spec, kind string, task TaskFunc) error {
+	c, err := ParseCron(spec)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries {
+		if e.name == name {
+			return fmt.Errorf("schedule %q already registered", name)
+		}
+	}
+	s.entries = append(s.entries, &entry{name: name, kind: kind, cron: c, task: task})
+	return nil
+}
+
+// Start arranca una goroutine por tarea registrada.
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries {
+		e.next = e.cron.Next(time.Now())
+		s.wg.Add(1)
+		go s.loop(e)
+		log.Printf("INFO: Schedule %s (%s) registered, next run at %s.", e.name, e.cron, e.next.Format(time.RFC3339))
+	}
+}
+
+// Stop detiene las tareas programadas; los jobs ya encolados siguen su curso.
+func (s *Scheduler) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// Statuses devuelve el estado de todas las tareas, en orden de registro.
+func (s *Scheduler) Statuses() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]Status, 0, len(s.entries))
+	for _, e := range s.entries {
+		st := Status{
+			Name:        e.name,
+			Cron:        e.cron.String(),
+			Kind:        e.kind,
+			LastRun:     e.lastRun,
+			LastSuccess: e.lastSuccess,
+			LastJobID:   e.lastJobID,
+			LastState:   e.lastState,
+			LastError:   e.lastError,
+			Running:     e.running,
+			Skipped:     e.skipped,
+		}
+		if !e.next.IsZero() {
+			next := e.next
+			st.NextRun = &next
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses
+}
+
+// loop espera al siguiente instante programado (más un jitter aleatorio) y dispara la tarea.
+func (s *Scheduler) loop(e *entry) {
+	defer s.wg.Done()
+	for {
+		s.mu.Lock()
+		next := e.next
+		s.mu.Unlock()
+		if next.IsZero() {
+			log.Printf("WARN: Schedule %s has no future runs; stopping it.", e.name)
+			return
+		}
+
+		wait := time.Until(next)
+		if s.jitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(s.jitter)))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		// Si el proceso estuvo suspendido o una ejecución tardó en encolarse, los instantes que ya pasaron
+		// se agrupan en una sola ejecución, la del último de ellos.
+		scheduledAt, missed := lastDue(e.cron, next, time.Now())
+		if missed > 0 {
+			log.Printf("WARN: Schedule %s missed %d runs; coalescing them into the run at %s.", e.name, missed, scheduledAt.Format(time.RFC3339))
+		}
+		s.trigger(e, scheduledAt)
+
+		// La siguiente ejecución se calcula desde ahora, no desde el instante programado, para no repetir
+		// los que pasaron mientras se encolaba esta.
+		s.mu.Lock()
+		e.next = e.cron.Next(time.Now())
+		s.mu.Unlock()
+	}
+}
+
+// lastDue devuelve el último instante programado no posterior a now a partir de next, y cuántos instantes
+// anteriores a ese se saltan.
+func lastDue(c *Cron, next, now time.Time) (time.Time, int) {
+	missed := 0
+	for {
+		following := c.Next(next)
+		if following.IsZero() || following.After(now) {
+			return next, missed
+		}
+		next = following
+		missed++
+	}
+}
+
+// trigger encola el job de la tarea, salvo que su ejecución anterior siga en curso.
+func (s *Scheduler) trigger(e *entry, scheduledAt time.Time) {
+	s.mu.Lock()
+	if e.running {
+		e.skipped++
+		s.mu.Unlock()
+		log.Printf("WARN: Schedule %s skipped: previous run (job %s) is still in progress.", e.name, e.lastJobID)
+		return
+	}
+	e.running = true
+	lastSuccess := e.lastSuccess
+	s.mu.Unlock()
+
+	started := time.Now().UTC()
+	params, fn := e.task(lastSuccess, scheduledAt)
+	if params == nil {
+		params = map[string]string{}
+	}
+	params["schedule"] = e.name
+
+	// Envuelve el job para registrar su resultado en la tarea cuando termine.
+	job, err := s.manager.Submit(e.kind, params, func() (jobs.Report, error) {
+		completed := false
+		defer func() {
+			// Si el job entra en pánico, la tarea también debe liberarse.
+			if !completed {
+				s.finish(e, started, fmt.Errorf("job panicked"))
+			}
+		}()
+		report, err := fn()
+		completed = true
+		s.finish(e, started, err)
+		return report, err
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.lastRun = &started
+	if err != nil {
+		e.running = false
+		e.lastState = jobs.StateFailed
+		e.lastError = err.Error()
+		log.Printf("ERROR: Schedule %s could not enqueue its job: %v", e.name, err)
+		return
+	}
+	e.lastJobID = job.ID
+	// Si el job ya terminó, finish registró su resultado y no debe sobrescribirse.
+	if e.running {
+		e.lastState = job.State
+		e.lastError = ""
+	}
+}
+
+// finish registra el resultado de una ejecución y libera la tarea para la siguiente.
+func (s *Scheduler) finish(e *entry, started time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.running = false
+	if err != nil {
+		e.lastState = jobs.StateFailed
+		e.lastError = err.Error()
+		return
+	}
+	e.lastState = jobs.StateSucceeded
+	e.lastError = ""
+	e.lastSuccess = &started
+}
+
+// IngestionTask programa ingestas sin "since" explícito: con marcas de agua configuradas en el
+// Pipeline cada ejecución es incremental respecto a la anterior.
+func IngestionTask(pipeline *etl.Pipeline) TaskFunc {
+	return func(_ *time.Time, _ time.Time) (map[string]string, jobs.Func) {
+		params := map[string]string{"model": string(pipeline.DefaultModel())}
+		return params, pipeline.IngestionJob(nil, pipeline.DefaultModel())
+	}
+}
+
+// ExportTask programa la exportación diaria del día anterior al instante programado, en la zona de reporte.
+func ExportTask(pipeline *etl.Pipeline) TaskFunc {
+	return func(_ *time.Time, scheduledAt time.Time) (map[string]string, jobs.Func) {
+		day := pipeline.Timezones().Day(scheduledAt, "").AddDate(0, 0, -1)
+		return map[string]string{"date": day.Format("2006-01-02")}, pipeline.ExportJob(day, false)
+	}
+}
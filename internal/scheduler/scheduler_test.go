@@ -0,0 +1,86 @@
+package scheduler
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btors/admira-etl/internal/jobs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduler_SkipsOverlappingRuns(t *testing.T) {
+	manager := jobs.NewManager(2, 10, 10)
+	defer manager.Close()
+	s := New(manager, 0)
+
+	release := make(chan struct{})
+	var seen []*time.Time
+	require.NoError(t, s.Add("ingest", "@hourly", "ingest", func(lastSuccess *time.Time, _ time.Time) (map[string]string, jobs.Func) {
+		seen = append(seen, lastSuccess)
+		return nil, func() (jobs.Report, error) {
+			<-release
+			return jobs.Report{}, nil
+		}
+	}))
+	e := s.entries[0]
+
+	s.trigger(e, time.Now())
+	s.trigger(e, time.Now())
+
+	status := s.Statuses()[0]
+	assert.True(t, status.Running)
+	assert.Equal(t, 1, status.Skipped)
+	assert.Len(t, seen, 1)
+
+	close(release)
+	require.Eventually(t, func() bool { return !s.Statuses()[0].Running }, time.Second, 5*time.Millisecond)
+	status = s.Statuses()[0]
+	assert.Equal(t, jobs.StateSucceeded, status.LastState)
+	require.NotNil(t, status.LastSuccess)
+
+	job, ok := manager.Get(status.LastJobID)
+	require.True(t, ok)
+	assert.Equal(t, "ingest", job.Params["schedule"])
+
+	// La siguiente ejecución recibe el inicio de la última ejecución exitosa.
+	s.trigger(e, time.Now())
+	require.Len(t, seen, 2)
+	assert.Equal(t, status.LastSuccess, seen[1])
+}
+
+func TestScheduler_RecordsFailures(t *testing.T) {
+	manager := jobs.NewManager(1, 10, 10)
+	defer manager.Close()
+	s := New(manager, 0)
+
+	require.NoError(t, s.Add("export", "30 1 * * *", "export", func(*time.Time, time.Time) (map[string]string, jobs.Func) {
+		return nil, func() (jobs.Report, error) { return jobs.Report{}, errors.New("sink down") }
+	}))
+	assert.Error(t, s.Add("export", "@daily", "export", nil))
+
+	s.trigger(s.entries[0], time.Now())
+	require.Eventually(t, func() bool { return !s.Statuses()[0].Running }, time.Second, 5*time.Millisecond)
+
+	status := s.Statuses()[0]
+	assert.Equal(t, jobs.StateFailed, status.LastState)
+	assert.Equal(t, "sink down", status.LastError)
+	assert.Nil(t, status.LastSuccess)
+}
+
+func TestLastDue_CoalescesMissedRuns(t *testing.T) {
+	c, err := ParseCron("@hourly")
+	require.NoError(t, err)
+	next := time.Date(2025, 8, 1, 10, 0, 0, 0, time.UTC)
+
+	// Un timer que dispara a tiempo no pierde ninguna ejecución.
+	at, missed := lastDue(c, next, next.Add(time.Second))
+	assert.Equal(t, next, at)
+	assert.Zero(t, missed)
+
+	// Tras tres horas y media suspendido, se ejecuta sólo la de las 13:00.
+	at, missed = lastDue(c, next, next.Add(3*time.Hour+30*time.Minute))
+	assert.Equal(t, time.Date(2025, 8, 1, 13, 0, 0, 0, time.UTC), at)
+	assert.Equal(t, 3, missed)
+}
@@ -0,0 +1,240 @@
+// Package signature pkg/signature/signature.go
+//
+// Firma y verificación de las peticiones que el ETL envía al sink. Está fuera de internal/ para que el
+// equipo del sink pueda importar Verify y comprobar las peticiones con el mismo código que las firma.
+//
+// Esquema v1: la firma es el HMAC-SHA256 (en hexadecimal) de la cadena
+//
+//	v1\n<MÉTODO>\n<ruta y query>\n<timestamp>\n<nonce>\n<sha256 hex del cuerpo>
+//
+// y viaja en X-Signature como "v1=<firma>", junto a X-Signature-Timestamp (segundos Unix),
+// X-Signature-Nonce (aleatorio por petición) y X-Signature-Key-Id (la clave con la que se firmó).
+package signature
+
+import (
+	"container/heap"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version es la versión del esquema de firma que produce Sign.
+const Version = "v1"
+
+// Cabeceras del esquema de firma.
+const (
+	HeaderSignature = "X-Signature"
+	HeaderTimestamp = "X-Signature-Timestamp"
+	HeaderNonce     = "X-Signature-Nonce"
+	HeaderKeyID     = "X-Signature-Key-Id"
+)
+
+// DefaultTolerance es la diferencia máxima por defecto entre el timestamp firmado y el reloj del verificador.
+const DefaultTolerance = 5 * time.Minute
+
+// Errores de Verify.
+var (
+	ErrMissingHeader      = errors.New("missing signature header")
+	ErrUnsupportedVersion = errors.New("unsupported signature version")
+	ErrUnknownKey         = errors.New("unknown signing key")
+	ErrStaleTimestamp     = errors.New("signature timestamp outside tolerance")
+	ErrInvalidSignature   = errors.New("invalid signature")
+	ErrReplayedNonce      = errors.New("nonce already used")
+)
+
+// Key es una clave de firma con su identificador.
+type Key struct {
+	ID     string
+	Secret string
+}
+
+// ParseKeys interpreta una lista de claves "id:secreto" separadas por comas, en orden. Durante una rotación
+// conviven varias: quien firma usa la primera y quien verifica acepta todas.
+func ParseKeys(s string) ([]Key, error) {
+	var keys []Key
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(part, ":")
+		id = strings.TrimSpace(id)
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("invalid signing key %q, expected id:secret", id)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("duplicate signing key id %q", id)
+		}
+		seen[id] = true
+		keys = append(keys, Key{ID: id, Secret: secret})
+	}
+	return keys, nil
+}
+
+// Compute devuelve la firma v1, en hexadecimal, de una petición.
+func Compute(secret, method, path, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{
+		Version, strings.ToUpper(method), path, timestamp, nonce, hex.EncodeToString(bodyHash[:]),
+	}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign firma req con key: añade el timestamp actual, un nonce nuevo, el ID de la clave y la firma. body
+// debe ser exactamente el cuerpo que se enviará. Cada reintento debe firmarse de nuevo, con su propio nonce.
+func Sign(req *http.Request, body []byte, key Key) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate signature nonce: %w", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	n := hex.EncodeToString(nonce)
+
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, n)
+	req.Header.Set(HeaderKeyID, key.ID)
+	req.Header.Set(HeaderSignature, Version+"="+Compute(key.Secret, req.Method, req.URL.RequestURI(), timestamp, n, body))
+	return nil
+}
+
+// NonceCache recuerda los nonces ya aceptados para rechazar peticiones repetidas.
+type NonceCache interface {
+	// Add registra el nonce hasta expires y devuelve false si ya estaba registrado.
+	Add(keyID, nonce string, expires time.Time) bool
+}
+
+// VerifyOptions ajusta Verify. El valor cero usa DefaultTolerance, el reloj del sistema y la caché de nonces
+// del proceso.
+type VerifyOptions struct {
+	Tolerance time.Duration    // Diferencia máxima entre el timestamp firmado y Now.
+	Now       func() time.Time // Reloj del verificador.
+	// Nonces rechaza los nonces repetidos dentro de la tolerancia. Sin él se usa una MemoryNonceCache
+	// compartida por todo el proceso: sin caché, una petición capturada podría repetirse hasta que su
+	// timestamp caduca.
+	Nonces NonceCache
+}
+
+// defaultNonces es la caché de nonces de Verify cuando VerifyOptions no indica ninguna.
+var defaultNonces = NewMemoryNonceCache()
+
+// Verify comprueba la firma de una petición recibida contra las claves activas. body es el cuerpo leído de
+// la petición. Acepta cualquier clave de keys, para que el emisor pueda cambiar de clave sin que el receptor
+// rechace peticiones durante la rotación.
+func Verify(r *http.Request, body []byte, keys []Key, opts VerifyOptions) error {
+	if opts.Tolerance <= 0 {
+		opts.Tolerance = DefaultTolerance
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	if opts.Nonces == nil {
+		opts.Nonces = defaultNonces
+	}
+
+	header := r.Header.Get(HeaderSignature)
+	timestamp := r.Header.Get(HeaderTimestamp)
+	nonce := r.Header.Get(HeaderNonce)
+	keyID := r.Header.Get(HeaderKeyID)
+	for name, value := range map[string]string{HeaderSignature: header, HeaderTimestamp: timestamp, HeaderNonce: nonce, HeaderKeyID: keyID} {
+		if value == "" {
+			return fmt.Errorf("%w: %s", ErrMissingHeader, name)
+		}
+	}
+	version, signature, ok := strings.Cut(header, "=")
+	if !ok || version != Version {
+		return fmt.Errorf("%w: %q", ErrUnsupportedVersion, version)
+	}
+
+	var secret string
+	for _, key := range keys {
+		if key.ID == keyID {
+			secret = key.Secret
+			break
+		}
+	}
+	if secret == "" {
+		return fmt.Errorf("%w: %q", ErrUnknownKey, keyID)
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %q", ErrStaleTimestamp, timestamp)
+	}
+	signedAt := time.Unix(seconds, 0)
+	if skew := opts.Now().Sub(signedAt); skew > opts.Tolerance || skew < -opts.Tolerance {
+		return fmt.Errorf("%w: signed at %s", ErrStaleTimestamp, signedAt.UTC().Format(time.RFC3339))
+	}
+
+	expected := Compute(secret, r.Method, r.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrInvalidSignature
+	}
+
+	// El nonce se registra sólo con la firma ya comprobada, para que peticiones falsas no llenen la caché.
+	if !opts.Nonces.Add(keyID, nonce, signedAt.Add(opts.Tolerance)) {
+		return ErrReplayedNonce
+	}
+	return nil
+}
+
+// MemoryNonceCache es un NonceCache en memoria que olvida cada nonce cuando caduca su timestamp.
+type MemoryNonceCache struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+	expiry nonceHeap // Los nonces de nonces, del que caduca antes al que caduca después.
+	now    func() time.Time
+}
+
+// NewMemoryNonceCache crea un NonceCache en memoria. Con varias réplicas del sink hace falta una caché
+// compartida, porque cada réplica sólo conoce los nonces que ha recibido.
+func NewMemoryNonceCache() *MemoryNonceCache {
+	return &MemoryNonceCache{nonces: make(map[string]time.Time), now: time.Now}
+}
+
+// Add registra el nonce hasta expires y devuelve false si ya estaba registrado. Antes descarta los nonces
+// caducados, que están al principio del montículo, así que el coste no crece con el tamaño de la caché.
+func (c *MemoryNonceCache) Add(keyID, nonce string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for len(c.expiry) > 0 && now.After(c.expiry[0].expires) {
+		delete(c.nonces, heap.Pop(&c.expiry).(nonceEntry).key)
+	}
+	k := keyID + ":" + nonce
+	if _, seen := c.nonces[k]; seen {
+		return false
+	}
+	c.nonces[k] = expires
+	heap.Push(&c.expiry, nonceEntry{key: k, expires: expires})
+	return true
+}
+
+// nonceEntry es un nonce registrado y su caducidad.
+type nonceEntry struct {
+	key     string
+	expires time.Time
+}
+
+// nonceHeap ordena los nonces por caducidad, para container/heap.
+type nonceHeap []nonceEntry
+
+func (h nonceHeap) Len() int           { return len(h) }
+func (h nonceHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h nonceHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *nonceHeap) Push(x any)        { *h = append(*h, x.(nonceEntry)) }
+func (h *nonceHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
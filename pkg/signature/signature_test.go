@@ -0,0 +1,118 @@
+package signature
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signedRequest firma un POST a path con body y key.
+func signedRequest(t *testing.T, path, body string, key Key) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	require.NoError(t, Sign(req, []byte(body), key))
+	return req
+}
+
+func TestVerify_AcceptsSignedRequestAndRejectsTampering(t *testing.T) {
+	key := Key{ID: "k1", Secret: "s3cret"}
+	body := `[{"CampaignID":"C-1001"}]`
+	keys := []Key{key}
+
+	req := signedRequest(t, "/metrics?source=etl", body, key)
+	assert.True(t, strings.HasPrefix(req.Header.Get(HeaderSignature), "v1="))
+	assert.Equal(t, "k1", req.Header.Get(HeaderKeyID))
+	require.NoError(t, Verify(req, []byte(body), keys, VerifyOptions{}))
+
+	// Cambiar el cuerpo, el método o la ruta invalida la firma.
+	assert.ErrorIs(t, Verify(req, []byte(`[]`), keys, VerifyOptions{}), ErrInvalidSignature)
+	req.Method = http.MethodPut
+	assert.ErrorIs(t, Verify(req, []byte(body), keys, VerifyOptions{}), ErrInvalidSignature)
+	req = signedRequest(t, "/metrics", body, key)
+	req.URL.Path = "/other"
+	assert.ErrorIs(t, Verify(req, []byte(body), keys, VerifyOptions{}), ErrInvalidSignature)
+
+	// Un nonce distinto del firmado también.
+	req = signedRequest(t, "/metrics", body, key)
+	req.Header.Set(HeaderNonce, "0000")
+	assert.ErrorIs(t, Verify(req, []byte(body), keys, VerifyOptions{}), ErrInvalidSignature)
+
+	req = signedRequest(t, "/metrics", body, key)
+	req.Header.Del(HeaderTimestamp)
+	assert.ErrorIs(t, Verify(req, []byte(body), keys, VerifyOptions{}), ErrMissingHeader)
+	req = signedRequest(t, "/metrics", body, key)
+	req.Header.Set(HeaderSignature, "v0="+strings.TrimPrefix(req.Header.Get(HeaderSignature), "v1="))
+	assert.ErrorIs(t, Verify(req, []byte(body), keys, VerifyOptions{}), ErrUnsupportedVersion)
+}
+
+func TestVerify_RejectsReplays(t *testing.T) {
+	key := Key{ID: "k1", Secret: "s3cret"}
+	body := `[]`
+	req := signedRequest(t, "/metrics", body, key)
+
+	// Fuera de la tolerancia la petición caduca aunque la firma sea válida.
+	late := VerifyOptions{Now: func() time.Time { return time.Now().Add(6 * time.Minute) }}
+	assert.ErrorIs(t, Verify(req, []byte(body), []Key{key}, late), ErrStaleTimestamp)
+
+	// Dentro de la tolerancia, el mismo nonce sólo se acepta una vez.
+	opts := VerifyOptions{Nonces: NewMemoryNonceCache()}
+	require.NoError(t, Verify(req, []byte(body), []Key{key}, opts))
+	assert.ErrorIs(t, Verify(req, []byte(body), []Key{key}, opts), ErrReplayedNonce)
+	require.NoError(t, Verify(signedRequest(t, "/metrics", body, key), []byte(body), []Key{key}, opts))
+}
+
+func TestVerify_RejectsReplaysWithoutNonceCache(t *testing.T) {
+	key := Key{ID: "k1", Secret: "s3cret"}
+	req := signedRequest(t, "/metrics", "[]", key)
+	require.NoError(t, Verify(req, []byte("[]"), []Key{key}, VerifyOptions{}))
+	assert.ErrorIs(t, Verify(req, []byte("[]"), []Key{key}, VerifyOptions{}), ErrReplayedNonce)
+}
+
+func TestMemoryNonceCache_ForgetsExpiredNonces(t *testing.T) {
+	now := time.Date(2025, 8, 1, 10, 0, 0, 0, time.UTC)
+	cache := NewMemoryNonceCache()
+	cache.now = func() time.Time { return now }
+
+	require.True(t, cache.Add("k1", "a", now.Add(time.Minute)))
+	require.True(t, cache.Add("k1", "b", now.Add(3*time.Minute)))
+	require.True(t, cache.Add("k2", "a", now.Add(2*time.Minute)))
+	assert.False(t, cache.Add("k1", "a", now.Add(time.Minute)))
+
+	// Pasado el primer vencimiento sólo se olvida el nonce caducado.
+	now = now.Add(90 * time.Second)
+	assert.True(t, cache.Add("k1", "a", now.Add(time.Minute)))
+	assert.False(t, cache.Add("k2", "a", now.Add(time.Minute)))
+	assert.Len(t, cache.nonces, 3)
+
+	now = now.Add(10 * time.Minute)
+	assert.True(t, cache.Add("k1", "c", now.Add(time.Minute)))
+	assert.Len(t, cache.nonces, 1)
+	assert.Len(t, cache.expiry, 1)
+}
+
+func TestVerify_KeyRotation(t *testing.T) {
+	keys, err := ParseKeys("k2:new-secret, k1:old-secret")
+	require.NoError(t, err)
+	require.Equal(t, []Key{{ID: "k2", Secret: "new-secret"}, {ID: "k1", Secret: "old-secret"}}, keys)
+
+	// Durante la rotación el receptor acepta la clave nueva y la anterior.
+	for _, signer := range keys {
+		req := signedRequest(t, "/metrics", "[]", signer)
+		assert.NoError(t, Verify(req, []byte("[]"), keys, VerifyOptions{}), signer.ID)
+	}
+	// Retirada la anterior, sus firmas se rechazan.
+	req := signedRequest(t, "/metrics", "[]", keys[1])
+	assert.ErrorIs(t, Verify(req, []byte("[]"), keys[:1], VerifyOptions{}), ErrUnknownKey)
+
+	_, err = ParseKeys("k1:a,k1:b")
+	assert.Error(t, err)
+	_, err = ParseKeys("missing-secret")
+	assert.Error(t, err)
+	keys, err = ParseKeys("")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}